@@ -0,0 +1,267 @@
+// Package alarm evaluates the [[alarms]] rules of rpm.toml against scans
+package alarm
+
+import (
+	"fmt"
+	"rpm/config"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Level of an alarm
+type Level int
+
+// Alarm levels, in increasing severity up to Crit
+const (
+	Normal Level = iota
+	Warn
+	Crit
+	Stale
+)
+
+var levelLabels = map[Level]string{
+	Normal: "normal",
+	Warn:   "warn",
+	Crit:   "crit",
+	Stale:  "stale",
+}
+
+func (lvl Level) String() string {
+	if label, ok := levelLabels[lvl]; ok {
+		return label
+	}
+	return fmt.Sprintf("level(%d)", int(lvl))
+}
+
+// State is the alarm state of a channel
+type State struct {
+	Chancode string
+	Label    string
+	Oid      string
+	Units    string
+	Level    Level
+	Value    string
+	Since    time.Time
+}
+
+// Transition is a change of the alarm level of a channel
+type Transition struct {
+	Chancode string
+	Label    string
+	Oid      string
+	Units    string
+	From     Level
+	To       Level
+	Value    string
+	Time     time.Time
+}
+
+// Message describes the transition for logs and notifications
+func (t Transition) Message() string {
+	if t.To == Stale {
+		return fmt.Sprintf("alarm %s (%s) %s -> %s: no current value", t.Chancode, t.Label, t.From, t.To)
+	}
+	return fmt.Sprintf("alarm %s (%s) %s -> %s: %s %s", t.Chancode, t.Label, t.From, t.To, t.Value, t.Units)
+}
+
+// Log the transition at the syslog severity of its new level, after prefix
+func (t Transition) Log(prefix string) {
+	switch t.To {
+	case Crit:
+		rlog.CritMsg("%s%s", prefix, t.Message())
+	case Warn, Stale:
+		rlog.WarningMsg("%s%s", prefix, t.Message())
+	default:
+		rlog.NoticeMsg("%s%s", prefix, t.Message())
+	}
+}
+
+// channel is the rule and state of an alarmed channel
+type channel struct {
+	rule    config.AlarmRule
+	info    config.OidInfo
+	state   State
+	known   bool
+	pending Level
+	since   time.Time
+}
+
+// Evaluator runs the alarm state machine of each channel with a rule
+type Evaluator struct {
+	mutex    sync.Mutex
+	channels []*channel
+}
+
+// NewEvaluator returns an Evaluator for the alarm rules of rpmCfg. Rules
+// for chancodes that are not data OIDs are an error
+func NewEvaluator(rpmCfg *config.RPMConfig) (*Evaluator, error) {
+
+	_, dataInfo := rpmCfg.DataOidsInfo()
+	infos := make(map[string]config.OidInfo)
+	for _, info := range dataInfo {
+		infos[info.Chancode] = info
+	}
+
+	e := &Evaluator{}
+	for _, rule := range rpmCfg.Alarms {
+		info, ok := infos[rule.Chancode]
+		if !ok {
+			return nil, fmt.Errorf("alarm rule for unknown chancode: %s", rule.Chancode)
+		}
+		e.channels = append(e.channels, &channel{
+			rule: rule,
+			info: info,
+			state: State{
+				Chancode: info.Chancode,
+				Label:    info.Label,
+				Oid:      info.Oid,
+				Units:    info.Units,
+			},
+		})
+	}
+
+	return e, nil
+}
+
+// Evaluate updates the alarm states from scan at time now and returns the
+// transitions. The first evaluation of a channel sets its level immediately
+func (e *Evaluator) Evaluate(now time.Time, scan *tycon.TPDin2Scan) []Transition {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var transitions []Transition
+	for _, ch := range e.channels {
+		if t, ok := ch.evaluate(now, scan); ok {
+			transitions = append(transitions, t)
+		}
+	}
+
+	return transitions
+}
+
+// Update is Evaluate for a scan of only some of the channels, e.g. the
+// values of a trap. Channels without a value in scan are left as they are
+func (e *Evaluator) Update(now time.Time, scan *tycon.TPDin2Scan) []Transition {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var transitions []Transition
+	for _, ch := range e.channels {
+		if _, ok := scan.Data[ch.info.Oid]; !ok {
+			continue
+		}
+		if t, ok := ch.evaluate(now, scan); ok {
+			transitions = append(transitions, t)
+		}
+	}
+
+	return transitions
+}
+
+// evaluate updates the alarm state of the channel from scan, reporting
+// whether its level changed
+func (ch *channel) evaluate(now time.Time, scan *tycon.TPDin2Scan) (Transition, bool) {
+
+	raw, ok := scan.Data[ch.info.Oid]
+	level := Stale
+	if ok && (ch.rule.Stale == 0 || now.Sub(scan.TS) <= ch.rule.Stale) {
+		if val, err := ch.info.Value(raw); err == nil {
+			level = classify(ch.rule, val, ch.state.Level)
+		}
+	}
+	ch.state.Value = ch.info.FormatValue(raw)
+
+	if !ch.known {
+		ch.known = true
+		ch.state.Level = level
+		ch.state.Since = now
+		ch.pending = level
+		return ch.transition(Normal, now), level != Normal
+	}
+
+	if level == ch.state.Level {
+		ch.pending = level
+		return Transition{}, false
+	}
+	if level != ch.pending {
+		ch.pending = level
+		ch.since = now
+	}
+	if now.Sub(ch.since) < ch.rule.Duration {
+		return Transition{}, false
+	}
+
+	from := ch.state.Level
+	ch.state.Level = level
+	ch.state.Since = now
+
+	return ch.transition(from, now), true
+}
+
+func (ch *channel) transition(from Level, now time.Time) Transition {
+	return Transition{
+		Chancode: ch.state.Chancode,
+		Label:    ch.state.Label,
+		Oid:      ch.state.Oid,
+		Units:    ch.state.Units,
+		From:     from,
+		To:       ch.state.Level,
+		Value:    ch.state.Value,
+		Time:     now,
+	}
+}
+
+// States returns the alarm states in chancode order
+func (e *Evaluator) States() []State {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	states := make([]State, 0, len(e.channels))
+	for _, ch := range e.channels {
+		states = append(states, ch.state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Chancode < states[j].Chancode })
+
+	return states
+}
+
+// Levels returns the alarm levels by OID
+func (e *Evaluator) Levels() map[string]Level {
+
+	levels := make(map[string]Level)
+	for _, state := range e.States() {
+		levels[state.Oid] = state.Level
+	}
+
+	return levels
+}
+
+// classify returns the level of val given the current level; limits of the
+// current level and below are relaxed by the hysteresis
+func classify(rule config.AlarmRule, val float64, current Level) Level {
+
+	relax := func(lvl Level) float64 {
+		if current != Stale && current >= lvl {
+			return rule.Hysteresis
+		}
+		return 0
+	}
+	beyond := func(low, high *float64, hyst float64) bool {
+		return (low != nil && val <= *low+hyst) || (high != nil && val >= *high-hyst)
+	}
+
+	if beyond(rule.Lowcrit, rule.Highcrit, relax(Crit)) {
+		return Crit
+	}
+	if beyond(rule.Lowwarn, rule.Highwarn, relax(Warn)) {
+		return Warn
+	}
+
+	return Normal
+}
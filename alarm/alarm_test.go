@@ -0,0 +1,197 @@
+package alarm
+
+import (
+	"rpm/config"
+	"rpm/tycon"
+	"testing"
+	"time"
+)
+
+const (
+	batteryOid = "1.3.6.1.4.1.45621.2.2.5.0"
+	tempOid    = "1.3.6.1.4.1.45621.2.2.13.0"
+)
+
+func float(val float64) *float64 {
+	return &val
+}
+
+// batteryRule alarms below 12 and above 14 volts, critically below 11 and
+// above 15, relaxed by 0.5 volts
+func batteryRule() config.AlarmRule {
+	return config.AlarmRule{
+		Chancode:   "MV1",
+		Lowcrit:    float(11),
+		Lowwarn:    float(12),
+		Highwarn:   float(14),
+		Highcrit:   float(15),
+		Hysteresis: 0.5,
+	}
+}
+
+func testConfig(rules ...config.AlarmRule) *config.RPMConfig {
+	precision := 1
+	return &config.RPMConfig{
+		Oids: config.TyconOids{
+			Voltages: []config.OidInfo{{Oid: batteryOid, Chancode: "MV1", Label: "Battery Output Voltage", Scale: 0.1, Units: "volts", Precision: &precision}},
+			Temps:    []config.OidInfo{{Oid: tempOid, Chancode: "TPE", Label: "Temp (Ext)", Units: "C"}},
+		},
+		Alarms: rules,
+	}
+}
+
+// step is a raw battery value, missing if empty, in a scan age old
+type step struct {
+	raw string
+	age time.Duration
+}
+
+// evaluateSteps evaluates a scan a second for each step, returning the
+// battery level after each and the transitions
+func evaluateSteps(t *testing.T, e *Evaluator, steps []step) ([]Level, []Transition) {
+
+	var levels []Level
+	var transitions []Transition
+	start := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	for i, s := range steps {
+		now := start.Add(time.Duration(i) * time.Second)
+		data := map[string]string{tempOid: "215"}
+		if s.raw != "" {
+			data[batteryOid] = s.raw
+		}
+		transitions = append(transitions, e.Evaluate(now, &tycon.TPDin2Scan{TS: now.Add(-s.age), Data: data})...)
+		levels = append(levels, e.Levels()[batteryOid])
+	}
+
+	return levels, transitions
+}
+
+func raws(values ...string) []step {
+	steps := make([]step, len(values))
+	for i, raw := range values {
+		steps[i] = step{raw: raw}
+	}
+	return steps
+}
+
+func TestEvaluate(t *testing.T) {
+
+	withDuration := batteryRule()
+	withDuration.Duration = 3 * time.Second
+	noHysteresis := batteryRule()
+	noHysteresis.Hysteresis = 0
+	withStale := batteryRule()
+	withStale.Stale = 5 * time.Second
+
+	tests := []struct {
+		name  string
+		rule  config.AlarmRule
+		steps []step
+		want  []Level
+	}{
+		{"low", batteryRule(),
+			raws("130", "125", "115", "105", "113", "116", "124", "126"),
+			[]Level{Normal, Normal, Warn, Crit, Crit, Warn, Warn, Normal}},
+		{"high", batteryRule(),
+			raws("130", "140", "136", "134", "150", "146", "144", "130"),
+			[]Level{Normal, Warn, Warn, Normal, Crit, Crit, Warn, Normal}},
+		{"no hysteresis", noHysteresis,
+			raws("130", "119", "121", "109", "111", "141"),
+			[]Level{Normal, Warn, Normal, Crit, Warn, Warn}},
+		{"first immediate", withDuration,
+			raws("105", "105", "130"),
+			[]Level{Crit, Crit, Crit}},
+		{"duration", withDuration,
+			raws("130", "115", "115", "130", "115", "115", "115", "115", "130"),
+			[]Level{Normal, Normal, Normal, Normal, Normal, Normal, Normal, Warn, Warn}},
+		{"pending changes", withDuration,
+			raws("130", "115", "105", "115", "105", "105", "105", "105"),
+			[]Level{Normal, Normal, Normal, Normal, Normal, Normal, Normal, Crit}},
+		{"missing", batteryRule(),
+			raws("115", "", "noSuchObject", "115"),
+			[]Level{Warn, Stale, Stale, Warn}},
+		{"stale", withStale,
+			[]step{{"130", 0}, {"130", 5 * time.Second}, {"130", 6 * time.Second}, {"105", time.Minute}, {"105", 0}},
+			[]Level{Normal, Normal, Stale, Stale, Crit}},
+		{"old scans without stale", batteryRule(),
+			[]step{{"130", 0}, {"105", time.Hour}},
+			[]Level{Normal, Crit}},
+	}
+
+	for _, tt := range tests {
+		e, err := NewEvaluator(testConfig(tt.rule))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, _ := evaluateSteps(t, e, tt.steps)
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: levels %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTransitions(t *testing.T) {
+
+	rule := batteryRule()
+	rule.Stale = 5 * time.Second
+	e, err := NewEvaluator(testConfig(rule))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, transitions := evaluateSteps(t, e, []step{{"125", 0}, {"115", 0}, {"115", 0}, {"105", 0}, {"130", time.Minute}, {"130", 0}})
+	want := []struct {
+		from, to Level
+		message  string
+	}{
+		{Normal, Warn, "alarm MV1 (Battery Output Voltage) normal -> warn: 11.5 volts"},
+		{Warn, Crit, "alarm MV1 (Battery Output Voltage) warn -> crit: 10.5 volts"},
+		{Crit, Stale, "alarm MV1 (Battery Output Voltage) crit -> stale: no current value"},
+		{Stale, Normal, "alarm MV1 (Battery Output Voltage) stale -> normal: 13.0 volts"},
+	}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions %v, want %d", transitions, len(want))
+	}
+	for i, w := range want {
+		tr := transitions[i]
+		if tr.From != w.from || tr.To != w.to || tr.Message() != w.message || tr.Chancode != "MV1" || tr.Oid != batteryOid {
+			t.Errorf("transition %d %+v, want %s", i, tr, w.message)
+		}
+	}
+
+	states := e.States()
+	if len(states) != 1 || states[0].Level != Normal || states[0].Value != "13.0" {
+		t.Errorf("states %+v, want MV1 normal at 13.0", states)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+
+	e, err := NewEvaluator(testConfig(batteryRule(), config.AlarmRule{Chancode: "TPE", Highwarn: float(40)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	e.Evaluate(now, &tycon.TPDin2Scan{TS: now, Data: map[string]string{batteryOid: "115", tempOid: "20"}})
+
+	// a trap with only the temperature leaves the battery warning alone
+	transitions := e.Update(now.Add(time.Second), &tycon.TPDin2Scan{TS: now, Data: map[string]string{tempOid: "45"}})
+	if len(transitions) != 1 || transitions[0].Chancode != "TPE" || transitions[0].To != Warn {
+		t.Errorf("update transitions %+v, want TPE normal -> warn", transitions)
+	}
+	levels := e.Levels()
+	if levels[batteryOid] != Warn || levels[tempOid] != Warn {
+		t.Errorf("levels %v after the update, want both warn", levels)
+	}
+}
+
+func TestNewEvaluatorUnknownChancode(t *testing.T) {
+
+	if _, err := NewEvaluator(testConfig(config.AlarmRule{Chancode: "XXX"})); err == nil {
+		t.Error("rule for an unknown chancode was not an error")
+	}
+}
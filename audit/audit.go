@@ -0,0 +1,159 @@
+// Package audit keeps the JSON-lines audit trail of relay actions
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources of relay actions run from the command line and through the API,
+// the watchdog and schedule packages have sources of their own
+const (
+	SourceCLI = "cli"
+	SourceAPI = "api"
+)
+
+// Results of an audited action. ResultStarted is a relay cycle that was
+// started without waiting to see it complete
+const (
+	ResultOK       = "ok"
+	ResultStarted  = "started"
+	ResultFailed   = "failed"
+	ResultSkipped  = "skipped"
+	ResultDeclined = "declined"
+	ResultRefused  = "refused"
+)
+
+// Operator is who ran an action: the login user, the host the action was
+// run from and its terminal, if any
+type Operator struct {
+	User   string `json:"user,omitempty"`
+	Origin string `json:"origin,omitempty"`
+	Tty    string `json:"tty,omitempty"`
+}
+
+// Record is an audit trail entry. Host is the device, Previous and State
+// the relay state before and after the action, Requested the target state
+// of a set and Schedule the name of the schedule that ran it
+type Record struct {
+	Time time.Time `json:"time"`
+	Operator
+	Source    string `json:"source"`
+	Schedule  string `json:"schedule,omitempty"`
+	Host      string `json:"host"`
+	Chancode  string `json:"chancode,omitempty"`
+	Label     string `json:"label,omitempty"`
+	Action    string `json:"action"`
+	Previous  string `json:"previous,omitempty"`
+	Requested string `json:"requested,omitempty"`
+	State     string `json:"state,omitempty"`
+	Result    string `json:"result"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// self is the operator of this process, taken at startup before rpm
+// switches to the nrts user
+var self = currentOperator()
+
+// Self returns the Operator running this process
+func Self() Operator {
+	return self
+}
+
+func currentOperator() Operator {
+
+	var op Operator
+
+	// the user behind sudo, else the user running rpm
+	op.User = os.Getenv("SUDO_USER")
+	if op.User == "" {
+		if u, err := user.Current(); err == nil {
+			op.User = u.Username
+		}
+	}
+	op.Origin, _ = os.Hostname()
+	if tty, err := os.Readlink("/proc/self/fd/0"); err == nil &&
+		(strings.HasPrefix(tty, "/dev/pts/") || strings.HasPrefix(tty, "/dev/tty")) {
+		op.Tty = tty
+	}
+
+	return op
+}
+
+// Log appends records to an audit file
+type Log struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// Open the audit file at path for appending, creating it and its directory if needed
+func Open(path string) (*Log, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{path: path, file: file}, nil
+}
+
+// Write appends rec, setting its time if unset
+func (l *Log) Write(rec Record) error {
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Time = rec.Time.UTC()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err = l.file.Write(append(line, '\n'))
+
+	return err
+}
+
+// Close the audit file
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// Read returns the records of the audit file at path for which keep returns
+// true, in file order. Lines that are not records are skipped
+func Read(path string, keep func(rec Record) bool) ([]Record, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if keep == nil || keep(rec) {
+			records = append(records, rec)
+		}
+	}
+
+	return records, scanner.Err()
+}
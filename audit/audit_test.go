@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteRead(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "log", "audit.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2020, 11, 1, 12, 0, 0, 0, time.FixedZone("PST", -8*3600))
+	cycle := Record{Time: ts, Operator: Operator{User: "nrts", Origin: "nrts-1"}, Source: SourceCLI, Host: "192.168.1.25:161",
+		Chancode: "RL1", Label: "Primary", Action: "cycle", Result: ResultOK}
+	set := Record{Source: SourceAPI, Host: "192.168.1.25:161", Chancode: "RL2", Action: "set",
+		Previous: "closed", Requested: "open", State: "open", Result: ResultRefused, Detail: "relay is protected"}
+	for _, rec := range []Record{cycle, set} {
+		if err := l.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := Read(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("records %+v, want 2", records)
+	}
+
+	// times are written in UTC, and set if unset
+	cycle.Time = ts.UTC()
+	if records[0] != cycle {
+		t.Errorf("record %+v, want %+v", records[0], cycle)
+	}
+	if records[1].Time.IsZero() || records[1].Time.Location() != time.UTC {
+		t.Errorf("record time %s, want set in UTC", records[1].Time)
+	}
+	set.Time = records[1].Time
+	if records[1] != set {
+		t.Errorf("record %+v, want %+v", records[1], set)
+	}
+
+	records, err = Read(path, func(rec Record) bool { return rec.Chancode == "RL2" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Action != "set" {
+		t.Errorf("kept records %+v, want the set of RL2", records)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+
+	// a partly written line and other text between the records
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	content := `{"time":"2020-11-01T12:00:00Z","source":"cli","host":"h","chancode":"RL1","action":"cycle","result":"ok"}
+{"time":"2020-11-01T12:01:00Z","source":"cli","ho
+not a record
+
+{"time":"2020-11-01T12:02:00Z","source":"api","host":"h","chancode":"RL2","action":"set","result":"failed"}
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := Read(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Chancode != "RL1" || records[1].Chancode != "RL2" {
+		t.Errorf("records %+v, want RL1 and RL2", records)
+	}
+
+	if _, err := Read(filepath.Join(t.TempDir(), "none.jsonl"), nil); !os.IsNotExist(err) {
+		t.Errorf("read of a missing file: %v, want not exist", err)
+	}
+}
@@ -0,0 +1,435 @@
+// Package buffer keeps the scans of poll in an on-disk ring buffer that
+// consumers read with a persistent cursor
+package buffer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rpm/tycon"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".jsonl"
+	cursorExt  = ".cursor"
+)
+
+// Record is a buffered scan. Time is the sample time the scan is for and
+// TS when the device was scanned. Alarms and Quality are the alarm levels
+// and quality flags of the channels by OID when the scan was appended
+type Record struct {
+	Seq     uint64            `json:"seq"`
+	Time    time.Time         `json:"time"`
+	TS      time.Time         `json:"ts"`
+	Data    map[string]string `json:"data"`
+	Alarms  map[string]string `json:"alarms,omitempty"`
+	Quality map[string]string `json:"quality,omitempty"`
+}
+
+// Scan returns the scan of rec
+func (rec *Record) Scan() *tycon.TPDin2Scan {
+	return &tycon.TPDin2Scan{TS: rec.TS, Data: rec.Data}
+}
+
+// Buffer is a ring of segment files of records in a directory, each named
+// by the sequence number of its first record. When there are more than
+// maxSegments the oldest is removed
+type Buffer struct {
+	dir         string
+	records     int
+	maxSegments int
+
+	mutex    sync.Mutex
+	file     *os.File
+	count    int
+	next     uint64
+	appended chan struct{}
+}
+
+// Open opens the buffer in dir, creating it if needed, with segments of
+// records records and at most maxSegments segments
+func Open(dir string, records, maxSegments int) (*Buffer, error) {
+
+	if records < 1 || maxSegments < 1 {
+		return nil, fmt.Errorf("buffer %s: records and segments must be at least 1", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	b := &Buffer{
+		dir:         dir,
+		records:     records,
+		maxSegments: maxSegments,
+		next:        1,
+		appended:    make(chan struct{}, 1),
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return b, nil
+	}
+
+	// continue the last segment after its last complete record
+	last := segments[len(segments)-1]
+	path := segmentPath(dir, last)
+	b.next = last
+	err = readRecords(path, func(rec *Record) {
+		b.count++
+		if rec.Seq >= b.next {
+			b.next = rec.Seq + 1
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := terminateLine(b.file); err != nil {
+		b.file.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Append adds scan for the sample time t with the alarm levels and quality
+// flags of its channels, returning its sequence number
+func (b *Buffer) Append(t time.Time, scan *tycon.TPDin2Scan, alarms, quality map[string]string) (uint64, error) {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.file == nil || b.count >= b.records {
+		if err := b.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	rec := Record{Seq: b.next, Time: t.UTC(), TS: scan.TS.UTC(), Data: scan.Data, Alarms: alarms, Quality: quality}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := b.file.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	b.count++
+	b.next++
+
+	select {
+	case b.appended <- struct{}{}:
+	default:
+	}
+
+	return rec.Seq, nil
+}
+
+// Appended returns a channel that receives after records are appended
+func (b *Buffer) Appended() <-chan struct{} {
+	return b.appended
+}
+
+// Close the buffer
+func (b *Buffer) Close() error {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+
+	return err
+}
+
+// rotate starts a new segment, removing the oldest segments beyond maxSegments
+func (b *Buffer) rotate() error {
+
+	if b.file != nil {
+		if err := b.file.Close(); err != nil {
+			return err
+		}
+		b.file = nil
+	}
+
+	file, err := os.OpenFile(segmentPath(b.dir, b.next), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	b.file = file
+	b.count = 0
+
+	segments, err := listSegments(b.dir)
+	if err != nil {
+		return err
+	}
+	for len(segments) > b.maxSegments {
+		if err := os.Remove(segmentPath(b.dir, segments[0])); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+
+	return nil
+}
+
+// Cursor is the read position of a consumer of a buffer, kept in the file
+// <name>.cursor of the buffer directory
+type Cursor struct {
+	dir     string
+	path    string
+	next    uint64
+	segment uint64
+	file    *os.File
+	reader  *bufio.Reader
+	lost    uint64
+}
+
+// Cursor returns the cursor of consumer name, at its committed position or
+// at the oldest record for a new consumer
+func (b *Buffer) Cursor(name string) (*Cursor, error) {
+	return OpenCursor(b.dir, name)
+}
+
+// OpenCursor returns the cursor of consumer name of the buffer in dir
+func OpenCursor(dir, name string) (*Cursor, error) {
+
+	c := &Cursor{dir: dir, path: filepath.Join(dir, name+cursorExt)}
+
+	content, err := ioutil.ReadFile(c.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		c.next, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid buffer cursor %s: %s", c.path, err.Error())
+		}
+	}
+
+	return c, nil
+}
+
+// Position returns the sequence number of the next record to read
+func (c *Cursor) Position() uint64 {
+	return c.next
+}
+
+// Lost returns the number of records removed from the ring before they were read
+func (c *Cursor) Lost() uint64 {
+	return c.lost
+}
+
+// Next returns the next record, or nil if there is none yet
+func (c *Cursor) Next() (*Record, error) {
+
+	for {
+		if c.reader == nil {
+			ok, err := c.open()
+			if err != nil || !ok {
+				return nil, err
+			}
+		}
+
+		line, err := c.reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a record being written is read when it is complete
+			if len(line) > 0 {
+				if _, err := c.file.Seek(-int64(len(line)), io.SeekCurrent); err != nil {
+					return nil, err
+				}
+				c.reader.Reset(c.file)
+			}
+			// the segment is complete once there is a newer one
+			newer, err := c.newerSegment()
+			if err != nil || newer == 0 {
+				return nil, err
+			}
+			c.close()
+			c.segment = newer
+			if c.next < newer {
+				c.next = newer
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var rec Record
+		if json.Unmarshal(line, &rec) != nil || rec.Seq < c.next {
+			continue
+		}
+		c.next = rec.Seq + 1
+
+		return &rec, nil
+	}
+}
+
+// Commit persists the position, records read before it are not read again
+// after a restart
+func (c *Cursor) Commit() error {
+
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(c.next, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+// Close the cursor, without committing its position
+func (c *Cursor) Close() error {
+	return c.close()
+}
+
+// open opens the segment with the next record, reporting false if there is none
+func (c *Cursor) open() (bool, error) {
+
+	segments, err := listSegments(c.dir)
+	if err != nil || len(segments) == 0 {
+		return false, err
+	}
+
+	if c.segment == 0 {
+		// records before the oldest segment were removed from the ring
+		if c.next < segments[0] {
+			if c.next > 0 {
+				c.lost += segments[0] - c.next
+			}
+			c.next = segments[0]
+		}
+		for _, first := range segments {
+			if first <= c.next {
+				c.segment = first
+			}
+		}
+	}
+
+	file, err := os.Open(segmentPath(c.dir, c.segment))
+	if os.IsNotExist(err) {
+		// removed from the ring while it was being read
+		c.segment = 0
+		return c.open()
+	}
+	if err != nil {
+		return false, err
+	}
+	c.file = file
+	c.reader = bufio.NewReader(file)
+
+	return true, nil
+}
+
+// newerSegment returns the first segment after the current one, or 0
+func (c *Cursor) newerSegment() (uint64, error) {
+
+	segments, err := listSegments(c.dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, first := range segments {
+		if first > c.segment {
+			return first, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (c *Cursor) close() error {
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	c.reader = nil
+
+	return err
+}
+
+// listSegments returns the first sequence numbers of the segments in dir, in order
+func listSegments(dir string) ([]uint64, error) {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		if first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64); err == nil {
+			segments = append(segments, first)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	return segments, nil
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", first, segmentExt))
+}
+
+// readRecords calls fn with each complete record of the segment at path
+func readRecords(path string, fn func(rec *Record)) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+			fn(&rec)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// terminateLine ends a record left incomplete by a crash, so the next one
+// starts on its own line
+func terminateLine(file *os.File) error {
+
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = file.Write([]byte{'\n'})
+	}
+
+	return err
+}
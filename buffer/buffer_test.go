@@ -0,0 +1,198 @@
+package buffer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rpm/tycon"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+
+func tempDir(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "rpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+// appendScans appends n scans a second apart after the i'th second
+func appendScans(t *testing.T, b *Buffer, i, n int) {
+
+	for ; n > 0; i, n = i+1, n-1 {
+		ts := start.Add(time.Duration(i) * time.Second)
+		scan := &tycon.TPDin2Scan{TS: ts, Data: map[string]string{"oid": strconv.Itoa(i)}}
+		if _, err := b.Append(ts, scan, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readAll returns the values of the records read from c
+func readAll(t *testing.T, c *Cursor) []string {
+
+	var vals []string
+	for {
+		rec, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec == nil {
+			return vals
+		}
+		if scan := rec.Scan(); !scan.TS.Equal(rec.Time) || scan.Data["oid"] == "" {
+			t.Fatalf("record %+v, want the scan appended", rec)
+		}
+		vals = append(vals, rec.Data["oid"])
+	}
+}
+
+func equal(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestResume(t *testing.T) {
+
+	dir := tempDir(t)
+	b, err := Open(dir, 4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendScans(t, b, 0, 6)
+
+	c, err := b.Cursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, c); !equal(got, []string{"0", "1", "2", "3", "4", "5"}) {
+		t.Fatalf("read %v, want 0-5", got)
+	}
+
+	// only the first 3 were written downstream before a restart
+	c.next = 3
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	b.Close()
+
+	b, err = Open(dir, 4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	appendScans(t, b, 6, 3)
+
+	c, err = b.Cursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := readAll(t, c); !equal(got, []string{"2", "3", "4", "5", "6", "7", "8"}) {
+		t.Errorf("read %v after restart, want 2-8", got)
+	}
+
+	// records appended while caught up are read
+	appendScans(t, b, 9, 1)
+	if got := readAll(t, c); !equal(got, []string{"9"}) {
+		t.Errorf("read %v, want 9", got)
+	}
+}
+
+func TestRing(t *testing.T) {
+
+	dir := tempDir(t)
+	b, err := Open(dir, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c, err := b.Cursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	appendScans(t, b, 0, 2)
+	if got := readAll(t, c); !equal(got, []string{"0", "1"}) {
+		t.Fatalf("read %v, want 0-1", got)
+	}
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// the cursor falls behind the ring
+	appendScans(t, b, 2, 8)
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Errorf("%d segments, want 3", len(segments))
+	}
+
+	c, err = b.Cursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, c); !equal(got, []string{"4", "5", "6", "7", "8", "9"}) {
+		t.Errorf("read %v, want 4-9", got)
+	}
+	if c.Lost() != 2 {
+		t.Errorf("lost %d, want 2", c.Lost())
+	}
+}
+
+func TestIncompleteRecord(t *testing.T) {
+
+	dir := tempDir(t)
+	b, err := Open(dir, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendScans(t, b, 0, 2)
+	b.Close()
+
+	// a crash while a record was written
+	path := filepath.Join(dir, "0000000000000001"+segmentExt)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"time":"2020-11`)
+	f.Close()
+
+	b, err = Open(dir, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	appendScans(t, b, 2, 1)
+
+	c, err := b.Cursor("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := readAll(t, c); !equal(got, []string{"0", "1", "2"}) {
+		t.Errorf("read %v, want 0-2", got)
+	}
+}
@@ -0,0 +1,168 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"rpm/buffer"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"time"
+)
+
+const (
+	// bufferConsumer is the name of the buffer cursor of poll output
+	bufferConsumer = "poll"
+	// bufferRetryInterval is the wait before writing a scan again
+	bufferRetryInterval = 5 * time.Second
+	// bufferRetryLogEvery is how many attempts to write a scan are logged once
+	bufferRetryLogEvery = 12
+	// bufferCloseTimeout is how long Close waits for a stalled output
+	bufferCloseTimeout = 5 * time.Second
+)
+
+// bufferedOutput is a scanOutput that appends scans, with their state, to
+// an on-disk ring buffer, and writes them to output from its cursor. Scans
+// polled while output is stalled or failing are written when it recovers,
+// and scans not written before exiting are written when poll is restarted
+type bufferedOutput struct {
+	buf    *buffer.Buffer
+	cursor *buffer.Cursor
+	output scanOutput
+	// retry is the wait before writing a scan again
+	retry time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newBufferedOutput returns output buffered in dir
+func newBufferedOutput(output scanOutput, dir string) (*bufferedOutput, error) {
+
+	buf, err := buffer.Open(dir, cfg.RPMCfg.Buffer.Records, cfg.RPMCfg.Buffer.Segments)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := buf.Cursor(bufferConsumer)
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+
+	out := &bufferedOutput{
+		buf:    buf,
+		cursor: cursor,
+		output: output,
+		retry:  bufferRetryInterval,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go out.drain()
+
+	return out, nil
+}
+
+func (out *bufferedOutput) WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error {
+	_, err := out.buf.Append(sampleTime, scan, state.alarms, state.quality)
+	return err
+}
+
+// Close stops writing output and closes it, unless it is stalled. Scans not
+// yet written stay in the buffer
+func (out *bufferedOutput) Close() error {
+
+	close(out.stop)
+	select {
+	case <-out.done:
+	case <-time.After(bufferCloseTimeout):
+		rlog.WarningMsg("poll output stalled, scans not written are left in the buffer")
+		return out.buf.Close()
+	}
+
+	out.cursor.Close()
+	if err := out.output.Close(); err != nil {
+		out.buf.Close()
+		return err
+	}
+
+	return out.buf.Close()
+}
+
+// drain writes the buffered scans to output until stopped
+func (out *bufferedOutput) drain() {
+
+	defer close(out.done)
+
+	var lost uint64
+	for {
+		rec, err := out.cursor.Next()
+		if err != nil {
+			rlog.ErrMsg("error reading scan buffer: %s", err.Error())
+		}
+		if n := out.cursor.Lost(); n > lost {
+			rlog.ErrMsg("%d buffered scans were overwritten before they were written", n-lost)
+			lost = n
+		}
+		if rec == nil {
+			select {
+			case <-out.buf.Appended():
+			case <-time.After(time.Second):
+			case <-out.stop:
+				return
+			}
+			continue
+		}
+
+		if !out.write(rec) {
+			return
+		}
+		if err := out.cursor.Commit(); err != nil {
+			rlog.ErrMsg("error saving scan buffer position: %s", err.Error())
+		}
+	}
+}
+
+// write writes rec to output with the state it was buffered with, trying
+// again after an error until it is written. It reports false if stopped
+// before rec was written, leaving the cursor on it
+func (out *bufferedOutput) write(rec *buffer.Record) bool {
+
+	state := scanState{alarms: rec.Alarms, quality: rec.Quality}
+	for attempt := 0; ; attempt++ {
+		err := out.output.WriteScan(rec.Time, rec.Scan(), state)
+		if err == nil {
+			if attempt > 0 {
+				rlog.NoticeMsg("buffered scan %s written after %d attempt(s)", rec.Time.Format(time.RFC3339), attempt+1)
+			}
+			return true
+		}
+		if attempt%bufferRetryLogEvery == 0 {
+			rlog.ErrMsg("error writing buffered scan %s, trying again: %s", rec.Time.Format(time.RFC3339), err.Error())
+		}
+
+		select {
+		case <-time.After(out.retry):
+		case <-out.stop:
+			return false
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"errors"
+	"rpm/buffer"
+	"rpm/tycon"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingOutput is a scanOutput that fails the first failures writes
+type failingOutput struct {
+	mutex    sync.Mutex
+	failures int
+	attempts int
+	written  []string
+	states   []scanState
+}
+
+func (out *failingOutput) WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error {
+
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+
+	out.attempts++
+	if out.attempts <= out.failures {
+		return errors.New("output failed")
+	}
+	out.written = append(out.written, scan.Data["oid"])
+	out.states = append(out.states, state)
+
+	return nil
+}
+
+func (out *failingOutput) Close() error {
+	return nil
+}
+
+// startBufferedOutput drains a buffer in dir to output, retrying quickly
+func startBufferedOutput(t *testing.T, output scanOutput, dir string) *bufferedOutput {
+
+	buf, err := buffer.Open(dir, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := buf.Cursor(bufferConsumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bufferedOutput{
+		buf:    buf,
+		cursor: cursor,
+		output: output,
+		retry:  10 * time.Millisecond,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go out.drain()
+
+	return out
+}
+
+func appendScan(t *testing.T, out *bufferedOutput, i int, state scanState) {
+
+	ts := time.Date(2020, 11, 1, 0, 0, i, 0, time.UTC)
+	scan := &tycon.TPDin2Scan{TS: ts, Data: map[string]string{"oid": strconv.Itoa(i)}}
+	if err := out.WriteScan(ts, scan, state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBufferedOutputRetries(t *testing.T) {
+
+	output := &failingOutput{failures: bufferRetryLogEvery + 3}
+	out := startBufferedOutput(t, output, t.TempDir())
+
+	// the state is the one appended, not the one when the scan is written
+	appendScan(t, out, 0, scanState{alarms: map[string]string{"oid": "highwarn"}, quality: map[string]string{"oid": "frozen"}})
+	appendScan(t, out, 1, scanState{})
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		output.mutex.Lock()
+		n := len(output.written)
+		output.mutex.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d scans written, want 2", n)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.written[0] != "0" || output.written[1] != "1" {
+		t.Errorf("scans written %v, want 0 and 1 after the failures", output.written)
+	}
+	if output.states[0].alarms["oid"] != "highwarn" || output.states[0].quality["oid"] != "frozen" {
+		t.Errorf("first scan state %+v, want the state it was appended with", output.states[0])
+	}
+	if output.states[1].alarms != nil || output.states[1].quality != nil {
+		t.Errorf("second scan state %+v, want none", output.states[1])
+	}
+}
+
+func TestBufferedOutputStopped(t *testing.T) {
+
+	dir := t.TempDir()
+	output := &failingOutput{failures: 1 << 30}
+	out := startBufferedOutput(t, output, dir)
+	appendScan(t, out, 0, scanState{})
+	appendScan(t, out, 1, scanState{})
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		output.mutex.Lock()
+		attempts := output.attempts
+		output.mutex.Unlock()
+		if attempts > 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the failed scan was not written again")
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the scan that was never written is the next after a restart
+	output = &failingOutput{}
+	out = startBufferedOutput(t, output, dir)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		output.mutex.Lock()
+		n := len(output.written)
+		output.mutex.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d scans written after the restart, want 2", n)
+		}
+	}
+	out.Close()
+	if output.written[0] != "0" || output.written[1] != "1" {
+		t.Errorf("scans written after the restart %v, want 0 and 1", output.written)
+	}
+}
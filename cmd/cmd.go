@@ -17,15 +17,86 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"rpm/alarm"
 	"rpm/config"
+	"rpm/daemon"
+	rlog "rpm/log"
+	"rpm/metrics"
+	"rpm/notify"
+	"rpm/tycon"
 	"syscall"
+	"time"
 )
 
-// config holds parameters for the STATUS command
+const (
+	accessRead  = "read"
+	accessWrite = "write"
+)
+
+// Exit codes of the commands, so scripts can tell why a relay action was not
+// done, or why a cycle that was started is not known to have completed
+const (
+	ExitOK               = 0
+	ExitFailed           = 1
+	ExitDeclined         = 2
+	ExitRefused          = 3
+	ExitCycleNotObserved = 4
+	ExitCycleIncomplete  = 5
+	ExitUnresponsive     = 6
+)
+
+// ActionError is an action that was not performed because it was declined
+// at the confirmation or refused by policy
+type ActionError struct {
+	Code int
+	Msg  string
+}
+
+func (e *ActionError) Error() string {
+	return e.Msg
+}
+
+// declinedf returns an ActionError with ExitDeclined
+func declinedf(format string, args ...interface{}) error {
+	return &ActionError{ExitDeclined, fmt.Sprintf(format, args...)}
+}
+
+// refusedf returns an ActionError with ExitRefused
+func refusedf(format string, args ...interface{}) error {
+	return &ActionError{ExitRefused, fmt.Sprintf(format, args...)}
+}
+
+// ExitCode returns the process exit code for the error returned by a command
+func ExitCode(err error) int {
+
+	if err == nil {
+		return ExitOK
+	}
+	var actionErr *ActionError
+	switch {
+	case errors.As(err, &actionErr):
+		return actionErr.Code
+	case errors.Is(err, errCycleNotObserved):
+		return ExitCycleNotObserved
+	case errors.Is(err, errCycleIncomplete):
+		return ExitCycleIncomplete
+	case errors.Is(err, errDeviceUnresponsive):
+		return ExitUnresponsive
+	}
+
+	return ExitFailed
+}
+
+// config holds parameters for the STATUS command. Device is the name of
+// the device in the [[devices]] when a command runs for several devices
 type cmdConfig struct {
+	Cmd    string
+	Device string
 	Host   string
 	Port   string
 	RPMCfg *config.RPMConfig
@@ -50,6 +121,10 @@ var allOids []string
 var cfg cmdConfig
 var sigdone chan bool
 
+// newPowerMonitor creates the device the commands operate on.
+// Tests can replace it to substitute a fake tycon.PowerMonitor.
+var newPowerMonitor = tycon.NewPowerMonitor
+
 func init() {
 
 	sigdone = setupSignals(syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
@@ -68,6 +143,232 @@ func initOids(c *config.RPMConfig) {
 
 }
 
+// deviceAddr returns the address of the device for display, or of the daemon used instead
+func (c *cmdConfig) deviceAddr() string {
+	if serverURL != "" {
+		return serverURL
+	}
+	return c.Host + ":" + c.Port
+}
+
+// logPrefix returns the prefix of the log messages of the device, its name
+// when there are several
+func (c *cmdConfig) logPrefix() string {
+	if c.Device == "" {
+		return ""
+	}
+	return "device " + c.Device + ": "
+}
+
+// warnInterlockHosts warns if no [[interlock.hosts]] rules restrict the
+// hosts that operate the relays
+func (c *cmdConfig) warnInterlockHosts() {
+	if len(c.RPMCfg.Oids.Relays) > 0 && len(c.RPMCfg.Interlock.Hosts) == 0 {
+		rlog.WarningMsg("%sno [[interlock.hosts]] rules, any host may operate the relays, including a host a relay powers", c.logPrefix())
+	}
+}
+
+// checkFirmware warns if the firmware version in the static results is not
+// one the OIDs are for
+func (c *cmdConfig) checkFirmware(results map[string]string) {
+	if warning := c.RPMCfg.Oids.FirmwareMismatch(results); warning != "" {
+		rlog.WarningMsg("%s%s", c.logPrefix(), warning)
+	}
+}
+
+// snmpCredentials builds the SNMP credentials for read or write access to the device
+func snmpCredentials(c *config.RPMConfig, settings config.SNMPSettings, access string) tycon.Credentials {
+
+	version := c.SNMP.Version
+	level := c.SNMP.V3.Level
+	if access == accessWrite {
+		if c.SNMP.Writeversion != "" {
+			version = c.SNMP.Writeversion
+		}
+		if c.SNMP.V3.Writelevel != "" {
+			level = c.SNMP.V3.Writelevel
+		}
+	}
+	if version == "" {
+		version = tycon.SNMPVersion2c
+	}
+	if level == "" {
+		level = tycon.SecLevelAuthPriv
+	}
+
+	community := settings.Readcommunity
+	if access == accessWrite {
+		community = settings.Writecommunity
+	}
+
+	return tycon.Credentials{
+		Version:        version,
+		Community:      community,
+		User:           c.SNMP.V3.User,
+		SecurityLevel:  level,
+		AuthProtocol:   c.SNMP.V3.Authprotocol,
+		AuthPassphrase: c.SNMP.V3.Authpassphrase,
+		PrivProtocol:   c.SNMP.V3.Privprotocol,
+		PrivPassphrase: c.SNMP.V3.Privpassphrase,
+	}
+}
+
+// newMetricsCollector returns a metrics.Collector for the device, counting
+// the SNMP errors of dev when it keeps count
+func (c *cmdConfig) newMetricsCollector(dev tycon.PowerMonitor) *metrics.Collector {
+
+	collector := metrics.NewCollector(c.RPMCfg)
+	if counter, ok := dev.(tycon.ErrorCounter); ok {
+		collector.SetErrorSource(counter.SNMPErrors)
+	}
+
+	return collector
+}
+
+// notifyCloseTimeout is how long commands wait for queued notifications when exiting
+const notifyCloseTimeout = 30 * time.Second
+
+// newNotifier returns a notify.Notifier for the [[notify]] sinks of the config
+func newNotifier() (*notify.Notifier, error) {
+	return notify.New(cfg.RPMCfg.Notify)
+}
+
+// newEvent returns a notify.Event of kind for the device and relay or channel info
+func (c *cmdConfig) newEvent(kind, severity string, info config.OidInfo, msg string) notify.Event {
+	return notify.Event{
+		Kind:     kind,
+		Time:     time.Now().UTC(),
+		Severity: severity,
+		Host:     c.deviceAddr(),
+		Net:      c.RPMCfg.General.Net,
+		Sta:      c.RPMCfg.General.Sta,
+		Loc:      c.RPMCfg.General.Loc,
+		Chancode: info.Chancode,
+		Label:    info.Label,
+		Units:    info.Units,
+		Message:  msg,
+	}
+}
+
+// notifyRelay sends a notification of a relay action, err is the error if it failed
+func (c *cmdConfig) notifyRelay(notifier *notify.Notifier, info config.OidInfo, action, targetState string, err error) {
+
+	msg := fmt.Sprintf("relay %s (%s) %s", info.Chancode, info.Label, action)
+	if targetState != "" {
+		msg += " " + targetState
+	}
+	severity := "notice"
+	if err != nil {
+		msg += " failed: " + err.Error()
+		severity = "err"
+	}
+
+	ev := c.newEvent(notify.KindRelay, severity, info, msg)
+	ev.Action = action
+	ev.To = targetState
+	notifier.Notify(ev)
+}
+
+// evaluateAlarms runs the alarm state machines on scan, logging and
+// notifying the transitions
+func (c *cmdConfig) evaluateAlarms(alarms *alarm.Evaluator, notifier *notify.Notifier, scan *tycon.TPDin2Scan) {
+	c.notifyAlarms(notifier, alarms.Evaluate(time.Now(), scan))
+}
+
+// notifyAlarms logs and notifies alarm transitions
+func (c *cmdConfig) notifyAlarms(notifier *notify.Notifier, transitions []alarm.Transition) {
+
+	for _, t := range transitions {
+		t.Log(c.logPrefix())
+
+		severity := "notice"
+		switch t.To {
+		case alarm.Crit:
+			severity = "crit"
+		case alarm.Warn, alarm.Stale:
+			severity = "warning"
+		}
+		ev := c.newEvent(notify.KindAlarm, severity, config.OidInfo{Chancode: t.Chancode, Label: t.Label, Units: t.Units}, t.Message())
+		ev.Time = t.Time.UTC()
+		ev.From = t.From.String()
+		ev.To = t.To.String()
+		ev.Value = t.Value
+		notifier.Notify(ev)
+	}
+}
+
+// connectPowerMonitor creates and connects the PowerMonitor for the device
+// with read or write access
+func (c *cmdConfig) connectPowerMonitor(access string) (tycon.PowerMonitor, error) {
+
+	host, port := c.Host, c.Port
+	settings := c.RPMCfg.SNMPFor(c.Cmd)
+	opts := tycon.Options{
+		Transport: settings.Transport,
+		Timeout:   settings.Timeout,
+		Retries:   settings.Retries,
+		MaxOids:   settings.Maxoids,
+	}
+
+	var dev tycon.PowerMonitor
+	var err error
+	if serverURL != "" {
+		dev = daemon.NewClient(serverURL, c.RPMCfg.Server.Token, settings.Timeout)
+	} else {
+		dev, err = newPowerMonitor(host, port, opts)
+	}
+	if err != nil {
+		rlog.ErrMsg("error initializing structures for %s:%s, quitting", host, port)
+		return nil, err
+	}
+
+	creds := snmpCredentials(c.RPMCfg, settings, access)
+	rlog.DebugMsg("connecting to %s:%s with SNMP v%s", host, port, creds.Version)
+
+	err = dev.Connect(creds)
+	if err != nil {
+		rlog.CritMsg("could not connect to %s:%s, quitting", host, port)
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+// parseCmdArgs parses the flags in args, which may be mixed with the positional
+// parameters, and returns the command name followed by the positional parameters
+func parseCmdArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+
+	positional := []string{args[0]}
+	args = args[1:]
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	return positional, nil
+}
+
+// doneOnSignal returns a channel that is closed when the process is signaled
+// to exit, for when several loops need to stop
+func doneOnSignal() <-chan struct{} {
+
+	done := make(chan struct{})
+	go func() {
+		<-sigdone
+		rlog.DebugMsg("got done signal")
+		close(done)
+	}()
+
+	return done
+}
+
 // SetupSignals to trap for external kill signals
 func setupSignals(sigs ...os.Signal) chan bool {
 
@@ -78,7 +379,7 @@ func setupSignals(sigs ...os.Signal) chan bool {
 
 	go func() {
 		sig := <-sigchan
-		fmt.Println(sig)
+		fmt.Fprintln(os.Stderr, sig)
 		done <- true
 	}()
 
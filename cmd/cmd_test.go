@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"rpm/config"
+	"rpm/tycon"
+	"testing"
+)
+
+func TestSNMPCredentials(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		version       string
+		writeversion  string
+		level         string
+		writelevel    string
+		access        string
+		wantVersion   string
+		wantLevel     string
+		wantCommunity string
+	}{
+		{"v2c read", "", "", "", "", accessRead, tycon.SNMPVersion2c, tycon.SecLevelAuthPriv, "vault"},
+		{"v2c write", "2c", "", "", "", accessWrite, tycon.SNMPVersion2c, tycon.SecLevelAuthPriv, "secret"},
+		{"v3 default level", "3", "", "", "", accessRead, tycon.SNMPVersion3, tycon.SecLevelAuthPriv, "vault"},
+		{"v3 read level", "3", "", "authNoPriv", "authPriv", accessRead, tycon.SNMPVersion3, "authNoPriv", "vault"},
+		// relay writes can require authPriv while queries do not
+		{"v3 writelevel", "3", "", "noAuthNoPriv", "authPriv", accessWrite, tycon.SNMPVersion3, "authPriv", "secret"},
+		{"v3 level for writes", "3", "", "authNoPriv", "", accessWrite, tycon.SNMPVersion3, "authNoPriv", "secret"},
+		{"writeversion read", "2c", "3", "", "authPriv", accessRead, tycon.SNMPVersion2c, tycon.SecLevelAuthPriv, "vault"},
+		{"writeversion write", "2c", "3", "noAuthNoPriv", "authPriv", accessWrite, tycon.SNMPVersion3, "authPriv", "secret"},
+	}
+
+	for _, tt := range tests {
+		rpmCfg := config.NewConfig()
+		rpmCfg.SNMP.Version, rpmCfg.SNMP.Writeversion = tt.version, tt.writeversion
+		rpmCfg.SNMP.V3.User = "rpm"
+		rpmCfg.SNMP.V3.Level, rpmCfg.SNMP.V3.Writelevel = tt.level, tt.writelevel
+		settings := config.SNMPSettings{Readcommunity: "vault", Writecommunity: "secret"}
+
+		creds := snmpCredentials(rpmCfg, settings, tt.access)
+		if creds.Version != tt.wantVersion || creds.SecurityLevel != tt.wantLevel || creds.Community != tt.wantCommunity || creds.User != "rpm" {
+			t.Errorf("%s: credentials version %s level %s community %s, want %s %s %s",
+				tt.name, creds.Version, creds.SecurityLevel, creds.Community, tt.wantVersion, tt.wantLevel, tt.wantCommunity)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"rpm/config"
+	rlog "rpm/log"
+)
+
+// Config runs the config command; it does not touch the device
+func Config(host, port string, rpmCfg *config.RPMConfig, args []string) error {
+
+	cfg.Cmd = args[0]
+	cfg.Host = host
+	cfg.Port = port
+	cfg.RPMCfg = rpmCfg
+
+	rlog.NoticeMsg("running %s command", args[0])
+
+	if len(args) < 2 {
+		return errors.New("not enough parameters, config sub-command must be specified")
+	}
+
+	switch args[1] {
+	case "check":
+		return configCheck(rpmCfg)
+	}
+
+	return fmt.Errorf("invalid config sub-command: %s", args[1])
+}
+
+// configCheck validates the config, printing all problems found
+func configCheck(rpmCfg *config.RPMConfig) error {
+
+	err := rpmCfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: ok\n", rpmCfg.CfgFile)
+	rlog.NoticeMsg("config file %s: ok", rpmCfg.CfgFile)
+
+	return nil
+}
@@ -0,0 +1,272 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"rpm/alarm"
+	rlog "rpm/log"
+	"rpm/metrics"
+	"rpm/notify"
+	"rpm/quality"
+	"rpm/tycon"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSNMPPort is the port of a device host without one
+	defaultSNMPPort = "161"
+	// deviceRetryInterval is the wait before a device that failed is polled again
+	deviceRetryInterval = time.Minute
+)
+
+// deviceConfigs returns the command config of each of the [[devices]]
+func deviceConfigs() ([]*cmdConfig, error) {
+
+	if len(cfg.RPMCfg.Devices) == 0 {
+		return nil, fmt.Errorf("the %s command requires a hostname-or-ip, or [[devices]] in the config", cfg.Cmd)
+	}
+
+	var devices []*cmdConfig
+	for _, d := range cfg.RPMCfg.Devices {
+		host, port := d.Host, defaultSNMPPort
+		if strings.Contains(d.Host, ":") {
+			var err error
+			if host, port, err = net.SplitHostPort(d.Host); err != nil {
+				return nil, fmt.Errorf("device %s: %w", d.Name, err)
+			}
+		}
+		devices = append(devices, &cmdConfig{
+			Cmd:    cfg.Cmd,
+			Device: d.Name,
+			Host:   host,
+			Port:   port,
+			RPMCfg: cfg.RPMCfg.DeviceConfig(d),
+		})
+	}
+
+	return devices, nil
+}
+
+// pollDevices polls the [[devices]] concurrently until signaled, each with
+// its own alarms and error handling, and merges their output
+func pollDevices(dInterval time.Duration, opts *pollOptions) error {
+
+	devices, err := deviceConfigs()
+	if err != nil {
+		return err
+	}
+	if opts.format == formatJSON {
+		return fmt.Errorf("the %s output format can not merge devices, use %s", formatJSON, formatNDJSON)
+	}
+	rlog.NoticeMsg("running %s command on %d devices", cfg.Cmd, len(devices))
+	rlog.NoticeMsg("polling interval: %.0f sec(s)", dInterval.Seconds())
+
+	notifier, err := newNotifier()
+	if err != nil {
+		return err
+	}
+	defer notifier.Close(notifyCloseTimeout)
+
+	merged := &mergedOutput{w: os.Stdout}
+	outputs := make([]scanOutput, len(devices))
+	alarms := make([]*alarm.Evaluator, len(devices))
+	checkers := make([]*quality.Checker, len(devices))
+	collectors := make([]*metrics.Collector, len(devices))
+	defer func() {
+		for _, output := range outputs {
+			if output != nil {
+				output.Close()
+			}
+		}
+	}()
+
+	for i, c := range devices {
+		if alarms[i], err = alarm.NewEvaluator(c.RPMCfg); err != nil {
+			return fmt.Errorf("device %s: %w", c.Device, err)
+		}
+		if checkers[i], err = quality.NewChecker(c.RPMCfg); err != nil {
+			return fmt.Errorf("device %s: %w", c.Device, err)
+		}
+		output, err := merged.newDeviceOutput(outputParams{
+			format:         opts.format,
+			host:           c.Host,
+			sampleInterval: dInterval,
+			rpmCfg:         c.RPMCfg,
+			scaled:         opts.scaled,
+			noHeader:       i > 0,
+		})
+		if err != nil {
+			return err
+		}
+		outputs[i] = output
+		if opts.buffer != "" {
+			buffered, err := newBufferedOutput(output, filepath.Join(opts.buffer, c.Device))
+			if err != nil {
+				return fmt.Errorf("device %s: %w", c.Device, err)
+			}
+			outputs[i] = buffered
+		}
+		collectors[i] = metrics.NewCollector(c.RPMCfg)
+	}
+	if opts.buffer != "" {
+		rlog.NoticeMsg("poll output buffered in %s", opts.buffer)
+	}
+	rlog.NoticeMsg("poll output format: %s", opts.format)
+
+	if opts.metrics != "" {
+		metricsSrv := serveMetrics(opts.metrics, collectors...)
+		defer metricsSrv.Close()
+	}
+
+	done := doneOnSignal()
+	var wg sync.WaitGroup
+	for i, c := range devices {
+		wg.Add(1)
+		go func(c *cmdConfig, output scanOutput, alarms *alarm.Evaluator, checker *quality.Checker, collector *metrics.Collector) {
+			defer wg.Done()
+			c.pollDeviceRetry(dInterval, output, alarms, checker, notifier, collector, done)
+		}(c, outputs[i], alarms[i], checkers[i], collectors[i])
+	}
+	wg.Wait()
+
+	rlog.NoticeMsg("poll exiting")
+
+	return nil
+}
+
+// pollDeviceRetry connects to and polls the device until done. When that
+// fails it tries again after deviceRetryInterval
+func (c *cmdConfig) pollDeviceRetry(dInterval time.Duration, output scanOutput,
+	alarms *alarm.Evaluator, checker *quality.Checker, notifier *notify.Notifier, collector *metrics.Collector, done <-chan struct{}) {
+
+	for {
+		err := c.connectAndPoll(dInterval, output, alarms, checker, notifier, collector, done)
+		if err == nil {
+			return
+		}
+		rlog.ErrMsg("%spolling failed, trying again in %s: %s", c.logPrefix(), deviceRetryInterval, err.Error())
+
+		select {
+		case <-time.After(deviceRetryInterval):
+		case <-done:
+			return
+		}
+	}
+}
+
+// connectAndPoll connects to the device and polls it until done
+func (c *cmdConfig) connectAndPoll(dInterval time.Duration, output scanOutput,
+	alarms *alarm.Evaluator, checker *quality.Checker, notifier *notify.Notifier, collector *metrics.Collector, done <-chan struct{}) error {
+
+	tp2din, err := c.connectPowerMonitor(accessRead)
+	if err != nil {
+		return err
+	}
+	defer tp2din.Close()
+
+	if counter, ok := tp2din.(tycon.ErrorCounter); ok {
+		collector.SetErrorSource(counter.SNMPErrors)
+	}
+
+	return c.pollDevice(tp2din, dInterval, output, alarms, checker, notifier, collector, done)
+}
+
+// mergedOutput writes the output of several devices to w, a scan at a time
+type mergedOutput struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// newDeviceOutput returns the scanOutput of a device, see deviceOutput
+func (merged *mergedOutput) newDeviceOutput(params outputParams) (*deviceOutput, error) {
+
+	out := &deviceOutput{merged: merged}
+	output, err := newScanOutput(&out.buf, params)
+	if err != nil {
+		return nil, err
+	}
+	out.output = output
+
+	return out, nil
+}
+
+// write writes p to w as a whole
+func (merged *mergedOutput) write(p []byte) error {
+
+	merged.mutex.Lock()
+	defer merged.mutex.Unlock()
+
+	_, err := merged.w.Write(p)
+
+	return err
+}
+
+// deviceOutput is the output of a device of a mergedOutput. Each scan is
+// formatted into buf and then written to the mergedOutput, so the scans of
+// the devices are not interleaved
+type deviceOutput struct {
+	merged *mergedOutput
+	buf    bytes.Buffer
+	output scanOutput
+}
+
+func (out *deviceOutput) WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error {
+
+	err := out.output.WriteScan(sampleTime, scan, state)
+	if ferr := out.flush(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
+
+func (out *deviceOutput) Close() error {
+
+	err := out.output.Close()
+	if ferr := out.flush(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
+
+// flush writes the formatted output to the mergedOutput
+func (out *deviceOutput) flush() error {
+
+	if out.buf.Len() == 0 {
+		return nil
+	}
+	err := out.merged.write(out.buf.Bytes())
+	out.buf.Reset()
+
+	return err
+}
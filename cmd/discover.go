@@ -0,0 +1,204 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rpm/config"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"strconv"
+	"strings"
+)
+
+// tyconEnterpriseOid is the root of the Tycon Systems enterprise subtree
+const tyconEnterpriseOid = "1.3.6.1.4.1.45621"
+
+// discoverCategories are the [oids] categories of a draft, in order, with
+// the chancode prefix of guessed data oids
+var discoverCategories = []struct {
+	name   string
+	prefix string
+}{
+	{categoryStatic, ""},
+	{categoryTests, ""},
+	{categoryRelays, "RL"},
+	{categoryVoltages, "MV"},
+	{categoryCurrents, "MC"},
+	{categoryTemps, "TP"},
+}
+
+// discoverOptions holds the discover command flags
+type discoverOptions struct {
+	root    string
+	draft   bool
+	profile string
+}
+
+// Discover runs the discover command, walking the OIDs of the device
+func Discover(host, port string, rpmCfg *config.RPMConfig, args []string) error {
+
+	cfg.Cmd = args[0]
+	cfg.Host = host
+	cfg.Port = port
+	cfg.RPMCfg = rpmCfg
+
+	rlog.NoticeMsg("running %s command on host: %s:%s", args[0], cfg.Host, cfg.Port)
+
+	opts := &discoverOptions{}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.root, "root", tyconEnterpriseOid, "OID of the subtree to walk")
+	flags.BoolVar(&opts.draft, "draft", false, "print a draft [oids] section of rpm.toml instead")
+	flags.StringVar(&opts.profile, "profile", "", "oid profile of the known oids of the draft, instead of the [oids] of rpm.toml")
+	if _, err := parseCmdArgs(flags, args); err != nil {
+		return err
+	}
+
+	known := cfg.RPMCfg.Oids
+	if opts.profile != "" {
+		var err error
+		if known, err = config.LoadProfile(opts.profile, cfg.RPMCfg.Profiles.Dir); err != nil {
+			return err
+		}
+	}
+
+	tp2din, err := cfg.connectPowerMonitor(accessRead)
+	if err != nil {
+		return err
+	}
+	defer tp2din.Close()
+
+	walker, ok := tp2din.(tycon.Walker)
+	if !ok {
+		return fmt.Errorf("the %s command is not supported by the device", cfg.Cmd)
+	}
+	variables, err := walker.Walk(opts.root)
+	if err != nil {
+		return err
+	}
+	rlog.NoticeMsg("discovered %d oids under %s", len(variables), opts.root)
+	if len(variables) == 0 {
+		return fmt.Errorf("no oids under %s on %s", opts.root, cfg.deviceAddr())
+	}
+
+	if opts.draft {
+		return writeDraftOids(os.Stdout, variables, known)
+	}
+	for _, v := range variables {
+		fmt.Printf("%-32s  %-16s  %s\n", v.Oid, v.Type, v.Value)
+	}
+
+	return nil
+}
+
+// writeDraftOids writes an [oids] section with the variables. Oids in known
+// keep their category, chancode and label; the category of the others is
+// guessed from their value, see guessCategory, and marked for review
+func writeDraftOids(w io.Writer, variables []tycon.Variable, known config.TyconOids) error {
+
+	chancodes := make(map[string]bool)
+	for _, oids := range [][]config.OidInfo{known.Tests, known.Relays, known.Voltages, known.Currents, known.Temps} {
+		for _, info := range oids {
+			chancodes[info.Chancode] = true
+		}
+	}
+
+	lines := make(map[string][]string)
+	for _, v := range variables {
+		category, info, found := findOid(known, v.Oid)
+		comment := ""
+		if !found {
+			category = guessCategory(v)
+			info = config.OidInfo{Oid: v.Oid}
+			for _, c := range discoverCategories {
+				if c.name == category && c.prefix != "" {
+					info.Chancode = nextChancode(c.prefix, chancodes)
+				}
+			}
+			comment = fmt.Sprintf(" # guessed from %s %q, set the label", v.Type, v.Value)
+		}
+		line := fmt.Sprintf("    { oid = %q, chancode = %q, label = %q", info.Oid, info.Chancode, info.Label)
+		if info.Function != "" {
+			line += fmt.Sprintf(", function = %q", info.Function)
+		}
+		lines[category] = append(lines[category], line+" },"+comment)
+	}
+
+	fmt.Fprintln(w, "[oids]")
+	for _, c := range discoverCategories {
+		if len(lines[c.name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s = [\n", c.name)
+		for _, line := range lines[c.name] {
+			fmt.Fprintln(w, line)
+		}
+		if _, err := fmt.Fprintln(w, "]"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// guessCategory guesses the category of v from its value: strings and
+// non-integers are static, 0 and 1 relay states, and the TPDin2's tenths up
+// to 10.0 currents, up to 20.0 voltages and above that temperatures
+func guessCategory(v tycon.Variable) string {
+
+	if v.Type != "Integer" {
+		return categoryStatic
+	}
+	val, err := strconv.Atoi(v.Value)
+	switch {
+	case err != nil:
+		return categoryStatic
+	case val == 0 || val == 1:
+		return categoryRelays
+	case val <= 100:
+		return categoryCurrents
+	case val <= 200:
+		return categoryVoltages
+	default:
+		return categoryTemps
+	}
+}
+
+// nextChancode returns the first chancode of prefix and a digit or letter
+// not in used, adding it to used
+func nextChancode(prefix string, used map[string]bool) string {
+
+	const suffixes = "123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	for _, suffix := range strings.Split(suffixes, "") {
+		if chancode := prefix + suffix; !used[chancode] {
+			used[chancode] = true
+			return chancode
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"bytes"
+	"rpm/config"
+	"rpm/simulator"
+	"rpm/tycon"
+	"strings"
+	"testing"
+)
+
+func TestGuessCategory(t *testing.T) {
+
+	tests := []struct {
+		v    tycon.Variable
+		want string
+	}{
+		{tycon.Variable{Type: "OctetString", Value: "TPDIN2"}, categoryStatic},
+		{tycon.Variable{Type: "OctetString", Value: "125"}, categoryStatic},
+		{tycon.Variable{Type: "TimeTicks", Value: "12345"}, categoryStatic},
+		{tycon.Variable{Type: "Integer", Value: "1.5"}, categoryStatic},
+		{tycon.Variable{Type: "Integer", Value: "0"}, categoryRelays},
+		{tycon.Variable{Type: "Integer", Value: "1"}, categoryRelays},
+		{tycon.Variable{Type: "Integer", Value: "2"}, categoryCurrents},
+		{tycon.Variable{Type: "Integer", Value: "100"}, categoryCurrents},
+		{tycon.Variable{Type: "Integer", Value: "101"}, categoryVoltages},
+		{tycon.Variable{Type: "Integer", Value: "200"}, categoryVoltages},
+		{tycon.Variable{Type: "Integer", Value: "201"}, categoryTemps},
+	}
+
+	for _, tt := range tests {
+		if got := guessCategory(tt.v); got != tt.want {
+			t.Errorf("guessCategory(%s %q) = %s, want %s", tt.v.Type, tt.v.Value, got, tt.want)
+		}
+	}
+}
+
+func TestWriteDraftOids(t *testing.T) {
+
+	// the device has more oids than are known
+	devCfg := config.NewConfig()
+	devCfg.Oids.Static = []config.OidInfo{{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Label: "Product Name"}}
+	devCfg.Oids.Tests = []config.OidInfo{{Oid: "1.3.6.1.2.1.1.3.0", Chancode: "TS1", Label: "Test OID #1"}}
+	devCfg.Oids.Relays = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.1.0", Chancode: "RL1"},
+		{Oid: "1.3.6.1.4.1.45621.2.2.2.0", Chancode: "RL2"},
+	}
+	devCfg.Oids.Voltages = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.5.0", Chancode: "MV1"},
+		{Oid: "1.3.6.1.4.1.45621.2.2.6.0", Chancode: "MV2"},
+	}
+	devCfg.Oids.Currents = []config.OidInfo{{Oid: "1.3.6.1.4.1.45621.2.2.9.0", Chancode: "MC1"}}
+	devCfg.Oids.Temps = []config.OidInfo{{Oid: "1.3.6.1.4.1.45621.2.2.13.0", Chancode: "TPE"}}
+	devCfg.Simulator.Static = []config.StaticValue{{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Value: "TPDIN2-SIM"}}
+	devCfg.Simulator.Waveforms = []config.WaveformInfo{
+		{Chancode: "MV1", Kind: simulator.WaveConstant, Base: 132},
+		{Chancode: "MV2", Kind: simulator.WaveConstant, Base: 125},
+		{Chancode: "MC1", Kind: simulator.WaveConstant, Base: 50},
+		{Chancode: "TPE", Kind: simulator.WaveConstant, Base: 215},
+	}
+
+	sim := simulator.New(devCfg)
+	if err := sim.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Stop()
+	host, port := sim.HostPort()
+	dev, err := tycon.NewPowerMonitor(host, port, tycon.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Connect(tycon.Credentials{Community: simulator.DefaultReadCommunity}); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	variables, err := dev.(tycon.Walker).Walk("1.3.6.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := config.TyconOids{
+		Static:   []config.OidInfo{{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Label: "Product Name"}},
+		Tests:    []config.OidInfo{{Oid: "1.3.6.1.2.1.1.3.0", Chancode: "TS1", Label: "Test OID #1"}},
+		Relays:   []config.OidInfo{{Oid: "1.3.6.1.4.1.45621.2.2.1.0", Chancode: "RL1", Label: "Primary"}},
+		Voltages: []config.OidInfo{{Oid: "1.3.6.1.4.1.45621.2.2.5.0", Chancode: "MV1", Label: "Battery", Function: "battery"}},
+	}
+	var out bytes.Buffer
+	if err := writeDraftOids(&out, variables, known); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		`[oids]`,
+		`static = [`,
+		`    { oid = "1.3.6.1.4.1.45621.2.1.1.0", chancode = "", label = "Product Name" },`,
+		`]`,
+		`tests = [`,
+		`    { oid = "1.3.6.1.2.1.1.3.0", chancode = "TS1", label = "Test OID #1" },`,
+		`]`,
+		`relays = [`,
+		`    { oid = "1.3.6.1.4.1.45621.2.2.1.0", chancode = "RL1", label = "Primary" },`,
+		`    { oid = "1.3.6.1.4.1.45621.2.2.2.0", chancode = "RL2", label = "" }, # guessed from Integer "1", set the label`,
+		`]`,
+		`voltages = [`,
+		`    { oid = "1.3.6.1.4.1.45621.2.2.5.0", chancode = "MV1", label = "Battery", function = "battery" },`,
+		`    { oid = "1.3.6.1.4.1.45621.2.2.6.0", chancode = "MV2", label = "" }, # guessed from Integer "125", set the label`,
+		`]`,
+		`currents = [`,
+		`    { oid = "1.3.6.1.4.1.45621.2.2.9.0", chancode = "MC1", label = "" }, # guessed from Integer "50", set the label`,
+		`]`,
+		`temps = [`,
+		`    { oid = "1.3.6.1.4.1.45621.2.2.13.0", chancode = "TP1", label = "" }, # guessed from Integer "215", set the label`,
+		`]`,
+		``,
+	}, "\n")
+	if got := out.String(); got != want {
+		t.Errorf("draft\n%s\nwant\n%s", got, want)
+	}
+}
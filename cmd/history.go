@@ -0,0 +1,172 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"rpm/audit"
+	rlog "rpm/log"
+	"time"
+)
+
+const (
+	historyFormatText = "text"
+	historyFormatJSON = "json"
+)
+
+// historyTimeLayouts are the accepted layouts of --since and --until, in UTC
+var historyTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// historyOptions holds the relay history flags
+type historyOptions struct {
+	since  string
+	until  string
+	relay  string
+	format string
+}
+
+// relayHistory prints the relay actions in the audit trail
+func relayHistory(args []string) error {
+
+	opts := &historyOptions{}
+	flags := flag.NewFlagSet(args[0]+" "+relayCmdHistory, flag.ContinueOnError)
+	flags.StringVar(&opts.since, "since", "", "only actions since a time or duration ago, e.g. 24h or 2020-11-01")
+	flags.StringVar(&opts.until, "until", "", "only actions before a time or duration ago")
+	flags.StringVar(&opts.relay, "relay", "", "only actions on a relay, by number, chancode or label")
+	flags.StringVar(&opts.format, "format", historyFormatText, "output format: text or json")
+
+	if _, err := parseCmdArgs(flags, args); err != nil {
+		return err
+	}
+	if opts.format != historyFormatText && opts.format != historyFormatJSON {
+		return fmt.Errorf("invalid history format: %s", opts.format)
+	}
+
+	now := time.Now()
+	since, err := parseHistoryTime(opts.since, now)
+	if err != nil {
+		return err
+	}
+	until, err := parseHistoryTime(opts.until, now)
+	if err != nil {
+		return err
+	}
+	chancode, err := historyRelay(opts.relay)
+	if err != nil {
+		return err
+	}
+
+	records, err := audit.Read(cfg.RPMCfg.Audit.File, func(rec audit.Record) bool {
+		return (rec.Action == relayCmdSet || rec.Action == relayCmdCycle) &&
+			(since.IsZero() || !rec.Time.Before(since)) &&
+			(until.IsZero() || rec.Time.Before(until)) &&
+			(chancode == "" || rec.Chancode == chancode)
+	})
+	if os.IsNotExist(err) {
+		rlog.NoticeMsg("no audit trail %s, no relay actions yet", cfg.RPMCfg.Audit.File)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.format == historyFormatJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, rec := range records {
+		fmt.Println(formatHistory(rec))
+	}
+
+	return nil
+}
+
+// formatHistory formats rec as a line of text
+func formatHistory(rec audit.Record) string {
+
+	action := rec.Action
+	if rec.Requested != "" {
+		action += " " + rec.Requested
+	}
+	states := rec.Previous
+	if rec.State != "" {
+		states += " -> " + rec.State
+	}
+	who := rec.User + "@" + rec.Origin
+	if rec.Tty != "" {
+		who += " " + rec.Tty
+	}
+
+	line := fmt.Sprintf("%s  %-8s  %-3s  %-24s  %-10s  %-16s  %-8s  %s",
+		rec.Time.UTC().Format("2006-01-02 15:04:05Z"), rec.Source, rec.Chancode, rec.Label, action, states, rec.Result, who)
+	if rec.Detail != "" {
+		line += "  " + rec.Detail
+	}
+
+	return line
+}
+
+// parseHistoryTime parses a --since or --until value, either a time or a
+// duration before now. Empty is the zero time
+func parseHistoryTime(val string, now time.Time) (time.Time, error) {
+
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(val); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range historyTimeLayouts {
+		if t, err := time.ParseInLocation(layout, val, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %s, must be a duration ago (e.g. 24h) or a UTC time (e.g. 2020-11-01 or 2020-11-01T15:04)", val)
+}
+
+// historyRelay returns the chancode of the relay given by number, chancode or label
+func historyRelay(relay string) (string, error) {
+
+	if relay == "" {
+		return "", nil
+	}
+	_, info, err := relayLookup(relay)
+
+	return info.Chancode, err
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"rpm/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestRelays sets cfg to the relays of the shipped config until the test
+// ends, with the two "Not Used" relays
+func setTestRelays(t *testing.T) {
+
+	rpmCfg := config.NewConfig()
+	rpmCfg.Oids.Relays = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.1.0", Chancode: "RL1", Label: "Primary"},
+		{Oid: "1.3.6.1.4.1.45621.2.2.2.0", Chancode: "RL2", Label: "Secondary"},
+		{Oid: "1.3.6.1.4.1.45621.2.2.3.0", Chancode: "RL3", Label: "Not Used"},
+		{Oid: "1.3.6.1.4.1.45621.2.2.4.0", Chancode: "RL4", Label: "Not Used"},
+	}
+	rpmCfg.ApplyDefaults()
+
+	saved := cfg
+	cfg = cmdConfig{RPMCfg: rpmCfg}
+	t.Cleanup(func() { cfg = saved })
+}
+
+func TestParseHistoryTime(t *testing.T) {
+
+	now := time.Date(2020, 11, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		val  string
+		want time.Time
+		err  bool
+	}{
+		{"", time.Time{}, false},
+		{"24h", time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), false},
+		{"90m", time.Date(2020, 11, 2, 10, 30, 0, 0, time.UTC), false},
+		{"2020-11-01", time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2020-11-01T15:04", time.Date(2020, 11, 1, 15, 4, 0, 0, time.UTC), false},
+		{"2020-11-01 15:04", time.Date(2020, 11, 1, 15, 4, 0, 0, time.UTC), false},
+		{"2020-11-01T15:04:05-08:00", time.Date(2020, 11, 1, 23, 4, 5, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+		{"2020-13-01", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseHistoryTime(tt.val, now)
+		if (err != nil) != tt.err {
+			t.Errorf("parseHistoryTime(%q) error %v, want error %v", tt.val, err, tt.err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseHistoryTime(%q) = %s, want %s", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestHistoryRelay(t *testing.T) {
+
+	setTestRelays(t)
+	tests := []struct {
+		relay string
+		want  string
+		err   string
+	}{
+		{"", "", ""},
+		{"2", "RL2", ""},
+		{"rl1", "RL1", ""},
+		{"secondary", "RL2", ""},
+		{"Not Used", "", "ambiguous"},
+		{"RL9", "", "invalid relay"},
+	}
+
+	for _, tt := range tests {
+		got, err := historyRelay(tt.relay)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("historyRelay(%q) error %v, want %q", tt.relay, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("historyRelay(%q) = %q, %v, want %q", tt.relay, got, err, tt.want)
+		}
+	}
+}
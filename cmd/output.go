@@ -0,0 +1,436 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"rpm/alarm"
+	"rpm/config"
+	rlog "rpm/log"
+	"rpm/mseed"
+	"rpm/quality"
+	"rpm/tycon"
+	"strconv"
+	"time"
+)
+
+const (
+	formatText   = "text"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatMseed2 = "mseed2"
+	formatMseed3 = "mseed3"
+
+	categoryStatic   = "static"
+	categoryTests    = "tests"
+	categoryRelays   = "relays"
+	categoryVoltages = "voltages"
+	categoryCurrents = "currents"
+	categoryTemps    = "temps"
+)
+
+var pollFormats = stringSlice{formatText, formatJSON, formatNDJSON, formatCSV, formatMseed2, formatMseed3}
+var statusFormats = stringSlice{formatText, formatJSON, formatNDJSON, formatCSV}
+
+// csvHeader is the column header of the csv format
+var csvHeader = []string{"time", "host", "net", "sta", "loc", "chancode", "label", "oid", "category", "raw", "value", "units", "alarm", "quality"}
+
+// outputParams are the settings shared by the scan outputs
+type outputParams struct {
+	format         string
+	host           string
+	sampleInterval time.Duration
+	rpmCfg         *config.RPMConfig
+	// single is set when only one scan will be written, e.g. by status
+	single bool
+	// scaled text output has values in engineering units instead of raw
+	scaled bool
+	// noHeader csv output leaves out the header row, e.g. when it follows
+	// the output of another device
+	noHeader bool
+}
+
+// scanState are the alarm levels and quality flags of the channels of a
+// scan by OID, as they were when it was polled
+type scanState struct {
+	alarms  map[string]string
+	quality map[string]string
+}
+
+// newScanState returns the current state of alarms and checker, either
+// may be nil
+func newScanState(alarms *alarm.Evaluator, checker *quality.Checker) scanState {
+
+	var state scanState
+	if alarms != nil {
+		state.alarms = make(map[string]string)
+		for oid, level := range alarms.Levels() {
+			state.alarms[oid] = level.String()
+		}
+	}
+	if checker != nil {
+		state.quality = make(map[string]string)
+		for oid, flag := range checker.Flags() {
+			state.quality[oid] = flag.String()
+		}
+	}
+
+	return state
+}
+
+// scanOutput writes poll scans in one of the output formats
+type scanOutput interface {
+	// WriteScan writes scan as the sample for sampleTime, with the state
+	// of its channels
+	WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error
+	// Close flushes any buffered output
+	Close() error
+}
+
+// newScanOutput returns the scanOutput for params.format writing to w
+func newScanOutput(w io.Writer, params outputParams) (scanOutput, error) {
+
+	switch params.format {
+	case formatText:
+		return &textOutput{w, params}, nil
+	case formatJSON, formatNDJSON:
+		return &jsonOutput{w: w, params: params}, nil
+	case formatCSV:
+		return &csvOutput{w: csv.NewWriter(w), params: params}, nil
+	case formatMseed2, formatMseed3:
+		version := mseed.Version2
+		if params.format == formatMseed3 {
+			version = mseed.Version3
+		}
+		mw, err := mseed.NewWriter(w, version, params.sampleInterval)
+		if err != nil {
+			return nil, err
+		}
+		return &mseedOutput{mw, params.rpmCfg, make(map[string]bool)}, nil
+	}
+
+	return nil, fmt.Errorf("invalid output format: %s", params.format)
+}
+
+// findOid returns the category and info of oid in the relays, data and
+// static oids of toids
+func findOid(toids config.TyconOids, oid string) (string, config.OidInfo, bool) {
+
+	categories := []struct {
+		name string
+		oids []config.OidInfo
+	}{
+		{categoryStatic, toids.Static},
+		{categoryTests, toids.Tests},
+		{categoryRelays, toids.Relays},
+		{categoryVoltages, toids.Voltages},
+		{categoryCurrents, toids.Currents},
+		{categoryTemps, toids.Temps},
+	}
+	for _, category := range categories {
+		for _, info := range category.oids {
+			if info.Oid == oid {
+				return category.name, info, true
+			}
+		}
+	}
+
+	return "", config.OidInfo{}, false
+}
+
+// scanRecord is a scan with its OID details, as written by the json, ndjson and csv formats
+type scanRecord struct {
+	Time     time.Time      `json:"time"`
+	Host     string         `json:"host"`
+	Net      string         `json:"net"`
+	Sta      string         `json:"sta"`
+	Loc      string         `json:"loc"`
+	Static   []staticValue  `json:"static"`
+	Channels []channelValue `json:"channels"`
+}
+
+// staticValue is the value of a static OID
+type staticValue struct {
+	Oid   string `json:"oid"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// channelValue is the value of a data OID. Value is the raw value in engineering Units,
+// it is omitted if the raw value is not numeric. State is set for relays,
+// Alarm for channels with an alarm rule and Quality with a quality rule
+type channelValue struct {
+	Chancode string   `json:"chancode"`
+	Label    string   `json:"label"`
+	Oid      string   `json:"oid"`
+	Category string   `json:"category"`
+	Raw      string   `json:"raw"`
+	Value    *float64 `json:"value,omitempty"`
+	Units    string   `json:"units,omitempty"`
+	State    string   `json:"state,omitempty"`
+	Alarm    string   `json:"alarm,omitempty"`
+	Quality  string   `json:"quality,omitempty"`
+}
+
+// newScanRecord collects the scan values with their OID details and state
+func newScanRecord(params outputParams, scan *tycon.TPDin2Scan, state scanState) *scanRecord {
+
+	c := params.rpmCfg
+	rec := &scanRecord{
+		Time:     scan.TS.UTC(),
+		Host:     params.host,
+		Net:      c.General.Net,
+		Sta:      c.General.Sta,
+		Loc:      c.General.Loc,
+		Static:   make([]staticValue, 0, len(c.Oids.Static)),
+		Channels: make([]channelValue, 0, len(c.Oids.Relays)+len(c.Oids.Voltages)+len(c.Oids.Currents)+len(c.Oids.Temps)),
+	}
+
+	for _, info := range c.Oids.Static {
+		rec.Static = append(rec.Static, staticValue{info.Oid, info.Label, scan.Data[info.Oid]})
+	}
+
+	categories := []struct {
+		name string
+		oids []config.OidInfo
+	}{
+		{categoryRelays, c.Oids.Relays},
+		{categoryVoltages, c.Oids.Voltages},
+		{categoryCurrents, c.Oids.Currents},
+		{categoryTemps, c.Oids.Temps},
+	}
+	for _, category := range categories {
+		for _, info := range category.oids {
+			rec.Channels = append(rec.Channels, newChannelValue(category.name, info, scan.Data[info.Oid], state))
+		}
+	}
+
+	return rec
+}
+
+// newChannelValue returns the raw value of the data OID info in category,
+// with its alarm level and quality flag in state if any
+func newChannelValue(category string, info config.OidInfo, raw string, state scanState) channelValue {
+
+	chv := channelValue{
+		Chancode: info.Chancode,
+		Label:    info.Label,
+		Oid:      info.Oid,
+		Category: category,
+		Raw:      raw,
+	}
+	if val, err := info.Value(raw); err == nil {
+		chv.Value = &val
+		chv.Units = info.Units
+	}
+	if category == categoryRelays {
+		chv.State = relayStatePretty(raw)
+	}
+	chv.Alarm = state.alarms[info.Oid]
+	chv.Quality = state.quality[info.Oid]
+
+	return chv
+}
+
+// textOutput writes scans as txtoida10 version 2 lines
+type textOutput struct {
+	w      io.Writer
+	params outputParams
+}
+
+func (out *textOutput) WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error {
+	_, err := fmt.Fprintf(out.w, "%s\n", formatScan(out.params.sampleInterval, out.params.rpmCfg, scan, out.params.scaled))
+	return err
+}
+
+func (out *textOutput) Close() error {
+	return nil
+}
+
+// jsonOutput writes scans as an indented JSON array, or a single object
+// if params.single, or as newline delimited JSON objects (ndjson)
+type jsonOutput struct {
+	w      io.Writer
+	params outputParams
+	count  int
+}
+
+func (out *jsonOutput) WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error {
+
+	rec := newScanRecord(out.params, scan, state)
+
+	if out.params.format == formatNDJSON {
+		out.count++
+		return json.NewEncoder(out.w).Encode(rec)
+	}
+
+	prefix, indent := "", "  "
+	if !out.params.single {
+		prefix = indent
+		sep := ",\n" + indent
+		if out.count == 0 {
+			sep = "[\n" + indent
+		}
+		if _, err := io.WriteString(out.w, sep); err != nil {
+			return err
+		}
+	}
+	out.count++
+
+	buf, err := json.MarshalIndent(rec, prefix, indent)
+	if err != nil {
+		return err
+	}
+	if out.params.single {
+		buf = append(buf, '\n')
+	}
+	_, err = out.w.Write(buf)
+
+	return err
+}
+
+func (out *jsonOutput) Close() error {
+
+	if out.params.format == formatNDJSON || out.params.single {
+		return nil
+	}
+
+	end := "\n]\n"
+	if out.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(out.w, end)
+
+	return err
+}
+
+// csvOutput writes a header row followed by a row per OID for each scan
+type csvOutput struct {
+	w      *csv.Writer
+	params outputParams
+	count  int
+}
+
+func (out *csvOutput) WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error {
+
+	if out.count == 0 && !out.params.noHeader {
+		if err := out.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	out.count++
+
+	rec := newScanRecord(out.params, scan, state)
+	ts := rec.Time.Format(time.RFC3339)
+	for _, sv := range rec.Static {
+		row := []string{ts, rec.Host, rec.Net, rec.Sta, rec.Loc, "", sv.Label, sv.Oid, categoryStatic, sv.Value, "", "", "", ""}
+		if err := out.w.Write(row); err != nil {
+			return err
+		}
+	}
+	for _, chv := range rec.Channels {
+		val := ""
+		if chv.Value != nil {
+			val = strconv.FormatFloat(*chv.Value, 'f', -1, 64)
+		}
+		row := []string{ts, rec.Host, rec.Net, rec.Sta, rec.Loc, chv.Chancode, chv.Label, chv.Oid, chv.Category, chv.Raw, val, chv.Units, chv.Alarm, chv.Quality}
+		if err := out.w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	// flush every scan so the output can be followed
+	out.w.Flush()
+
+	return out.w.Error()
+}
+
+func (out *csvOutput) Close() error {
+	out.w.Flush()
+	return out.w.Error()
+}
+
+// mseedOutput writes scans as miniSEED records, one channel per data OID chancode
+type mseedOutput struct {
+	mw      *mseed.Writer
+	rpmCfg  *config.RPMConfig
+	invalid map[string]bool
+}
+
+func (out *mseedOutput) WriteScan(sampleTime time.Time, scan *tycon.TPDin2Scan, state scanState) error {
+
+	_, dataInfo := out.rpmCfg.DataOidsInfo()
+	for _, oidinfo := range dataInfo {
+		ch := mseed.Channel{
+			Net:  out.rpmCfg.General.Net,
+			Sta:  out.rpmCfg.General.Sta,
+			Loc:  out.rpmCfg.General.Loc,
+			Chan: oidinfo.Chancode,
+		}
+
+		val, err := strconv.ParseInt(scan.Data[oidinfo.Oid], 10, 32)
+		if err != nil {
+			// log once per channel, the gap is handled by the writer
+			if !out.invalid[oidinfo.Oid] {
+				rlog.WarningMsg("%s: non-integer value %q, not written to miniSEED", ch, scan.Data[oidinfo.Oid])
+				out.invalid[oidinfo.Oid] = true
+			}
+			continue
+		}
+		out.invalid[oidinfo.Oid] = false
+
+		if err = out.mw.Add(ch, sampleTime, int32(val), mseedQuality(state.quality, oidinfo.Oid)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mseedFlags are the miniSEED data quality flags of the quality flags
+var mseedFlags = map[string]mseed.Flags{
+	quality.Step.String():        mseed.FlagSpikes,
+	quality.Implausible.String(): mseed.FlagGlitches,
+	quality.Frozen.String():      mseed.FlagGlitches,
+}
+
+// mseedQuality returns the miniSEED data quality of the value of oid with
+// the quality flags by OID, checked if it has a flag
+func mseedQuality(flags map[string]string, oid string) mseed.Quality {
+
+	flag, ok := flags[oid]
+	if !ok {
+		return mseed.Quality{}
+	}
+
+	return mseed.Quality{Checked: true, Flags: mseedFlags[flag]}
+}
+
+func (out *mseedOutput) Close() error {
+	return out.mw.Flush()
+}
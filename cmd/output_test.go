@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"bytes"
+	"rpm/config"
+	"rpm/tycon"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testProductOid = "1.3.6.1.4.1.45621.2.1.1.0"
+	testBatteryOid = "1.3.6.1.4.1.45621.2.2.5.0"
+	testTempOid    = "1.3.6.1.4.1.45621.2.2.13.0"
+)
+
+func testOutputConfig() *config.RPMConfig {
+
+	rpmCfg := config.NewConfig()
+	rpmCfg.General.Net, rpmCfg.General.Sta, rpmCfg.General.Loc = "II", "VALT", "25"
+	rpmCfg.Oids.Voltages = []config.OidInfo{{Oid: testBatteryOid, Chancode: "MV1", Label: "Battery"}}
+	rpmCfg.Oids.Temps = []config.OidInfo{{Oid: testTempOid, Chancode: "TPE", Label: "Temp (Ext)"}}
+	rpmCfg.ApplyDefaults()
+
+	return rpmCfg
+}
+
+func TestTextOutputQuality(t *testing.T) {
+
+	scan := &tycon.TPDin2Scan{
+		TS:   time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC),
+		Data: map[string]string{testBatteryOid: "125", testTempOid: "215"},
+	}
+	state := scanState{quality: map[string]string{testBatteryOid: "frozen", testTempOid: "good"}}
+
+	// the txtoida10 line does not carry the quality flags
+	var out bytes.Buffer
+	output, err := newScanOutput(&out, outputParams{format: formatText, sampleInterval: 10 * time.Second, rpmCfg: testOutputConfig()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := output.WriteScan(scan.TS, scan, state); err != nil {
+		t.Fatal(err)
+	}
+	want := "2020 11 01 12 00 00 II VALT 25 10 MV1:125 TPE:215\n"
+	if got := out.String(); got != want {
+		t.Errorf("text output %q, want %q", got, want)
+	}
+}
+
+func TestMseedQuality(t *testing.T) {
+
+	var out bytes.Buffer
+	output, err := newScanOutput(&out, outputParams{format: formatMseed2, sampleInterval: time.Second, rpmCfg: testOutputConfig()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MV1 is checked and steps, TPE has no quality rule
+	start := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	for i, flag := range []string{"good", "step", "good"} {
+		scan := &tycon.TPDin2Scan{TS: start, Data: map[string]string{testBatteryOid: "125", testTempOid: "215"}}
+		state := scanState{quality: map[string]string{testBatteryOid: flag}}
+		if err := output.WriteScan(start.Add(time.Duration(i)*time.Second), scan, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string][]byte)
+	for rec := out.Bytes(); len(rec) >= 512; rec = rec[512:] {
+		records[string(bytes.TrimSpace(rec[15:18]))] = rec[:512]
+	}
+	if len(records) != 2 {
+		t.Fatalf("records for %d channels, want 2", len(records))
+	}
+	if rec := records["MV1"]; rec[6] != 'Q' || rec[38] != 0x04 {
+		t.Errorf("MV1 quality %c flags %#x, want Q with the spikes flag", rec[6], rec[38])
+	}
+	if rec := records["TPE"]; rec[6] != 'D' || rec[38] != 0 {
+		t.Errorf("TPE quality %c flags %#x, want D without flags", rec[6], rec[38])
+	}
+}
+
+// writeGolden writes a scan with params, returning the output. The device
+// has a static OID, a relay, a voltage with an alarm level and quality flag
+// and a temperature without a value
+func writeGolden(t *testing.T, params outputParams) string {
+
+	rpmCfg := testOutputConfig()
+	rpmCfg.Oids.Static = []config.OidInfo{{Oid: testProductOid, Label: "Product Name"}}
+	rpmCfg.Oids.Relays = []config.OidInfo{{Oid: testRelayOid, Chancode: "RL1", Label: "Primary"}}
+	rpmCfg.ApplyDefaults()
+	params.rpmCfg = rpmCfg
+	params.host = "192.168.1.25"
+	params.sampleInterval = 10 * time.Second
+
+	var out bytes.Buffer
+	output, err := newScanOutput(&out, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scan time is written in UTC
+	ts := time.Date(2020, 11, 1, 4, 0, 0, 0, time.FixedZone("PST", -8*3600))
+	scan := &tycon.TPDin2Scan{TS: ts, Data: map[string]string{
+		testProductOid: "TPDIN2", testRelayOid: "1", testBatteryOid: "125", testTempOid: "noSuchObject",
+	}}
+	state := scanState{alarms: map[string]string{testBatteryOid: "normal"}, quality: map[string]string{testBatteryOid: "good"}}
+	if err := output.WriteScan(ts, scan, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+const goldenJSON = `{
+  "time": "2020-11-01T12:00:00Z",
+  "host": "192.168.1.25",
+  "net": "II",
+  "sta": "VALT",
+  "loc": "25",
+  "static": [
+    {
+      "oid": "1.3.6.1.4.1.45621.2.1.1.0",
+      "label": "Product Name",
+      "value": "TPDIN2"
+    }
+  ],
+  "channels": [
+    {
+      "chancode": "RL1",
+      "label": "Primary",
+      "oid": "1.3.6.1.4.1.45621.2.2.1.0",
+      "category": "relays",
+      "raw": "1",
+      "value": 1,
+      "state": "closed"
+    },
+    {
+      "chancode": "MV1",
+      "label": "Battery",
+      "oid": "1.3.6.1.4.1.45621.2.2.5.0",
+      "category": "voltages",
+      "raw": "125",
+      "value": 12.5,
+      "units": "volts",
+      "alarm": "normal",
+      "quality": "good"
+    },
+    {
+      "chancode": "TPE",
+      "label": "Temp (Ext)",
+      "oid": "1.3.6.1.4.1.45621.2.2.13.0",
+      "category": "temps",
+      "raw": "noSuchObject"
+    }
+  ]
+}
+`
+
+const goldenCSVRows = `2020-11-01T12:00:00Z,192.168.1.25,II,VALT,25,,Product Name,1.3.6.1.4.1.45621.2.1.1.0,static,TPDIN2,,,,
+2020-11-01T12:00:00Z,192.168.1.25,II,VALT,25,RL1,Primary,1.3.6.1.4.1.45621.2.2.1.0,relays,1,1,,,
+2020-11-01T12:00:00Z,192.168.1.25,II,VALT,25,MV1,Battery,1.3.6.1.4.1.45621.2.2.5.0,voltages,125,12.5,volts,normal,good
+2020-11-01T12:00:00Z,192.168.1.25,II,VALT,25,TPE,Temp (Ext),1.3.6.1.4.1.45621.2.2.13.0,temps,noSuchObject,,,,
+`
+
+func TestOutputGolden(t *testing.T) {
+
+	// the poll array indents the status object one level
+	array := "[\n  " + strings.Replace(strings.TrimSuffix(goldenJSON, "\n"), "\n", "\n  ", -1) + "\n]\n"
+
+	tests := []struct {
+		name   string
+		params outputParams
+		want   string
+	}{
+		{"status json", outputParams{format: formatJSON, single: true}, goldenJSON},
+		{"poll json", outputParams{format: formatJSON}, array},
+		{"ndjson", outputParams{format: formatNDJSON},
+			`{"time":"2020-11-01T12:00:00Z","host":"192.168.1.25","net":"II","sta":"VALT","loc":"25",` +
+				`"static":[{"oid":"1.3.6.1.4.1.45621.2.1.1.0","label":"Product Name","value":"TPDIN2"}],` +
+				`"channels":[{"chancode":"RL1","label":"Primary","oid":"1.3.6.1.4.1.45621.2.2.1.0","category":"relays","raw":"1","value":1,"state":"closed"},` +
+				`{"chancode":"MV1","label":"Battery","oid":"1.3.6.1.4.1.45621.2.2.5.0","category":"voltages","raw":"125","value":12.5,"units":"volts","alarm":"normal","quality":"good"},` +
+				`{"chancode":"TPE","label":"Temp (Ext)","oid":"1.3.6.1.4.1.45621.2.2.13.0","category":"temps","raw":"noSuchObject"}]}` + "\n"},
+		{"csv", outputParams{format: formatCSV},
+			"time,host,net,sta,loc,chancode,label,oid,category,raw,value,units,alarm,quality\n" + goldenCSVRows},
+		{"csv without header", outputParams{format: formatCSV, noHeader: true}, goldenCSVRows},
+	}
+
+	for _, tt := range tests {
+		if got := writeGolden(t, tt.params); got != tt.want {
+			t.Errorf("%s output\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJSONOutputEmpty(t *testing.T) {
+
+	var out bytes.Buffer
+	output, err := newScanOutput(&out, outputParams{format: formatJSON, rpmCfg: testOutputConfig()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "[]\n" {
+		t.Errorf("json output without scans %q, want an empty array", got)
+	}
+}
@@ -25,9 +25,16 @@ package cmd
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"rpm/alarm"
 	"rpm/config"
 	rlog "rpm/log"
+	"rpm/metrics"
+	"rpm/notify"
+	"rpm/quality"
 	"rpm/tycon"
 	"strconv"
 	"sync"
@@ -55,7 +62,8 @@ func getSampleInterval(intstr string) (float64, error) {
 	return val, nil
 }
 
-func formatScan(sampleInterval time.Duration, cfg *config.RPMConfig, scan *tycon.TPDin2Scan) string {
+// formatScan returns scan as a txtoida10 line, with values in engineering units if scaled
+func formatScan(sampleInterval time.Duration, cfg *config.RPMConfig, scan *tycon.TPDin2Scan, scaled bool) string {
 
 	outstr := fmt.Sprintf(
 		"%04d %02d %02d %02d %02d %02d",
@@ -74,84 +82,185 @@ func formatScan(sampleInterval time.Duration, cfg *config.RPMConfig, scan *tycon
 		sampleInterval.Seconds(),
 	)
 
-	for _, oidinfo := range dataOidInfo {
-		oid := oidinfo.Oid
-		outstr += fmt.Sprintf(" %s:%s", oidinfo.Chancode, scan.Data[oid])
+	_, dataInfo := cfg.DataOidsInfo()
+	for _, oidinfo := range dataInfo {
+		val := scan.Data[oidinfo.Oid]
+		if scaled {
+			val = oidinfo.FormatValue(val)
+		}
+		outstr += fmt.Sprintf(" %s:%s", oidinfo.Chancode, val)
 	}
 
 	return outstr
 
 }
 
-func logDeviceInfo(scan *tycon.TPDin2Scan) {
+// logDeviceInfo logs the static values of the device in scan
+func (c *cmdConfig) logDeviceInfo(scan *tycon.TPDin2Scan) {
 
-	for _, oidinfo := range staticOidInfo {
-		rlog.NoticeMsg("%s: %s", oidinfo.Label, scan.Data[oidinfo.Oid])
+	_, staticInfo := c.RPMCfg.StaticOidsInfo()
+	for _, oidinfo := range staticInfo {
+		rlog.NoticeMsg("%s%s: %s", c.logPrefix(), oidinfo.Label, scan.Data[oidinfo.Oid])
 	}
+	c.checkFirmware(scan.Data)
+
+}
 
+// pollOptions holds the poll command flags
+type pollOptions struct {
+	format  string
+	metrics string
+	buffer  string
+	scaled  bool
 }
 
-func pollArgsParse(args []string) (time.Duration, error) {
+func pollArgsParse(args []string) (time.Duration, *pollOptions, error) {
 
 	var dInterval time.Duration
 
-	if len(args) < 1 {
+	opts := &pollOptions{}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.format, "format", formatText, "output format: text, json, ndjson, csv, mseed2 or mseed3")
+	flags.BoolVar(&opts.scaled, "scaled", false, "text output in engineering units instead of raw device values")
+	flags.StringVar(&opts.metrics, "metrics", "", "address to serve Prometheus metrics on, e.g. :9161")
+	flags.StringVar(&opts.buffer, "buffer", cfg.RPMCfg.Buffer.Dir, "directory of an on-disk buffer of scans, output resumes from it after a stall or restart")
+
+	args, err := parseCmdArgs(flags, args)
+	if err != nil {
+		return dInterval, nil, err
+	}
+	if !pollFormats.contains(opts.format) {
+		return dInterval, nil, fmt.Errorf("invalid poll output format: %s", opts.format)
+	}
+
+	if len(args) < 2 {
 		err := errors.New("not enough parameters, polling internval must be specified")
-		return dInterval, err
+		return dInterval, nil, err
 	}
 	intervalSecsf64, err := getSampleInterval(args[1])
 	if err != nil {
-		return dInterval, err
+		return dInterval, nil, err
 	}
 
 	fInterval := float32(intervalSecsf64)
 	dInterval = time.Duration(fInterval) * time.Second
 
-	return dInterval, nil
+	return dInterval, opts, nil
 
 }
 
-// Poll the TPDin2 device
+// Poll the TPDin2 device, or the [[devices]] of the config if no host is given
 func Poll(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 	// snmpwalk -On -c readwrite -M /usr/local/share/snmp/mibs -v 1 localhost
 
 	// rlog.DebugMsg(fmt.Sprintf("poll cmd with args[]: %v\n", args))
 	var err error
 
+	cfg.Cmd = args[0]
 	cfg.Host = host
 	cfg.Port = port
 	cfg.RPMCfg = rpmCfg
 
-	rlog.NoticeMsg(fmt.Sprintf("running %s command on host: %s:%s\n", args[0], cfg.Host, cfg.Port))
-
-	dInterval, err := pollArgsParse(args)
+	dInterval, opts, err := pollArgsParse(args)
 	if err != nil {
 		return err
 	}
-	hInterval := dInterval / 2
+	if cfg.Host == "" && serverURL == "" {
+		return pollDevices(dInterval, opts)
+	}
 
+	rlog.NoticeMsg(fmt.Sprintf("running %s command on host: %s:%s\n", args[0], cfg.Host, cfg.Port))
 	rlog.NoticeMsg(fmt.Sprintf("polling interval: %.0f sec(s)\n", dInterval.Seconds()))
 
-	initOids(cfg.RPMCfg)
+	alarms, err := alarm.NewEvaluator(cfg.RPMCfg)
+	if err != nil {
+		return err
+	}
+	checker, err := quality.NewChecker(cfg.RPMCfg)
+	if err != nil {
+		return err
+	}
+	notifier, err := newNotifier()
+	if err != nil {
+		return err
+	}
+	defer notifier.Close(notifyCloseTimeout)
+
+	output, err := newScanOutput(os.Stdout, outputParams{
+		format:         opts.format,
+		host:           cfg.Host,
+		sampleInterval: dInterval,
+		rpmCfg:         rpmCfg,
+		scaled:         opts.scaled,
+	})
+	if err != nil {
+		return err
+	}
+	if opts.buffer != "" {
+		output, err = newBufferedOutput(output, opts.buffer)
+		if err != nil {
+			return err
+		}
+		rlog.NoticeMsg("poll output buffered in %s", opts.buffer)
+	}
+	defer output.Close()
+	rlog.NoticeMsg("poll output format: %s", opts.format)
 
-	tp2din := tycon.NewTPDin2()
-	err = tp2din.InitAndConnect(cfg.Host, cfg.Port, "read")
+	tp2din, err := cfg.connectPowerMonitor(accessRead)
 	if err != nil {
 		return err
 	}
-	defer tp2din.SNMPParams.Conn.Close()
+	defer tp2din.Close()
+
+	collector := cfg.newMetricsCollector(tp2din)
+	if opts.metrics != "" {
+		metricsSrv := serveMetrics(opts.metrics, collector)
+		defer metricsSrv.Close()
+	}
+
+	err = cfg.pollDevice(tp2din, dInterval, output, alarms, checker, notifier, collector, doneOnSignal())
+
+	rlog.NoticeMsg("poll exiting")
+
+	return err
+}
+
+// serveMetrics serves the Prometheus metrics of collectors on addr
+func serveMetrics(addr string, collectors ...*metrics.Collector) *http.Server {
+
+	metricsSrv := &http.Server{Addr: addr, Handler: metrics.Handler(collectors...)}
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			rlog.ErrMsg("metrics server error: %s", err.Error())
+		}
+	}()
+	rlog.NoticeMsg("serving metrics on %s", addr)
+
+	return metricsSrv
+}
+
+// pollDevice polls tp2din every dInterval, writing the scans to output,
+// until done is closed
+func (c *cmdConfig) pollDevice(tp2din tycon.PowerMonitor, dInterval time.Duration, output scanOutput,
+	alarms *alarm.Evaluator, checker *quality.Checker, notifier *notify.Notifier, collector *metrics.Collector, done <-chan struct{}) error {
+
+	hInterval := dInterval / 2
+	staticOids, _ := c.RPMCfg.StaticOidsInfo()
+	dataOids, dataInfo := c.RPMCfg.DataOidsInfo()
+	pollOids := append(staticOids, dataOids...)
+	prefix := c.logPrefix()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
 
-	err = tp2din.PollStart(ctx, &wg, &allOids, dInterval)
+	err := tp2din.PollStart(ctx, &wg, &pollOids, dInterval)
 	if err != nil {
-		rlog.ErrMsg("could not start internal polling loop... quitting")
+		rlog.ErrMsg("%scould not start internal polling loop... quitting", prefix)
 		cancel()
 		wg.Wait()
 		return err
 	}
-	rlog.NoticeMsg("internal polling loop spawned")
+	rlog.NoticeMsg("%sinternal polling loop spawned", prefix)
 
 	var scan, prevScan *tycon.TPDin2Scan
 	targetTime := time.Now().Round(dInterval).Add(dInterval)
@@ -165,7 +274,7 @@ func Poll(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 	for !exiting {
 
 		targetTime = targetTime.Add(dInterval)
-		rlog.DebugMsg("next target time: %v\n", targetTime.String())
+		rlog.DebugMsg("%snext target time: %v\n", prefix, targetTime.String())
 
 		select {
 
@@ -175,27 +284,34 @@ func Poll(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 			scan, err = tp2din.GetScan()
 			if scan == nil {
 				if !scanMissed {
-					rlog.ErrMsg("no rpm scan available\n")
+					rlog.ErrMsg("%sno rpm scan available\n", prefix)
 				}
+				collector.IncMissed()
+				c.evaluateAlarms(alarms, notifier, &tycon.TPDin2Scan{Data: map[string]string{}})
 				scanMissed = true
 				first = true
 				continue
 			}
 
-			rlog.DebugMsg("Scan time:   %s", scan.TS.String())
-			for _, oidinfo := range dataOidInfo {
-				rlog.DebugMsg("(%s) %s: %s", oidinfo.Chancode, oidinfo.Oid, scan.Data[oidinfo.Oid])
+			c.evaluateAlarms(alarms, notifier, scan)
+			for _, change := range checker.Check(scan) {
+				change.Log(prefix)
+			}
+
+			rlog.DebugMsg("%sScan time:   %s", prefix, scan.TS.String())
+			for _, oidinfo := range dataInfo {
+				rlog.DebugMsg("%s(%s) %s: %s", prefix, oidinfo.Chancode, oidinfo.Oid, scan.Data[oidinfo.Oid])
 			}
 
 			if first {
-				rlog.NoticeMsg("initial rpm scan received")
-				logDeviceInfo(scan)
+				rlog.NoticeMsg("%sinitial rpm scan received", prefix)
+				c.logDeviceInfo(scan)
 				first = false
 			}
 			scanMissed = false
 
-		case <-sigdone:
-			rlog.DebugMsg("got done signal")
+		case <-done:
+			rlog.DebugMsg("%sgot done signal", prefix)
 			exiting = true
 			continue
 		}
@@ -208,20 +324,22 @@ func Poll(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 
 		if offset > hInterval {
 			// really should never get here unless this loop is taking more than an interval to complete
-			rlog.WarningMsg("well, this is awkward, a scan from more than 1/2 interval in the future")
-			rlog.WarningMsg("incrementing TargetTime by one interval (to catch up) creating a gap")
+			rlog.WarningMsg("%swell, this is awkward, a scan from more than 1/2 interval in the future", prefix)
+			rlog.WarningMsg("%sincrementing TargetTime by one interval (to catch up) creating a gap", prefix)
 			targetTime = scan.TS.Round(dInterval) //targetTime.Add(dInterval)
 			first = true
 		} else if offset < -hInterval {
 			// current scan does not appear to be available.
-			rlog.ErrMsg("missing scan: current scan time (%v) not found within 1/2 interval of target (%v)", scan.TS, targetTime)
+			rlog.ErrMsg("%smissing scan: current scan time (%v) not found within 1/2 interval of target (%v)", prefix, scan.TS, targetTime)
+			collector.IncMissed()
 
 			// if previous scan not alreadcy repeated, repeat previous scan (if it exists)
 			// and set flag so con only do this one time in a row.
 			if (prevScan != nil) && (!scanRepeated) {
-				rlog.WarningMsg("repeating previous scan value")
+				rlog.WarningMsg("%srepeating previous scan value", prefix)
 				scanRepeated = true
 				scan = prevScan
+				collector.IncRepeated()
 			} else {
 				// missed scan but can't repeat previous, so there will be a gap
 				first = true
@@ -230,14 +348,16 @@ func Poll(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 		}
 
 		scanRepeated = false
+		collector.Observe(scan)
 		// send record to Stdout
-		fmt.Printf("%s\n", formatScan(dInterval, rpmCfg, scan))
+		err = output.WriteScan(targetTime, scan, newScanState(alarms, checker))
+		if err != nil {
+			rlog.ErrMsg("%serror writing output: %s", prefix, err.Error())
+		}
 
 	}
 	cancel()
 	wg.Wait()
 
-	rlog.NoticeMsg("poll exiting")
-
 	return nil
 }
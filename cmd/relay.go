@@ -24,11 +24,18 @@ THE SOFTWARE.
 */
 
 import (
+	"bufio"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"rpm/audit"
 	"rpm/config"
+	"rpm/daemon"
+	"rpm/interlock"
 	rlog "rpm/log"
+	"rpm/notify"
 	"rpm/tycon"
 	"strconv"
 	"strings"
@@ -36,23 +43,29 @@ import (
 )
 
 const (
-	relay1           = "1"
-	relay2           = "2"
-	relay3           = "3"
-	relay4           = "4"
 	relayCmdSet      = "set"
 	relayCmdShow     = "show"
 	relayCmdCycle    = "cycle"
+	relayCmdHistory  = "history"
 	relayStateOpen   = "open"
 	relayStateClosed = "closed"
 )
 
-var relays stringSlice
+// Reasons a relay cycle is not confirmed complete, each with its exit code
+var (
+	errCycleNotObserved   = errors.New("relay was not seen leaving its state")
+	errCycleIncomplete    = errors.New("relay did not return to its state in time")
+	errDeviceUnresponsive = errors.New("device stopped responding")
+)
+
+// relayMaxQueryErrors is the number of consecutive failed queries after which
+// the device is considered unresponsive during a cycle
+const relayMaxQueryErrors = 3
+
 var relayCommands stringSlice
 var relayStates stringSlice
 
 func init() {
-	relays = stringSlice{relay1, relay2, relay3, relay4}
 	relayCommands = stringSlice{relayCmdSet, relayCmdShow, relayCmdCycle}
 	relayStates = stringSlice{relayStateOpen, relayStateClosed}
 }
@@ -68,67 +81,124 @@ func (arr *stringSlice) contains(val string) bool {
 	return false
 }
 
-func relayParseArgs(args []string) (string, string, string, error) {
+// relayOptions holds the relay command flags
+type relayOptions struct {
+	yes    bool
+	dryRun bool
+	force  bool
+}
+
+// RelaySubCommand returns the sub-command of the relay command args, the
+// first parameter after any of the (boolean) relay flags
+func RelaySubCommand(args []string) string {
+	for _, arg := range args[1:] {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return ""
+}
+
+func relayParseArgs(args []string) (string, string, string, *relayOptions, error) {
 
 	var err error
 
-	if len(args) < 3 {
-		err = errors.New("not enough parameters, the relay command requires a relay number and an action")
-		return "", "", "", err
+	opts := &relayOptions{}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.BoolVar(&opts.yes, "yes", false, "do not ask for confirmation")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "report what would change without doing it")
+	flags.BoolVar(&opts.force, "force", false, "operate a protected relay")
+
+	args, err = parseCmdArgs(flags, args)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+
+	if len(args) < 2 {
+		err = errors.New("not enough parameters, the relay command requires an action")
+		return "", "", "", nil, err
 	}
 
 	action := args[1]
 	if !relayCommands.contains(action) {
 		err = fmt.Errorf("invalid relay action: %s", action)
-		return "", "", "", err
+		return "", "", "", nil, err
 	}
 
-	relay := args[2]
-	if !relays.contains(relay) {
-		err = fmt.Errorf("invalid relay: %s", relay)
-		return "", "", "", err
+	// show without a relay shows them all
+	relay := ""
+	if len(args) < 3 {
+		if action != relayCmdShow {
+			err = fmt.Errorf("not enough parameters, the 'relay %s' command requires a relay number, chancode or label", action)
+			return "", "", "", nil, err
+		}
+	} else {
+		relay, _, err = relayLookup(args[2])
+		if err != nil {
+			return "", "", "", nil, err
+		}
 	}
 
 	targetState := ""
 	if action == relayCmdSet {
 		if len(args) < 4 {
-			err = errors.New("not enough parameters, the 'relay set' command requires a relay number, action and target state (open, closed)")
-			return "", "", "", err
+			err = errors.New("not enough parameters, the 'relay set' command requires a relay, action and target state (open, closed)")
+			return "", "", "", nil, err
 		}
 		targetState = args[3]
 		if !relayStates.contains(targetState) {
 			err = fmt.Errorf("invalid relay state: %s", targetState)
-			return "", "", "", err
+			return "", "", "", nil, err
 		}
 	}
 
-	rlog.NoticeMsg(fmt.Sprintf("relay: %s, action: %s, targetState: %s\n", relay, action, targetState))
+	rlog.NoticeMsg(fmt.Sprintf("relay: %s, action: %s, targetState: %s, yes: %t, dry-run: %t, force: %t\n", relay, action, targetState, opts.yes, opts.dryRun, opts.force))
 
-	return relay, action, targetState, nil
+	return relay, action, targetState, opts, nil
 }
 
 // Relay sets, gets, and cycles relays
 func Relay(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 
+	cfg.Cmd = args[0]
 	cfg.Host = host
 	cfg.Port = port
 	cfg.RPMCfg = rpmCfg
 
 	rlog.NoticeMsg(fmt.Sprintf("running %s command on host: %s:%s\n", args[0], cfg.Host, cfg.Port))
 
-	relay, action, targetState, err := relayParseArgs(args)
+	if RelaySubCommand(args) == relayCmdHistory {
+		return relayHistory(args)
+	}
+	cfg.warnInterlockHosts()
+
+	relay, action, targetState, opts, err := relayParseArgs(args)
 	if err != nil {
 		return err
 	}
 
 	initOids(cfg.RPMCfg)
 
-	tp2din := tycon.NewTPDin2()
-	err = tp2din.InitAndConnect(cfg.Host, cfg.Port, "write")
+	tp2din, err := cfg.connectPowerMonitor(accessWrite)
+	if err != nil {
+		return err
+	}
+	defer tp2din.Close()
+	if client, ok := tp2din.(*daemon.Client); ok {
+		client.SetForce(opts.force)
+	}
+
+	// the rpm daemon sends the notifications for actions through its API
+	var notifier *notify.Notifier
+	if serverURL == "" {
+		notifier, err = newNotifier()
+	} else {
+		notifier, err = notify.New(nil)
+	}
 	if err != nil {
 		return err
 	}
-	defer tp2din.SNMPParams.Conn.Close()
+	defer notifier.Close(notifyCloseTimeout)
 
 	// lets start with current station of the relays
 	ts, results, err := tp2din.QueryOids(&relayOids)
@@ -137,57 +207,66 @@ func Relay(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 		return err
 	}
 
-	relayNdx, _ := strconv.Atoi(relay)
-	relayInfo := cfg.RPMCfg.Oids.Relays[relayNdx-1]
+	var relayInfo config.OidInfo
+	if relay != "" {
+		_, relayInfo, _ = relayLookup(relay)
+	}
 
 	switch action {
 	case relayCmdShow:
 		displayRelayInfo(relay, ts, results)
 	case relayCmdSet:
 		{
-			err := relayActionAllowed(action, relay)
-			if err != nil {
-				return err
-			}
-
 			curState := relayStatePretty(results[relayInfo.Oid])
 
 			if curState == targetState {
 				msg := fmt.Sprintf("relay %s (%s) is already %s, no action needed", relay, relayInfo.Label, strings.ToUpper(curState))
 				fmt.Fprintln(os.Stderr, msg)
 				rlog.WarningMsg(msg)
+			} else if err := relayInterlock(action, targetState, relayInfo, results, opts); err != nil {
+				relayAudit(tp2din, relayInfo, action, curState, targetState, err)
+				return err
+			} else if opts.dryRun {
+				relayDryRun(fmt.Sprintf("would set relay %s (%s) from %s to %s", relay, relayInfo.Label, strings.ToUpper(curState), strings.ToUpper(targetState)))
 			} else {
 
-				if relayConfirmAction(relay, relayCmdSet, targetState, relayInfo) {
+				if err := relayConfirmAction(relay, relayCmdSet, targetState, relayInfo, opts); err != nil {
+					relayAudit(tp2din, relayInfo, action, curState, targetState, err)
+					return err
+				}
 
-					err = relaySet(tp2din, relay, targetState, relayInfo)
-					if err != nil {
-						return err
-					}
+				err = relaySet(tp2din, relay, targetState, relayInfo)
+				relayAudit(tp2din, relayInfo, action, curState, targetState, err)
+				cfg.notifyRelay(notifier, relayInfo, relayCmdSet, targetState, err)
+				if err != nil {
+					return err
 				}
 			}
 		}
 	case relayCmdCycle:
 		{
-			err := relayActionAllowed(action, relay)
-			if err != nil {
+			// end state (and current state) prior to issuing the cycle command
+			endState := relayStatePretty(results[relayInfo.Oid])
+
+			if err := relayInterlock(action, "", relayInfo, results, opts); err != nil {
+				relayAudit(tp2din, relayInfo, action, endState, "", err)
 				return err
 			}
+			if opts.dryRun {
+				relayDryRun(fmt.Sprintf("would cycle relay %s (%s) from %s and back", relay, relayInfo.Label, strings.ToUpper(endState)))
+				return nil
+			}
 
-			if relayConfirmAction(relay, relayCmdCycle, "", relayInfo) {
-
-				// end state (and current state) prior to issuing the cycle command
-				endState := relayStatePretty(results[relayInfo.Oid])
-
-				err = relayCycle(tp2din, relay, endState, relayInfo)
-				if err != nil {
-					return err
-				}
+			if err := relayConfirmAction(relay, relayCmdCycle, "", relayInfo, opts); err != nil {
+				relayAudit(tp2din, relayInfo, action, endState, "", err)
+				return err
+			}
 
-			} else {
-				msg := fmt.Sprintf("relay %s command canceled", action)
-				fmt.Println(msg)
-				rlog.NoticeMsg(msg)
+			err = relayCycle(tp2din, relay, endState, relayInfo)
+			relayAudit(tp2din, relayInfo, action, endState, "", err)
+			cfg.notifyRelay(notifier, relayInfo, relayCmdCycle, "", err)
+			if err != nil {
+				return err
 			}
 
 		}
@@ -195,7 +274,7 @@ func Relay(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 	return nil
 }
 
-func relaySet(tp2din *tycon.TPDin2Device, relay, targetState string, relayInfo config.OidInfo) error {
+func relaySet(tp2din tycon.PowerMonitor, relay, targetState string, relayInfo config.OidInfo) error {
 
 	err := tp2din.SetRelay(relayInfo.Oid, targetState)
 	if err != nil {
@@ -216,17 +295,21 @@ func relaySet(tp2din *tycon.TPDin2Device, relay, targetState string, relayInfo c
 	return nil
 }
 
-func relayCycle(tp2din *tycon.TPDin2Device, relay, endState string, relayInfo config.OidInfo) error {
+func relayCycle(tp2din tycon.PowerMonitor, relay, endState string, relayInfo config.OidInfo) error {
 
 	msg := relayState(relay, relayInfo.Label, endState)
 	fmt.Printf("%s\n", msg)
 	rlog.NoticeMsg("%s", msg)
 
+	expected := relayCycleTime(tp2din, relayInfo)
+	rlog.NoticeMsg("relay %s (%s) cycle time is %s, waiting at most %s more", relay, relayInfo.Label, expected, cfg.RPMCfg.Relay.Cycletimeout)
+
+	start := time.Now()
 	err := tp2din.CycleRelay(relayInfo.Oid)
 	if err != nil {
 		return err
 	}
-	err = relayCycleWait(tp2din, relay, endState, relayInfo)
+	err = relayCycleWait(tp2din, relay, endState, relayInfo, start, expected)
 	if err != nil {
 		return err
 	}
@@ -237,12 +320,18 @@ func relayCycle(tp2din *tycon.TPDin2Device, relay, endState string, relayInfo co
 	return nil
 }
 
-func relayConfirmAction(relay, action, targetState string, info config.OidInfo) bool {
+// confirmInput is where confirmations are answered and confirmIsTerminal
+// whether a person can answer there, replaced by the tests
+var (
+	confirmInput      io.Reader = os.Stdin
+	confirmIsTerminal           = stdinIsTerminal
+)
 
-	var ans string
-	var msg string
+// relayConfirmAction asks for confirmation of the action as required by the
+// confirm policy of the relay, returning an ActionError if it is declined
+func relayConfirmAction(relay, action, targetState string, info config.OidInfo, opts *relayOptions) error {
 
-	valid := stringSlice{"YES", "NO"}
+	var msg string
 
 	switch action {
 	case relayCmdCycle:
@@ -250,16 +339,103 @@ func relayConfirmAction(relay, action, targetState string, info config.OidInfo)
 	case relayCmdSet:
 		msg = fmt.Sprintf("\nType 'YES' to SET relay %s (%s) to %s or 'NO' to cancel: ", relay, info.Label, strings.ToUpper(targetState))
 	default:
-		return false
+		return declinedf("relay %s command canceled, nothing to confirm", action)
 	}
 
-	for !valid.contains(ans) {
-		fmt.Printf(msg)
-		fmt.Scanln(&ans)
+	if opts.yes || info.Confirm == config.ConfirmNever {
+		rlog.NoticeMsg("relay %s of relay %s confirmed without asking (yes: %t, confirm: %s)", action, relay, opts.yes, info.Confirm)
+		return nil
+	}
+	if !confirmIsTerminal() {
+		if info.Confirm == config.ConfirmTTY {
+			rlog.NoticeMsg("relay %s of relay %s not run from a terminal, confirmation not required", action, relay)
+			return nil
+		}
+		err := declinedf("relay %s of relay %s (%s) requires confirmation, use --yes when not run from a terminal", action, relay, info.Label)
+		rlog.WarningMsg("%s", err.Error())
+		return err
 	}
 
+	valid := stringSlice{"YES", "NO"}
+	reader := bufio.NewReader(confirmInput)
+	ans := ""
+	for !valid.contains(ans) {
+		fmt.Print(msg)
+		line, err := reader.ReadString('\n')
+		ans = strings.TrimSpace(line)
+		if err != nil && !valid.contains(ans) {
+			break
+		}
+	}
 	fmt.Println()
-	return ans == "YES"
+
+	if ans != "YES" {
+		msg := fmt.Sprintf("relay %s command canceled", action)
+		rlog.NoticeMsg(msg)
+		return declinedf("%s", msg)
+	}
+
+	return nil
+}
+
+// relayAudit appends a set or cycle of the relay info from the previous
+// state to the audit trail, with its outcome err. The rpm daemon audits the
+// actions done through its API
+func relayAudit(tp2din tycon.PowerMonitor, info config.OidInfo, action, previous, requested string, err error) {
+
+	if serverURL != "" {
+		return
+	}
+
+	rec := audit.Record{
+		Operator:  audit.Self(),
+		Source:    audit.SourceCLI,
+		Host:      cfg.deviceAddr(),
+		Chancode:  info.Chancode,
+		Label:     info.Label,
+		Action:    action,
+		Previous:  previous,
+		Requested: requested,
+		State:     previous,
+		Result:    audit.ResultOK,
+	}
+
+	var actionErr *ActionError
+	switch {
+	case errors.As(err, &actionErr) && actionErr.Code == ExitDeclined:
+		rec.Result = audit.ResultDeclined
+	case errors.As(err, &actionErr) && actionErr.Code == ExitRefused:
+		rec.Result = audit.ResultRefused
+	case err != nil:
+		rec.Result = audit.ResultFailed
+	}
+	if err != nil {
+		rec.Detail = err.Error()
+	}
+
+	// the state the action left the relay in
+	if rec.Result == audit.ResultOK || rec.Result == audit.ResultFailed {
+		rec.State = ""
+		if _, results, qerr := tp2din.QueryOids(&[]string{info.Oid}); qerr == nil {
+			rec.State = relayStatePretty(results[info.Oid])
+		}
+	}
+
+	auditLog, err := audit.Open(cfg.RPMCfg.Audit.File)
+	if err == nil {
+		err = auditLog.Write(rec)
+		auditLog.Close()
+	}
+	if err != nil {
+		rlog.ErrMsg("could not write audit trail %s: %s", cfg.RPMCfg.Audit.File, err.Error())
+	}
+}
+
+// relayDryRun reports an action that --dry-run skipped
+func relayDryRun(msg string) {
+	msg = "dry run: " + msg
+	fmt.Println(msg)
+	rlog.NoticeMsg(msg)
 }
 
 func relayState(relay, label, state string) string {
@@ -271,76 +447,156 @@ func relayState(relay, label, state string) string {
 	)
 }
 
+// displayRelayInfo prints the state of relay, or of all relays if it is empty
 func displayRelayInfo(relay string, ts time.Time, results map[string]string) {
 
 	for ndx, val := range cfg.RPMCfg.Oids.Relays {
-		if strconv.Itoa(ndx+1) == relay {
-			fmt.Printf("%s\n", relayState(relay, val.Label, relayStatePretty(results[val.Oid])))
+		number := strconv.Itoa(ndx + 1)
+		if relay == "" || number == relay {
+			fmt.Printf("%s\n", relayState(number, val.Label, relayStatePretty(results[val.Oid])))
 		}
 	}
 }
 
-func relayCycleWait(tp2din *tycon.TPDin2Device, relay, targetState string, info config.OidInfo) error {
-
-	time.Sleep(time.Duration(time.Second))
+// relayCycleWait waits until the relay, cycled at start, has left endState and
+// is back in it, taking at most expected plus the configured cycle timeout
+func relayCycleWait(tp2din tycon.PowerMonitor, relay, endState string, info config.OidInfo, start time.Time, expected time.Duration) error {
+
+	settings := cfg.RPMCfg.Relay
+	deadline := start.Add(expected + settings.Cycletimeout)
+
+	left := false
+	curState := endState
+	failures := 0
+	for {
+		time.Sleep(settings.Pollinterval)
+
+		_, results, err := tp2din.QueryOids(&[]string{info.Oid})
+		state := ""
+		if err == nil {
+			state = relayStatePretty(results[info.Oid])
+			if state == "" {
+				err = fmt.Errorf("invalid relay state %q", results[info.Oid])
+			}
+		}
 
-	_, results, _ := tp2din.QueryOids(&[]string{info.Oid})
-	curState := relayStatePretty(results[info.Oid])
+		if err != nil {
+			failures++
+			rlog.WarningMsg("query of relay %s (%s) during cycle failed (%d of %d): %s", relay, info.Label, failures, relayMaxQueryErrors, err.Error())
+			if failures >= relayMaxQueryErrors {
+				return fmt.Errorf("cycle of relay %s (%s): %w, %d queries failed: %s", relay, info.Label, errDeviceUnresponsive, failures, err.Error())
+			}
+		} else {
+			failures = 0
+			if state != curState {
+				curState = state
+				msg := relayState(relay, info.Label, curState)
+				fmt.Println(msg)
+				rlog.NoticeMsg("%s", msg)
+			}
+			if curState != endState {
+				left = true
+			} else if left {
+				return nil
+			}
+		}
 
-	for curState != targetState {
-		msg := relayState(relay, info.Label, curState)
-		fmt.Println(msg)
-		rlog.NoticeMsg(msg)
+		if time.Now().After(deadline) {
+			waited := time.Since(start).Round(time.Second)
+			if !left {
+				return fmt.Errorf("cycle of relay %s (%s): %w, still %s after %s", relay, info.Label, errCycleNotObserved, strings.ToUpper(endState), waited)
+			}
+			return fmt.Errorf("cycle of relay %s (%s): %w, still %s after %s", relay, info.Label, errCycleIncomplete, strings.ToUpper(curState), waited)
+		}
+	}
+}
 
-		time.Sleep(time.Duration(time.Second))
+// relayCycleTime returns how long the relay is expected to take to cycle,
+// the device's own cycle time if the relay has a cycletimeoid
+func relayCycleTime(tp2din tycon.PowerMonitor, info config.OidInfo) time.Duration {
 
-		_, results, _ := tp2din.QueryOids(&[]string{info.Oid})
-		curState = relayStatePretty(results[info.Oid])
+	cycleTime := cfg.RPMCfg.Relay.Cycletime
+	if info.Cycletimeoid == "" {
+		return cycleTime
 	}
 
-	msg := relayState(relay, info.Label, curState)
-	fmt.Println(msg)
-	rlog.NoticeMsg(msg)
+	_, results, err := tp2din.QueryOids(&[]string{info.Cycletimeoid})
+	if err != nil {
+		rlog.WarningMsg("could not read cycle time of relay %s (%s), expecting %s: %s", info.Chancode, info.Label, cycleTime, err.Error())
+		return cycleTime
+	}
+	secs, err := strconv.Atoi(strings.TrimSpace(results[info.Cycletimeoid]))
+	if err != nil || secs <= 0 {
+		rlog.WarningMsg("invalid cycle time %q of relay %s (%s), expecting %s", results[info.Cycletimeoid], info.Chancode, info.Label, cycleTime)
+		return cycleTime
+	}
 
-	return nil
+	return time.Duration(secs) * time.Second
 }
 
-func relayActionAllowed(action, relay string) error {
+// relayInterlock checks the action against the [interlock] policy with the
+// relays in the states of results, returning an ActionError if it is refused
+func relayInterlock(action, targetState string, info config.OidInfo, results map[string]string, opts *relayOptions) error {
 
-	hostname, _ := os.Hostname()
-	fmt.Println("hostname: " + hostname)
-	hostrune := []rune(hostname)
-	hostndx := hostrune[len(hostrune)-1]
-
-	if []rune(relay)[0] == hostndx {
-		err := fmt.Errorf("The %s action for relay %s from %s is not allowed", action, relay, hostname)
+	hostname, err := os.Hostname()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	err = interlock.New(cfg.RPMCfg).Check(interlock.Request{
+		Host:   hostname,
+		Relay:  info,
+		Action: action,
+		State:  targetState,
+		Force:  opts.force,
+	}, results)
+	if err != nil {
+		rlog.WarningMsg("%s", err.Error())
+		return refusedf("%s", err.Error())
+	}
 
+	return nil
 }
 
 func relayStatePretty(state string) string {
-	switch state {
-	case "0":
-		return relayStateOpen
-	case "1":
-		return relayStateClosed
-	default:
-		return ""
+	return tycon.RelayStateLabel(state)
+}
+
+// relayLookup returns the number (from 1, in the order of [oids] relays) and
+// info of the relay given by number, chancode or label
+func relayLookup(relay string) (string, config.OidInfo, error) {
+
+	var matches []int
+	for ndx, info := range cfg.RPMCfg.Oids.Relays {
+		if relay == strconv.Itoa(ndx+1) || strings.EqualFold(relay, info.Chancode) {
+			return strconv.Itoa(ndx + 1), info, nil
+		}
+		if strings.EqualFold(relay, info.Label) {
+			matches = append(matches, ndx)
+		}
 	}
+
+	switch len(matches) {
+	case 0:
+		return "", config.OidInfo{}, fmt.Errorf("invalid relay: %s, must be 1-%d, a relay chancode or label", relay, len(cfg.RPMCfg.Oids.Relays))
+	case 1:
+		return strconv.Itoa(matches[0] + 1), cfg.RPMCfg.Oids.Relays[matches[0]], nil
+	}
+
+	var chancodes []string
+	for _, ndx := range matches {
+		chancodes = append(chancodes, cfg.RPMCfg.Oids.Relays[ndx].Chancode)
+	}
+
+	return "", config.OidInfo{}, fmt.Errorf("relay label %q is ambiguous, use a chancode: %s", relay, strings.Join(chancodes, ", "))
 }
 
 func relayToOid(relay string) (string, error) {
 
-	if !relays.contains(relay) {
-		err := fmt.Errorf("invalid relay #: %s", relay)
+	_, info, err := relayLookup(relay)
+	if err != nil {
 		return "", err
 	}
 
-	relayNdx, _ := strconv.Atoi(relay)
-	oid := cfg.RPMCfg.Oids.Relays[relayNdx-1].Oid
-
-	return oid, nil
+	return info.Oid, nil
 }
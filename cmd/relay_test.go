@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rpm/config"
+	"rpm/simulator"
+	"rpm/tycon"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRelayOid = "1.3.6.1.4.1.45621.2.2.1.0"
+
+// startRelaySimulator runs a simulator with a relay that cycles for
+// cycleTime until the test ends, returning it and a device connected to it.
+// cfg is set up for relay commands, polling the relay quickly
+func startRelaySimulator(t *testing.T, cycleTime time.Duration) (*simulator.Simulator, tycon.PowerMonitor) {
+
+	rpmCfg := config.NewConfig()
+	rpmCfg.Oids.Relays = []config.OidInfo{{Oid: testRelayOid, Chancode: "RL1", Label: "Primary"}}
+	rpmCfg.Simulator.Cycletime = cycleTime
+	rpmCfg.Relay.Pollinterval = 20 * time.Millisecond
+	rpmCfg.ApplyDefaults()
+
+	saved := cfg
+	cfg = cmdConfig{RPMCfg: rpmCfg}
+	t.Cleanup(func() { cfg = saved })
+
+	sim := simulator.New(rpmCfg)
+	if err := sim.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Stop() })
+
+	host, port := sim.HostPort()
+	opts := tycon.DefaultOptions
+	opts.Timeout = 100 * time.Millisecond
+	dev, err := tycon.NewPowerMonitor(host, port, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Connect(tycon.Credentials{Community: simulator.DefaultWriteCommunity}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+
+	return sim, dev
+}
+
+func TestRelayCycleWait(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		cycleTime time.Duration
+		cycle     bool
+		stop      bool
+		expected  time.Duration
+		timeout   time.Duration
+		want      int
+	}{
+		{"complete", 200 * time.Millisecond, true, false, 200 * time.Millisecond, time.Second, ExitOK},
+		{"not observed", 200 * time.Millisecond, false, false, 100 * time.Millisecond, 200 * time.Millisecond, ExitCycleNotObserved},
+		{"incomplete", 5 * time.Second, true, false, 100 * time.Millisecond, 200 * time.Millisecond, ExitCycleIncomplete},
+		{"unresponsive", 5 * time.Second, true, true, time.Second, 5 * time.Second, ExitUnresponsive},
+	}
+
+	for _, tt := range tests {
+		sim, dev := startRelaySimulator(t, tt.cycleTime)
+		cfg.RPMCfg.Relay.Cycletimeout = tt.timeout
+		info := cfg.RPMCfg.Oids.Relays[0]
+
+		start := time.Now()
+		if tt.cycle {
+			if err := dev.CycleRelay(info.Oid); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if tt.stop {
+			sim.Stop()
+		}
+
+		err := relayCycleWait(dev, "1", relayStateClosed, info, start, tt.expected)
+		if got := ExitCode(err); got != tt.want {
+			t.Errorf("%s: exit code %d for %v, want %d", tt.name, got, err, tt.want)
+		}
+		if tt.want == ExitOK {
+			if state, _ := sim.RelayState(info.Oid); state != 1 {
+				t.Errorf("%s: relay state %d after the cycle, want closed", tt.name, state)
+			}
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitOK},
+		{errors.New("connection refused"), ExitFailed},
+		{declinedf("cycle declined"), ExitDeclined},
+		{fmt.Errorf("relay 1: %w", refusedf("relay is protected")), ExitRefused},
+		{fmt.Errorf("cycle of relay 1 (Primary): %w", errCycleNotObserved), ExitCycleNotObserved},
+		{fmt.Errorf("cycle of relay 1 (Primary): %w", errCycleIncomplete), ExitCycleIncomplete},
+		{fmt.Errorf("cycle of relay 1 (Primary): %w", errDeviceUnresponsive), ExitUnresponsive},
+	}
+
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+// setConfirmInput answers confirmations with input, on a terminal if
+// terminal, until the test ends
+func setConfirmInput(t *testing.T, input string, terminal bool) {
+
+	savedInput, savedIsTerminal := confirmInput, confirmIsTerminal
+	confirmInput = strings.NewReader(input)
+	confirmIsTerminal = func() bool { return terminal }
+	t.Cleanup(func() { confirmInput, confirmIsTerminal = savedInput, savedIsTerminal })
+}
+
+func TestRelayConfirmAction(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		confirm  string
+		yes      bool
+		terminal bool
+		input    string
+		want     int
+	}{
+		{"always yes", config.ConfirmAlways, false, true, "YES\n", ExitOK},
+		{"always no", config.ConfirmAlways, false, true, "NO\n", ExitDeclined},
+		{"always asks again", config.ConfirmAlways, false, true, "yes\nmaybe\nYES\n", ExitOK},
+		{"always no answer", config.ConfirmAlways, false, true, "", ExitDeclined},
+		{"always without a terminal", config.ConfirmAlways, false, false, "YES\n", ExitDeclined},
+		{"always with --yes", config.ConfirmAlways, true, false, "", ExitOK},
+		{"never", config.ConfirmNever, false, true, "", ExitOK},
+		{"never without a terminal", config.ConfirmNever, false, false, "", ExitOK},
+		{"tty asks on a terminal", config.ConfirmTTY, false, true, "NO\n", ExitDeclined},
+		{"tty without a terminal", config.ConfirmTTY, false, false, "", ExitOK},
+		{"tty with --yes", config.ConfirmTTY, true, true, "", ExitOK},
+	}
+
+	for _, tt := range tests {
+		info := config.OidInfo{Oid: testRelayOid, Chancode: "RL1", Label: "Primary", Confirm: tt.confirm}
+		for _, action := range []string{relayCmdCycle, relayCmdSet} {
+			setConfirmInput(t, tt.input, tt.terminal)
+			err := relayConfirmAction("1", action, relayStateOpen, info, &relayOptions{yes: tt.yes})
+			if got := ExitCode(err); got != tt.want {
+				t.Errorf("%s: %s exit code %d for %v, want %d", tt.name, action, got, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestRelayDryRun(t *testing.T) {
+
+	sim, _ := startRelaySimulator(t, 200*time.Millisecond)
+	rpmCfg := cfg.RPMCfg
+	rpmCfg.Audit.File = filepath.Join(t.TempDir(), "audit.jsonl")
+	// a dry run does not ask, so it needs no terminal
+	setConfirmInput(t, "", false)
+
+	host, port := sim.HostPort()
+	for _, args := range [][]string{
+		{"relay", "--dry-run", "cycle", "RL1"},
+		{"relay", "--dry-run", "set", "RL1", relayStateOpen},
+	} {
+		if err := Relay(host, port, rpmCfg, args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		if state, _ := sim.RelayState(testRelayOid); state != 1 {
+			t.Errorf("%v: relay state %d, want closed", args, state)
+		}
+	}
+	if _, err := os.Stat(rpmCfg.Audit.File); !os.IsNotExist(err) {
+		t.Errorf("audit trail after dry runs: %v, want none", err)
+	}
+}
+
+func TestRelayLookup(t *testing.T) {
+
+	setTestRelays(t)
+	tests := []struct {
+		relay  string
+		number string
+		oid    string
+		err    string
+	}{
+		{"1", "1", "1.3.6.1.4.1.45621.2.2.1.0", ""},
+		{"4", "4", "1.3.6.1.4.1.45621.2.2.4.0", ""},
+		{"RL2", "2", "1.3.6.1.4.1.45621.2.2.2.0", ""},
+		{"rl3", "3", "1.3.6.1.4.1.45621.2.2.3.0", ""},
+		{"Primary", "1", "1.3.6.1.4.1.45621.2.2.1.0", ""},
+		{"SECONDARY", "2", "1.3.6.1.4.1.45621.2.2.2.0", ""},
+		{"not used", "", "", `relay label "not used" is ambiguous, use a chancode: RL3, RL4`},
+		{"0", "", "", "invalid relay: 0, must be 1-4"},
+		{"5", "", "", "invalid relay: 5, must be 1-4"},
+		{"RL9", "", "", "invalid relay: RL9"},
+		{"", "", "", "invalid relay"},
+	}
+
+	for _, tt := range tests {
+		number, info, err := relayLookup(tt.relay)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("relayLookup(%q) error %v, want %q", tt.relay, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || number != tt.number || info.Oid != tt.oid {
+			t.Errorf("relayLookup(%q) = %s %s %v, want %s %s", tt.relay, number, info.Oid, err, tt.number, tt.oid)
+		}
+	}
+}
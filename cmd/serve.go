@@ -0,0 +1,262 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"rpm/alarm"
+	"rpm/audit"
+	"rpm/config"
+	"rpm/daemon"
+	rlog "rpm/log"
+	"rpm/metrics"
+	"rpm/notify"
+	"rpm/schedule"
+	"rpm/tycon"
+	"time"
+)
+
+// serverURL is the URL of a running rpm daemon; when set the commands use
+// it instead of connecting to the device
+var serverURL string
+
+// UseServer makes the commands thin clients of the rpm daemon at url
+func UseServer(url string) {
+	serverURL = url
+}
+
+// serveOptions holds the serve command flags
+type serveOptions struct {
+	listen   string
+	interval time.Duration
+}
+
+func serveArgsParse(args []string, c *config.RPMConfig) (*serveOptions, error) {
+
+	opts := &serveOptions{}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.listen, "listen", c.Server.Listen, "address for the HTTP API")
+	flags.DurationVar(&opts.interval, "interval", c.Server.Interval, "device polling interval")
+
+	if _, err := parseCmdArgs(flags, args); err != nil {
+		return nil, err
+	}
+	if opts.listen == "" {
+		opts.listen = config.DefaultServerListen
+	}
+	if opts.interval == 0 {
+		opts.interval = config.DefaultServerInterval
+	}
+	if opts.interval < tycon.MinSampleInterval || opts.interval > tycon.MaxSampleInterval {
+		return nil, fmt.Errorf("invalid polling interval %s must be between %s and %s",
+			opts.interval, tycon.MinSampleInterval, tycon.MaxSampleInterval)
+	}
+
+	return opts, nil
+}
+
+// Serve polls the device and serves the results and relay actions over HTTP
+// until signaled. Without a host it serves the [[devices]] of the config
+func Serve(host, port string, rpmCfg *config.RPMConfig, args []string) error {
+
+	cfg.Cmd = args[0]
+	cfg.Host = host
+	cfg.Port = port
+	cfg.RPMCfg = rpmCfg
+
+	if serverURL != "" {
+		return errors.New("the serve command can not be a client of another rpm daemon")
+	}
+
+	opts, err := serveArgsParse(args, cfg.RPMCfg)
+	if err != nil {
+		return err
+	}
+	if cfg.Host == "" {
+		return serveDevices(opts)
+	}
+
+	rlog.NoticeMsg(fmt.Sprintf("running %s command on host: %s:%s\n", args[0], cfg.Host, cfg.Port))
+	rlog.NoticeMsg("polling interval: %.0f sec(s)", opts.interval.Seconds())
+	cfg.warnInterlockHosts()
+
+	tp2din, err := cfg.connectPowerMonitor(accessWrite)
+	if err != nil {
+		return err
+	}
+	defer tp2din.Close()
+
+	auditLog, err := audit.Open(cfg.RPMCfg.Audit.File)
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	notifier, err := newNotifier()
+	if err != nil {
+		return err
+	}
+	defer notifier.Close(notifyCloseTimeout)
+
+	// the schedules of the [[devices]] do not run on the host
+	hostCfg := *cfg.RPMCfg
+	hostCfg.Schedules = cfg.RPMCfg.DeviceSchedules("")
+	cfg.RPMCfg = &hostCfg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-sigdone
+		rlog.DebugMsg("got done signal")
+		cancel()
+	}()
+
+	collector := metrics.NewCollector(cfg.RPMCfg)
+	collector.CountGaps(opts.interval)
+	srv, err := cfg.newServer(ctx, tp2din, opts.interval, auditLog, notifier, collector)
+	if err != nil {
+		cancel()
+		return err
+	}
+	srv.Handle("/metrics", metrics.Handler(collector))
+
+	err = srv.Run(ctx, opts.listen)
+	cancel()
+
+	rlog.NoticeMsg("serve exiting")
+
+	return err
+}
+
+// serveDevices polls the [[devices]] concurrently and serves each of them
+// under daemon.DevicesPrefix followed by its name until signaled
+func serveDevices(opts *serveOptions) error {
+
+	devices, err := deviceConfigs()
+	if err != nil {
+		return err
+	}
+	rlog.NoticeMsg("running %s command on %d devices", cfg.Cmd, len(devices))
+	rlog.NoticeMsg("polling interval: %.0f sec(s)", opts.interval.Seconds())
+
+	auditLog, err := audit.Open(cfg.RPMCfg.Audit.File)
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	notifier, err := newNotifier()
+	if err != nil {
+		return err
+	}
+	defer notifier.Close(notifyCloseTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-sigdone
+		rlog.DebugMsg("got done signal")
+		cancel()
+	}()
+
+	hub := daemon.NewHub()
+	collectors := make([]*metrics.Collector, len(devices))
+	for i, c := range devices {
+		c.warnInterlockHosts()
+		collectors[i] = metrics.NewCollector(c.RPMCfg)
+		collectors[i].CountGaps(opts.interval)
+
+		// the hub connects to the device, and again after it failed
+		hub.Add(c.Device, func(c *cmdConfig, collector *metrics.Collector) daemon.Starter {
+			return func(ctx context.Context) (*daemon.Server, error) {
+				tp2din, err := c.connectPowerMonitor(accessWrite)
+				if err != nil {
+					return nil, err
+				}
+				go func() {
+					<-ctx.Done()
+					tp2din.Close()
+				}()
+				return c.newServer(ctx, tp2din, opts.interval, auditLog, notifier, collector)
+			}
+		}(c, collectors[i]))
+	}
+	hub.Handle("/metrics", metrics.Handler(collectors...))
+
+	err = hub.Run(ctx, opts.listen)
+
+	rlog.NoticeMsg("serve exiting")
+
+	return err
+}
+
+// newServer returns the daemon.Server of the device, observed by collector,
+// with its alarms, notifications and schedules, which run until ctx is done
+func (c *cmdConfig) newServer(ctx context.Context, tp2din tycon.PowerMonitor, interval time.Duration,
+	auditLog *audit.Log, notifier *notify.Notifier, collector *metrics.Collector) (*daemon.Server, error) {
+
+	srv := daemon.NewServer(tp2din, c.RPMCfg, c.Host, c.Port, interval, c.RPMCfg.Server.Token)
+	srv.SetAuditLog(auditLog)
+
+	if counter, ok := tp2din.(tycon.ErrorCounter); ok {
+		collector.SetErrorSource(counter.SNMPErrors)
+	}
+	srv.AddScanHandler(collector.Observe)
+
+	alarms, err := alarm.NewEvaluator(c.RPMCfg)
+	if err != nil {
+		return nil, err
+	}
+	srv.AddScanHandler(func(scan *tycon.TPDin2Scan) {
+		c.evaluateAlarms(alarms, notifier, scan)
+	})
+	srv.AddRelayHandler(func(action daemon.RelayAction, info config.OidInfo, err error) {
+		c.notifyRelay(notifier, info, action.Action, action.State, err)
+	})
+
+	if len(c.RPMCfg.Schedules) > 0 {
+		scheduler, err := schedule.New(tp2din, c.RPMCfg, c.deviceAddr(), auditLog)
+		if err != nil {
+			return nil, err
+		}
+		scheduler.AddRunHandler(func(sched config.Schedule, relay config.OidInfo, action, state, result, detail string) {
+			severity := "notice"
+			switch result {
+			case audit.ResultFailed, audit.ResultRefused:
+				severity = "err"
+			case audit.ResultSkipped:
+				severity = "warning"
+			}
+			ev := c.newEvent(notify.KindRelay, severity, relay, detail)
+			ev.Action = action
+			ev.To = state
+			notifier.Notify(ev)
+		})
+		go scheduler.Run(ctx)
+	}
+
+	return srv, nil
+}
@@ -0,0 +1,59 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"net"
+	"rpm/config"
+	rlog "rpm/log"
+	"rpm/simulator"
+)
+
+// Simulate runs a TPDin2 simulator listening on host:port until signaled
+func Simulate(host, port string, rpmCfg *config.RPMConfig, args []string) error {
+
+	cfg.Cmd = args[0]
+	cfg.Host = host
+	cfg.Port = port
+	cfg.RPMCfg = rpmCfg
+
+	rlog.NoticeMsg(fmt.Sprintf("running %s command on host: %s:%s\n", args[0], cfg.Host, cfg.Port))
+
+	sim := simulator.New(cfg.RPMCfg)
+	err := sim.Start(net.JoinHostPort(cfg.Host, cfg.Port))
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("TPDin2 simulator for %s.%s.%s listening on %s", cfg.RPMCfg.General.Net, cfg.RPMCfg.General.Sta, cfg.RPMCfg.General.Loc, sim.Addr())
+	fmt.Println(msg)
+	rlog.NoticeMsg(msg)
+
+	<-sigdone
+
+	rlog.NoticeMsg("simulator exiting")
+
+	return sim.Stop()
+}
@@ -24,48 +24,101 @@ THE SOFTWARE.
 */
 
 import (
+	"flag"
 	"fmt"
-	"log"
+	"os"
+	"rpm/alarm"
 	"rpm/config"
 	rlog "rpm/log"
 	"rpm/tycon"
-	"strconv"
+	"strings"
 	"time"
 )
 
 // Status runs the status command
 func Status(host, port string, rpmCfg *config.RPMConfig, args []string) error {
 
+	cfg.Cmd = args[0]
 	cfg.Host = host
 	cfg.Port = port
 	cfg.RPMCfg = rpmCfg
 
 	rlog.NoticeMsg(fmt.Sprintf("running %s command on host: %s:%s\n", args[0], cfg.Host, cfg.Port))
 
+	opts, err := statusArgsParse(args)
+	if err != nil {
+		return err
+	}
+
 	initOids(cfg.RPMCfg)
 
-	tp2din := tycon.NewTPDin2()
-	err := tp2din.InitAndConnect(cfg.Host, cfg.Port, "read")
+	tp2din, err := cfg.connectPowerMonitor(accessRead)
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	defer tp2din.Close()
+
+	alarms, err := alarm.NewEvaluator(cfg.RPMCfg)
+	if err != nil {
+		return err
 	}
-	defer tp2din.SNMPParams.Conn.Close()
 
 	ts, results, err := tp2din.QueryOids(&allOids)
 	if err != nil {
 		rlog.ErrMsg("error querying device %s:%s", cfg.Host, cfg.Port)
 		return err
 	}
+	cfg.checkFirmware(results)
+	scan := &tycon.TPDin2Scan{TS: ts, Data: results}
+	alarms.Evaluate(ts, scan)
+
+	if opts.format != formatText {
+		output, err := newScanOutput(os.Stdout, outputParams{
+			format: opts.format,
+			host:   cfg.Host,
+			rpmCfg: cfg.RPMCfg,
+			single: true,
+		})
+		if err != nil {
+			return err
+		}
+		err = output.WriteScan(ts, scan, newScanState(alarms, nil))
+		if err != nil {
+			return err
+		}
+		return output.Close()
+	}
 
 	fmt.Println()
-	fmt.Printf("%40s:  %s:%s\n", "Host", cfg.Host, cfg.Port)
+	fmt.Printf("%40s:  %s\n", "Host", cfg.deviceAddr())
 
-	displayStatusInfo(ts, results)
+	displayStatusInfo(ts, results, alarms.Levels())
 
 	return nil
 }
 
-func displayStatusInfo(ts time.Time, results map[string]string) {
+// statusOptions holds the status command flags
+type statusOptions struct {
+	format string
+}
+
+func statusArgsParse(args []string) (*statusOptions, error) {
+
+	opts := &statusOptions{}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.format, "format", formatText, "output format: text, json, ndjson or csv")
+
+	if _, err := parseCmdArgs(flags, args); err != nil {
+		return nil, err
+	}
+	if !statusFormats.contains(opts.format) {
+		return nil, fmt.Errorf("invalid status output format: %s", opts.format)
+	}
+
+	return opts, nil
+}
+
+func displayStatusInfo(ts time.Time, results map[string]string, levels map[string]alarm.Level) {
 
 	for _, val := range cfg.RPMCfg.Oids.Static {
 		fmt.Printf("%40s:  %s\n", val.Label, results[val.Oid])
@@ -74,25 +127,30 @@ func displayStatusInfo(ts time.Time, results map[string]string) {
 	fmt.Println() /// Mon Jan 2 15:04:05 MST 2006
 
 	for _, val := range cfg.RPMCfg.Oids.Relays {
-		fmt.Printf("%40s:  %s\n", val.Label, relayStatePretty(results[val.Oid]))
+		fmt.Printf("%40s:  %s%s\n", val.Label, relayStatePretty(results[val.Oid]), alarmSuffix(levels, val.Oid))
 	}
 	fmt.Println()
 
-	for _, val := range cfg.RPMCfg.Oids.Voltages {
-		volts, _ := strconv.ParseFloat(results[val.Oid], 64)
-		fmt.Printf("%40s:  %4.1f (volts)\n", val.Label, volts/10)
+	categories := [][]config.OidInfo{
+		cfg.RPMCfg.Oids.Voltages,
+		cfg.RPMCfg.Oids.Currents,
+		cfg.RPMCfg.Oids.Temps,
 	}
-	fmt.Println()
-
-	for _, val := range cfg.RPMCfg.Oids.Currents {
-		amps, _ := strconv.ParseFloat(results[val.Oid], 64)
-		fmt.Printf("%40s:  %4.1f (amps)\n", val.Label, amps/10)
+	for i, oids := range categories {
+		if i > 0 {
+			fmt.Println()
+		}
+		for _, val := range oids {
+			fmt.Printf("%40s:  %4s (%s)%s\n", val.Label, val.FormatValue(results[val.Oid]), val.Units, alarmSuffix(levels, val.Oid))
+		}
 	}
-	fmt.Println()
 
-	for _, val := range cfg.RPMCfg.Oids.Temps {
-		temp, _ := strconv.ParseFloat(results[val.Oid], 64)
-		fmt.Printf("%40s:  %4.1f (deg celsius)\n", val.Label, temp/10)
-	}
+}
 
+// alarmSuffix returns the alarm level of oid for display, if it is not normal
+func alarmSuffix(levels map[string]alarm.Level, oid string) string {
+	if level, ok := levels[oid]; ok && level != alarm.Normal {
+		return fmt.Sprintf("  ** %s **", strings.ToUpper(level.String()))
+	}
+	return ""
 }
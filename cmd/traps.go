@@ -0,0 +1,318 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"rpm/alarm"
+	"rpm/config"
+	rlog "rpm/log"
+	"rpm/notify"
+	"rpm/tycon"
+	"strings"
+	"sync"
+	"time"
+)
+
+var trapsFormats = stringSlice{formatText, formatNDJSON}
+
+// trapsOptions holds the traps command flags
+type trapsOptions struct {
+	listen string
+	format string
+}
+
+// trapDevice is a device traps are accepted from, with the alarm states
+// of its channels
+type trapDevice struct {
+	*cmdConfig
+	alarms *alarm.Evaluator
+}
+
+// trapRecord is a trap with the channels of its varbinds, as written by
+// the ndjson format. Variables are the varbinds not in the [oids]
+type trapRecord struct {
+	Time      time.Time      `json:"time"`
+	Host      string         `json:"host"`
+	Net       string         `json:"net"`
+	Sta       string         `json:"sta"`
+	Loc       string         `json:"loc"`
+	Kind      string         `json:"kind"`
+	Version   string         `json:"version"`
+	TrapOid   string         `json:"trapoid"`
+	Uptime    string         `json:"uptime"`
+	Static    []staticValue  `json:"static,omitempty"`
+	Channels  []channelValue `json:"channels"`
+	Variables []trapVariable `json:"variables,omitempty"`
+}
+
+// trapVariable is a varbind of a trap that is not in the [oids]
+type trapVariable struct {
+	Oid   string `json:"oid"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// trapWriter writes the traps of all devices to w in format
+type trapWriter struct {
+	w      io.Writer
+	format string
+	mutex  sync.Mutex
+}
+
+// Traps runs the traps command, listening for the traps and informs of the
+// device, or of the [[devices]] of the config if no host is given
+func Traps(host, port string, rpmCfg *config.RPMConfig, args []string) error {
+
+	cfg.Cmd = args[0]
+	cfg.Host = host
+	cfg.Port = port
+	cfg.RPMCfg = rpmCfg
+
+	opts := &trapsOptions{}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.listen, "listen", cfg.RPMCfg.Traps.Listen, "UDP address to listen for traps on")
+	flags.StringVar(&opts.format, "format", formatText, "output format: text or ndjson")
+	if _, err := parseCmdArgs(flags, args); err != nil {
+		return err
+	}
+	if !trapsFormats.contains(opts.format) {
+		return fmt.Errorf("invalid traps output format: %s", opts.format)
+	}
+
+	devices, err := trapDevices()
+	if err != nil {
+		return err
+	}
+	senders := make([]tycon.TrapSender, len(devices))
+	for i, d := range devices {
+		if senders[i], err = d.trapSender(); err != nil {
+			return err
+		}
+	}
+
+	notifier, err := newNotifier()
+	if err != nil {
+		return err
+	}
+	defer notifier.Close(notifyCloseTimeout)
+
+	out := &trapWriter{w: os.Stdout, format: opts.format}
+	listener, err := tycon.NewTrapListener(cfg.RPMCfg.Traps.Engineid, senders, func(trap tycon.Trap) {
+		for _, d := range devices {
+			if d.Device == trap.Sender {
+				d.handleTrap(trap, notifier, out)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := listener.Start(opts.listen); err != nil {
+		return err
+	}
+	rlog.NoticeMsg("traps output format: %s, SNMPv3 inform engine ID: %s", opts.format, listener.EngineID())
+
+	<-doneOnSignal()
+	err = listener.Stop()
+
+	rlog.NoticeMsg("traps exiting")
+
+	return err
+}
+
+// trapDevices returns the devices traps are accepted from: the host given,
+// else the [[devices]] of the config, else any host with the [snmp] settings
+func trapDevices() ([]*trapDevice, error) {
+
+	configs := []*cmdConfig{&cfg}
+	if cfg.Host == "" && len(cfg.RPMCfg.Devices) > 0 {
+		var err error
+		if configs, err = deviceConfigs(); err != nil {
+			return nil, err
+		}
+	}
+
+	var devices []*trapDevice
+	for _, c := range configs {
+		alarms, err := alarm.NewEvaluator(c.RPMCfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s%w", c.logPrefix(), err)
+		}
+		devices = append(devices, &trapDevice{c, alarms})
+	}
+	if cfg.Host == "" && len(cfg.RPMCfg.Devices) == 0 {
+		rlog.WarningMsg("no host or [[devices]], accepting traps from any host")
+	} else {
+		rlog.NoticeMsg("accepting traps from %d device(s)", len(devices))
+	}
+
+	return devices, nil
+}
+
+// trapSender returns the tycon.TrapSender of the device, with the SNMP
+// version and v3 user it is polled with
+func (d *trapDevice) trapSender() (tycon.TrapSender, error) {
+
+	settings := d.RPMCfg.SNMPFor(d.Cmd)
+	if d.RPMCfg.Traps.Community != "" {
+		settings.Readcommunity = d.RPMCfg.Traps.Community
+	}
+	sender := tycon.TrapSender{
+		Name:     d.Device,
+		Creds:    snmpCredentials(d.RPMCfg, settings, accessRead),
+		EngineID: d.RPMCfg.SNMP.V3.Engineid,
+	}
+	if d.Host == "" {
+		return sender, nil
+	}
+
+	ips, err := net.LookupIP(d.Host)
+	if err != nil {
+		return sender, fmt.Errorf("%s%w", d.logPrefix(), err)
+	}
+	sender.Host = ips[0].String()
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			sender.Host = ip.String()
+			break
+		}
+	}
+
+	return sender, nil
+}
+
+// handleTrap logs and writes trap, updating the alarms of the channels in
+// it and notifying their transitions and the trap itself
+func (d *trapDevice) handleTrap(trap tycon.Trap, notifier *notify.Notifier, out *trapWriter) {
+
+	c := d.cmdConfig
+	if c.Host == "" {
+		// accepting traps from any host
+		c = &cmdConfig{Cmd: d.Cmd, Host: trap.Source, Port: d.Port, RPMCfg: d.RPMCfg}
+	}
+
+	scan := &tycon.TPDin2Scan{TS: trap.Time, Data: make(map[string]string)}
+	for _, v := range trap.Variables {
+		scan.Data[v.Oid] = v.Value
+	}
+	c.notifyAlarms(notifier, d.alarms.Update(trap.Time, scan))
+
+	rec := c.newTrapRecord(trap, newScanState(d.alarms, nil))
+	desc := rec.describe()
+	rlog.NoticeMsg("%s%s %s from %s: %s", c.logPrefix(), rec.Kind, rec.TrapOid, trap.Source, desc)
+	notifier.Notify(c.newEvent(notify.KindTrap, "notice", config.OidInfo{},
+		fmt.Sprintf("%s %s from %s: %s", rec.Kind, rec.TrapOid, trap.Source, desc)))
+
+	if err := out.write(rec, desc); err != nil {
+		rlog.ErrMsg("%straps output: %s", c.logPrefix(), err.Error())
+	}
+}
+
+// newTrapRecord maps the varbinds of trap to the static and data OIDs of
+// the config, with the alarm levels of the channels in state
+func (c *cmdConfig) newTrapRecord(trap tycon.Trap, state scanState) *trapRecord {
+
+	kind := "trap"
+	if trap.Inform {
+		kind = "inform"
+	}
+	rec := &trapRecord{
+		Time:     trap.Time.UTC(),
+		Host:     c.Host,
+		Net:      c.RPMCfg.General.Net,
+		Sta:      c.RPMCfg.General.Sta,
+		Loc:      c.RPMCfg.General.Loc,
+		Kind:     kind,
+		Version:  trap.Version,
+		TrapOid:  trap.TrapOid,
+		Uptime:   trap.Uptime,
+		Channels: []channelValue{},
+	}
+
+	for _, v := range trap.Variables {
+		category, info, found := findOid(c.RPMCfg.Oids, v.Oid)
+		switch {
+		case !found:
+			rec.Variables = append(rec.Variables, trapVariable{v.Oid, v.Type, v.Value})
+		case category == categoryStatic || category == categoryTests:
+			rec.Static = append(rec.Static, staticValue{info.Oid, info.Label, v.Value})
+		default:
+			rec.Channels = append(rec.Channels, newChannelValue(category, info, v.Value, state))
+		}
+	}
+
+	return rec
+}
+
+// describe returns the values of the trap for the log and text output
+func (rec *trapRecord) describe() string {
+
+	var values []string
+	for _, st := range rec.Static {
+		values = append(values, fmt.Sprintf("%s=%s", st.Label, st.Value))
+	}
+	for _, chv := range rec.Channels {
+		value := chv.Raw
+		switch {
+		case chv.State != "":
+			value = chv.State
+		case chv.Value != nil:
+			value = fmt.Sprintf("%g %s", *chv.Value, chv.Units)
+		}
+		if chv.Alarm != "" && chv.Alarm != alarm.Normal.String() {
+			value += " (" + chv.Alarm + ")"
+		}
+		values = append(values, fmt.Sprintf("%s (%s)=%s", chv.Chancode, chv.Label, strings.TrimSpace(value)))
+	}
+	for _, v := range rec.Variables {
+		values = append(values, fmt.Sprintf("%s=%s", v.Oid, v.Value))
+	}
+	if len(values) == 0 {
+		return "no values"
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// write writes rec, or its description desc in the text format
+func (out *trapWriter) write(rec *trapRecord, desc string) error {
+
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+
+	if out.format == formatNDJSON {
+		return json.NewEncoder(out.w).Encode(rec)
+	}
+	_, err := fmt.Fprintf(out.w, "%s %s %s v%s %s uptime %s: %s\n",
+		rec.Time.Format(time.RFC3339), rec.Host, rec.Kind, rec.Version, rec.TrapOid, rec.Uptime, desc)
+
+	return err
+}
@@ -0,0 +1,95 @@
+// Package cmd handles CLI commands
+package cmd
+
+/*
+Copyright © 2020 Regents of the University of California
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+import (
+	"context"
+	"fmt"
+	"rpm/audit"
+	"rpm/config"
+	rlog "rpm/log"
+	"rpm/notify"
+	"rpm/watchdog"
+)
+
+// Watchdog checks the [watchdog] targets and cycles their relays when they stop answering, until signaled
+func Watchdog(host, port string, rpmCfg *config.RPMConfig, args []string) error {
+
+	cfg.Cmd = args[0]
+	cfg.Host = host
+	cfg.Port = port
+	cfg.RPMCfg = rpmCfg
+
+	rlog.NoticeMsg(fmt.Sprintf("running %s command on host: %s:%s\n", args[0], cfg.Host, cfg.Port))
+	cfg.warnInterlockHosts()
+
+	auditLog, err := audit.Open(cfg.RPMCfg.Audit.File)
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	notifier, err := newNotifier()
+	if err != nil {
+		return err
+	}
+	defer notifier.Close(notifyCloseTimeout)
+
+	tp2din, err := cfg.connectPowerMonitor(accessWrite)
+	if err != nil {
+		return err
+	}
+	defer tp2din.Close()
+
+	wd, err := watchdog.New(tp2din, cfg.RPMCfg, cfg.deviceAddr(), auditLog)
+	if err != nil {
+		return err
+	}
+	wd.AddCycleHandler(func(target config.WatchdogTarget, relay config.OidInfo, result, detail string) {
+		severity := "warning"
+		switch result {
+		case audit.ResultFailed:
+			severity = "err"
+		case audit.ResultSkipped:
+			severity = "crit"
+		}
+		ev := cfg.newEvent(notify.KindRelay, severity, relay, "watchdog: "+detail)
+		ev.Action = relayCmdCycle
+		notifier.Notify(ev)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-sigdone
+		rlog.DebugMsg("got done signal")
+		cancel()
+	}()
+
+	err = wd.Run(ctx)
+	cancel()
+
+	rlog.NoticeMsg("watchdog exiting")
+
+	return err
+}
@@ -3,6 +3,14 @@ package config
 import (
 	"fmt"
 	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
 )
 
 // Config interface for RPM
@@ -17,10 +25,44 @@ func NewConfig() *RPMConfig {
 
 // RPMConfig hold the RPM configuration structure
 type RPMConfig struct {
-	General generalConfig
-	WinMain winMainConfig
-	Oids    TyconOids
-	CfgFile string
+	General   generalConfig
+	WinMain   winMainConfig
+	SNMP      snmpConfig
+	Oids      TyconOids
+	Alarms    []AlarmRule
+	Quality   []QualityRule
+	Notify    []NotifyConfig
+	Watchdog  watchdogConfig
+	Audit     auditConfig
+	Relay     relayConfig
+	Buffer    bufferConfig
+	Profiles  profilesConfig
+	Interlock interlockConfig
+	Schedules []Schedule
+	Devices   []Device
+	Simulator simulatorConfig
+	Server    serverConfig
+	Traps     trapsConfig
+	CfgFile   string
+	// unknown are the keys of the config file that are not settings
+	unknown []string
+}
+
+// Unmarshal decodes the settings of v into cfg. Keys that are not
+// settings, e.g. misspelled ones, are kept for Validate to report
+func (cfg *RPMConfig) Unmarshal(v *viper.Viper) error {
+
+	var md mapstructure.Metadata
+	if err := v.Unmarshal(cfg, func(dc *mapstructure.DecoderConfig) { dc.Metadata = &md }); err != nil {
+		return err
+	}
+	cfg.unknown = nil
+	for _, key := range md.Unused {
+		cfg.unknown = append(cfg.unknown, strings.ToLower(key))
+	}
+	sort.Strings(cfg.unknown)
+
+	return nil
 }
 
 // GeneralConfig top lebel config settings
@@ -49,23 +91,595 @@ type winMainConfig struct {
 	LBLAuxamp   string
 }
 
-// TyconOids wraps the info for different categrories of Oids
+// Defaults for the [snmp] settings
+const (
+	DefaultReadCommunity  string        = "read"
+	DefaultWriteCommunity string        = "write"
+	DefaultSNMPTimeout    time.Duration = 10 * time.Second
+	DefaultSNMPRetries    int           = 0
+	DefaultSNMPTransport  string        = "udp4"
+)
+
+// SNMPEnvKeys are the [snmp] settings that can also be set with RPM_SNMP_* environment variables
+var SNMPEnvKeys = []string{
+	"snmp.readcommunity",
+	"snmp.writecommunity",
+	"snmp.timeout",
+	"snmp.retries",
+	"snmp.transport",
+	"snmp.maxoids",
+	"snmp.poll.timeout",
+	"snmp.poll.retries",
+	"snmp.status.timeout",
+	"snmp.status.retries",
+	"snmp.relay.timeout",
+	"snmp.relay.retries",
+	"snmp.v3.user",
+	"snmp.v3.authpassphrase",
+	"snmp.v3.privpassphrase",
+}
+
+// snmpConfig SNMP session settings. Writeversion, if set, overrides Version for relay writes.
+// Poll, Status and Relay override the session settings for that command
+type snmpConfig struct {
+	Version        string
+	Writeversion   string
+	Readcommunity  string
+	Writecommunity string
+	Timeout        time.Duration
+	Retries        int
+	Transport      string
+	Maxoids        int
+	V3             snmpV3Config
+	Poll           snmpOverrides
+	Status         snmpOverrides
+	Relay          snmpOverrides
+}
+
+// snmpOverrides per command session settings, only values that are set are applied
+type snmpOverrides struct {
+	Readcommunity  string
+	Writecommunity string
+	Timeout        time.Duration
+	Retries        *int
+	Transport      string
+	Maxoids        int
+}
+
+// SNMPSettings are the effective SNMP session settings for a command
+type SNMPSettings struct {
+	Readcommunity  string
+	Writecommunity string
+	Timeout        time.Duration
+	Retries        int
+	Transport      string
+	Maxoids        int
+}
+
+// snmpV3Config USM settings used when the SNMP version is 3.
+// Writelevel, if set, overrides Level for relay writes. Engineid is the
+// device's engine ID in hex, needed to authenticate its v3 traps
+type snmpV3Config struct {
+	User           string
+	Authprotocol   string
+	Authpassphrase string
+	Privprotocol   string
+	Privpassphrase string
+	Level          string
+	Writelevel     string
+	Engineid       string
+}
+
+// Defaults for the [server] settings
+const (
+	DefaultServerListen   string        = "127.0.0.1:8161"
+	DefaultServerInterval time.Duration = 10 * time.Second
+)
+
+// serverConfig settings for 'rpm serve' and its clients. If Token is set
+// relay actions through the API require it
+type serverConfig struct {
+	Listen   string
+	Interval time.Duration
+	Token    string
+}
+
+// DefaultTrapsListen is the address 'rpm traps' listens on, the SNMP trap port
+const DefaultTrapsListen string = ":162"
+
+// trapsConfig settings for 'rpm traps'. Traps are accepted with the SNMP
+// version and v3 user of the device, v2c traps with Community or else the
+// device's read community. Engineid is the SNMPv3 engine ID in hex that v3
+// informs are sent to, by default from the hostname
+type trapsConfig struct {
+	Listen    string
+	Community string
+	Engineid  string
+}
+
+// AlarmRule are the alarm limits for the data OID with Chancode, in its
+// engineering units. Unset limits are not checked. A level is left only once
+// the value is back past the limit by Hysteresis, and a new level must hold
+// for Duration before it is reported. The channel is stale when its value is
+// missing or, if Stale is set, the scan is older than Stale
+type AlarmRule struct {
+	Chancode   string
+	Lowcrit    *float64
+	Lowwarn    *float64
+	Highwarn   *float64
+	Highcrit   *float64
+	Hysteresis float64
+	Duration   time.Duration
+	Stale      time.Duration
+}
+
+// QualityRule are the data quality checks of the data OID with Chancode,
+// or of the OIDs of Category (relays, voltages, currents or temps) without
+// a rule of their own, in engineering units. Values below Min or above Max
+// can not occur, a change of more than Step between scans is a step, and a
+// value that stays within Epsilon for Frozen scans is frozen. Unset checks
+// are not made
+type QualityRule struct {
+	Chancode string
+	Category string
+	Min      *float64
+	Max      *float64
+	Step     float64
+	Epsilon  float64
+	Frozen   int
+}
+
+// Notifier types
+const (
+	NotifyEmail   string = "email"
+	NotifyWebhook string = "webhook"
+	NotifyExec    string = "exec"
+)
+
+// Defaults for the [[notify]] settings
+const (
+	DefaultNotifyTimeout time.Duration = 10 * time.Second
+	DefaultNotifyBackoff time.Duration = 5 * time.Second
+	DefaultNotifyPeriod  time.Duration = time.Hour
+)
+
+// NotifyConfig settings of an alarm and relay action notification sink.
+// Smtp, From, To, Username and Password are for email, Url for webhook,
+// Command and Args for exec. At most Ratelimit notifications are sent per
+// Rateperiod (0 is unlimited); failed sends are retried Retries times,
+// waiting Backoff, doubled each retry
+type NotifyConfig struct {
+	Type       string
+	Name       string
+	Smtp       string
+	From       string
+	To         []string
+	Username   string
+	Password   string
+	Url        string
+	Command    string
+	Args       []string
+	Timeout    time.Duration
+	Ratelimit  int
+	Rateperiod time.Duration
+	Retries    int
+	Backoff    time.Duration
+}
+
+// Watchdog check types
+const (
+	CheckPing string = "ping"
+	CheckTCP  string = "tcp"
+)
+
+// Defaults for the [watchdog] settings
+const (
+	DefaultWatchdogInterval  time.Duration = 30 * time.Second
+	DefaultWatchdogFailures  int           = 5
+	DefaultWatchdogCooldown  time.Duration = 15 * time.Minute
+	DefaultWatchdogMaxperday int           = 3
+	DefaultWatchdogTimeout   time.Duration = 5 * time.Second
+)
+
+// watchdogConfig settings for 'rpm <host> watchdog'. A target's relay is
+// cycled after Failures consecutive failed checks, at most Maxperday times in
+// 24 hours, and its checks are not counted for Cooldown after a cycle
+type watchdogConfig struct {
+	Interval  time.Duration
+	Failures  int
+	Cooldown  time.Duration
+	Maxperday int
+	Targets   []WatchdogTarget
+}
+
+// WatchdogTarget is a host checked by ping or a TCP connect to Port, and
+// the chancode of the relay that powers it. Force, like 'relay --force',
+// lets the watchdog cycle a protected relay
+type WatchdogTarget struct {
+	Name    string
+	Host    string
+	Check   string
+	Port    int
+	Relay   string
+	Timeout time.Duration
+	Force   bool
+}
+
+// DefaultAuditFile is the relay audit trail, relative to the nrts home directory
+const DefaultAuditFile string = "log/rpm-audit.jsonl"
+
+// auditConfig settings of the relay audit trail
+type auditConfig struct {
+	File string
+}
+
+// Defaults for the [relay] settings
+const (
+	DefaultRelayCycletime    time.Duration = 10 * time.Second
+	DefaultRelayCycletimeout time.Duration = 30 * time.Second
+	DefaultRelayPollinterval time.Duration = time.Second
+)
+
+// relayConfig settings for 'rpm <host> relay cycle'. The relay is expected
+// back in its state Cycletime after the cycle command, unless the relay's
+// cycletimeoid reports the device's own cycle time, and must be back within
+// Cycletimeout more. Its state is queried every Pollinterval
+type relayConfig struct {
+	Cycletime    time.Duration
+	Cycletimeout time.Duration
+	Pollinterval time.Duration
+}
+
+// Defaults for the [buffer] settings, a day of 1 second scans
+const (
+	DefaultBufferRecords  int = 3600
+	DefaultBufferSegments int = 24
+)
+
+// bufferConfig settings of the on-disk scan buffer of 'rpm <host> poll'.
+// Dir, relative to the nrts home directory, enables it; it keeps at most
+// Segments files of Records scans
+type bufferConfig struct {
+	Dir      string
+	Records  int
+	Segments int
+}
+
+// interlockConfig is the policy relay actions are checked against: the
+// hosts allowed to operate a relay, groups of relays that must never all be
+// open and protected relays that need --force. Relays are chancodes
+type interlockConfig struct {
+	Hosts     []InterlockHosts
+	Groups    [][]string
+	Protected []string
+}
+
+// InterlockHosts are the hosts allowed to operate a relay, "*" is any host
+type InterlockHosts struct {
+	Relay string
+	Hosts []string
+}
+
+// Schedule is a relay action run by 'rpm <host> serve' at the times of Cron,
+// five fields in UTC: minute hour day-of-month month day-of-week. Action is
+// set (to State) or cycle. A set with a Duration is a window, after which
+// the relay is set back. A run missed while rpm was not running is done at
+// startup if it is less than Catchup late. A schedule with a Device runs
+// on that device of the [[devices]], otherwise on the host given to serve.
+// Force, like 'relay --force', lets it operate a protected relay
+type Schedule struct {
+	Name     string
+	Device   string
+	Cron     string
+	Relay    string
+	Action   string
+	State    string
+	Duration time.Duration
+	Catchup  time.Duration
+	Force    bool
+}
+
+// Device is one of the devices polled by 'rpm poll' and 'rpm serve' when
+// no host is given, at Host[:port]. The station codes, SNMP settings and
+// OIDs that are set override the top level ones for the device; Loc is a
+// pointer so a device can have an empty location code
+type Device struct {
+	Name string
+	Host string
+	Net  string
+	Sta  string
+	Loc  *string
+	SNMP deviceSNMP
+	Oids TyconOids
+}
+
+// deviceSNMP are the SNMP settings of a device, values that are set override [snmp]
+type deviceSNMP struct {
+	Version        string
+	Writeversion   string
+	Readcommunity  string
+	Writecommunity string
+	Timeout        time.Duration
+	Retries        *int
+	Transport      string
+	Maxoids        int
+	V3             snmpV3Config
+}
+
+// simulatorConfig settings for the TPDin2 simulator
+type simulatorConfig struct {
+	Cycletime time.Duration
+	Static    []StaticValue
+	Waveforms []WaveformInfo
+}
+
+// StaticValue is the simulated value of a static OID
+type StaticValue struct {
+	Oid   string
+	Value string
+}
+
+// WaveformInfo describes the simulated signal for a chancode
+type WaveformInfo struct {
+	Chancode  string
+	Kind      string
+	Base      float64
+	Amplitude float64
+	Period    time.Duration
+}
+
+// TyconOids wraps the info for different categrories of Oids. With a
+// Profile the OIDs listed only override those of the profile, see
+// ApplyProfiles. Firmware are the patterns, as of path.Match, of the
+// firmware versions reported by the static Firmwareoid the OIDs are for
 type TyconOids struct {
-	Static   []OidInfo
-	Tests    []OidInfo
-	Relays   []OidInfo
-	Voltages []OidInfo
-	Currents []OidInfo
-	Temps    []OidInfo
+	Profile     string
+	Firmwareoid string
+	Firmware    []string
+	Static      []OidInfo
+	Tests       []OidInfo
+	Relays      []OidInfo
+	Voltages    []OidInfo
+	Currents    []OidInfo
+	Temps       []OidInfo
 }
 
-// OidInfo holds detailed info for each Oid endpoint
+// OidInfo holds detailed info for each Oid endpoint. The engineering value
+// of a raw device value is raw*Scale + Offset in Units, displayed with
+// Precision decimals; unset fields take the defaults of the OID category.
+// Confirm is the confirmation policy of a relay and Cycletimeoid the OID
+// of its cycle time in seconds
 type OidInfo struct {
-	Oid      string
-	Chancode string
-	Label    string
-	Function string
-	// Cycletime int
+	Oid          string
+	Chancode     string
+	Label        string
+	Function     string
+	Scale        float64
+	Offset       float64
+	Units        string
+	Precision    *int
+	Confirm      string
+	Cycletimeoid string
+}
+
+// Relay confirmation policies: always ask (or require --yes), never ask,
+// or ask only when run from a terminal
+const (
+	ConfirmAlways string = "always"
+	ConfirmNever  string = "never"
+	ConfirmTTY    string = "tty"
+)
+
+// oidScaling are the engineering unit defaults for a category of OIDs
+type oidScaling struct {
+	scale     float64
+	units     string
+	precision int
+}
+
+// Engineering unit defaults by category; TPDin2 reports tenths
+var (
+	relayScaling   = oidScaling{1, "", 0}
+	voltageScaling = oidScaling{0.1, "volts", 1}
+	currentScaling = oidScaling{0.1, "amps", 1}
+	tempScaling    = oidScaling{0.1, "deg celsius", 1}
+)
+
+// applyScaling sets the unset scaling fields of oids to the defaults
+func applyScaling(oids []OidInfo, defaults oidScaling) {
+	for i := range oids {
+		if oids[i].Scale == 0 {
+			oids[i].Scale = defaults.scale
+		}
+		if oids[i].Units == "" {
+			oids[i].Units = defaults.units
+		}
+		if oids[i].Precision == nil {
+			precision := defaults.precision
+			oids[i].Precision = &precision
+		}
+	}
+}
+
+// ApplyDefaults fills in the settings left unset in the config file.
+// Call it once after unmarshaling
+func (cfg *RPMConfig) ApplyDefaults() {
+	if cfg.Watchdog.Interval == 0 {
+		cfg.Watchdog.Interval = DefaultWatchdogInterval
+	}
+	if cfg.Watchdog.Failures == 0 {
+		cfg.Watchdog.Failures = DefaultWatchdogFailures
+	}
+	if cfg.Watchdog.Cooldown == 0 {
+		cfg.Watchdog.Cooldown = DefaultWatchdogCooldown
+	}
+	if cfg.Watchdog.Maxperday == 0 {
+		cfg.Watchdog.Maxperday = DefaultWatchdogMaxperday
+	}
+	for i := range cfg.Watchdog.Targets {
+		if cfg.Watchdog.Targets[i].Timeout == 0 {
+			cfg.Watchdog.Targets[i].Timeout = DefaultWatchdogTimeout
+		}
+	}
+	if cfg.Audit.File == "" {
+		cfg.Audit.File = DefaultAuditFile
+	}
+	if cfg.Relay.Cycletime == 0 {
+		cfg.Relay.Cycletime = DefaultRelayCycletime
+	}
+	if cfg.Relay.Cycletimeout == 0 {
+		cfg.Relay.Cycletimeout = DefaultRelayCycletimeout
+	}
+	if cfg.Relay.Pollinterval == 0 {
+		cfg.Relay.Pollinterval = DefaultRelayPollinterval
+	}
+	if cfg.Traps.Listen == "" {
+		cfg.Traps.Listen = DefaultTrapsListen
+	}
+	if cfg.Buffer.Records == 0 {
+		cfg.Buffer.Records = DefaultBufferRecords
+	}
+	if cfg.Buffer.Segments == 0 {
+		cfg.Buffer.Segments = DefaultBufferSegments
+	}
+
+	cfg.Oids.applyDefaults()
+	for i := range cfg.Devices {
+		cfg.Devices[i].Oids.applyDefaults()
+	}
+}
+
+// applyDefaults sets the unset scaling and relay confirmation fields
+func (toids *TyconOids) applyDefaults() {
+	applyScaling(toids.Relays, relayScaling)
+	for i := range toids.Relays {
+		if toids.Relays[i].Confirm == "" {
+			toids.Relays[i].Confirm = ConfirmAlways
+		}
+	}
+	applyScaling(toids.Voltages, voltageScaling)
+	applyScaling(toids.Currents, currentScaling)
+	applyScaling(toids.Temps, tempScaling)
+}
+
+// empty reports whether no OIDs are configured
+func (toids TyconOids) empty() bool {
+	return len(toids.Static)+len(toids.Tests)+len(toids.Relays)+len(toids.Voltages)+len(toids.Currents)+len(toids.Temps) == 0
+}
+
+// NeedsOids reports whether the top level [oids] are used by a device: when
+// there are no [[devices]] or a device has no [devices.oids] of its own
+func (cfg *RPMConfig) NeedsOids() bool {
+
+	if len(cfg.Devices) == 0 {
+		return true
+	}
+	for _, d := range cfg.Devices {
+		if d.Oids.empty() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeviceSchedules returns the schedules of the device name, "" for the
+// host given on the command line
+func (cfg *RPMConfig) DeviceSchedules(name string) []Schedule {
+
+	var schedules []Schedule
+	for _, sched := range cfg.Schedules {
+		if sched.Device == name {
+			schedules = append(schedules, sched)
+		}
+	}
+
+	return schedules
+}
+
+// DeviceConfig returns the config of device d, a copy of cfg with the
+// settings and schedules of d and no devices
+func (cfg *RPMConfig) DeviceConfig(d Device) *RPMConfig {
+
+	dc := *cfg
+	dc.Devices = nil
+	dc.Schedules = cfg.DeviceSchedules(d.Name)
+
+	if d.Net != "" {
+		dc.General.Net = d.Net
+	}
+	if d.Sta != "" {
+		dc.General.Sta = d.Sta
+	}
+	if d.Loc != nil {
+		dc.General.Loc = *d.Loc
+	}
+	if !d.Oids.empty() {
+		dc.Oids = d.Oids
+	}
+
+	s := d.SNMP
+	if s.Version != "" {
+		dc.SNMP.Version = s.Version
+	}
+	if s.Writeversion != "" {
+		dc.SNMP.Writeversion = s.Writeversion
+	}
+	if s.Readcommunity != "" {
+		dc.SNMP.Readcommunity = s.Readcommunity
+	}
+	if s.Writecommunity != "" {
+		dc.SNMP.Writecommunity = s.Writecommunity
+	}
+	if s.Timeout > 0 {
+		dc.SNMP.Timeout = s.Timeout
+	}
+	if s.Retries != nil {
+		dc.SNMP.Retries = *s.Retries
+	}
+	if s.Transport != "" {
+		dc.SNMP.Transport = s.Transport
+	}
+	if s.Maxoids > 0 {
+		dc.SNMP.Maxoids = s.Maxoids
+	}
+	if s.V3 != (snmpV3Config{}) {
+		dc.SNMP.V3 = s.V3
+	}
+
+	return &dc
+}
+
+// Value returns raw in engineering units
+func (info OidInfo) Value(raw string) (float64, error) {
+
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, err
+	}
+	scale := info.Scale
+	if scale == 0 {
+		scale = 1
+	}
+
+	// round off binary floating point noise, e.g. 132*0.1 = 13.200000000000001
+	return math.Round((val*scale+info.Offset)*1e9) / 1e9, nil
+}
+
+// FormatValue returns raw in engineering units with the display precision,
+// or raw unchanged if it is not numeric
+func (info OidInfo) FormatValue(raw string) string {
+
+	val, err := info.Value(raw)
+	if err != nil {
+		return raw
+	}
+	precision := 0
+	if info.Precision != nil {
+		precision = *info.Precision
+	}
+
+	return strconv.FormatFloat(val, 'f', precision, 64)
 }
 
 // DataOids provides list of list of Data Oids
@@ -79,9 +693,59 @@ func (toids *TyconOids) DataOids() *[][]OidInfo {
 	}
 }
 
-// Validate the rpm TOML config file
-func (cfg RPMConfig) Validate() (e error) {
-	return nil
+// SNMPFor returns the [snmp] session settings, with defaults and any
+// overrides for command applied
+func (cfg *RPMConfig) SNMPFor(command string) SNMPSettings {
+
+	settings := SNMPSettings{
+		Readcommunity:  DefaultReadCommunity,
+		Writecommunity: DefaultWriteCommunity,
+		Timeout:        DefaultSNMPTimeout,
+		Retries:        DefaultSNMPRetries,
+		Transport:      DefaultSNMPTransport,
+	}
+	overrides := []snmpOverrides{
+		{
+			Readcommunity:  cfg.SNMP.Readcommunity,
+			Writecommunity: cfg.SNMP.Writecommunity,
+			Timeout:        cfg.SNMP.Timeout,
+			Retries:        &cfg.SNMP.Retries,
+			Transport:      cfg.SNMP.Transport,
+			Maxoids:        cfg.SNMP.Maxoids,
+		},
+	}
+
+	switch command {
+	case "poll":
+		overrides = append(overrides, cfg.SNMP.Poll)
+	case "status":
+		overrides = append(overrides, cfg.SNMP.Status)
+	case "relay":
+		overrides = append(overrides, cfg.SNMP.Relay)
+	}
+
+	for _, o := range overrides {
+		if o.Readcommunity != "" {
+			settings.Readcommunity = o.Readcommunity
+		}
+		if o.Writecommunity != "" {
+			settings.Writecommunity = o.Writecommunity
+		}
+		if o.Timeout > 0 {
+			settings.Timeout = o.Timeout
+		}
+		if o.Retries != nil {
+			settings.Retries = *o.Retries
+		}
+		if o.Transport != "" {
+			settings.Transport = o.Transport
+		}
+		if o.Maxoids > 0 {
+			settings.Maxoids = o.Maxoids
+		}
+	}
+
+	return settings
 }
 
 // DumpCfg writes config to string for printing/saving
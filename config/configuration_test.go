@@ -1 +1,317 @@
 package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func validConfig() *RPMConfig {
+
+	rpmCfg := NewConfig()
+	rpmCfg.General = generalConfig{Sta: "VALT", Net: "II", Loc: "25"}
+	rpmCfg.Oids.Static = []OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Label: "Product Name"},
+	}
+	rpmCfg.Oids.Relays = []OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.1.0", Chancode: "RL1", Label: "Relay 1"},
+	}
+	rpmCfg.Oids.Voltages = []OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.5.0", Chancode: "MV1", Label: "Battery"},
+	}
+
+	return rpmCfg
+}
+
+func problems(t *testing.T, rpmCfg *RPMConfig) []Problem {
+
+	err := rpmCfg.Validate()
+	if err == nil {
+		return nil
+	}
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Validate() error %T, want *ValidationError", err)
+	}
+
+	return verr.Problems
+}
+
+func TestValidateOK(t *testing.T) {
+
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil", err)
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(c *RPMConfig)
+		want   string
+	}{
+		{"network code", func(c *RPMConfig) { c.General.Net = "IIX" }, "invalid network code"},
+		{"station code", func(c *RPMConfig) { c.General.Sta = "valt" }, "invalid station code"},
+		{"location code", func(c *RPMConfig) { c.General.Loc = "1-2" }, "invalid location code"},
+		{"no relays", func(c *RPMConfig) { c.Oids.Relays = nil }, "no relays"},
+		{"oid format", func(c *RPMConfig) { c.Oids.Voltages[0].Oid = "1.3.6.1.4.1.45621.2.2.5.0." }, "invalid oid"},
+		{"oid name", func(c *RPMConfig) { c.Oids.Voltages[0].Oid = "iso.3.6.1" }, "invalid oid"},
+		{"chancode length", func(c *RPMConfig) { c.Oids.Voltages[0].Chancode = "MV" }, "invalid chancode"},
+		{"duplicate chancode", func(c *RPMConfig) { c.Oids.Voltages[0].Chancode = "RL1" }, "duplicate chancode"},
+		{"duplicate oid", func(c *RPMConfig) { c.Oids.Voltages[0].Oid = c.Oids.Relays[0].Oid }, "duplicate oid"},
+		{"alarm chancode", func(c *RPMConfig) { c.Alarms = []AlarmRule{{Chancode: "MV9"}} }, "unknown chancode"},
+		{"quality chancode", func(c *RPMConfig) { c.Quality = []QualityRule{{Chancode: "MV9", Frozen: 10}} }, "unknown chancode"},
+		{"quality category", func(c *RPMConfig) { c.Quality = []QualityRule{{Category: "volts", Frozen: 10}} }, "invalid category"},
+		{"quality range", func(c *RPMConfig) {
+			min, max := 10.0, 0.0
+			c.Quality = []QualityRule{{Category: "voltages", Min: &min, Max: &max}}
+		}, "max 0 is below min 10"},
+		{"quality frozen", func(c *RPMConfig) { c.Quality = []QualityRule{{Chancode: "MV1", Frozen: -1}} }, "must not be negative"},
+		{"watchdog relay", func(c *RPMConfig) {
+			c.Watchdog.Targets = []WatchdogTarget{{Host: "10.0.0.1", Check: CheckPing, Relay: "MV1"}}
+		}, "not the chancode of a relay"},
+		{"watchdog force", func(c *RPMConfig) {
+			c.Watchdog.Targets = []WatchdogTarget{{Host: "10.0.0.1", Check: CheckPing, Relay: "RL1", Force: true}}
+		}, "force is only for protected relays"},
+		{"notify url", func(c *RPMConfig) { c.Notify = []NotifyConfig{{Type: NotifyWebhook}} }, "requires url"},
+		{"interlock group", func(c *RPMConfig) { c.Interlock.Groups = [][]string{{"RL1"}} }, "at least 2 relays"},
+		{"schedule cron", func(c *RPMConfig) {
+			c.Schedules = []Schedule{{Name: "reboot", Cron: "0 3 * *", Relay: "RL1", Action: "cycle"}}
+		}, "must have 5 fields"},
+		{"schedule state", func(c *RPMConfig) {
+			c.Schedules = []Schedule{{Name: "window", Cron: "0 3 * * sun", Relay: "RL1", Action: "set"}}
+		}, "requires state"},
+		{"schedule force", func(c *RPMConfig) {
+			c.Schedules = []Schedule{{Name: "reboot", Cron: "0 3 * * sun", Relay: "RL1", Action: "cycle", Force: true}}
+		}, "force is only for protected relays"},
+		{"interlock protected", func(c *RPMConfig) { c.Interlock.Protected = []string{"RL9"} }, "not the chancode of a relay"},
+		{"firmwareoid", func(c *RPMConfig) { c.Oids.Firmwareoid = "1.3.6.1.4.1.45621.2.1.2.0" }, "not a static oid"},
+		{"firmware pattern", func(c *RPMConfig) { c.Oids.Firmware = []string{"1.[0-"} }, "invalid firmware pattern"},
+		{"engineid", func(c *RPMConfig) { c.SNMP.V3.Engineid = "80001f88zz" }, "invalid engineid"},
+		{"snmp version", func(c *RPMConfig) { c.SNMP.Version = "4" }, `invalid snmp version "4"`},
+		{"snmp writeversion", func(c *RPMConfig) { c.SNMP.Writeversion = "v3" }, `invalid snmp writeversion "v3"`},
+		{"snmp transport", func(c *RPMConfig) { c.SNMP.Transport = "udp9" }, `invalid snmp transport "udp9"`},
+		{"snmp poll transport", func(c *RPMConfig) { c.SNMP.Poll.Transport = "sctp" }, `invalid snmp transport "sctp"`},
+		{"snmp level", func(c *RPMConfig) { c.SNMP.V3.Level = "authpriv-typo" }, `invalid snmp level "authpriv-typo"`},
+		{"snmp writelevel", func(c *RPMConfig) { c.SNMP.V3.Writelevel = "priv" }, `invalid snmp writelevel "priv"`},
+		{"snmp authprotocol", func(c *RPMConfig) { c.SNMP.V3.Authprotocol = "MD5" }, `invalid snmp authprotocol "MD5"`},
+		{"snmp privprotocol", func(c *RPMConfig) { c.SNMP.V3.Privprotocol = "DES" }, `invalid snmp privprotocol "DES"`},
+		{"device snmp level", func(c *RPMConfig) {
+			c.Devices = []Device{{Name: "vault1", Host: "10.0.0.5", SNMP: deviceSNMP{V3: snmpV3Config{Level: "authpriv-typo"}}}}
+		}, `device vault1: invalid snmp level "authpriv-typo"`},
+		{"device snmp transport", func(c *RPMConfig) {
+			c.Devices = []Device{{Name: "vault1", Host: "10.0.0.5", SNMP: deviceSNMP{Transport: "udp9"}}}
+		}, `device vault1: invalid snmp transport "udp9"`},
+		{"device host", func(c *RPMConfig) { c.Devices = []Device{{Name: "vault1"}} }, "requires a host"},
+		{"device station", func(c *RPMConfig) {
+			c.Devices = []Device{{Name: "vault1", Host: "10.0.0.5"}, {Name: "vault2", Host: "10.0.0.6"}}
+		}, "both station II.VALT.25"},
+	}
+
+	for _, tt := range tests {
+		rpmCfg := validConfig()
+		tt.modify(rpmCfg)
+		got := problems(t, rpmCfg)
+		if len(got) != 1 || !strings.Contains(got[0].Msg, tt.want) {
+			t.Errorf("%s: problems %v, want one containing %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateDeviceOids(t *testing.T) {
+
+	// every device has its own oids, there are none at the top level
+	rpmCfg := validConfig()
+	deviceOids := rpmCfg.Oids
+	deviceOids.Relays = append(deviceOids.Relays, OidInfo{Oid: "1.3.6.1.4.1.45621.2.2.2.0", Chancode: "RL2", Label: "Relay 2"})
+	rpmCfg.Oids = TyconOids{}
+	rpmCfg.Devices = []Device{
+		{Name: "vault1", Host: "10.0.0.5", Sta: "VAL1", Oids: deviceOids},
+		{Name: "vault2", Host: "10.0.0.6", Sta: "VAL2", Oids: deviceOids},
+	}
+	rpmCfg.Alarms = []AlarmRule{{Chancode: "MV1"}}
+	rpmCfg.Interlock.Groups = [][]string{{"RL1", "RL2"}}
+	if got := problems(t, rpmCfg); len(got) != 0 {
+		t.Fatalf("problems %v, want none without top level oids", got)
+	}
+
+	// relays of the interlock and watchdog must be relays of each device
+	rpmCfg.Devices[1].Oids.Relays = rpmCfg.Devices[1].Oids.Relays[:1]
+	rpmCfg.Watchdog.Targets = []WatchdogTarget{{Name: "nrts-2", Host: "10.0.0.2", Check: CheckPing, Relay: "RL2"}}
+	got := problems(t, rpmCfg)
+	want := []string{
+		`device vault2: watchdog target nrts-2: relay "RL2" is not the chancode of a relay`,
+		`device vault2: interlock group [RL1 RL2]: "RL2" is not the chancode of a relay`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("problems %v, want %q", got, want)
+	}
+	for i := range want {
+		if got[i].Msg != want[i] {
+			t.Errorf("problem %q, want %q", got[i].Msg, want[i])
+		}
+	}
+
+	// a device without its own oids needs the top level relays
+	rpmCfg.Devices[1].Oids = TyconOids{}
+	if got := problems(t, rpmCfg); len(got) == 0 || !strings.Contains(got[0].Msg, "no relays configured") {
+		t.Errorf("problems %v, want no relays configured", got)
+	}
+}
+
+func TestDeviceConfig(t *testing.T) {
+
+	rpmCfg := validConfig()
+	rpmCfg.SNMP.Readcommunity = "public"
+	rpmCfg.SNMP.Timeout = 5 * time.Second
+	loc := ""
+	retries := 2
+	d := Device{Name: "vault2", Host: "10.0.0.6", Loc: &loc, SNMP: deviceSNMP{Readcommunity: "vault", Retries: &retries}}
+	rpmCfg.Devices = []Device{d}
+
+	dc := rpmCfg.DeviceConfig(d)
+	if dc.General != (generalConfig{Net: "II", Sta: "VALT", Loc: ""}) {
+		t.Errorf("station %+v, want II.VALT with an empty location", dc.General)
+	}
+	if dc.SNMP.Readcommunity != "vault" || dc.SNMP.Retries != 2 || dc.SNMP.Timeout != 5*time.Second {
+		t.Errorf("snmp %+v, want the vault community and retries with the top level timeout", dc.SNMP)
+	}
+	if len(dc.Oids.Relays) != 1 || len(dc.Devices) != 0 {
+		t.Errorf("device config has oids %+v and devices %+v, want the top level oids and no devices", dc.Oids, dc.Devices)
+	}
+	if rpmCfg.General.Loc != "25" || rpmCfg.SNMP.Readcommunity != "public" {
+		t.Error("DeviceConfig changed the top level config")
+	}
+}
+
+func TestValidateAllProblemsWithLines(t *testing.T) {
+
+	content := `[general]
+sta = "VALT"
+net = "IIX"
+loc = "25"
+
+[oids]
+relays = [
+    { oid = "1.3.6.1.4.1.45621.2.2.1.0", chancode = "RL1", label = "Relay 1" },
+]
+voltages = [
+    { oid = "1.3.6.1.4.1.45621.2.2.5.0", chancode = "MV1", label = "Battery" },
+    { oid = "1.3.6.1.4.1.45621.2.2.5.0", chancode = "MV", label = "Battery again" },
+]
+`
+	dir, err := ioutil.TempDir("", "rpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfgFile := filepath.Join(dir, "rpm.toml")
+	if err := ioutil.WriteFile(cfgFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rpmCfg := validConfig()
+	rpmCfg.CfgFile = cfgFile
+	rpmCfg.General.Net = "IIX"
+	rpmCfg.Oids.Voltages = append(rpmCfg.Oids.Voltages,
+		OidInfo{Oid: "1.3.6.1.4.1.45621.2.2.5.0", Chancode: "MV", Label: "Battery again"})
+
+	got := problems(t, rpmCfg)
+	wantLines := []int{3, 12, 12}
+	if len(got) != len(wantLines) {
+		t.Fatalf("problems %v, want %d", got, len(wantLines))
+	}
+	for i, p := range got {
+		if p.Line != wantLines[i] {
+			t.Errorf("problem %q at line %d, want %d", p.Msg, p.Line, wantLines[i])
+		}
+	}
+	if msg := rpmCfg.Validate().Error(); !strings.Contains(msg, cfgFile+":12: ") {
+		t.Errorf("error message %q has no file:line context", msg)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+
+	content := `[general]
+sta = "VALT"
+net = "II"
+loc = "25"
+
+[oids]
+static = [
+    { oid = "1.3.6.1.4.1.45621.2.1.1.0", label = "Product Name" },
+]
+relays = [
+    { oid = "1.3.6.1.4.1.45621.2.2.1.0", chancode = "RL1", label = "Relay 1" },
+]
+voltages = [
+    { oid = "1.3.6.1.4.1.45621.2.2.5.0", chancde = "MV1", lable = "Battery" },
+]
+
+[notfy]
+kind = "email"
+`
+	cfgFile := filepath.Join(t.TempDir(), "rpm.toml")
+	if err := ioutil.WriteFile(cfgFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.SetConfigFile(cfgFile)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	rpmCfg := NewConfig()
+	if err := rpmCfg.Unmarshal(v); err != nil {
+		t.Fatal(err)
+	}
+	rpmCfg.CfgFile = cfgFile
+
+	want := []Problem{
+		{17, "unknown setting notfy"},
+		{14, "unknown setting oids.voltages[0].chancde"},
+		{14, "unknown setting oids.voltages[0].lable"},
+	}
+	got := problems(t, rpmCfg)
+	if len(got) < len(want) {
+		t.Fatalf("problems %v, want %v first", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("problem %d %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestApplyDefaultsScaling(t *testing.T) {
+
+	rpmCfg := validConfig()
+	precision := 2
+	rpmCfg.Oids.Currents = []OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.9.0", Chancode: "MC1", Scale: 0.05, Offset: -2.5, Units: "A", Precision: &precision},
+	}
+	rpmCfg.ApplyDefaults()
+
+	if got := rpmCfg.Oids.Voltages[0].FormatValue("132"); got != "13.2" {
+		t.Errorf("default voltage FormatValue(132) = %s, want 13.2", got)
+	}
+	if got := rpmCfg.Oids.Voltages[0].Units; got != "volts" {
+		t.Errorf("default voltage units %s, want volts", got)
+	}
+	if got := rpmCfg.Oids.Currents[0].FormatValue("100"); got != "2.50" {
+		t.Errorf("configured current FormatValue(100) = %s, want 2.50", got)
+	}
+	if got := rpmCfg.Oids.Relays[0].FormatValue("1"); got != "1" {
+		t.Errorf("relay FormatValue(1) = %s, want 1", got)
+	}
+	if got := rpmCfg.Oids.Currents[0].FormatValue("n/a"); got != "n/a" {
+		t.Errorf("FormatValue(n/a) = %s, want n/a unchanged", got)
+	}
+}
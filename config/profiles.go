@@ -0,0 +1,272 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultProfilesDir is the directory of OID profile files, relative to the
+// nrts home directory
+const DefaultProfilesDir string = "etc/rpm-profiles"
+
+// profileExt is the extension of a profile file, named by the profile
+const profileExt = ".toml"
+
+// profilesConfig settings of the OID profiles. A profile file in Dir,
+// <name>.toml with an [oids] section, takes precedence over the built-in
+// profile of the same name
+type profilesConfig struct {
+	Dir string
+}
+
+// tpdin2Oids is the [oids] section of the TPDin2 profiles, firmware 1.x
+// and 2.x serve the same OIDs
+const tpdin2Oids = `
+static = [
+    { oid = "1.3.6.1.4.1.45621.2.1.1.0", chancode = "", label = "Product Name" },
+    { oid = "1.3.6.1.4.1.45621.2.1.2.0", chancode = "", label = "Product FW Ver" },
+    { oid = "1.3.6.1.4.1.45621.2.1.3.0", chancode = "", label = "Product FW Date" },
+]
+tests = [
+    { oid = "1.3.6.1.2.1.1.3.0", chancode = "TS1", label = "Test OID #1" },
+    { oid = "1.3.6.1.2.1.1.4.0", chancode = "TS2", label = "Test OID #2" },
+]
+relays = [
+    { oid = "1.3.6.1.4.1.45621.2.2.1.0", chancode = "RL1", label = "Relay 1" },
+    { oid = "1.3.6.1.4.1.45621.2.2.2.0", chancode = "RL2", label = "Relay 2" },
+    { oid = "1.3.6.1.4.1.45621.2.2.3.0", chancode = "RL3", label = "Relay 3" },
+    { oid = "1.3.6.1.4.1.45621.2.2.4.0", chancode = "RL4", label = "Relay 4" },
+]
+voltages = [
+    { oid = "1.3.6.1.4.1.45621.2.2.5.0", chancode = "MV1", label = "Voltage 1" },
+    { oid = "1.3.6.1.4.1.45621.2.2.6.0", chancode = "MV2", label = "Voltage 2" },
+    { oid = "1.3.6.1.4.1.45621.2.2.7.0", chancode = "MV3", label = "Voltage 3" },
+    { oid = "1.3.6.1.4.1.45621.2.2.8.0", chancode = "MV4", label = "Voltage 4" },
+]
+currents = [
+    { oid = "1.3.6.1.4.1.45621.2.2.9.0",  chancode = "MC1", label = "Current 1" },
+    { oid = "1.3.6.1.4.1.45621.2.2.10.0", chancode = "MC2", label = "Current 2" },
+    { oid = "1.3.6.1.4.1.45621.2.2.11.0", chancode = "MC3", label = "Current 3" },
+    { oid = "1.3.6.1.4.1.45621.2.2.12.0", chancode = "MC4", label = "Current 4" },
+]
+temps = [
+    { oid = "1.3.6.1.4.1.45621.2.2.13.0", chancode = "TPE", label = "Temp (Int)" },
+    { oid = "1.3.6.1.4.1.45621.2.2.14.0", chancode = "TPI", label = "Temp (Ext)" },
+]
+`
+
+// builtinProfiles are the profiles shipped with rpm, by name
+var builtinProfiles = map[string]string{
+	"tpdin2-fw1.x": `[oids]
+firmwareoid = "1.3.6.1.4.1.45621.2.1.2.0"
+firmware = ["1.*"]
+` + tpdin2Oids,
+	"tpdin2-fw2.x": `[oids]
+firmwareoid = "1.3.6.1.4.1.45621.2.1.2.0"
+firmware = ["2.*"]
+` + tpdin2Oids,
+}
+
+// ProfileNames returns the names of the built-in profiles and of the
+// profile files in dir, sorted
+func ProfileNames(dir string) []string {
+
+	seen := make(map[string]bool)
+	for name := range builtinProfiles {
+		seen[name] = true
+	}
+	if entries, err := ioutil.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), profileExt) {
+				seen[strings.TrimSuffix(entry.Name(), profileExt)] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// LoadProfile returns the OIDs of the profile name, from its file in dir
+// or else built in
+func LoadProfile(name, dir string) (TyconOids, error) {
+
+	var toids TyconOids
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, name+profileExt))
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		builtin, ok := builtinProfiles[name]
+		if !ok {
+			return toids, fmt.Errorf("unknown oid profile %q, profiles are: %s", name, strings.Join(ProfileNames(dir), ", "))
+		}
+		content = []byte(builtin)
+	default:
+		return toids, err
+	}
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(strings.NewReader(string(content))); err != nil {
+		return toids, fmt.Errorf("oid profile %s: %w", name, err)
+	}
+	var profile struct {
+		Oids TyconOids
+	}
+	if err := v.Unmarshal(&profile); err != nil {
+		return toids, fmt.Errorf("oid profile %s: %w", name, err)
+	}
+	if profile.Oids.Profile != "" {
+		return toids, fmt.Errorf("oid profile %s: a profile can not use another profile", name)
+	}
+	if profile.Oids.empty() {
+		return toids, fmt.Errorf("oid profile %s has no oids", name)
+	}
+
+	return profile.Oids, nil
+}
+
+// ApplyProfiles replaces the [oids] of the config and of its devices that
+// name a profile with the profile's OIDs, overridden by the OIDs listed.
+// Call it once after unmarshaling, before ApplyDefaults
+func (cfg *RPMConfig) ApplyProfiles() error {
+
+	if cfg.Profiles.Dir == "" {
+		cfg.Profiles.Dir = DefaultProfilesDir
+	}
+
+	if err := cfg.Oids.applyProfile(cfg.Profiles.Dir); err != nil {
+		return err
+	}
+	for i := range cfg.Devices {
+		if err := cfg.Devices[i].Oids.applyProfile(cfg.Profiles.Dir); err != nil {
+			return fmt.Errorf("device %s: %w", cfg.Devices[i].Name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyProfile resolves the profile of toids, if any. The fields set in the
+// OIDs listed override those of the profile OID with the same oid in the
+// same category, e.g. the label or, for a station's sensors, the scale
+func (toids *TyconOids) applyProfile(dir string) error {
+
+	if toids.Profile == "" {
+		return nil
+	}
+	profile, err := LoadProfile(toids.Profile, dir)
+	if err != nil {
+		return err
+	}
+	profile.Profile = toids.Profile
+
+	categories := []struct {
+		name      string
+		overrides []OidInfo
+		oids      []OidInfo
+	}{
+		{"static", toids.Static, profile.Static},
+		{"tests", toids.Tests, profile.Tests},
+		{"relays", toids.Relays, profile.Relays},
+		{"voltages", toids.Voltages, profile.Voltages},
+		{"currents", toids.Currents, profile.Currents},
+		{"temps", toids.Temps, profile.Temps},
+	}
+	for _, category := range categories {
+		for _, over := range category.overrides {
+			i := indexOfOid(category.oids, over.Oid)
+			if i < 0 {
+				return fmt.Errorf("%s oid %s is not in oid profile %s", category.name, over.Oid, toids.Profile)
+			}
+			category.oids[i].override(over)
+		}
+	}
+	if len(toids.Firmware) > 0 || toids.Firmwareoid != "" {
+		return fmt.Errorf("firmware and firmwareoid are set by oid profile %s", toids.Profile)
+	}
+	*toids = profile
+
+	return nil
+}
+
+// override sets the fields that are set in over
+func (info *OidInfo) override(over OidInfo) {
+
+	if over.Chancode != "" {
+		info.Chancode = over.Chancode
+	}
+	if over.Label != "" {
+		info.Label = over.Label
+	}
+	if over.Function != "" {
+		info.Function = over.Function
+	}
+	if over.Scale != 0 {
+		info.Scale = over.Scale
+	}
+	if over.Offset != 0 {
+		info.Offset = over.Offset
+	}
+	if over.Units != "" {
+		info.Units = over.Units
+	}
+	if over.Precision != nil {
+		info.Precision = over.Precision
+	}
+	if over.Confirm != "" {
+		info.Confirm = over.Confirm
+	}
+	if over.Cycletimeoid != "" {
+		info.Cycletimeoid = over.Cycletimeoid
+	}
+}
+
+// indexOfOid returns the index of the OID oid in oids, or -1
+func indexOfOid(oids []OidInfo, oid string) int {
+	for i := range oids {
+		if oids[i].Oid == oid {
+			return i
+		}
+	}
+	return -1
+}
+
+// FirmwareMismatch returns a warning if the firmware version in the static
+// results is not one the OIDs are for, or "" if it is or nothing is known
+func (toids TyconOids) FirmwareMismatch(results map[string]string) string {
+
+	if toids.Firmwareoid == "" || len(toids.Firmware) == 0 {
+		return ""
+	}
+	version, ok := results[toids.Firmwareoid]
+	if !ok {
+		return ""
+	}
+	for _, pattern := range toids.Firmware {
+		if match, _ := path.Match(pattern, version); match {
+			return ""
+		}
+	}
+
+	oidsOf := "the [oids]"
+	if toids.Profile != "" {
+		oidsOf = "oid profile " + toids.Profile
+	}
+
+	return fmt.Sprintf("firmware version %q does not match %s (firmware %s), values may be wrong",
+		version, oidsOf, strings.Join(toids.Firmware, ", "))
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestApplyProfiles(t *testing.T) {
+
+	rpmCfg := NewConfig()
+	rpmCfg.General = generalConfig{Sta: "VALT", Net: "II", Loc: "25"}
+	rpmCfg.Profiles.Dir = filepath.Join("testdata", "none")
+	rpmCfg.Oids = TyconOids{
+		Profile: "tpdin2-fw1.x",
+		Relays:  []OidInfo{{Oid: "1.3.6.1.4.1.45621.2.2.2.0", Label: "CPU-2", Confirm: ConfirmNever}},
+		Temps:   []OidInfo{{Oid: "1.3.6.1.4.1.45621.2.2.14.0", Chancode: "TPV"}},
+	}
+	rpmCfg.Devices = []Device{{Name: "vault2", Host: "10.0.0.6", Sta: "VAL2", Oids: TyconOids{Profile: "tpdin2-fw2.x"}}}
+	if err := rpmCfg.ApplyProfiles(); err != nil {
+		t.Fatal(err)
+	}
+	rpmCfg.ApplyDefaults()
+
+	oids := rpmCfg.Oids
+	if len(oids.Relays) != 4 || len(oids.Voltages) != 4 || len(oids.Static) != 3 {
+		t.Fatalf("oids %+v, want those of the profile", oids)
+	}
+	relay := oids.Relays[1]
+	if relay.Label != "CPU-2" || relay.Chancode != "RL2" || relay.Confirm != ConfirmNever {
+		t.Errorf("relay %+v, want the label and confirm overridden", relay)
+	}
+	if oids.Relays[0].Label != "Relay 1" || oids.Temps[1].Chancode != "TPV" || oids.Temps[1].Label != "Temp (Ext)" {
+		t.Errorf("relay %+v and temp %+v, want only the fields set overridden", oids.Relays[0], oids.Temps[1])
+	}
+	if oids.Voltages[0].Units != "volts" {
+		t.Errorf("voltage units %q, want the defaults applied", oids.Voltages[0].Units)
+	}
+	if dc := rpmCfg.DeviceConfig(rpmCfg.Devices[0]); dc.Oids.Profile != "tpdin2-fw2.x" || dc.Oids.Relays[1].Label != "Relay 2" {
+		t.Errorf("device oids %+v, want its own profile", dc.Oids)
+	}
+	if err := rpmCfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+}
+
+func TestApplyProfilesStation(t *testing.T) {
+
+	content := `[oids]
+profile = "tpdin2-fw1.x"
+relays = [
+    { oid = "1.3.6.1.4.1.45621.2.2.1.0", label = "12V PWR to Primary", cycletimeoid = "1.3.6.1.4.1.45621.2.3.1.0" },
+]
+currents = [
+    { oid = "1.3.6.1.4.1.45621.2.2.12.0", chancode = "MC4", label = "Shunt Current", scale = 0.05, offset = -2.5, units = "amps", precision = 2 },
+]
+`
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	rpmCfg := validConfig()
+	rpmCfg.Oids = TyconOids{}
+	if err := rpmCfg.Unmarshal(v); err != nil {
+		t.Fatal(err)
+	}
+	rpmCfg.Profiles.Dir = filepath.Join("testdata", "none")
+	if err := rpmCfg.ApplyProfiles(); err != nil {
+		t.Fatal(err)
+	}
+	rpmCfg.ApplyDefaults()
+
+	shunt := rpmCfg.Oids.Currents[3]
+	if shunt.Scale != 0.05 || shunt.Offset != -2.5 || shunt.Units != "amps" || shunt.Precision == nil || *shunt.Precision != 2 {
+		t.Errorf("current %+v, want the station's scaling", shunt)
+	}
+	if value := shunt.FormatValue("100"); value != "2.50" {
+		t.Errorf("shunt value %s, want 2.50", value)
+	}
+	if current := rpmCfg.Oids.Currents[0]; current.Scale != 0.1 || current.Label != "Current 1" {
+		t.Errorf("current %+v, want the profile's with the defaults", current)
+	}
+	if relay := rpmCfg.Oids.Relays[0]; relay.Cycletimeoid != "1.3.6.1.4.1.45621.2.3.1.0" || relay.Chancode != "RL1" {
+		t.Errorf("relay %+v, want the cycletimeoid overridden", relay)
+	}
+	if err := rpmCfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+}
+
+func TestApplyProfilesProblems(t *testing.T) {
+
+	tests := []struct {
+		name string
+		oids TyconOids
+		want string
+	}{
+		{"unknown profile", TyconOids{Profile: "tpdin9"}, "unknown oid profile"},
+		{"oid not in profile", TyconOids{Profile: "tpdin2-fw1.x",
+			Voltages: []OidInfo{{Oid: "1.3.6.1.4.1.45621.2.2.9.0", Label: "Battery"}}}, "not in oid profile"},
+		{"firmware set", TyconOids{Profile: "tpdin2-fw1.x", Firmware: []string{"3.*"}}, "set by oid profile"},
+	}
+
+	for _, tt := range tests {
+		rpmCfg := NewConfig()
+		rpmCfg.Oids = tt.oids
+		err := rpmCfg.ApplyProfiles()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: ApplyProfiles() = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestProfileDir(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := `[oids]
+firmwareoid = "1.3.6.1.4.1.45621.2.1.2.0"
+firmware = ["1.4*"]
+static = [
+    { oid = "1.3.6.1.4.1.45621.2.1.2.0", label = "Product FW Ver" },
+]
+relays = [
+    { oid = "1.3.6.1.4.1.45621.2.2.1.0", chancode = "RL1", label = "Relay 1" },
+]
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "tpdin2-fw1.x.toml"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	toids, err := LoadProfile("tpdin2-fw1.x", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toids.Relays) != 1 || len(toids.Firmware) != 1 || toids.Firmware[0] != "1.4*" {
+		t.Errorf("profile oids %+v, want those of the file", toids)
+	}
+	if names := ProfileNames(dir); strings.Join(names, " ") != "tpdin2-fw1.x tpdin2-fw2.x" {
+		t.Errorf("profile names %v, want the built-in profiles once", names)
+	}
+}
+
+func TestFirmwareMismatch(t *testing.T) {
+
+	toids, err := LoadProfile("tpdin2-fw2.x", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	toids.Profile = "tpdin2-fw2.x"
+
+	if warning := toids.FirmwareMismatch(map[string]string{toids.Firmwareoid: "2.1"}); warning != "" {
+		t.Errorf("firmware 2.1 warning %q, want none", warning)
+	}
+	warning := toids.FirmwareMismatch(map[string]string{toids.Firmwareoid: "1.4"})
+	if !strings.Contains(warning, `"1.4" does not match oid profile tpdin2-fw2.x`) {
+		t.Errorf("firmware 1.4 warning %q, want a mismatch", warning)
+	}
+	if warning := toids.FirmwareMismatch(map[string]string{}); warning != "" {
+		t.Errorf("warning %q without a firmware version, want none", warning)
+	}
+}
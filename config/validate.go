@@ -0,0 +1,680 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+	"rpm/cron"
+	"strings"
+	"time"
+)
+
+var (
+	netCodeRe  = regexp.MustCompile(`^[A-Z0-9]{1,2}$`)
+	staCodeRe  = regexp.MustCompile(`^[A-Z0-9]{1,5}$`)
+	locCodeRe  = regexp.MustCompile(`^[A-Z0-9]{0,2}$`)
+	chanCodeRe = regexp.MustCompile(`^[A-Z0-9]{3}$`)
+	oidRe      = regexp.MustCompile(`^[0-9]+(\.[0-9]+)+$`)
+)
+
+// SNMP settings accepted by tycon, the levels and protocols in any case
+var (
+	snmpVersions      = []string{"2c", "3"}
+	snmpTransports    = []string{"udp", "udp4", "udp6", "tcp", "tcp4", "tcp6"}
+	snmpLevels        = []string{"noAuthNoPriv", "authNoPriv", "authPriv"}
+	snmpAuthProtocols = []string{"SHA", "SHA-224", "SHA-256", "SHA-384", "SHA-512"}
+	snmpPrivProtocols = []string{"AES", "AES-192", "AES-256"}
+)
+
+// Problem is a single config error; Line is 0 if it could not be located in the file
+type Problem struct {
+	Line int
+	Msg  string
+}
+
+// ValidationError holds all the problems found by Validate
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+func (verr *ValidationError) Error() string {
+
+	lines := make([]string, 0, len(verr.Problems)+1)
+	lines = append(lines, fmt.Sprintf("%d problem(s) in config file %s", len(verr.Problems), verr.File))
+	for _, p := range verr.Problems {
+		if p.Line > 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s", verr.File, p.Line, p.Msg))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: %s", verr.File, p.Msg))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// validator collects problems, locating them in the lines of the config file
+type validator struct {
+	lines    []string
+	problems []Problem
+}
+
+// addf adds a problem located at the first line containing all of the
+// values in near, e.g. an oid or a key and its value
+func (v *validator) addf(near []string, format string, args ...interface{}) {
+	v.addNthf(near, 0, format, args...)
+}
+
+// addNthf adds a problem located at the nth (from 0) line containing all of the values in near
+func (v *validator) addNthf(near []string, nth int, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{v.lineOf(near, nth), fmt.Sprintf(format, args...)})
+}
+
+// lineOf returns the 1-based number of the nth line containing all of terms, or 0
+func (v *validator) lineOf(terms []string, nth int) int {
+
+	if len(terms) == 0 {
+		return 0
+	}
+	for i, line := range v.lines {
+		found := true
+		for _, term := range terms {
+			if !strings.Contains(line, term) {
+				found = false
+				break
+			}
+		}
+		if found {
+			if nth == 0 {
+				return i + 1
+			}
+			nth--
+		}
+	}
+
+	return 0
+}
+
+// quoted returns val as it appears as a TOML string
+func quoted(val string) string {
+	return `"` + val + `"`
+}
+
+// checkUnknown reports the keys that are not settings, e.g. oids.voltages[0].lable,
+// located at the first line setting the key, or its table
+func (v *validator) checkUnknown(keys []string) {
+
+	for _, key := range keys {
+		name := key[strings.LastIndex(key, ".")+1:]
+		v.problems = append(v.problems, Problem{v.lineOfKey(name), fmt.Sprintf("unknown setting %s", key)})
+	}
+}
+
+// lineOfKey returns the 1-based number of the first line that sets the key
+// name, also in an inline table, or is the header of a table name, or 0
+func (v *validator) lineOfKey(name string) int {
+
+	keyRe := regexp.MustCompile(`(^|[{,]\s*)` + regexp.QuoteMeta(name) + `\s*=`)
+	for i, line := range v.lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "["):
+			table := strings.Trim(line, "[] ")
+			if table == name || strings.HasSuffix(table, "."+name) {
+				return i + 1
+			}
+		case keyRe.MatchString(line):
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+func (v *validator) checkStation(g generalConfig) {
+
+	if !netCodeRe.MatchString(g.Net) {
+		v.addf([]string{"net", quoted(g.Net)}, "invalid network code %q: must be 1-2 upper case letters or digits", g.Net)
+	}
+	if !staCodeRe.MatchString(g.Sta) {
+		v.addf([]string{"sta", quoted(g.Sta)}, "invalid station code %q: must be 1-5 upper case letters or digits", g.Sta)
+	}
+	if !locCodeRe.MatchString(g.Loc) {
+		v.addf([]string{"loc", quoted(g.Loc)}, "invalid location code %q: must be 0-2 upper case letters or digits", g.Loc)
+	}
+}
+
+// checkOids checks the OIDs of toids, which must include relays if required
+func (v *validator) checkOids(toids TyconOids, required bool) {
+
+	categories := []struct {
+		name string
+		oids []OidInfo
+		data bool
+	}{
+		{"static", toids.Static, false},
+		{"tests", toids.Tests, false},
+		{"relays", toids.Relays, true},
+		{"voltages", toids.Voltages, true},
+		{"currents", toids.Currents, true},
+		{"temps", toids.Temps, true},
+	}
+
+	if required && len(toids.Relays) == 0 {
+		v.addf([]string{"relays"}, "no relays configured in [oids]")
+	}
+
+	// the nth occurrence of an oid is on the nth line containing it
+	oidCount := make(map[string]int)
+	oidSeen := make(map[string]string)
+	chanSeen := make(map[string]string)
+	for _, category := range categories {
+		for _, info := range category.oids {
+			near := []string{quoted(info.Oid)}
+			nth := oidCount[info.Oid]
+			oidCount[info.Oid]++
+			if !oidRe.MatchString(info.Oid) {
+				v.addNthf(near, nth, "invalid oid %q in %s: must be dotted decimal, e.g. 1.3.6.1.4.1.45621.2.2.1.0", info.Oid, category.name)
+			} else if prev, ok := oidSeen[info.Oid]; ok {
+				v.addNthf(near, nth, "duplicate oid %s in %s, also in %s", info.Oid, category.name, prev)
+			} else {
+				oidSeen[info.Oid] = category.name
+			}
+
+			if !category.data {
+				continue
+			}
+			if !chanCodeRe.MatchString(info.Chancode) {
+				v.addNthf(near, nth, "invalid chancode %q for oid %s: must be 3 upper case letters or digits", info.Chancode, info.Oid)
+			} else if prev, ok := chanSeen[info.Chancode]; ok {
+				v.addNthf(near, nth, "duplicate chancode %s for oid %s, also used for oid %s", info.Chancode, info.Oid, prev)
+			} else {
+				chanSeen[info.Chancode] = info.Oid
+			}
+			if category.name == "relays" {
+				switch info.Confirm {
+				case "", ConfirmAlways, ConfirmNever, ConfirmTTY:
+				default:
+					v.addNthf(near, nth, "invalid confirm %q for relay %s: must be always, never or tty", info.Confirm, info.Chancode)
+				}
+				if info.Cycletimeoid != "" && !oidRe.MatchString(info.Cycletimeoid) {
+					v.addNthf(near, nth, "invalid cycletimeoid %q for relay %s: must be dotted decimal", info.Cycletimeoid, info.Chancode)
+				}
+			}
+			if info.Precision != nil && *info.Precision < 0 {
+				v.addNthf(near, nth, "invalid precision %d for oid %s: must not be negative", *info.Precision, info.Oid)
+			}
+		}
+	}
+
+	if toids.Firmwareoid != "" && indexOfOid(toids.Static, toids.Firmwareoid) < 0 {
+		v.addf([]string{"firmwareoid"}, "firmwareoid %s is not a static oid", toids.Firmwareoid)
+	}
+	for _, pattern := range toids.Firmware {
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.addf([]string{"firmware", quoted(pattern)}, "invalid firmware pattern %q: %s", pattern, err.Error())
+		}
+	}
+}
+
+func (v *validator) checkAlarms(rules []AlarmRule, toids TyconOids) {
+
+	chancodes := make(map[string]bool)
+	for _, oids := range [][]OidInfo{toids.Relays, toids.Voltages, toids.Currents, toids.Temps} {
+		for _, info := range oids {
+			chancodes[info.Chancode] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		near := []string{"chancode", quoted(rule.Chancode)}
+		if !chancodes[rule.Chancode] {
+			v.addf(near, "alarm rule for unknown chancode %q", rule.Chancode)
+		}
+		if seen[rule.Chancode] {
+			v.addf(near, "duplicate alarm rule for chancode %s", rule.Chancode)
+		}
+		seen[rule.Chancode] = true
+
+		// limits must increase from lowcrit to highcrit
+		var prev *float64
+		prevName := ""
+		limits := []struct {
+			name string
+			val  *float64
+		}{
+			{"lowcrit", rule.Lowcrit},
+			{"lowwarn", rule.Lowwarn},
+			{"highwarn", rule.Highwarn},
+			{"highcrit", rule.Highcrit},
+		}
+		for _, limit := range limits {
+			if limit.val == nil {
+				continue
+			}
+			if prev != nil && *limit.val < *prev {
+				v.addf(near, "alarm rule for %s: %s %g is below %s %g", rule.Chancode, limit.name, *limit.val, prevName, *prev)
+			}
+			prev, prevName = limit.val, limit.name
+		}
+		if rule.Hysteresis < 0 || rule.Duration < 0 || rule.Stale < 0 {
+			v.addf(near, "alarm rule for %s: hysteresis, duration and stale must not be negative", rule.Chancode)
+		}
+	}
+}
+
+func (v *validator) checkQuality(rules []QualityRule, toids TyconOids) {
+
+	categories := map[string][]OidInfo{
+		"relays":   toids.Relays,
+		"voltages": toids.Voltages,
+		"currents": toids.Currents,
+		"temps":    toids.Temps,
+	}
+	chancodes := make(map[string]bool)
+	for _, oids := range categories {
+		for _, info := range oids {
+			chancodes[info.Chancode] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		name := rule.Chancode
+		near := []string{"chancode", quoted(rule.Chancode)}
+		switch {
+		case rule.Chancode != "" && rule.Category != "":
+			v.addf(near, "quality rule for %s: set chancode or category, not both", rule.Chancode)
+		case rule.Chancode != "":
+			if !chancodes[rule.Chancode] {
+				v.addf(near, "quality rule for unknown chancode %q", rule.Chancode)
+			}
+		case rule.Category != "":
+			name = rule.Category
+			near = []string{"category", quoted(rule.Category)}
+			if _, ok := categories[rule.Category]; !ok {
+				v.addf(near, "quality rule for invalid category %q: must be relays, voltages, currents or temps", rule.Category)
+			}
+		default:
+			v.addf([]string{"[[quality]]"}, "quality rule requires a chancode or category")
+			continue
+		}
+		if seen[name] {
+			v.addf(near, "duplicate quality rule for %s", name)
+		}
+		seen[name] = true
+
+		if rule.Min != nil && rule.Max != nil && *rule.Max < *rule.Min {
+			v.addf(near, "quality rule for %s: max %g is below min %g", name, *rule.Max, *rule.Min)
+		}
+		if rule.Step < 0 || rule.Epsilon < 0 || rule.Frozen < 0 {
+			v.addf(near, "quality rule for %s: step, epsilon and frozen must not be negative", name)
+		}
+	}
+}
+
+func (v *validator) checkNotify(sinks []NotifyConfig) {
+
+	for i, sink := range sinks {
+		near := []string{"type", quoted(sink.Type)}
+		nth := 0
+		for _, prev := range sinks[:i] {
+			if prev.Type == sink.Type {
+				nth++
+			}
+		}
+		name := sink.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		switch sink.Type {
+		case NotifyEmail:
+			if sink.Smtp == "" || sink.From == "" || len(sink.To) == 0 {
+				v.addNthf(near, nth, "email notifier %s requires smtp, from and to", name)
+			}
+		case NotifyWebhook:
+			if sink.Url == "" {
+				v.addNthf(near, nth, "webhook notifier %s requires url", name)
+			}
+		case NotifyExec:
+			if sink.Command == "" {
+				v.addNthf(near, nth, "exec notifier %s requires command", name)
+			}
+		default:
+			v.addNthf(near, nth, "invalid notifier type %q for %s: must be email, webhook or exec", sink.Type, name)
+		}
+		if sink.Ratelimit < 0 || sink.Retries < 0 || sink.Timeout < 0 || sink.Backoff < 0 || sink.Rateperiod < 0 {
+			v.addNthf(near, nth, "notifier %s: ratelimit, rateperiod, retries, timeout and backoff must not be negative", name)
+		}
+	}
+}
+
+// relaySet are the relay chancodes of the [oids] of a device, or of the
+// top level if device is empty
+type relaySet struct {
+	device string
+	relays map[string]bool
+}
+
+// prefix of the problems with the relays of the set
+func (rs relaySet) prefix() string {
+	if rs.device == "" {
+		return ""
+	}
+	return "device " + rs.device + ": "
+}
+
+// relaySets returns the relays of the top level [oids], if top, and of
+// each device with its own [devices.oids]
+func relaySets(cfg RPMConfig, top bool) []relaySet {
+
+	var sets []relaySet
+	add := func(device string, toids TyconOids) {
+		rs := relaySet{device, make(map[string]bool)}
+		for _, info := range toids.Relays {
+			rs.relays[info.Chancode] = true
+		}
+		sets = append(sets, rs)
+	}
+	if top {
+		add("", cfg.Oids)
+	}
+	for i, d := range cfg.Devices {
+		if d.Oids.empty() {
+			continue
+		}
+		name := d.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		add(name, d.Oids)
+	}
+
+	return sets
+}
+
+func (v *validator) checkWatchdog(wd watchdogConfig, sets []relaySet, protected []string) {
+
+	if wd.Failures < 0 || wd.Maxperday < 0 || wd.Interval < 0 || wd.Cooldown < 0 {
+		v.addf([]string{"[watchdog]"}, "watchdog interval, failures, cooldown and maxperday must not be negative")
+	}
+	isProtected := make(map[string]bool)
+	for _, relay := range protected {
+		isProtected[relay] = true
+	}
+	for i, target := range wd.Targets {
+		near := []string{"host", quoted(target.Host)}
+		name := target.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if target.Host == "" {
+			v.addf([]string{"[[watchdog.targets]]"}, "watchdog target %s requires host", name)
+		}
+		for _, rs := range sets {
+			if !rs.relays[target.Relay] {
+				v.addf(near, "%swatchdog target %s: relay %q is not the chancode of a relay", rs.prefix(), name, target.Relay)
+			}
+		}
+		switch target.Check {
+		case CheckPing:
+		case CheckTCP:
+			if target.Port <= 0 || target.Port > 65535 {
+				v.addf(near, "watchdog target %s: tcp check requires a port", name)
+			}
+		default:
+			v.addf(near, "watchdog target %s: invalid check %q, must be ping or tcp", name, target.Check)
+		}
+		if target.Force && !isProtected[target.Relay] {
+			v.addf(near, "watchdog target %s: force is only for protected relays, relay %q is not in [interlock] protected", name, target.Relay)
+		}
+	}
+}
+
+func (v *validator) checkRelay(r relayConfig) {
+	if r.Cycletime < 0 || r.Cycletimeout < 0 || r.Pollinterval < 0 {
+		v.addf([]string{"[relay]"}, "relay cycletime, cycletimeout and pollinterval must not be negative")
+	}
+}
+
+func (v *validator) checkBuffer(b bufferConfig) {
+	if b.Records < 0 || b.Segments < 0 {
+		v.addf([]string{"[buffer]"}, "buffer records and segments must not be negative")
+	}
+}
+
+func (v *validator) checkInterlock(il interlockConfig, sets []relaySet) {
+
+	for _, h := range il.Hosts {
+		near := []string{"relay", quoted(h.Relay)}
+		for _, rs := range sets {
+			if !rs.relays[h.Relay] {
+				v.addf(near, "%sinterlock hosts: relay %q is not the chancode of a relay", rs.prefix(), h.Relay)
+			}
+		}
+		if len(h.Hosts) == 0 {
+			v.addf(near, "interlock hosts for relay %s: no hosts listed, use \"*\" for any host", h.Relay)
+		}
+	}
+	for _, group := range il.Groups {
+		if len(group) < 2 {
+			v.addf([]string{"groups"}, "interlock group %v: must have at least 2 relays", group)
+		}
+		for _, chancode := range group {
+			for _, rs := range sets {
+				if !rs.relays[chancode] {
+					v.addf([]string{"groups"}, "%sinterlock group %v: %q is not the chancode of a relay", rs.prefix(), group, chancode)
+				}
+			}
+		}
+	}
+	for _, chancode := range il.Protected {
+		for _, rs := range sets {
+			if !rs.relays[chancode] {
+				v.addf([]string{"protected"}, "%sinterlock protected: %q is not the chancode of a relay", rs.prefix(), chancode)
+			}
+		}
+	}
+}
+
+func (v *validator) checkSchedules(schedules []Schedule, toids TyconOids, devices []Device, protected []string) {
+
+	relays := make(map[string]map[string]bool)
+	relays[""] = make(map[string]bool)
+	for _, info := range toids.Relays {
+		relays[""][info.Chancode] = true
+	}
+	for _, d := range devices {
+		relays[d.Name] = relays[""]
+		if !d.Oids.empty() {
+			relays[d.Name] = make(map[string]bool)
+			for _, info := range d.Oids.Relays {
+				relays[d.Name][info.Chancode] = true
+			}
+		}
+	}
+
+	isProtected := make(map[string]bool)
+	for _, relay := range protected {
+		isProtected[relay] = true
+	}
+
+	names := make(map[string]bool)
+	for i, sched := range schedules {
+		near := []string{"cron", quoted(sched.Cron)}
+		name := sched.Name
+		if name == "" {
+			v.addf(near, "schedule #%d requires a name", i+1)
+			name = fmt.Sprintf("#%d", i+1)
+		} else if names[name] {
+			v.addf([]string{"name", quoted(name)}, "duplicate schedule name %q", name)
+		}
+		names[name] = true
+
+		if _, err := cron.Parse(sched.Cron, time.UTC); err != nil {
+			v.addf(near, "schedule %s: %s", name, err.Error())
+		}
+		if _, ok := relays[sched.Device]; !ok {
+			v.addf(near, "schedule %s: device %q is not the name of a device", name, sched.Device)
+		} else if !relays[sched.Device][sched.Relay] {
+			v.addf(near, "schedule %s: relay %q is not the chancode of a relay", name, sched.Relay)
+		}
+		switch sched.Action {
+		case "set":
+			if sched.State != "open" && sched.State != "closed" {
+				v.addf(near, "schedule %s: set requires state open or closed", name)
+			}
+		case "cycle":
+			if sched.State != "" || sched.Duration != 0 {
+				v.addf(near, "schedule %s: cycle takes no state or duration", name)
+			}
+		default:
+			v.addf(near, "schedule %s: invalid action %q, must be set or cycle", name, sched.Action)
+		}
+		if sched.Duration < 0 || sched.Catchup < 0 {
+			v.addf(near, "schedule %s: duration and catchup must not be negative", name)
+		}
+		if sched.Force && !isProtected[sched.Relay] {
+			v.addf(near, "schedule %s: force is only for protected relays, relay %q is not in [interlock] protected", name, sched.Relay)
+		}
+	}
+}
+
+// checkSNMP checks the SNMP versions, transports and v3 settings that are
+// set, name prefixes the problems
+func (v *validator) checkSNMP(version, writeversion string, transports []string, v3 snmpV3Config, name string) {
+
+	v.checkSNMPValue("version", version, snmpVersions, false, name)
+	v.checkSNMPValue("writeversion", writeversion, snmpVersions, false, name)
+	for _, transport := range transports {
+		v.checkSNMPValue("transport", transport, snmpTransports, false, name)
+	}
+	v.checkSNMPValue("level", v3.Level, snmpLevels, true, name)
+	v.checkSNMPValue("writelevel", v3.Writelevel, snmpLevels, true, name)
+	v.checkSNMPValue("authprotocol", v3.Authprotocol, snmpAuthProtocols, true, name)
+	v.checkSNMPValue("privprotocol", v3.Privprotocol, snmpPrivProtocols, true, name)
+	v.checkEngineID(v3.Engineid, name)
+}
+
+// checkSNMPValue checks that the SNMP setting key, if set, is one of values,
+// compared without case if fold
+func (v *validator) checkSNMPValue(key, value string, values []string, fold bool, name string) {
+
+	if value == "" {
+		return
+	}
+	for _, valid := range values {
+		if value == valid || fold && strings.EqualFold(value, valid) {
+			return
+		}
+	}
+	v.addf([]string{key, quoted(value)}, "%sinvalid snmp %s %q, must be one of %s", name, key, value, strings.Join(values, ", "))
+}
+
+// checkEngineID checks an SNMPv3 engine ID, if set
+func (v *validator) checkEngineID(engineID, name string) {
+
+	if engineID == "" {
+		return
+	}
+	if id, err := hex.DecodeString(strings.TrimPrefix(engineID, "0x")); err != nil || len(id) < 5 || len(id) > 32 {
+		v.addf([]string{"engineid", quoted(engineID)}, "%sinvalid engineid %q: must be 5-32 bytes in hex", name, engineID)
+	}
+}
+
+func (v *validator) checkDevices(cfg RPMConfig) {
+
+	names := make(map[string]bool)
+	stations := make(map[string]string)
+	for i, d := range cfg.Devices {
+		near := []string{"host", quoted(d.Host)}
+		name := d.Name
+		if name == "" {
+			v.addf(near, "device #%d requires a name", i+1)
+			name = fmt.Sprintf("#%d", i+1)
+		} else if names[name] {
+			v.addf([]string{"name", quoted(name)}, "duplicate device name %q", name)
+		}
+		names[name] = true
+
+		if d.Host == "" {
+			v.addf([]string{"name", quoted(d.Name)}, "device %s requires a host", name)
+		} else if strings.Contains(d.Host, ":") {
+			if _, _, err := net.SplitHostPort(d.Host); err != nil {
+				v.addf(near, "device %s: invalid host %q: %s", name, d.Host, err.Error())
+			}
+		}
+
+		if d.Net != "" && !netCodeRe.MatchString(d.Net) {
+			v.addf([]string{"net", quoted(d.Net)}, "device %s: invalid network code %q: must be 1-2 upper case letters or digits", name, d.Net)
+		}
+		if d.Sta != "" && !staCodeRe.MatchString(d.Sta) {
+			v.addf([]string{"sta", quoted(d.Sta)}, "device %s: invalid station code %q: must be 1-5 upper case letters or digits", name, d.Sta)
+		}
+		if d.Loc != nil && !locCodeRe.MatchString(*d.Loc) {
+			v.addf([]string{"loc", quoted(*d.Loc)}, "device %s: invalid location code %q: must be 0-2 upper case letters or digits", name, *d.Loc)
+		}
+
+		// the output of the devices is merged, so each needs its own station
+		g := cfg.DeviceConfig(d).General
+		station := g.Net + "." + g.Sta + "." + g.Loc
+		if other, ok := stations[station]; ok {
+			v.addf(near, "devices %s and %s are both station %s, each device needs its own net, sta or loc", other, name, station)
+		}
+		stations[station] = name
+
+		v.checkSNMP(d.SNMP.Version, d.SNMP.Writeversion, []string{d.SNMP.Transport}, d.SNMP.V3, "device "+name+": ")
+
+		if !d.Oids.empty() {
+			v.checkOids(d.Oids, true)
+			v.checkAlarms(cfg.Alarms, d.Oids)
+			v.checkQuality(cfg.Quality, d.Oids)
+		}
+	}
+}
+
+// Validate the rpm TOML config file, returning a *ValidationError with all
+// problems found
+func (cfg RPMConfig) Validate() (e error) {
+
+	v := &validator{}
+	if cfg.CfgFile != "" {
+		if content, err := ioutil.ReadFile(cfg.CfgFile); err == nil {
+			v.lines = strings.Split(string(content), "\n")
+		}
+	}
+
+	v.checkUnknown(cfg.unknown)
+	v.checkStation(cfg.General)
+	v.checkSNMP(cfg.SNMP.Version, cfg.SNMP.Writeversion,
+		[]string{cfg.SNMP.Transport, cfg.SNMP.Poll.Transport, cfg.SNMP.Status.Transport, cfg.SNMP.Relay.Transport}, cfg.SNMP.V3, "")
+	v.checkEngineID(cfg.Traps.Engineid, "[traps] ")
+
+	// the top level [oids] are for a host given on the command line and the
+	// devices without their own, not needed if all devices have their own
+	top := cfg.NeedsOids() || !cfg.Oids.empty()
+	if top {
+		v.checkOids(cfg.Oids, cfg.NeedsOids())
+		v.checkAlarms(cfg.Alarms, cfg.Oids)
+		v.checkQuality(cfg.Quality, cfg.Oids)
+	}
+	sets := relaySets(cfg, top)
+	v.checkNotify(cfg.Notify)
+	v.checkWatchdog(cfg.Watchdog, sets, cfg.Interlock.Protected)
+	v.checkRelay(cfg.Relay)
+	v.checkBuffer(cfg.Buffer)
+	v.checkInterlock(cfg.Interlock, sets)
+	v.checkSchedules(cfg.Schedules, cfg.Oids, cfg.Devices, cfg.Interlock.Protected)
+	v.checkDevices(cfg)
+
+	if len(v.problems) > 0 {
+		return &ValidationError{cfg.CfgFile, v.problems}
+	}
+
+	return nil
+}
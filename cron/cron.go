@@ -0,0 +1,197 @@
+// Package cron parses the five field cron expressions of relay schedules
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field is the set of values of a cron field, bit n set for value n
+type field uint64
+
+// bounds of a cron field
+type bounds struct {
+	name     string
+	min, max int
+	names    []string // names of min, min+1, ...
+}
+
+var (
+	minutes  = bounds{"minute", 0, 59, nil}
+	hours    = bounds{"hour", 0, 23, nil}
+	days     = bounds{"day of month", 1, 31, nil}
+	months   = bounds{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	weekdays = bounds{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// maxSearch bounds the search for the next time, e.g. for Feb 30
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Expr is a parsed cron expression: minute hour day-of-month month day-of-week
+type Expr struct {
+	spec              string
+	minute, hour, dom field
+	month, dow        field
+	domStar, dowStar  bool
+	location          *time.Location
+}
+
+// Parse parses spec, e.g. "0 3 * * sun", whose times are in loc
+func Parse(spec string, loc *time.Location) (*Expr, error) {
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: must have 5 fields (minute hour day-of-month month day-of-week), has %d", spec, len(fields))
+	}
+
+	e := &Expr{spec: spec, location: loc}
+	var err error
+	if e.minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, fmt.Errorf("cron %q: %s", spec, err.Error())
+	}
+	if e.hour, err = parseField(fields[1], hours); err != nil {
+		return nil, fmt.Errorf("cron %q: %s", spec, err.Error())
+	}
+	if e.dom, err = parseField(fields[2], days); err != nil {
+		return nil, fmt.Errorf("cron %q: %s", spec, err.Error())
+	}
+	if e.month, err = parseField(fields[3], months); err != nil {
+		return nil, fmt.Errorf("cron %q: %s", spec, err.Error())
+	}
+	if e.dow, err = parseField(fields[4], weekdays); err != nil {
+		return nil, fmt.Errorf("cron %q: %s", spec, err.Error())
+	}
+	// 7 is Sunday too
+	if e.dow&(1<<7) != 0 {
+		e.dow |= 1
+	}
+	e.domStar = fields[2] == "*"
+	e.dowStar = fields[4] == "*"
+
+	return e, nil
+}
+
+// String returns the expression as parsed
+func (e *Expr) String() string {
+	return e.spec
+}
+
+// Next returns the first time of the expression after t, or the zero time
+// if there is none
+func (e *Expr) Next(t time.Time) time.Time {
+
+	t = t.In(e.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+
+	for t.Before(limit) {
+		if !e.month.has(int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, e.location)
+			continue
+		}
+		if !e.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, e.location)
+			continue
+		}
+		if !e.hour.has(t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, e.location)
+			continue
+		}
+		if !e.minute.has(t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches applies the cron rule that a day matches either restricted
+// day-of-month or day-of-week
+func (e *Expr) dayMatches(t time.Time) bool {
+
+	dom := e.dom.has(t.Day())
+	dow := e.dow.has(int(t.Weekday()))
+	switch {
+	case e.domStar && e.dowStar:
+		return true
+	case e.domStar:
+		return dow
+	case e.dowStar:
+		return dom
+	}
+
+	return dom || dow
+}
+
+func (f field) has(n int) bool {
+	return f&(1<<uint(n)) != 0
+}
+
+// parseField parses a comma separated list of *, n, a-b, */s, a-b/s or n/s
+func parseField(spec string, b bounds) (field, error) {
+
+	var f field
+	for _, part := range strings.Split(spec, ",") {
+		rng, step := part, 1
+		stepped := strings.Contains(part, "/")
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s %q", b.name, part)
+			}
+		}
+
+		lo, hi := b.min, b.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			ends := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = b.value(ends[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = b.value(ends[1]); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range in %s %q", b.name, part)
+			}
+		default:
+			var err error
+			if lo, err = b.value(rng); err != nil {
+				return 0, err
+			}
+			// n/s is n to the maximum in steps of s
+			if !stepped {
+				hi = lo
+			}
+		}
+
+		for n := lo; n <= hi; n += step {
+			f |= 1 << uint(n)
+		}
+	}
+
+	return f, nil
+}
+
+// value parses a number or name of the field
+func (b bounds) value(s string) (int, error) {
+
+	for i, name := range b.names {
+		if strings.EqualFold(s, name) {
+			return b.min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < b.min || n > b.max {
+		return 0, fmt.Errorf("invalid %s %q, must be %d-%d", b.name, s, b.min, b.max)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,61 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+
+	// a Wednesday
+	from := time.Date(2020, 11, 4, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2020, 11, 4, 10, 31, 0, 0, time.UTC)},
+		{"0 3 * * sun", time.Date(2020, 11, 8, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2020, 11, 8, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 11, 4, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2020, 11, 5, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1-7 * mon", time.Date(2020, 11, 4, 12, 0, 0, 0, time.UTC)},
+		{"0 12 8-14 * mon", time.Date(2020, 11, 8, 12, 0, 0, 0, time.UTC)},
+		{"50/5 * * * *", time.Date(2020, 11, 4, 10, 50, 0, 0, time.UTC)},
+		{"0 8-17/4 * * mon-fri", time.Date(2020, 11, 4, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		e, err := Parse(tt.spec, time.UTC)
+		if err != nil {
+			t.Errorf("Parse(%q) = %v", tt.spec, err)
+			continue
+		}
+		if got := e.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next(%s) = %s, want %s", tt.spec, from, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	for _, spec := range []string{
+		"",
+		"0 3 * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * * funday",
+	} {
+		if _, err := Parse(spec, time.UTC); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package daemon serves a polled PowerMonitor over an HTTP/JSON API and
+// provides a client for it that is itself a PowerMonitor
+package daemon
+
+import (
+	"time"
+)
+
+// API endpoints
+const (
+	PathDevice = "/api/v1/device"
+	PathScan   = "/api/v1/scan"
+	PathQuery  = "/api/v1/query"
+	PathRelays = "/api/v1/relays"
+
+	// PathDevices lists the devices of a Hub, each served under
+	// DevicesPrefix followed by its name
+	PathDevices   = "/api/v1/devices"
+	DevicesPrefix = "/devices/"
+)
+
+// Relay actions accepted by PathRelays
+const (
+	ActionSet   = "set"
+	ActionCycle = "cycle"
+)
+
+// Relay states of ActionSet
+const (
+	StateOpen   = "open"
+	StateClosed = "closed"
+)
+
+// Scan is the latest scan of the device, Data maps OIDs to their raw values
+type Scan struct {
+	Time     time.Time         `json:"time"`
+	Data     map[string]string `json:"data"`
+	Channels []Channel         `json:"channels"`
+}
+
+// Channel is a data OID value with its config details. Value is the raw
+// device value, Scaled the value in engineering Units
+type Channel struct {
+	Chancode string `json:"chancode"`
+	Label    string `json:"label"`
+	Oid      string `json:"oid"`
+	Value    string `json:"value"`
+	Scaled   string `json:"scaled,omitempty"`
+	Units    string `json:"units,omitempty"`
+}
+
+// StaticValue is the value of a static OID
+type StaticValue struct {
+	Oid   string `json:"oid"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// DeviceInfo describes the device served by the daemon. Name and Path,
+// the base path of its API, are set for the devices of a Hub
+type DeviceInfo struct {
+	Name     string        `json:"name,omitempty"`
+	Path     string        `json:"path,omitempty"`
+	Host     string        `json:"host"`
+	Port     string        `json:"port"`
+	Net      string        `json:"net"`
+	Sta      string        `json:"sta"`
+	Loc      string        `json:"loc"`
+	Interval float64       `json:"interval"`
+	Static   []StaticValue `json:"static"`
+}
+
+// Relay is the state of a relay
+type Relay struct {
+	Relay    int    `json:"relay"`
+	Chancode string `json:"chancode"`
+	Label    string `json:"label"`
+	Oid      string `json:"oid"`
+	State    string `json:"state"`
+}
+
+// RelayAction is the request body for PathRelays. The relay is identified
+// by Oid or Chancode, State is required for ActionSet. Force allows
+// protected relays, only if the server has a token. Host is the host the
+// action is run from; with User and Tty it is recorded in the audit trail,
+// but the interlock checks the action as run on the daemon's host
+type RelayAction struct {
+	Oid      string `json:"oid,omitempty"`
+	Chancode string `json:"chancode,omitempty"`
+	Action   string `json:"action"`
+	State    string `json:"state,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Force    bool   `json:"force,omitempty"`
+	User     string `json:"user,omitempty"`
+	Tty      string `json:"tty,omitempty"`
+}
+
+// apiError is the body of an error response
+type apiError struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,224 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"rpm/audit"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultClientTimeout for requests to the daemon
+	DefaultClientTimeout = 30 * time.Second
+
+	fetchDivisor = 10
+)
+
+// Client is a PowerMonitor that operates the device through a running daemon
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	self    audit.Operator
+	force   bool
+
+	mutex       sync.Mutex
+	currentScan *tycon.TPDin2Scan
+	lastTS      time.Time
+}
+
+// Client must satisfy tycon.PowerMonitor
+var _ tycon.PowerMonitor = (*Client)(nil)
+
+// NewClient returns a Client for the daemon at baseURL, e.g. http://localhost:8161
+func NewClient(baseURL, token string, timeout time.Duration) *Client {
+
+	if timeout <= 0 {
+		timeout = DefaultClientTimeout
+	}
+
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: timeout},
+		self:    audit.Self(),
+	}
+}
+
+// SetForce has the relay actions of the client operate protected relays
+func (c *Client) SetForce(force bool) {
+	c.force = force
+}
+
+// Connect checks the daemon is reachable. The SNMP credentials are those of the daemon
+func (c *Client) Connect(creds tycon.Credentials) error {
+
+	var info DeviceInfo
+	if err := c.get(PathDevice, &info); err != nil {
+		return err
+	}
+	rlog.NoticeMsg("using rpm daemon %s for device %s:%s", c.baseURL, info.Host, info.Port)
+
+	return nil
+}
+
+// QueryOids has the daemon query the device for oids
+func (c *Client) QueryOids(oids *[]string) (time.Time, map[string]string, error) {
+
+	params := url.Values{}
+	for _, oid := range *oids {
+		params.Add("oid", oid)
+	}
+
+	var scan Scan
+	if err := c.get(PathQuery+"?"+params.Encode(), &scan); err != nil {
+		return time.Now(), nil, err
+	}
+
+	return scan.Time, scan.Data, nil
+}
+
+// SetRelay has the daemon set the relay at relayOid to targetState
+func (c *Client) SetRelay(relayOid, targetState string) error {
+	return c.post(PathRelays, c.relayAction(relayOid, ActionSet, targetState))
+}
+
+// CycleRelay has the daemon cycle the relay at relayOid
+func (c *Client) CycleRelay(relayOid string) error {
+	return c.post(PathRelays, c.relayAction(relayOid, ActionCycle, ""))
+}
+
+// relayAction is the request for action on the relay at relayOid, from this client
+func (c *Client) relayAction(relayOid, action, state string) RelayAction {
+	return RelayAction{
+		Oid:    relayOid,
+		Action: action,
+		State:  state,
+		Host:   c.self.Origin,
+		Force:  c.force,
+		User:   c.self.User,
+		Tty:    c.self.Tty,
+	}
+}
+
+// PollStart fetches the daemon's latest scan until ctx is done. The daemon
+// polls its configured OIDs at its own interval, pollOids is not used.
+func (c *Client) PollStart(ctx context.Context, wg *sync.WaitGroup, pollOids *[]string, sampleInterval time.Duration) error {
+
+	// fetch often enough that the scan is within half an interval of when it is used
+	fetchInterval := sampleInterval / fetchDivisor
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-time.After(fetchInterval):
+				var scan Scan
+				if err := c.get(PathScan, &scan); err != nil {
+					rlog.ErrMsg(err.Error())
+					continue
+				}
+				c.mutex.Lock()
+				if scan.Time.After(c.lastTS) {
+					c.currentScan = &tycon.TPDin2Scan{TS: scan.Time, Data: scan.Data}
+					c.lastTS = scan.Time
+				}
+				c.mutex.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// GetScan returns the most recent scan fetched from the daemon
+func (c *Client) GetScan() (*tycon.TPDin2Scan, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.currentScan == nil {
+		return nil, errors.New("scan unavailable")
+	}
+
+	scan := copyScan(c.currentScan)
+	c.currentScan = nil
+
+	return scan, nil
+}
+
+// Close releases idle connections to the daemon
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// get path and decode the JSON response into result
+func (c *Client) get(path string, result interface{}) error {
+
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.do(req, result)
+}
+
+// post body as JSON to path
+func (c *Client) post(path string, body interface{}) error {
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	return c.do(req, nil)
+}
+
+// do sends req, decoding a successful response into result if it is not nil
+func (c *Client) do(req *http.Request, result interface{}) error {
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("rpm daemon: %s", apiErr.Error)
+		}
+		return fmt.Errorf("rpm daemon: %s", resp.Status)
+	}
+
+	if result == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
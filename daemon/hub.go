@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	rlog "rpm/log"
+	"sync"
+	"time"
+)
+
+// hubRetryInterval is the wait before a device that failed is polled again
+const hubRetryInterval = time.Minute
+
+// Starter connects to a device and returns its Server. Anything it starts
+// for the Server runs until ctx is done
+type Starter func(ctx context.Context) (*Server, error)
+
+// Hub serves the Servers of several devices on one address, each API under
+// DevicesPrefix followed by the device name
+type Hub struct {
+	mux      *http.ServeMux
+	names    []string
+	starters map[string]Starter
+
+	mutex   sync.RWMutex
+	servers map[string]*Server
+}
+
+// NewHub returns an empty Hub
+func NewHub() *Hub {
+
+	hub := &Hub{
+		mux:      http.NewServeMux(),
+		starters: make(map[string]Starter),
+		servers:  make(map[string]*Server),
+	}
+	hub.mux.HandleFunc(PathDevices, hub.handleDevices)
+
+	return hub
+}
+
+// Add serves the device name with the Server returned by start, which Run
+// calls again whenever the device failed
+func (hub *Hub) Add(name string, start Starter) {
+
+	hub.names = append(hub.names, name)
+	hub.starters[name] = start
+	hub.mux.Handle(DevicesPrefix+name+"/", http.StripPrefix(DevicesPrefix+name, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			srv := hub.server(name)
+			if srv == nil {
+				writeError(w, http.StatusServiceUnavailable, errors.New("device not connected"))
+				return
+			}
+			srv.ServeHTTP(w, r)
+		})))
+}
+
+// server returns the Server of the device name, nil while it is not connected
+func (hub *Hub) server(name string) *Server {
+
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	return hub.servers[name]
+}
+
+// setServer sets the Server of the device name, nil when it is not connected
+func (hub *Hub) setServer(name string, srv *Server) {
+
+	hub.mutex.Lock()
+	hub.servers[name] = srv
+	hub.mutex.Unlock()
+}
+
+// runDevice starts and polls the device name until it fails, stopping
+// anything started with it before returning
+func (hub *Hub) runDevice(ctx context.Context, name string) error {
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	srv, err := hub.starters[name](runCtx)
+	if err != nil {
+		return err
+	}
+	srv.name = name
+	hub.setServer(name, srv)
+	defer hub.setServer(name, nil)
+
+	return srv.Run(runCtx, "")
+}
+
+// Handle registers an additional HTTP handler for pattern
+func (hub *Hub) Handle(pattern string, handler http.Handler) {
+	hub.mux.Handle(pattern, handler)
+}
+
+// Run starts and polls the devices and serves the API on listen until ctx
+// is done. A device that fails to start or poll is started again after a
+// while, without affecting the others
+func (hub *Hub) Run(ctx context.Context, listen string) error {
+
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, name := range hub.names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for {
+				err := hub.runDevice(pollCtx, name)
+				if pollCtx.Err() != nil {
+					return
+				}
+				rlog.ErrMsg("device %s: polling failed, trying again in %s: %v", name, hubRetryInterval, err)
+				select {
+				case <-time.After(hubRetryInterval):
+				case <-pollCtx.Done():
+					return
+				}
+			}
+		}(name)
+	}
+
+	httpSrv := &http.Server{Addr: listen, Handler: hub.mux}
+	httpErr := make(chan error, 1)
+	go func() {
+		httpErr <- httpSrv.ListenAndServe()
+	}()
+	rlog.NoticeMsg("serving API of %d devices on %s", len(hub.names), listen)
+
+	var err error
+	select {
+	case err = <-httpErr:
+	case <-ctx.Done():
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = httpSrv.Shutdown(shutdownCtx)
+		shutdownCancel()
+	}
+	cancel()
+	wg.Wait()
+
+	return err
+}
+
+// handleDevices lists the devices
+func (hub *Hub) handleDevices(w http.ResponseWriter, r *http.Request) {
+
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	devices := make([]DeviceInfo, 0, len(hub.names))
+	for _, name := range hub.names {
+		// a device that is not connected is listed by its name only
+		info := DeviceInfo{Name: name}
+		if srv := hub.server(name); srv != nil {
+			info = srv.deviceInfo()
+		}
+		info.Path = DevicesPrefix + name
+		devices = append(devices, info)
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
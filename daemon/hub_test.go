@@ -0,0 +1,85 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"rpm/simulator"
+	"rpm/tycon"
+	"testing"
+	"time"
+)
+
+func TestHubFailingDevice(t *testing.T) {
+
+	rpmCfg := testConfig()
+	sim := simulator.New(rpmCfg)
+	if err := sim.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Stop()
+	host, port := sim.HostPort()
+
+	hub := NewHub()
+	hub.Add("down", func(ctx context.Context) (*Server, error) {
+		return nil, errors.New("connection refused")
+	})
+	hub.Add("up", func(ctx context.Context) (*Server, error) {
+		dev, err := tycon.NewPowerMonitor(host, port, tycon.DefaultOptions)
+		if err != nil {
+			return nil, err
+		}
+		if err = dev.Connect(tycon.Credentials{Community: simulator.DefaultWriteCommunity}); err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			dev.Close()
+		}()
+		return NewServer(dev, rpmCfg, host, port, time.Second, ""), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- hub.Run(ctx, "127.0.0.1:0") }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	ts := httptest.NewServer(hub.mux)
+	defer ts.Close()
+
+	// the device that failed to connect does not stop the other
+	var devices []DeviceInfo
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		getJSON(t, ts, PathDevices, &devices)
+		if len(devices) == 2 && len(devices[1].Static) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("devices %+v, want the up device with its static values", devices)
+		}
+	}
+	if devices[0].Name != "down" || devices[0].Path != DevicesPrefix+"down" || devices[0].Sta != "" {
+		t.Errorf("device %+v, want down by its name only", devices[0])
+	}
+	if devices[1].Name != "up" || devices[1].Sta != "VALT" {
+		t.Errorf("device %+v, want up of station VALT", devices[1])
+	}
+
+	var info DeviceInfo
+	getJSON(t, ts, DevicesPrefix+"up"+PathDevice, &info)
+	if info.Name != "up" || info.Host != host {
+		t.Errorf("device %+v, want up on %s", info, host)
+	}
+
+	resp, err := http.Get(ts.URL + DevicesPrefix + "down" + PathDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("down device status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,510 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"rpm/audit"
+	"rpm/config"
+	"rpm/interlock"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shutdownTimeout  = 5 * time.Second
+	scanCheckDivisor = 20
+)
+
+// ScanHandler is called with each new scan from the polling loop
+type ScanHandler func(scan *tycon.TPDin2Scan)
+
+// RelayHandler is called after each relay action through the API, with the
+// relay config and the error if the action failed
+type RelayHandler func(action RelayAction, info config.OidInfo, err error)
+
+// Server polls a PowerMonitor and serves the results over HTTP
+type Server struct {
+	name     string
+	dev      tycon.PowerMonitor
+	rpmCfg   *config.RPMConfig
+	host     string
+	port     string
+	interval time.Duration
+	token    string
+	// hostname is the host relay actions are checked as run from by the
+	// interlock, the daemon's own
+	hostname string
+
+	mux      *http.ServeMux
+	mutex    sync.RWMutex
+	latest   *tycon.TPDin2Scan
+	static   []StaticValue
+	handlers []ScanHandler
+
+	relayHandlers []RelayHandler
+	auditLog      *audit.Log
+}
+
+// NewServer returns a Server for dev, connected to host:port, polled every interval.
+// If token is set, relay actions require it as a bearer token.
+func NewServer(dev tycon.PowerMonitor, rpmCfg *config.RPMConfig, host, port string, interval time.Duration, token string) *Server {
+
+	srv := &Server{
+		dev:      dev,
+		rpmCfg:   rpmCfg,
+		host:     host,
+		port:     port,
+		interval: interval,
+		token:    token,
+		mux:      http.NewServeMux(),
+	}
+	srv.hostname, _ = os.Hostname()
+
+	srv.mux.HandleFunc(PathDevice, srv.handleDevice)
+	srv.mux.HandleFunc(PathScan, srv.handleScan)
+	srv.mux.HandleFunc(PathQuery, srv.handleQuery)
+	srv.mux.HandleFunc(PathRelays, srv.handleRelays)
+
+	return srv
+}
+
+// Handle registers an additional HTTP handler for pattern
+func (srv *Server) Handle(pattern string, handler http.Handler) {
+	srv.mux.Handle(pattern, handler)
+}
+
+// AddScanHandler registers fn to be called with each new scan
+func (srv *Server) AddScanHandler(fn ScanHandler) {
+	srv.handlers = append(srv.handlers, fn)
+}
+
+// SetAuditLog has the relay actions recorded in auditLog
+func (srv *Server) SetAuditLog(auditLog *audit.Log) {
+	srv.auditLog = auditLog
+}
+
+// AddRelayHandler registers fn to be called after each relay action
+func (srv *Server) AddRelayHandler(fn RelayHandler) {
+	srv.relayHandlers = append(srv.relayHandlers, fn)
+}
+
+// Latest returns a copy of the most recent scan, or nil if there is none yet
+func (srv *Server) Latest() *tycon.TPDin2Scan {
+
+	srv.mutex.RLock()
+	defer srv.mutex.RUnlock()
+
+	if srv.latest == nil {
+		return nil
+	}
+	return copyScan(srv.latest)
+}
+
+// ServeHTTP serves the API, for when it is not served by Run
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mux.ServeHTTP(w, r)
+}
+
+// logPrefix returns the prefix of the log messages of the server, with its
+// device name on a Hub
+func (srv *Server) logPrefix() string {
+	if srv.name == "" {
+		return ""
+	}
+	return "device " + srv.name + ": "
+}
+
+// Run polls the device and serves the API on listen until ctx is done. If
+// listen is empty the API is only served by ServeHTTP
+func (srv *Server) Run(ctx context.Context, listen string) error {
+
+	staticOids, staticInfo := srv.rpmCfg.StaticOidsInfo()
+	dataOids, _ := srv.rpmCfg.DataOidsInfo()
+	pollOids := append(staticOids[:len(staticOids):len(staticOids)], dataOids...)
+
+	_, results, err := srv.dev.QueryOids(&staticOids)
+	if err != nil {
+		return err
+	}
+	static := make([]StaticValue, 0, len(staticInfo))
+	for _, info := range staticInfo {
+		static = append(static, StaticValue{info.Oid, info.Label, results[info.Oid]})
+		rlog.NoticeMsg("%s%s: %s", srv.logPrefix(), info.Label, results[info.Oid])
+	}
+	if warning := srv.rpmCfg.Oids.FirmwareMismatch(results); warning != "" {
+		rlog.WarningMsg("%s%s", srv.logPrefix(), warning)
+	}
+	srv.mutex.Lock()
+	srv.static = static
+	srv.mutex.Unlock()
+
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	if err = srv.dev.PollStart(pollCtx, &wg, &pollOids, srv.interval); err != nil {
+		return err
+	}
+
+	var httpSrv *http.Server
+	httpErr := make(chan error, 1)
+	if listen != "" {
+		httpSrv = &http.Server{Addr: listen, Handler: srv.mux}
+		go func() {
+			httpErr <- httpSrv.ListenAndServe()
+		}()
+		rlog.NoticeMsg("serving API on %s", listen)
+	}
+
+	// check for new scans often so the latest scan is never much older than
+	// the device polling loop's, which polls at a third of the interval
+	ticker := time.NewTicker(srv.interval / scanCheckDivisor)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			scan, _ := srv.dev.GetScan()
+			if scan == nil {
+				continue
+			}
+			srv.mutex.Lock()
+			srv.latest = scan
+			srv.mutex.Unlock()
+			for _, fn := range srv.handlers {
+				fn(copyScan(scan))
+			}
+
+		case err = <-httpErr:
+			cancel()
+			wg.Wait()
+			return err
+
+		case <-ctx.Done():
+			if httpSrv != nil {
+				shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				err = httpSrv.Shutdown(shutdownCtx)
+				shutdownCancel()
+			}
+			cancel()
+			wg.Wait()
+			return err
+		}
+	}
+}
+
+func (srv *Server) handleDevice(w http.ResponseWriter, r *http.Request) {
+
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, srv.deviceInfo())
+}
+
+// deviceInfo describes the device
+func (srv *Server) deviceInfo() DeviceInfo {
+
+	srv.mutex.RLock()
+	defer srv.mutex.RUnlock()
+
+	return DeviceInfo{
+		Name:     srv.name,
+		Host:     srv.host,
+		Port:     srv.port,
+		Net:      srv.rpmCfg.General.Net,
+		Sta:      srv.rpmCfg.General.Sta,
+		Loc:      srv.rpmCfg.General.Loc,
+		Interval: srv.interval.Seconds(),
+		Static:   srv.static,
+	}
+}
+
+func (srv *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	scan := srv.Latest()
+	if scan == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("scan unavailable"))
+		return
+	}
+
+	_, dataInfo := srv.rpmCfg.DataOidsInfo()
+	resp := Scan{Time: scan.TS, Data: scan.Data}
+	for _, info := range dataInfo {
+		raw := scan.Data[info.Oid]
+		resp.Channels = append(resp.Channels, Channel{info.Chancode, info.Label, info.Oid, raw, info.FormatValue(raw), info.Units})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleQuery does a live query of the oid parameters
+func (srv *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	oids := r.URL.Query()["oid"]
+	if len(oids) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no oid parameters"))
+		return
+	}
+
+	ts, results, err := srv.dev.QueryOids(&oids)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Scan{Time: ts, Data: results})
+}
+
+// handleRelays returns the relay states for GET and performs a RelayAction for POST
+func (srv *Server) handleRelays(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		relays, err := srv.relayStates()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, relays)
+
+	case http.MethodPost:
+		if !srv.authorized(r) {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+
+		var action RelayAction
+		if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		status, err := srv.relayAction(action, remote)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		relays, err := srv.relayStates()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, relays)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// relayAction performs action from the remote address, returning an HTTP
+// status for any error
+func (srv *Server) relayAction(action RelayAction, remote string) (int, error) {
+
+	var info *config.OidInfo
+	for ndx, relay := range srv.rpmCfg.Oids.Relays {
+		if (action.Oid != "" && relay.Oid == action.Oid) ||
+			(action.Chancode != "" && relay.Chancode == action.Chancode) {
+			info = &srv.rpmCfg.Oids.Relays[ndx]
+			break
+		}
+	}
+	if info == nil {
+		return http.StatusNotFound, fmt.Errorf("unknown relay: %s%s", action.Oid, action.Chancode)
+	}
+
+	if action.Action != ActionSet && action.Action != ActionCycle {
+		return http.StatusBadRequest, fmt.Errorf("invalid relay action: %s", action.Action)
+	}
+	if action.Action == ActionSet && action.State != StateOpen && action.State != StateClosed {
+		return http.StatusBadRequest, fmt.Errorf("invalid relay state: %q, expecting %s or %s", action.State, StateOpen, StateClosed)
+	}
+
+	relayOids, _ := srv.rpmCfg.RelayOidsInfo()
+	_, results, err := srv.dev.QueryOids(&relayOids)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	previous := tycon.RelayStateLabel(results[info.Oid])
+
+	if err := srv.interlock(action, *info, results); err != nil {
+		rlog.WarningMsg("api: %s from %s", err.Error(), remote)
+		srv.audit(action, remote, *info, previous, previous, audit.ResultRefused, err.Error())
+		return http.StatusForbidden, err
+	}
+
+	switch action.Action {
+	case ActionSet:
+		rlog.NoticeMsg("api: setting relay %s (%s) to %s", info.Chancode, info.Label, strings.ToUpper(action.State))
+		err = srv.dev.SetRelay(info.Oid, action.State)
+	case ActionCycle:
+		rlog.NoticeMsg("api: cycling relay %s (%s)", info.Chancode, info.Label)
+		err = srv.dev.CycleRelay(info.Oid)
+	}
+
+	// the state the action left the relay in; a cycle is not waited for, so
+	// it is audited as started rather than ok
+	state, result := "", audit.ResultStarted
+	if action.Action == ActionSet {
+		result = audit.ResultOK
+		if _, results, qerr := srv.dev.QueryOids(&[]string{info.Oid}); qerr == nil {
+			state = tycon.RelayStateLabel(results[info.Oid])
+		}
+	}
+	if err != nil {
+		srv.audit(action, remote, *info, previous, state, audit.ResultFailed, err.Error())
+	} else {
+		srv.audit(action, remote, *info, previous, state, result, "")
+	}
+
+	for _, fn := range srv.relayHandlers {
+		fn(action, *info, err)
+	}
+
+	if err != nil {
+		rlog.ErrMsg("api: relay %s %s failed: %s", info.Chancode, action.Action, err.Error())
+		return http.StatusBadGateway, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// interlock checks action on the relay info against the [interlock] policy
+// with the relays in the states of results. The host of the action is the
+// daemon's, not the one the client claims, and the client may only force
+// protected relays if the server has a token
+func (srv *Server) interlock(action RelayAction, info config.OidInfo, results map[string]string) error {
+
+	if action.Force && srv.token == "" {
+		return &interlock.Violation{
+			Request: interlock.Request{Host: srv.hostname, Relay: info, Action: action.Action, State: action.State, Force: true},
+			Reason:  "force requires a [server] token",
+		}
+	}
+
+	return interlock.New(srv.rpmCfg).Check(interlock.Request{
+		Host:   srv.hostname,
+		Relay:  info,
+		Action: action.Action,
+		State:  action.State,
+		Force:  action.Force,
+	}, results)
+}
+
+// audit appends a relay action from the remote address to the audit trail,
+// if the server has one. The origin is the remote address, followed by the
+// host the client says it is, which is not verified
+func (srv *Server) audit(action RelayAction, remote string, info config.OidInfo, previous, state, result, detail string) {
+
+	if srv.auditLog == nil {
+		return
+	}
+	origin := remote
+	if action.Host != "" {
+		origin += " (" + action.Host + ")"
+	}
+	err := srv.auditLog.Write(audit.Record{
+		Operator:  audit.Operator{User: action.User, Origin: origin, Tty: action.Tty},
+		Source:    audit.SourceAPI,
+		Host:      srv.host + ":" + srv.port,
+		Chancode:  info.Chancode,
+		Label:     info.Label,
+		Action:    action.Action,
+		Previous:  previous,
+		Requested: action.State,
+		State:     state,
+		Result:    result,
+		Detail:    detail,
+	})
+	if err != nil {
+		rlog.ErrMsg("api: could not write audit trail: %s", err.Error())
+	}
+}
+
+// relayStates queries the device for the current relay states
+func (srv *Server) relayStates() ([]Relay, error) {
+
+	relayOids, relayInfo := srv.rpmCfg.RelayOidsInfo()
+	_, results, err := srv.dev.QueryOids(&relayOids)
+	if err != nil {
+		return nil, err
+	}
+
+	relays := make([]Relay, 0, len(relayInfo))
+	for ndx, info := range relayInfo {
+		relays = append(relays, Relay{ndx + 1, info.Chancode, info.Label, info.Oid, tycon.RelayStateLabel(results[info.Oid])})
+	}
+
+	return relays, nil
+}
+
+// authorized checks the bearer token of r if the server has one
+func (srv *Server) authorized(r *http.Request) bool {
+
+	if srv.token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	given := strings.TrimPrefix(auth, "Bearer ")
+
+	return given != auth && subtle.ConstantTimeCompare([]byte(given), []byte(srv.token)) == 1
+}
+
+// allowMethod writes a 405 response and returns false unless r.Method is method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		rlog.ErrMsg("api: error writing response: %s", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+// copyScan returns a deep copy of scan
+func copyScan(scan *tycon.TPDin2Scan) *tycon.TPDin2Scan {
+
+	data := make(map[string]string, len(scan.Data))
+	for key, val := range scan.Data {
+		data[key] = val
+	}
+
+	return &tycon.TPDin2Scan{TS: scan.TS, Data: data}
+}
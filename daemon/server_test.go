@@ -0,0 +1,296 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"rpm/audit"
+	"rpm/config"
+	"rpm/simulator"
+	"rpm/tycon"
+	"testing"
+	"time"
+)
+
+const (
+	relay1Oid  = "1.3.6.1.4.1.45621.2.2.1.0"
+	relay2Oid  = "1.3.6.1.4.1.45621.2.2.2.0"
+	batteryOid = "1.3.6.1.4.1.45621.2.2.5.0"
+)
+
+func testConfig() *config.RPMConfig {
+
+	precision := 1
+	rpmCfg := config.NewConfig()
+	rpmCfg.General.Net, rpmCfg.General.Sta, rpmCfg.General.Loc = "II", "VALT", "25"
+	rpmCfg.Oids.Static = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Label: "Product Name"},
+	}
+	rpmCfg.Oids.Relays = []config.OidInfo{
+		{Oid: relay1Oid, Chancode: "RL1", Label: "Relay 1"},
+		{Oid: relay2Oid, Chancode: "RL2", Label: "Relay 2"},
+	}
+	rpmCfg.Oids.Voltages = []config.OidInfo{
+		{Oid: batteryOid, Chancode: "MV1", Label: "Battery", Scale: 0.1, Units: "volts", Precision: &precision},
+	}
+	rpmCfg.Simulator.Static = []config.StaticValue{
+		{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Value: "TPDIN2-SIM"},
+	}
+	rpmCfg.Simulator.Waveforms = []config.WaveformInfo{
+		{Chancode: "MV1", Kind: simulator.WaveConstant, Base: 125},
+	}
+
+	return rpmCfg
+}
+
+// startServer runs a Server with token for a simulator on free local ports
+// until the test ends, once it has a scan
+func startServer(t *testing.T, rpmCfg *config.RPMConfig, token string) (*simulator.Simulator, *Server, *httptest.Server) {
+
+	sim := simulator.New(rpmCfg)
+	if err := sim.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Stop() })
+
+	host, port := sim.HostPort()
+	dev, err := tycon.NewPowerMonitor(host, port, tycon.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Connect(tycon.Credentials{Community: simulator.DefaultWriteCommunity}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+
+	srv := NewServer(dev, rpmCfg, host, port, time.Second, token)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx, "") }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); srv.Latest() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("no scan from the simulator")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	return sim, srv, ts
+}
+
+// postAction posts action with token, if set, returning the response status
+// and decoding the body into result
+func postAction(t *testing.T, ts *httptest.Server, token string, action RelayAction, result interface{}) int {
+
+	body, err := json.Marshal(action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+PathRelays, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return resp.StatusCode
+}
+
+func getJSON(t *testing.T, ts *httptest.Server, path string, result interface{}) {
+
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+
+	_, _, ts := startServer(t, testConfig(), "")
+
+	var info DeviceInfo
+	getJSON(t, ts, PathDevice, &info)
+	if info.Sta != "VALT" || len(info.Static) != 1 || info.Static[0].Value != "TPDIN2-SIM" {
+		t.Errorf("device %+v, want station VALT of a TPDIN2-SIM", info)
+	}
+
+	var scan Scan
+	getJSON(t, ts, PathScan, &scan)
+	want := Channel{"MV1", "Battery", batteryOid, "125", "12.5", "volts"}
+	if len(scan.Channels) != 3 || scan.Channels[0] != want {
+		t.Errorf("scan channels %+v, want %+v first", scan.Channels, want)
+	}
+
+	// the client reads the device through the API
+	client := NewClient(ts.URL, "", time.Second)
+	_, results, err := client.QueryOids(&[]string{relay1Oid, batteryOid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[relay1Oid] != "1" || results[batteryOid] != "125" {
+		t.Errorf("client query %v, want RL1 closed and MV1 125", results)
+	}
+}
+
+func TestRelay(t *testing.T) {
+
+	sim, _, ts := startServer(t, testConfig(), "")
+
+	var relays []Relay
+	status := postAction(t, ts, "", RelayAction{Chancode: "RL2", Action: ActionSet, State: StateOpen}, &relays)
+	if status != http.StatusOK || len(relays) != 2 || relays[1].State != StateOpen {
+		t.Errorf("set RL2 open: status %d relays %+v, want RL2 open", status, relays)
+	}
+	if state, _ := sim.RelayState(relay2Oid); state != 0 {
+		t.Errorf("simulated RL2 state %d, want 0 (open)", state)
+	}
+
+	tests := []struct {
+		name   string
+		action RelayAction
+		want   int
+	}{
+		{"state", RelayAction{Chancode: "RL1", Action: ActionSet, State: "ajar"}, http.StatusBadRequest},
+		{"no state", RelayAction{Chancode: "RL1", Action: ActionSet}, http.StatusBadRequest},
+		{"action", RelayAction{Chancode: "RL1", Action: "toggle"}, http.StatusBadRequest},
+		{"relay", RelayAction{Chancode: "RL9", Action: ActionCycle}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if status := postAction(t, ts, "", tt.action, nil); status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.want)
+		}
+	}
+	if state, _ := sim.RelayState(relay1Oid); state != 1 {
+		t.Errorf("simulated RL1 state %d after invalid actions, want 1 (closed)", state)
+	}
+}
+
+func TestToken(t *testing.T) {
+
+	sim, _, ts := startServer(t, testConfig(), "secret")
+
+	action := RelayAction{Chancode: "RL1", Action: ActionSet, State: StateOpen}
+	for _, token := range []string{"", "wrong"} {
+		if status := postAction(t, ts, token, action, nil); status != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want %d", token, status, http.StatusUnauthorized)
+		}
+	}
+	if state, _ := sim.RelayState(relay1Oid); state != 1 {
+		t.Errorf("simulated RL1 state %d after unauthorized actions, want 1 (closed)", state)
+	}
+
+	// reading needs no token
+	var relays []Relay
+	getJSON(t, ts, PathRelays, &relays)
+
+	client := NewClient(ts.URL, "secret", time.Second)
+	if err := client.SetRelay(relay1Oid, StateOpen); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := sim.RelayState(relay1Oid); state != 0 {
+		t.Errorf("simulated RL1 state %d, want 0 (open)", state)
+	}
+}
+
+func TestInterlock(t *testing.T) {
+
+	rpmCfg := testConfig()
+	rpmCfg.Interlock.Hosts = []config.InterlockHosts{{Relay: "RL1", Hosts: []string{"nrts-2"}}}
+	rpmCfg.Interlock.Protected = []string{"RL2"}
+	sim, srv, ts := startServer(t, rpmCfg, "")
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := audit.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	srv.SetAuditLog(auditLog)
+
+	// the host a client claims is not the one checked
+	srv.hostname = "nrts-1"
+	action := RelayAction{Chancode: "RL1", Action: ActionSet, State: StateOpen, Host: "nrts-2", User: "ops"}
+	if status := postAction(t, ts, "", action, nil); status != http.StatusForbidden {
+		t.Errorf("RL1 from a daemon on nrts-1: status %d, want %d", status, http.StatusForbidden)
+	}
+	srv.hostname = "nrts-2"
+	if status := postAction(t, ts, "", action, nil); status != http.StatusOK {
+		t.Errorf("RL1 from a daemon on nrts-2: status %d, want %d", status, http.StatusOK)
+	}
+	action.Action, action.State = ActionCycle, ""
+	if status := postAction(t, ts, "", action, nil); status != http.StatusOK {
+		t.Errorf("RL1 cycle from a daemon on nrts-2: status %d, want %d", status, http.StatusOK)
+	}
+
+	// force is not accepted without a token
+	action = RelayAction{Chancode: "RL2", Action: ActionSet, State: StateOpen, Force: true}
+	if status := postAction(t, ts, "", action, nil); status != http.StatusForbidden {
+		t.Errorf("forced RL2 without a token: status %d, want %d", status, http.StatusForbidden)
+	}
+	if state, _ := sim.RelayState(relay2Oid); state != 1 {
+		t.Errorf("simulated RL2 state %d, want 1 (closed)", state)
+	}
+
+	records, err := audit.Read(auditFile, func(audit.Record) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cycle is not waited for, it is only started
+	want := []string{audit.ResultRefused, audit.ResultOK, audit.ResultStarted, audit.ResultRefused}
+	if len(records) != len(want) {
+		t.Fatalf("%d audit records, want %d", len(records), len(want))
+	}
+	for i, rec := range records {
+		if rec.Result != want[i] {
+			t.Errorf("audit record %d result %s, want %s", i, rec.Result, want[i])
+		}
+	}
+	if origin := records[0].Origin; origin != "127.0.0.1 (nrts-2)" {
+		t.Errorf("audit origin %q, want the remote address and claimed host", origin)
+	}
+}
+
+func TestForceWithToken(t *testing.T) {
+
+	rpmCfg := testConfig()
+	rpmCfg.Interlock.Protected = []string{"RL2"}
+	sim, _, ts := startServer(t, rpmCfg, "secret")
+
+	action := RelayAction{Chancode: "RL2", Action: ActionSet, State: StateOpen}
+	if status := postAction(t, ts, "secret", action, nil); status != http.StatusForbidden {
+		t.Errorf("protected RL2: status %d, want %d", status, http.StatusForbidden)
+	}
+	action.Force = true
+	if status := postAction(t, ts, "secret", action, nil); status != http.StatusOK {
+		t.Errorf("forced RL2 with the token: status %d, want %d", status, http.StatusOK)
+	}
+	if state, _ := sim.RelayState(relay2Oid); state != 0 {
+		t.Errorf("simulated RL2 state %d, want 0 (open)", state)
+	}
+}
@@ -0,0 +1,144 @@
+// Package interlock checks relay actions against the [interlock] policy of rpm.toml
+package interlock
+
+import (
+	"fmt"
+	"rpm/config"
+	"rpm/tycon"
+	"strings"
+)
+
+// Relay actions checked by the policy
+const (
+	ActionSet   = "set"
+	ActionCycle = "cycle"
+)
+
+// relayStateOpen is the state of a relay that has cut the power
+const relayStateOpen = "open"
+
+// Request is a relay action to check
+type Request struct {
+	Host   string         // host the action is run from
+	Relay  config.OidInfo // relay to operate
+	Action string         // ActionSet or ActionCycle
+	State  string         // target state of ActionSet
+	Force  bool           // protected relays may be operated
+}
+
+// Violation is a relay action refused by the policy
+type Violation struct {
+	Request Request
+	Reason  string
+}
+
+func (v *Violation) Error() string {
+
+	action := v.Request.Action
+	if v.Request.Action == ActionSet {
+		action += " " + v.Request.State
+	}
+
+	return fmt.Sprintf("interlock: %s of relay %s (%s) refused: %s",
+		action, v.Request.Relay.Chancode, v.Request.Relay.Label, v.Reason)
+}
+
+// Policy is the interlock policy of a config
+type Policy struct {
+	hosts     map[string][]string
+	groups    [][]string
+	protected map[string]bool
+	relays    map[string]config.OidInfo
+}
+
+// New returns the Policy of the [interlock] section of rpmCfg
+func New(rpmCfg *config.RPMConfig) *Policy {
+
+	p := &Policy{
+		hosts:     make(map[string][]string),
+		groups:    rpmCfg.Interlock.Groups,
+		protected: make(map[string]bool),
+		relays:    make(map[string]config.OidInfo),
+	}
+	for _, h := range rpmCfg.Interlock.Hosts {
+		p.hosts[h.Relay] = append(p.hosts[h.Relay], h.Hosts...)
+	}
+	for _, chancode := range rpmCfg.Interlock.Protected {
+		p.protected[chancode] = true
+	}
+	for _, info := range rpmCfg.Oids.Relays {
+		p.relays[info.Chancode] = info
+	}
+
+	return p
+}
+
+// Check returns a *Violation if req is not allowed with the relays in the
+// states of results, the raw values of a query of the relay OIDs
+func (p *Policy) Check(req Request, results map[string]string) error {
+
+	chancode := req.Relay.Chancode
+
+	if allowed, ok := p.hosts[chancode]; ok && !hostAllowed(allowed, req.Host) {
+		return &Violation{req, fmt.Sprintf("host %s may not operate it, only %s", req.Host, strings.Join(allowed, ", "))}
+	}
+
+	if p.protected[chancode] && !req.Force {
+		return &Violation{req, "the relay is protected, use --force to operate it"}
+	}
+
+	// a cycle opens a closed relay for the cycle time
+	opens := false
+	switch req.Action {
+	case ActionSet:
+		opens = req.State == relayStateOpen
+	case ActionCycle:
+		opens = tycon.RelayStateLabel(results[req.Relay.Oid]) != relayStateOpen
+	}
+	if !opens {
+		return nil
+	}
+
+	for _, group := range p.groups {
+		if !contains(group, chancode) {
+			continue
+		}
+		var open []string
+		for _, member := range group {
+			if member == chancode {
+				continue
+			}
+			info, ok := p.relays[member]
+			if ok && tycon.RelayStateLabel(results[info.Oid]) == relayStateOpen {
+				open = append(open, member)
+			}
+		}
+		if len(open) == len(group)-1 {
+			return &Violation{req, fmt.Sprintf("%s open, relays %s must never all be open", strings.Join(open, ", "), strings.Join(group, ", "))}
+		}
+	}
+
+	return nil
+}
+
+// hostAllowed reports whether host, or its name without the domain, is in allowed
+func hostAllowed(allowed []string, host string) bool {
+
+	short := strings.SplitN(host, ".", 2)[0]
+	for _, h := range allowed {
+		if h == "*" || strings.EqualFold(h, host) || strings.EqualFold(h, short) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, val string) bool {
+	for _, elem := range list {
+		if elem == val {
+			return true
+		}
+	}
+	return false
+}
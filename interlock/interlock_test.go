@@ -0,0 +1,68 @@
+package interlock
+
+import (
+	"rpm/config"
+	"strings"
+	"testing"
+)
+
+const (
+	rl1Oid = "1.3.6.1.4.1.45621.2.2.1.0"
+	rl2Oid = "1.3.6.1.4.1.45621.2.2.2.0"
+	rl3Oid = "1.3.6.1.4.1.45621.2.2.3.0"
+
+	rawOpen   = "0"
+	rawClosed = "1"
+)
+
+func testConfig() *config.RPMConfig {
+
+	rpmCfg := config.NewConfig()
+	rpmCfg.Oids.Relays = []config.OidInfo{
+		{Oid: rl1Oid, Chancode: "RL1", Label: "Primary"},
+		{Oid: rl2Oid, Chancode: "RL2", Label: "Secondary"},
+		{Oid: rl3Oid, Chancode: "RL3", Label: "Radio"},
+	}
+	rpmCfg.Interlock.Hosts = []config.InterlockHosts{{Relay: "RL1", Hosts: []string{"nrts-2"}}}
+	rpmCfg.Interlock.Groups = [][]string{{"RL1", "RL2"}}
+	rpmCfg.Interlock.Protected = []string{"RL3"}
+
+	return rpmCfg
+}
+
+func TestCheck(t *testing.T) {
+
+	rpmCfg := testConfig()
+	relays := rpmCfg.Oids.Relays
+	allClosed := map[string]string{rl1Oid: rawClosed, rl2Oid: rawClosed, rl3Oid: rawClosed}
+	rl1Open := map[string]string{rl1Oid: rawOpen, rl2Oid: rawClosed, rl3Oid: rawClosed}
+
+	tests := []struct {
+		name    string
+		req     Request
+		results map[string]string
+		want    string
+	}{
+		{"allowed host", Request{Host: "nrts-2.example.org", Relay: relays[0], Action: ActionSet, State: "open"}, allClosed, ""},
+		{"other host", Request{Host: "nrts-1", Relay: relays[0], Action: ActionCycle}, allClosed, "host nrts-1 may not operate it"},
+		{"any host", Request{Host: "nrts-1", Relay: relays[1], Action: ActionSet, State: "open"}, allClosed, ""},
+		{"group open", Request{Host: "nrts-1", Relay: relays[1], Action: ActionSet, State: "open"}, rl1Open, "must never all be open"},
+		{"group cycle", Request{Host: "nrts-1", Relay: relays[1], Action: ActionCycle}, rl1Open, "must never all be open"},
+		{"group close", Request{Host: "nrts-1", Relay: relays[1], Action: ActionSet, State: "closed"}, rl1Open, ""},
+		{"protected", Request{Host: "nrts-1", Relay: relays[2], Action: ActionCycle}, allClosed, "use --force"},
+		{"protected forced", Request{Host: "nrts-1", Relay: relays[2], Action: ActionCycle, Force: true}, allClosed, ""},
+	}
+
+	policy := New(rpmCfg)
+	for _, tt := range tests {
+		err := policy.Check(tt.req, tt.results)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: Check() = %v, want nil", tt.name, err)
+		case tt.want != "" && err == nil:
+			t.Errorf("%s: Check() = nil, want a violation %q", tt.name, tt.want)
+		case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+			t.Errorf("%s: Check() = %v, want a violation %q", tt.name, err, tt.want)
+		}
+	}
+}
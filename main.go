@@ -48,6 +48,7 @@ type appConfig struct {
 	cmd     string
 	host    string
 	port    string
+	server  string
 	rpmCfg  *config.RPMConfig
 }
 
@@ -57,6 +58,7 @@ var appCfg = &appConfig{
 	cmd:     "",
 	host:    "",
 	port:    "",
+	server:  "",
 	rpmCfg:  nil,
 }
 
@@ -113,7 +115,7 @@ func setUser(username string) error {
 		wd, err = os.Getwd()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
-			rlog.ErrMsg("could not determine working dir", gid)
+			rlog.ErrMsg("could not determine working dir")
 			rlog.ErrMsg(err.Error())
 		} else {
 			rlog.NoticeMsg(fmt.Sprintf("working dir: %s", wd))
@@ -134,16 +136,36 @@ func main() {
 		log.Fatal("rpm: error creating logger (log.fatal)")
 	}
 
-	// parse host[]:port]
-	hostport := flag.Args()[0]
-	appCfg.host, appCfg.port, err = formatSNMPHostPort(hostport)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		rlog.ErrMsg(err.Error())
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "command line error, not enough parameters")
+		usage()
 		os.Exit(1)
 	}
 
-	err = readCLI(flag.Args())
+	// parse host[]:port], which may be omitted for some commands
+	if !validCmd(args[0]) {
+		hostport := args[0]
+		appCfg.host, appCfg.port, err = formatSNMPHostPort(hostport)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			rlog.ErrMsg(err.Error())
+			os.Exit(1)
+		}
+		args = args[1:]
+	}
+	// discover also takes the host after the command
+	if appCfg.host == "" && len(args) > 1 && args[0] == "discover" && !strings.HasPrefix(args[1], "-") {
+		appCfg.host, appCfg.port, err = formatSNMPHostPort(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			rlog.ErrMsg(err.Error())
+			os.Exit(1)
+		}
+		args = append(args[:1], args[2:]...)
+	}
+
+	err = readCLI(args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		rlog.ErrMsg(err.Error())
@@ -173,33 +195,54 @@ func main() {
         os.Exit(1)
     }
 
-	executeCmd(flag.Args())
+	if appCfg.server != "" {
+		cmd.UseServer(appCfg.server)
+	}
+
+	err = executeCmd(args)
 
 	rlog.NoticeMsg("%s shutting down", os.Args[0])
+
+	os.Exit(cmd.ExitCode(err))
 }
 
-func executeCmd(parms []string) {
+func executeCmd(parms []string) error {
 
 	var err error
 
 	switch appCfg.cmd {
 	case "poll":
-		err = cmd.Poll(appCfg.host, appCfg.port, appCfg.rpmCfg, parms[1:])
+		err = cmd.Poll(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
 	case "status":
-		err = cmd.Status(appCfg.host, appCfg.port, appCfg.rpmCfg, parms[1:])
+		err = cmd.Status(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
 	case "relay":
-		err = cmd.Relay(appCfg.host, appCfg.port, appCfg.rpmCfg, parms[1:])
+		err = cmd.Relay(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
+	case "simulate":
+		err = cmd.Simulate(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
+	case "serve":
+		err = cmd.Serve(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
+	case "config":
+		err = cmd.Config(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
+	case "watchdog":
+		err = cmd.Watchdog(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
+	case "discover":
+		err = cmd.Discover(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
+	case "traps":
+		err = cmd.Traps(appCfg.host, appCfg.port, appCfg.rpmCfg, parms)
 	}
 
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		rlog.ErrMsg(err.Error())
 	}
+
+	return err
 }
 
 func initFlags() {
 
 	flag.BoolVar(&appCfg.debug, "debug", false, "enable debug logging")
+	flag.StringVar(&appCfg.server, "server", "", "URL of a running rpm daemon to use instead of the device")
 	// flag.StringVar(&appCfg.cfgFile, "config", "", "specify config file")
 	flag.Parse()
 
@@ -210,6 +253,12 @@ func validCmd(cmd string) bool {
 		"poll",
 		"status",
 		"relay",
+		"simulate",
+		"serve",
+		"config",
+		"watchdog",
+		"discover",
+		"traps",
 	}
 	for _, n := range validCommands {
 		if cmd == n {
@@ -219,51 +268,200 @@ func validCmd(cmd string) bool {
 	return false
 }
 
+// hostOptional reports whether the command of parms can run without <hostname-or-ip[:port]>
+func hostOptional(parms []string) bool {
+	name := parms[0]
+	if name == "config" || (name == "relay" && cmd.RelaySubCommand(parms) == "history") {
+		return true
+	}
+	// poll, serve and traps run for the [[devices]] of the config
+	if name == "poll" || name == "serve" || name == "traps" {
+		return true
+	}
+	clientCommands := []string{
+		"poll",
+		"status",
+		"relay",
+	}
+	if appCfg.server != "" {
+		for _, n := range clientCommands {
+			if name == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // read CLI flags adjust app config appropriately
 func readCLI(parms []string) error {
 
 	var err error
 
-	// sanity check on params; needs at least host and cmd
-	if len(parms) < 2 {
+	// sanity check on params; needs at least cmd
+	if len(parms) < 1 {
 		err := errors.New("command line error, not enough parameters")
 		return err
 	}
 
 	// get command
-	cmd := parms[1]
+	cmd := parms[0]
 	if !validCmd(cmd) {
 		err = fmt.Errorf("invalid command: %s", cmd)
 		return err
 	}
+	if appCfg.host == "" && !hostOptional(parms) {
+		err = fmt.Errorf("command line error, the %s command requires a hostname-or-ip", cmd)
+		return err
+	}
 	appCfg.cmd = cmd
 
+	// config check [file] checks file instead of the usual rpm.toml
+	if cmd == "config" && len(parms) > 2 {
+		appCfg.cfgFile, err = filepath.Abs(parms[2])
+		if err != nil {
+			return err
+		}
+	}
+
 	return err
 }
 
 func usage() {
 	usagesMsg := `
-usage: rpm <hostname-or-ip[:port]> <command> [ command-parameters ]
+usage: rpm [-debug] [-server <url>] <hostname-or-ip[:port]> <command> [ command-parameters ]
+
+    -server <url>         - use the rpm daemon at <url> (see serve) instead of
+                            connecting to the device; <hostname-or-ip[:port]>
+                            may then be omitted for status, poll and relay
 
 Commands:
-    status                - display Tycon TPDin2 current values
+    status [--format <fmt>]
+                          - display Tycon TPDin2 current values as
+                            text (the default), json, ndjson or csv,
+                            flagging values in alarm per [[alarms]]
 
-    poll <interval-secs>  - will poll TPDin device repeatedly, 
+    poll <interval-secs> [--format <fmt>] [--scaled] [--metrics <addr>] [--buffer <dir>]
+                          - will poll TPDin device repeatedly, 
                             outputing results to stdout in
-                            txtoida10 version 2 format
-
-    relay <sub-command>, where <sub-sommand> is one of:
+                            txtoida10 version 2 format (text, the
+                            default), json, ndjson, csv or as miniSEED
+                            records (mseed2 or mseed3) with one
+                            channel per chancode; --scaled writes text
+                            values in the engineering units of [oids];
+                            with --metrics also serve Prometheus
+                            metrics on <addr>/metrics; with --buffer
+                            (or [buffer] dir) scans are kept in an
+                            on-disk ring buffer in <dir> and output
+                            resumes from it after a stall or restart.
+                            Without a host it polls all [[devices]] of
+                            rpm.toml concurrently and merges their
+                            output (not the json format); buffers are
+                            then kept in <dir>/<device name>. Values
+                            frozen, implausible or stepping per the
+                            [[quality]] rules are logged and flagged in
+                            the json, ndjson and csv output, in miniSEED
+                            by the data quality indicator Q and the data
+                            quality flags; the text output is unchanged
+
+    relay [--yes] [--dry-run] [--force] <sub-command>, where <sub-sommand> is one of:
 	
-        show  <relay-#>                   - to show current state of relay
-        cycle <relay-#>                   - to cycle relay
-        set   <relay-#> { open | closed } - set relay to a new state
+        show  [<relay>]                   - to show current state of relay,
+                                            or of all relays
+        cycle <relay>                     - to cycle relay
+        set   <relay> { open | closed }   - set relay to a new state
+        history [--since <time>] [--until <time>] [--relay <relay>]
+                [--format text|json]      - list the relay actions in the
+                                            audit trail, needs no host
+
+        <relay> is the relay number (1 to the number of relays in [oids]),
+        its chancode (RL1) or its label (quoted if it has spaces).
+        --yes skips the confirmation, --dry-run reports what would change.
+        Relays confirm per their confirm policy in rpm.toml (always, never
+        or tty). Actions the [interlock] policy of rpm.toml does not allow
+        from this host, or with the other relays of a group open, are
+        refused; --force is required for protected relays. Exit status is
+        0 on success, 1 on failure, 2 if the action was declined and 3 if
+        it was refused. A cycle that was started exits 4 if the relay was
+        never seen to change, 5 if it did not change back in time and 6 if
+        the device stopped responding. Set and cycle actions are recorded
+        with who ran them in the [audit] file; history times are a
+        duration ago (24h) or a UTC time (2020-11-01T15:04)
+
+    serve [--listen <addr>] [--interval <duration>]
+                          - poll the device continuously and serve the
+                            latest scan, device info, relay states and
+                            relay set/cycle actions as an HTTP/JSON API
+                            and Prometheus metrics on /metrics
+                            (defaults from [server] in rpm.toml); runs
+                            the relay actions of [[schedules]]. Without
+                            a host it serves all [[devices]], each under
+                            /devices/<name>, listed on /api/v1/devices
+
+    watchdog              - ping or TCP check the [watchdog] targets and
+                            cycle the relay powering a target after
+                            repeated failures, with a cool-down and a
+                            daily limit, recording each step in the
+                            audit trail ([audit] file)
+
+    discover [--root <oid>] [--draft] [--profile <name>]
+                          - walk the Tycon enterprise subtree
+                            (1.3.6.1.4.1.45621), or <oid>, printing
+                            each OID with its type and value; --draft
+                            prints a draft [oids] section instead, with
+                            the OIDs of [oids] (or of the profile) as
+                            configured and the categories of new OIDs
+                            guessed from their values. The host may
+                            also follow the command
+
+    traps [--listen <addr>] [--format text|ndjson]
+                          - listen for the SNMP v2c and v3 traps and
+                            informs of the device (on [traps] listen,
+                            :162 by default), logging and writing each
+                            with its varbinds mapped to the chancodes
+                            and labels of [oids], updating [[alarms]]
+                            and sending [[notify]] events as poll does.
+                            Traps are accepted with the SNMP settings
+                            of the device ([traps] community for v2c,
+                            [snmp.v3] engineid for v3). Without a host
+                            it accepts the traps of all [[devices]],
+                            or of any host if there are none
+
+    config check [<file>]  - validate rpm.toml, or <file>, reporting all
+                            problems found without contacting a device,
+                            with the [oids] profile, if any, resolved
+
+    simulate              - run a TPDin2 simulator listening on
+                            <hostname-or-ip[:port]> (UDP) using the
+                            OIDs and [simulator] settings in rpm.toml
 
 Examples:
     rpm 192.168.1.25 status        
+    rpm 192.168.1.25 status --format json
     rpm 192.168.1.25 poll 1
+    rpm 192.168.1.25 poll 10 --format mseed2 > rpm.mseed
+    rpm 192.168.1.25 poll 5 --format ndjson
+    rpm 192.168.1.25 poll 10 --metrics :9161
+    rpm 192.168.1.25 poll 1 --buffer buf/rpm
     rpm 192.168.1.25 relay cycle 2 
     rpm 192.168.1.25 relay show 2 
     rpm 192.168.1.25 relay set 3 closed  
+    rpm 192.168.1.25 relay --yes cycle 2
+    rpm 192.168.1.25 relay show
+    rpm 192.168.1.25 relay set RL2 open
+    rpm relay history --since 24h --relay RL1
+    rpm 127.0.0.1:1161 simulate
+    rpm 192.168.1.25 serve --listen 127.0.0.1:8161 --interval 5s
+    rpm -server http://127.0.0.1:8161 status
+    rpm poll 1
+    rpm serve
+    rpm -server http://127.0.0.1:8161/devices/vault2 relay show
+    rpm 192.168.1.25 watchdog
+    rpm discover 192.168.1.25
+    rpm 192.168.1.25 discover --draft --profile tpdin2-fw2.x
+    rpm 192.168.1.25 traps --listen :1162 --format ndjson
+    rpm traps
+    rpm config check /home/nrts/etc/rpm.toml
 	`
 	fmt.Println(usagesMsg)
 }
@@ -295,7 +493,13 @@ func initTPDin2Config(rpmCfgFile string) (*config.RPMConfig, error) {
 		viper.SetConfigType("toml")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// read in environment variables that match, e.g. RPM_SNMP_TIMEOUT for snmp.timeout
+	viper.SetEnvPrefix("rpm")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	for _, key := range config.SNMPEnvKeys {
+		viper.BindEnv(key)
+	}
+	viper.AutomaticEnv()
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err != nil {
@@ -305,13 +509,26 @@ func initTPDin2Config(rpmCfgFile string) (*config.RPMConfig, error) {
 	rlog.NoticeMsg(fmt.Sprintf("Using config file: %s", viper.ConfigFileUsed()))
 
 	rpmCfg := config.NewConfig()
-	viper.Unmarshal(&rpmCfg)
+	if err := rpmCfg.Unmarshal(viper.GetViper()); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", viper.ConfigFileUsed(), err)
+	}
 	rpmCfg.CfgFile = viper.ConfigFileUsed()
+	if err := rpmCfg.ApplyProfiles(); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", rpmCfg.CfgFile, err)
+	}
+	rpmCfg.ApplyDefaults()
 
+	// the config command reports validation problems itself
+	if appCfg.cmd == "config" {
+		return rpmCfg, nil
+	}
 	if err := rpmCfg.Validate(); err != nil {
-		fmt.Printf(err.Error())
 		return nil, err
 	}
+	// a host given on the command line uses the top level [oids]
+	if appCfg.host != "" && len(rpmCfg.Oids.Relays) == 0 {
+		return nil, fmt.Errorf("config file %s: no relays configured in [oids], required for host %s", rpmCfg.CfgFile, appCfg.host)
+	}
 
 	return rpmCfg, err
 }
@@ -0,0 +1,309 @@
+// Package metrics exposes scans and polling counters in the Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"rpm/config"
+	"rpm/tycon"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ContentType of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// family describes a metric; category selects the OIDs of a gauge family.
+// The name of a family with units is suffixed with the units of its OIDs,
+// so OIDs in different units are different metrics
+type family struct {
+	name     string
+	help     string
+	kind     string
+	category string
+	units    bool
+}
+
+// families are written in this order
+var families = []family{
+	{"rpm_relay_closed", "Relay state, 1 if closed and 0 if open.", "gauge", "relays", false},
+	{"rpm_voltage", "Measured voltage", "gauge", "voltages", true},
+	{"rpm_current", "Measured current", "gauge", "currents", true},
+	{"rpm_temperature", "Measured temperature", "gauge", "temps", true},
+	{"rpm_scan_timestamp_seconds", "Unix time of the most recent scan.", "gauge", "", false},
+	{"rpm_snmp_errors_total", "SNMP request errors.", "counter", "", false},
+	{"rpm_scans_missed_total", "Scans missing from the polling sequence.", "counter", "", false},
+	{"rpm_scans_repeated_total", "Scans repeated to fill a missing scan.", "counter", "", false},
+}
+
+// unitSuffixes are the metric name suffixes of common spellings of units
+var unitSuffixes = map[string]string{
+	"v":              "volts",
+	"volt":           "volts",
+	"mv":             "millivolts",
+	"a":              "amps",
+	"amp":            "amps",
+	"amperes":        "amps",
+	"ma":             "milliamps",
+	"c":              "celsius",
+	"degc":           "celsius",
+	"deg c":          "celsius",
+	"deg celsius":    "celsius",
+	"f":              "fahrenheit",
+	"degf":           "fahrenheit",
+	"deg f":          "fahrenheit",
+	"deg fahrenheit": "fahrenheit",
+}
+
+// unitSuffix returns the metric name suffix for units: the known spellings
+// of unitSuffixes, or units in lower case with characters not allowed in
+// a metric name as underscores
+func unitSuffix(units string) string {
+
+	units = strings.ToLower(strings.TrimSpace(units))
+	if suffix, ok := unitSuffixes[units]; ok {
+		return suffix
+	}
+
+	suffix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, units)
+
+	return strings.Trim(suffix, "_")
+}
+
+// metricName returns the name of the metric of fam for an OID in units,
+// and its help text
+func (fam family) metricName(units string) (string, string) {
+
+	if !fam.units {
+		return fam.name, fam.help
+	}
+	suffix := unitSuffix(units)
+	if suffix == "" {
+		return fam.name, fam.help + "."
+	}
+
+	return fam.name + "_" + suffix, fam.help + " in " + strings.Replace(suffix, "_", " ", -1) + "."
+}
+
+// Collector holds the metrics of one device
+type Collector struct {
+	rpmCfg *config.RPMConfig
+
+	mutex       sync.Mutex
+	values      map[string]string
+	lastScan    time.Time
+	gapInterval time.Duration
+	errorSource func() uint64
+
+	snmpErrors uint64
+	missed     uint64
+	repeated   uint64
+}
+
+// NewCollector returns a Collector for the device described by rpmCfg
+func NewCollector(rpmCfg *config.RPMConfig) *Collector {
+	return &Collector{
+		rpmCfg: rpmCfg,
+		values: make(map[string]string),
+	}
+}
+
+// SetErrorSource adds the count returned by fn, e.g. from a tycon.ErrorCounter, to the SNMP errors
+func (c *Collector) SetErrorSource(fn func() uint64) {
+	c.mutex.Lock()
+	c.errorSource = fn
+	c.mutex.Unlock()
+}
+
+// CountGaps makes Observe count the scans missing between observed scans
+// that are expected every interval
+func (c *Collector) CountGaps(interval time.Duration) {
+	c.mutex.Lock()
+	c.gapInterval = interval
+	c.mutex.Unlock()
+}
+
+// Observe updates the gauges from scan, in the engineering units of the OIDs
+func (c *Collector) Observe(scan *tycon.TPDin2Scan) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.gapInterval > 0 && !c.lastScan.IsZero() {
+		gap := scan.TS.Sub(c.lastScan)
+		if missed := int64(math.Round(float64(gap)/float64(c.gapInterval))) - 1; missed > 0 {
+			atomic.AddUint64(&c.missed, uint64(missed))
+		}
+	}
+	if scan.TS.After(c.lastScan) {
+		c.lastScan = scan.TS
+	}
+
+	for key, val := range scan.Data {
+		c.values[key] = val
+	}
+}
+
+// IncSNMPErrors counts an SNMP error
+func (c *Collector) IncSNMPErrors() {
+	atomic.AddUint64(&c.snmpErrors, 1)
+}
+
+// IncMissed counts a missed scan
+func (c *Collector) IncMissed() {
+	atomic.AddUint64(&c.missed, 1)
+}
+
+// IncRepeated counts a repeated scan
+func (c *Collector) IncRepeated() {
+	atomic.AddUint64(&c.repeated, 1)
+}
+
+// oids returns the OIDs of category
+func (c *Collector) oids(category string) []config.OidInfo {
+	switch category {
+	case "relays":
+		return c.rpmCfg.Oids.Relays
+	case "voltages":
+		return c.rpmCfg.Oids.Voltages
+	case "currents":
+		return c.rpmCfg.Oids.Currents
+	case "temps":
+		return c.rpmCfg.Oids.Temps
+	}
+	return nil
+}
+
+// writeSamples writes the samples of the metric name of fam for this device
+func (c *Collector) writeSamples(w io.Writer, fam family, name string) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	station := [][2]string{
+		{"net", c.rpmCfg.General.Net},
+		{"sta", c.rpmCfg.General.Sta},
+		{"loc", c.rpmCfg.General.Loc},
+	}
+
+	var val float64
+	switch fam.name {
+	case "rpm_scan_timestamp_seconds":
+		if c.lastScan.IsZero() {
+			return nil
+		}
+		val = float64(c.lastScan.UnixNano()) / 1e9
+	case "rpm_snmp_errors_total":
+		val = float64(atomic.LoadUint64(&c.snmpErrors))
+		if c.errorSource != nil {
+			val += float64(c.errorSource())
+		}
+	case "rpm_scans_missed_total":
+		val = float64(atomic.LoadUint64(&c.missed))
+	case "rpm_scans_repeated_total":
+		val = float64(atomic.LoadUint64(&c.repeated))
+	default:
+		for _, info := range c.oids(fam.category) {
+			if metric, _ := fam.metricName(info.Units); metric != name {
+				continue
+			}
+			val, err := info.Value(c.values[info.Oid])
+			if err != nil {
+				continue
+			}
+			labels := append(station[:len(station):len(station)],
+				[2]string{"chancode", info.Chancode},
+				[2]string{"label", info.Label})
+			if err := writeSample(w, name, labels, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return writeSample(w, fam.name, station, val)
+}
+
+// Handler returns an http.Handler serving the metrics of collectors
+func Handler(collectors ...*Collector) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if err := Write(w, collectors...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Write the metrics of collectors to w
+func Write(w io.Writer, collectors ...*Collector) error {
+
+	for _, fam := range families {
+		names, helps := metricNames(fam, collectors)
+		for i, name := range names {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helps[i], name, fam.kind); err != nil {
+				return err
+			}
+			for _, c := range collectors {
+				if err := c.writeSamples(w, fam, name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// metricNames returns the metric names of fam, and their help texts, in
+// the order of the OIDs of collectors: one per units of the OIDs of a
+// family with units
+func metricNames(fam family, collectors []*Collector) ([]string, []string) {
+
+	if !fam.units {
+		return []string{fam.name}, []string{fam.help}
+	}
+
+	var names, helps []string
+	seen := make(map[string]bool)
+	for _, c := range collectors {
+		for _, info := range c.oids(fam.category) {
+			name, help := fam.metricName(info.Units)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+				helps = append(helps, help)
+			}
+		}
+	}
+
+	return names, helps
+}
+
+// writeSample writes a sample line with labels in the given order
+func writeSample(w io.Writer, name string, labels [][2]string, val float64) error {
+
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label[0], escapeLabel(label[1])))
+	}
+
+	_, err := fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(val, 'g', -1, 64))
+
+	return err
+}
+
+// escapeLabel escapes a label value for the text format
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
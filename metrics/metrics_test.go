@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"rpm/config"
+	"rpm/tycon"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	rl1Oid = "1.3.6.1.4.1.45621.2.2.1.0"
+	mv1Oid = "1.3.6.1.4.1.45621.2.2.5.0"
+	mv2Oid = "1.3.6.1.4.1.45621.2.2.6.0"
+	mc1Oid = "1.3.6.1.4.1.45621.2.2.9.0"
+	tpeOid = "1.3.6.1.4.1.45621.2.2.13.0"
+)
+
+// testConfig is a station with MV2 in millivolts and the other OIDs in the
+// units of their category
+func testConfig(sta string) *config.RPMConfig {
+
+	rpmCfg := config.NewConfig()
+	rpmCfg.General.Net, rpmCfg.General.Sta, rpmCfg.General.Loc = "II", sta, "25"
+	rpmCfg.Oids.Relays = []config.OidInfo{{Oid: rl1Oid, Chancode: "RL1", Label: "Primary"}}
+	rpmCfg.Oids.Voltages = []config.OidInfo{
+		{Oid: mv1Oid, Chancode: "MV1", Label: "Battery"},
+		{Oid: mv2Oid, Chancode: "MV2", Label: "Sensor \"B\"", Scale: 1, Units: "mV"},
+	}
+	rpmCfg.Oids.Currents = []config.OidInfo{{Oid: mc1Oid, Chancode: "MC1", Label: "Load"}}
+	rpmCfg.Oids.Temps = []config.OidInfo{{Oid: tpeOid, Chancode: "TPE", Label: "Temp (Ext)"}}
+	rpmCfg.ApplyDefaults()
+
+	return rpmCfg
+}
+
+func TestWrite(t *testing.T) {
+
+	ts := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	c := NewCollector(testConfig("VALT"))
+	c.CountGaps(10 * time.Second)
+	c.SetErrorSource(func() uint64 { return 2 })
+	c.Observe(&tycon.TPDin2Scan{TS: ts, Data: map[string]string{rl1Oid: "1", mv1Oid: "132", mv2Oid: "1250", mc1Oid: "15", tpeOid: "215"}})
+	c.Observe(&tycon.TPDin2Scan{TS: ts.Add(30 * time.Second), Data: map[string]string{mv1Oid: "131"}})
+	c.IncSNMPErrors()
+	c.IncRepeated()
+
+	// a second device without values yet
+	other := NewCollector(testConfig("PFO"))
+
+	var out bytes.Buffer
+	if err := Write(&out, c, other); err != nil {
+		t.Fatal(err)
+	}
+
+	station := `net="II",sta="VALT",loc="25"`
+	want := strings.Join([]string{
+		`# HELP rpm_relay_closed Relay state, 1 if closed and 0 if open.`,
+		`# TYPE rpm_relay_closed gauge`,
+		`rpm_relay_closed{` + station + `,chancode="RL1",label="Primary"} 1`,
+		`# HELP rpm_voltage_volts Measured voltage in volts.`,
+		`# TYPE rpm_voltage_volts gauge`,
+		`rpm_voltage_volts{` + station + `,chancode="MV1",label="Battery"} 13.1`,
+		`# HELP rpm_voltage_millivolts Measured voltage in millivolts.`,
+		`# TYPE rpm_voltage_millivolts gauge`,
+		`rpm_voltage_millivolts{` + station + `,chancode="MV2",label="Sensor \"B\""} 1250`,
+		`# HELP rpm_current_amps Measured current in amps.`,
+		`# TYPE rpm_current_amps gauge`,
+		`rpm_current_amps{` + station + `,chancode="MC1",label="Load"} 1.5`,
+		`# HELP rpm_temperature_celsius Measured temperature in celsius.`,
+		`# TYPE rpm_temperature_celsius gauge`,
+		`rpm_temperature_celsius{` + station + `,chancode="TPE",label="Temp (Ext)"} 21.5`,
+		`# HELP rpm_scan_timestamp_seconds Unix time of the most recent scan.`,
+		`# TYPE rpm_scan_timestamp_seconds gauge`,
+		`rpm_scan_timestamp_seconds{` + station + `} 1.60423203e+09`,
+		`# HELP rpm_snmp_errors_total SNMP request errors.`,
+		`# TYPE rpm_snmp_errors_total counter`,
+		`rpm_snmp_errors_total{` + station + `} 3`,
+		`rpm_snmp_errors_total{net="II",sta="PFO",loc="25"} 0`,
+		`# HELP rpm_scans_missed_total Scans missing from the polling sequence.`,
+		`# TYPE rpm_scans_missed_total counter`,
+		`rpm_scans_missed_total{` + station + `} 2`,
+		`rpm_scans_missed_total{net="II",sta="PFO",loc="25"} 0`,
+		`# HELP rpm_scans_repeated_total Scans repeated to fill a missing scan.`,
+		`# TYPE rpm_scans_repeated_total counter`,
+		`rpm_scans_repeated_total{` + station + `} 1`,
+		`rpm_scans_repeated_total{net="II",sta="PFO",loc="25"} 0`,
+		``,
+	}, "\n")
+	if got := out.String(); got != want {
+		t.Errorf("exposition\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnitSuffix(t *testing.T) {
+
+	tests := []struct {
+		units string
+		want  string
+	}{
+		{"volts", "volts"},
+		{"V", "volts"},
+		{"mV", "millivolts"},
+		{"amps", "amps"},
+		{"A", "amps"},
+		{"deg celsius", "celsius"},
+		{"degC", "celsius"},
+		{"deg F", "fahrenheit"},
+		{"kW h", "kw_h"},
+		{"%", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := unitSuffix(tt.units); got != tt.want {
+			t.Errorf("unitSuffix(%q) = %q, want %q", tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+
+	rpmCfg := testConfig("VALT")
+	rpmCfg.Oids.Voltages[0].Units = ""
+	c := NewCollector(rpmCfg)
+	c.Observe(&tycon.TPDin2Scan{TS: time.Now(), Data: map[string]string{mv1Oid: "132"}})
+
+	rec := httptest.NewRecorder()
+	Handler(c).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("content type %q, want %q", ct, ContentType)
+	}
+
+	// a voltage without units has no suffix
+	body := rec.Body.String()
+	if !strings.Contains(body, "# HELP rpm_voltage Measured voltage.\n") ||
+		!strings.Contains(body, `rpm_voltage{net="II",sta="VALT",loc="25",chancode="MV1",label="Battery"} 13.2`) {
+		t.Errorf("metrics without units\n%s", body)
+	}
+}
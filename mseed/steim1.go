@@ -0,0 +1,94 @@
+package mseed
+
+import (
+	"encoding/binary"
+)
+
+const (
+	steimFrameSize  int = 64
+	steimFrameWords int = 16
+
+	// nibble codes for Steim1 data words
+	nibbleSpecial uint32 = 0
+	nibbleByte    uint32 = 1
+	nibbleHalf    uint32 = 2
+	nibbleWord    uint32 = 3
+)
+
+// steim1Encode packs samples into at most maxFrames Steim1 frames. prev is the
+// last sample of the preceding record, used for the first difference.
+// It returns the encoded frames and the number of samples that fit.
+func steim1Encode(samples []int32, prev int32, maxFrames int) ([]byte, int) {
+
+	if len(samples) == 0 || maxFrames < 1 {
+		return nil, 0
+	}
+
+	diffs := make([]int32, len(samples))
+	diffs[0] = samples[0] - prev
+	for i := 1; i < len(samples); i++ {
+		diffs[i] = samples[i] - samples[i-1]
+	}
+
+	frames := make([]uint32, 0, maxFrames*steimFrameWords)
+	ndx := 0
+	for f := 0; f < maxFrames && ndx < len(diffs); f++ {
+
+		frame := make([]uint32, steimFrameWords)
+		first := 1
+		if f == 0 {
+			// words 1 and 2 of the first frame hold the forward and reverse integration constants
+			frame[1] = uint32(samples[0])
+			first = 3
+		}
+
+		for w := first; w < steimFrameWords && ndx < len(diffs); w++ {
+			nibble, word, n := steim1Word(diffs[ndx:])
+			frame[0] |= nibble << uint(2*(steimFrameWords-1-w))
+			frame[w] = word
+			ndx += n
+		}
+		frames = append(frames, frame...)
+	}
+
+	// reverse integration constant is the last sample packed
+	frames[2] = uint32(samples[ndx-1])
+
+	out := make([]byte, 4*len(frames))
+	for i, word := range frames {
+		binary.BigEndian.PutUint32(out[4*i:], word)
+	}
+
+	return out, ndx
+}
+
+// steim1Word packs as many of diffs as possible into a single data word
+func steim1Word(diffs []int32) (uint32, uint32, int) {
+
+	if len(diffs) >= 4 && fitsIn(diffs[:4], 8) {
+		var word uint32
+		for i := 0; i < 4; i++ {
+			word |= uint32(uint8(int8(diffs[i]))) << uint(24-8*i)
+		}
+		return nibbleByte, word, 4
+	}
+
+	if len(diffs) >= 2 && fitsIn(diffs[:2], 16) {
+		word := uint32(uint16(int16(diffs[0])))<<16 | uint32(uint16(int16(diffs[1])))
+		return nibbleHalf, word, 2
+	}
+
+	return nibbleWord, uint32(diffs[0]), 1
+}
+
+// fitsIn reports whether all vals fit in a signed integer of bits
+func fitsIn(vals []int32, bits uint) bool {
+
+	limit := int32(1) << (bits - 1)
+	for _, val := range vals {
+		if val < -limit || val >= limit {
+			return false
+		}
+	}
+	return true
+}
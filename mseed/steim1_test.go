@@ -0,0 +1,124 @@
+package mseed
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// steim1Decode returns the differences in the Steim1 frames of data, and
+// the forward and reverse integration constants
+func steim1Decode(t *testing.T, data []byte) ([]int32, int32, int32) {
+
+	if len(data)%steimFrameSize != 0 {
+		t.Fatalf("%d bytes of Steim1 data, not whole frames", len(data))
+	}
+
+	var diffs []int32
+	var x0, xn int32
+	for f := 0; f < len(data)/steimFrameSize; f++ {
+		words := make([]uint32, steimFrameWords)
+		for w := range words {
+			words[w] = binary.BigEndian.Uint32(data[f*steimFrameSize+4*w:])
+		}
+		first := 1
+		if f == 0 {
+			x0, xn = int32(words[1]), int32(words[2])
+			first = 3
+		}
+		for w := first; w < steimFrameWords; w++ {
+			switch (words[0] >> uint(2*(steimFrameWords-1-w))) & 3 {
+			case nibbleByte:
+				for i := 0; i < 4; i++ {
+					diffs = append(diffs, int32(int8(words[w]>>uint(24-8*i))))
+				}
+			case nibbleHalf:
+				diffs = append(diffs, int32(int16(words[w]>>16)), int32(int16(words[w])))
+			case nibbleWord:
+				diffs = append(diffs, int32(words[w]))
+			}
+		}
+	}
+
+	return diffs, x0, xn
+}
+
+// steim1Samples integrates the first n differences of data from its forward
+// integration constant, checking the first difference is from prev and the
+// reverse integration constant is the last sample
+func steim1Samples(t *testing.T, data []byte, n int, prev int32) []int32 {
+
+	diffs, x0, xn := steim1Decode(t, data)
+	if len(diffs) < n {
+		t.Fatalf("%d differences decoded, want %d", len(diffs), n)
+	}
+	if diffs[0] != x0-prev {
+		t.Errorf("first difference %d, want %d from the previous sample %d", diffs[0], x0-prev, prev)
+	}
+
+	samples := make([]int32, n)
+	samples[0] = x0
+	for i := 1; i < n; i++ {
+		samples[i] = samples[i-1] + diffs[i]
+	}
+	if samples[n-1] != xn {
+		t.Errorf("reverse integration constant %d, want the last sample %d", xn, samples[n-1])
+	}
+
+	return samples
+}
+
+func TestSteim1RoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		samples []int32
+		prev    int32
+	}{
+		{"constant", []int32{125, 125, 125, 125, 125, 125, 125, 125}, 0},
+		{"bytes", []int32{125, 126, 124, 127, -1, 0, 127, 100}, 125},
+		{"halfwords", []int32{0, 1000, -1000, 30000, 200, -32768}, -5},
+		{"words", []int32{2147483647, -2147483648, 0, 1 << 20, -(1 << 24)}, 7},
+		{"mixed", []int32{1, 2, 3, 4, 5000, 5001, 5002, 5003, 5004, 100000, 3, 2, 1}, 1},
+		{"single", []int32{-42}, 0},
+	}
+
+	for _, tt := range tests {
+		data, n := steim1Encode(tt.samples, tt.prev, maxFrames)
+		if n != len(tt.samples) {
+			t.Errorf("%s: %d samples encoded, want %d", tt.name, n, len(tt.samples))
+			continue
+		}
+		got := steim1Samples(t, data, n, tt.prev)
+		for i := range tt.samples {
+			if got[i] != tt.samples[i] {
+				t.Errorf("%s: decoded %v, want %v", tt.name, got, tt.samples)
+				break
+			}
+		}
+	}
+}
+
+func TestSteim1Frames(t *testing.T) {
+
+	// differences that each need a word fill 13 words of the first frame
+	// and 15 of each following one
+	samples := make([]int32, 100)
+	for i := range samples {
+		samples[i] = int32(i%2) << 30
+	}
+
+	data, n := steim1Encode(samples, 0, 2)
+	if len(data) != 2*steimFrameSize || n != 13+15 {
+		t.Fatalf("%d bytes with %d samples, want 2 frames of %d samples", len(data), n, 13+15)
+	}
+	got := steim1Samples(t, data, n, 0)
+	for i := 0; i < n; i++ {
+		if got[i] != samples[i] {
+			t.Fatalf("decoded %v, want %v", got, samples[:n])
+		}
+	}
+
+	if data, n := steim1Encode(nil, 0, maxFrames); data != nil || n != 0 {
+		t.Errorf("encoding no samples returned %d bytes and %d samples", len(data), n)
+	}
+}
@@ -0,0 +1,368 @@
+// Package mseed writes integer time series as miniSEED v2 or v3 records
+package mseed
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// Supported miniSEED format versions
+const (
+	Version2 int = 2
+	Version3 int = 3
+)
+
+const (
+	encodingSteim1 uint8 = 10
+
+	// v2 records are 512 bytes: 48 byte fixed header, blockette 1000 and data
+	v2RecordLength int   = 512
+	v2RecordExp    uint8 = 9
+	v2DataOffset   int   = 64
+	v2MaxSequence  int   = 999999
+
+	v3HeaderLength int = 40
+	v3MaxSIDLength int = 255
+
+	// data quality indicators of unchecked and quality controlled records
+	qualityIndeterminate byte = 'D'
+	qualityControlled    byte = 'Q'
+
+	// both versions pack the same number of Steim1 frames per record
+	maxFrames int = (v2RecordLength - v2DataOffset) / steimFrameSize
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// v3PubVersions are the v3 publication versions of the v2 data quality
+// indicators
+var v3PubVersions = map[byte]uint8{'R': 1, 'D': 2, 'Q': 3, 'M': 4}
+
+// Flags are data quality flags of a sample, with the bits of the v2 data
+// quality flags
+type Flags uint8
+
+// Data quality flags
+const (
+	FlagSpikes      Flags = 1 << 2
+	FlagGlitches    Flags = 1 << 3
+	FlagMissingData Flags = 1 << 4
+)
+
+// v3FlagNames are the FDSN.Flags extra headers of v3 records for the flags
+var v3FlagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagSpikes, "Spikes"},
+	{FlagGlitches, "Glitches"},
+	{FlagMissingData, "MissingData"},
+}
+
+// Quality is the data quality of a sample. A record has the Flags of any
+// of its samples, and the quality indicator Q if they were Checked, else D
+type Quality struct {
+	Checked bool
+	Flags   Flags
+}
+
+// Channel identifies a time series by its SEED codes
+type Channel struct {
+	Net  string
+	Sta  string
+	Loc  string
+	Chan string
+}
+
+// String returns the channel as NET.STA.LOC.CHAN
+func (ch Channel) String() string {
+	return fmt.Sprintf("%s.%s.%s.%s", ch.Net, ch.Sta, ch.Loc, ch.Chan)
+}
+
+// sid returns the FDSN source identifier of the channel, e.g. FDSN:II_VALT_25_M_V_1
+func (ch Channel) sid() string {
+
+	var codes []string
+	for _, r := range ch.Chan {
+		codes = append(codes, string(r))
+	}
+	if len(codes) != 3 {
+		// not a band/source/subsource code, use it as the source
+		codes = []string{"", ch.Chan, ""}
+	}
+
+	return fmt.Sprintf("FDSN:%s_%s_%s_%s", ch.Net, ch.Sta, ch.Loc, strings.Join(codes, "_"))
+}
+
+// stream holds the samples of a channel not yet written
+type stream struct {
+	ch      Channel
+	start   time.Time
+	samples []int32
+	quality []Quality
+	prev    int32
+}
+
+// recordQuality returns the data quality indicator and flags of a record
+// of the first n samples
+func (s *stream) recordQuality(n int) (byte, Flags) {
+
+	indicator := qualityIndeterminate
+	var flags Flags
+	for _, q := range s.quality[:n] {
+		if q.Checked {
+			indicator = qualityControlled
+		}
+		flags |= q.Flags
+	}
+
+	return indicator, flags
+}
+
+// next returns the expected time of the next sample
+func (s *stream) next(period time.Duration) time.Time {
+	return s.start.Add(time.Duration(len(s.samples)) * period)
+}
+
+// Writer packs samples of regularly sampled channels into miniSEED records.
+// Samples for a channel are packed into the same record for as long as they
+// are contiguous; a gap starts a new record.
+type Writer struct {
+	w       io.Writer
+	version int
+	period  time.Duration
+	seq     int
+	streams map[Channel]*stream
+}
+
+// NewWriter returns a Writer of miniSEED version records with a sample every period
+func NewWriter(w io.Writer, version int, period time.Duration) (*Writer, error) {
+
+	if version != Version2 && version != Version3 {
+		return nil, fmt.Errorf("unsupported miniSEED version: %d", version)
+	}
+	if period < time.Second || period%time.Second != 0 {
+		return nil, fmt.Errorf("unsupported miniSEED sample period: %s", period)
+	}
+
+	mw := &Writer{
+		w:       w,
+		version: version,
+		period:  period,
+		streams: make(map[Channel]*stream),
+	}
+
+	return mw, nil
+}
+
+// Add a sample for ch at ts with its data quality q, writing any records
+// that are complete
+func (mw *Writer) Add(ch Channel, ts time.Time, val int32, q Quality) error {
+
+	s, ok := mw.streams[ch]
+	if !ok {
+		s = &stream{ch: ch}
+		mw.streams[ch] = s
+	}
+
+	// a sample more than half a period from where it is expected is a gap
+	if len(s.samples) > 0 {
+		offset := ts.Sub(s.next(mw.period))
+		if offset < -mw.period/2 || offset > mw.period/2 {
+			if err := mw.flush(s, len(s.samples)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(s.samples) == 0 {
+		s.start = ts
+	}
+	s.samples = append(s.samples, val)
+	s.quality = append(s.quality, q)
+
+	// write a record once the samples no longer fit in one
+	if _, n := steim1Encode(s.samples, s.prev, maxFrames); n < len(s.samples) {
+		return mw.flush(s, n)
+	}
+
+	return nil
+}
+
+// Flush writes partial records for all channels
+func (mw *Writer) Flush() error {
+
+	for _, s := range mw.streams {
+		if err := mw.flush(s, len(s.samples)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flush writes the first n samples of s as a record
+func (mw *Writer) flush(s *stream, n int) error {
+
+	if n == 0 {
+		return nil
+	}
+
+	data, cnt := steim1Encode(s.samples[:n], s.prev, maxFrames)
+
+	var rec []byte
+	var err error
+	switch mw.version {
+	case Version2:
+		rec, err = mw.recordV2(s, data, cnt)
+	case Version3:
+		rec, err = mw.recordV3(s, data, cnt)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = mw.w.Write(rec); err != nil {
+		return err
+	}
+
+	s.prev = s.samples[cnt-1]
+	s.start = s.start.Add(time.Duration(cnt) * mw.period)
+	s.samples = append(s.samples[:0], s.samples[cnt:]...)
+	s.quality = append(s.quality[:0], s.quality[cnt:]...)
+
+	return nil
+}
+
+// recordV2 builds a 512 byte miniSEED v2 record with a blockette 1000
+func (mw *Writer) recordV2(s *stream, data []byte, cnt int) ([]byte, error) {
+
+	mw.seq++
+	if mw.seq > v2MaxSequence {
+		mw.seq = 1
+	}
+
+	indicator, flags := s.recordQuality(cnt)
+	rec := make([]byte, v2RecordLength)
+	copy(rec[0:6], fmt.Sprintf("%06d", mw.seq))
+	rec[6] = indicator
+	rec[7] = ' '
+	copy(rec[8:13], padCode(s.ch.Sta, 5))
+	copy(rec[13:15], padCode(s.ch.Loc, 2))
+	copy(rec[15:18], padCode(s.ch.Chan, 3))
+	copy(rec[18:20], padCode(s.ch.Net, 2))
+
+	ts := s.start.UTC()
+	be := binary.BigEndian
+	be.PutUint16(rec[20:], uint16(ts.Year()))
+	be.PutUint16(rec[22:], uint16(ts.YearDay()))
+	rec[24] = uint8(ts.Hour())
+	rec[25] = uint8(ts.Minute())
+	rec[26] = uint8(ts.Second())
+	be.PutUint16(rec[28:], uint16(ts.Nanosecond()/100000))
+	be.PutUint16(rec[30:], uint16(cnt))
+
+	// sample rate factor and multiplier; a negative factor is a period in seconds
+	factor := int16(1)
+	if secs := int16(mw.period / time.Second); secs > 1 {
+		factor = -secs
+	}
+	be.PutUint16(rec[32:], uint16(factor))
+	be.PutUint16(rec[34:], 1)
+
+	rec[38] = uint8(flags)
+	rec[39] = 1 // number of blockettes
+	be.PutUint16(rec[44:], uint16(v2DataOffset))
+	be.PutUint16(rec[46:], 48)
+
+	// blockette 1000
+	be.PutUint16(rec[48:], 1000)
+	be.PutUint16(rec[50:], 0)
+	rec[52] = encodingSteim1
+	rec[53] = 1 // big endian
+	rec[54] = v2RecordExp
+
+	copy(rec[v2DataOffset:], data)
+
+	return rec, nil
+}
+
+// recordV3 builds a miniSEED v3 record
+func (mw *Writer) recordV3(s *stream, data []byte, cnt int) ([]byte, error) {
+
+	sid := s.ch.sid()
+	if len(sid) > v3MaxSIDLength {
+		return nil, fmt.Errorf("source identifier too long: %s", sid)
+	}
+
+	indicator, flags := s.recordQuality(cnt)
+	extra, err := v3ExtraHeaders(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := make([]byte, v3HeaderLength+len(sid)+len(extra)+len(data))
+	copy(rec[0:2], "MS")
+	rec[2] = 3
+
+	ts := s.start.UTC()
+	le := binary.LittleEndian
+	le.PutUint32(rec[4:], uint32(ts.Nanosecond()))
+	le.PutUint16(rec[8:], uint16(ts.Year()))
+	le.PutUint16(rec[10:], uint16(ts.YearDay()))
+	rec[12] = uint8(ts.Hour())
+	rec[13] = uint8(ts.Minute())
+	rec[14] = uint8(ts.Second())
+	rec[15] = encodingSteim1
+
+	// sample rate in Hz, or a negative period in seconds
+	rate := 1.0
+	if secs := (mw.period / time.Second); secs > 1 {
+		rate = -float64(secs)
+	}
+	le.PutUint64(rec[16:], math.Float64bits(rate))
+	le.PutUint32(rec[24:], uint32(cnt))
+	rec[32] = v3PubVersions[indicator]
+	rec[33] = uint8(len(sid))
+	le.PutUint16(rec[34:], uint16(len(extra)))
+	le.PutUint32(rec[36:], uint32(len(data)))
+
+	copy(rec[v3HeaderLength:], sid)
+	copy(rec[v3HeaderLength+len(sid):], extra)
+	copy(rec[v3HeaderLength+len(sid)+len(extra):], data)
+
+	le.PutUint32(rec[28:], crc32.Checksum(rec, crc32c))
+
+	return rec, nil
+}
+
+// v3ExtraHeaders returns the JSON extra headers of a v3 record with flags,
+// none if no flags are set
+func v3ExtraHeaders(flags Flags) ([]byte, error) {
+
+	if flags == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool)
+	for _, f := range v3FlagNames {
+		if flags&f.flag != 0 {
+			set[f.name] = true
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{"FDSN": map[string]interface{}{"Flags": set}})
+}
+
+// padCode left justifies code in a space padded field of width characters
+func padCode(code string, width int) string {
+
+	if len(code) > width {
+		return code[:width]
+	}
+	return code + strings.Repeat(" ", width-len(code))
+}
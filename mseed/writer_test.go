@@ -0,0 +1,251 @@
+package mseed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	testChannel = Channel{Net: "II", Sta: "VALT", Loc: "25", Chan: "MV1"}
+	testStart   = time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+)
+
+// writeRecords writes the samples a period apart with their quality as
+// version records
+func writeRecords(t *testing.T, version int, period time.Duration, samples []int32, quality []Quality) []byte {
+
+	var out bytes.Buffer
+	mw, err := NewWriter(&out, version, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, val := range samples {
+		var q Quality
+		if quality != nil {
+			q = quality[i]
+		}
+		if err := mw.Add(testChannel, testStart.Add(time.Duration(i)*period), val, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+func TestRecordQuality(t *testing.T) {
+
+	samples := []int32{125, 125, 160}
+	quality := []Quality{{Checked: true}, {Checked: true, Flags: FlagGlitches}, {Checked: true, Flags: FlagSpikes}}
+
+	rec := writeRecords(t, Version2, time.Second, samples, quality)
+	if rec[6] != 'Q' || Flags(rec[38]) != FlagGlitches|FlagSpikes {
+		t.Errorf("v2 quality %c flags %#x, want Q with glitches and spikes", rec[6], rec[38])
+	}
+	rec = writeRecords(t, Version2, time.Second, samples, nil)
+	if rec[6] != 'D' || rec[38] != 0 {
+		t.Errorf("unchecked v2 quality %c flags %#x, want D without flags", rec[6], rec[38])
+	}
+
+	rec = writeRecords(t, Version3, time.Second, samples, quality)
+	sidLen := int(rec[33])
+	extraLen := int(binary.LittleEndian.Uint16(rec[34:]))
+	extra := string(rec[v3HeaderLength+sidLen : v3HeaderLength+sidLen+extraLen])
+	if want := `{"FDSN":{"Flags":{"Glitches":true,"Spikes":true}}}`; extra != want {
+		t.Errorf("v3 extra headers %s, want %s", extra, want)
+	}
+	if rec[32] != 3 {
+		t.Errorf("v3 publication version %d, want 3 for quality controlled data", rec[32])
+	}
+	rec = writeRecords(t, Version3, time.Second, samples, nil)
+	if rec[32] != 2 || binary.LittleEndian.Uint16(rec[34:]) != 0 {
+		t.Errorf("unchecked v3 publication version %d with extra headers, want 2 without", rec[32])
+	}
+}
+
+func TestRecordV2Layout(t *testing.T) {
+
+	samples := []int32{125, 126, 124, 2000, -70000}
+	rec := writeRecords(t, Version2, 10*time.Second, samples, nil)
+	if len(rec) != v2RecordLength {
+		t.Fatalf("%d bytes written, want one %d byte record", len(rec), v2RecordLength)
+	}
+
+	if got, want := string(rec[0:20]), "000001D VALT 25MV1II"; got != want {
+		t.Errorf("v2 identification %q, want %q", got, want)
+	}
+
+	be := binary.BigEndian
+	start := []int{int(be.Uint16(rec[20:])), int(be.Uint16(rec[22:])), int(rec[24]), int(rec[25]), int(rec[26]), int(be.Uint16(rec[28:]))}
+	if want := []int{2020, 306, 12, 0, 0, 0}; !equalInts(start, want) {
+		t.Errorf("v2 start time %v, want %v", start, want)
+	}
+	if cnt := be.Uint16(rec[30:]); int(cnt) != len(samples) {
+		t.Errorf("v2 sample count %d, want %d", cnt, len(samples))
+	}
+	if factor, mult := int16(be.Uint16(rec[32:])), int16(be.Uint16(rec[34:])); factor != -10 || mult != 1 {
+		t.Errorf("v2 rate factor %d multiplier %d, want -10 for a 10s period and 1", factor, mult)
+	}
+	if rec[39] != 1 || int(be.Uint16(rec[44:])) != v2DataOffset || be.Uint16(rec[46:]) != 48 {
+		t.Errorf("v2 %d blockettes at %d with data at %d, want 1 at 48 with data at %d",
+			rec[39], be.Uint16(rec[46:]), be.Uint16(rec[44:]), v2DataOffset)
+	}
+
+	// blockette 1000 is the last, Steim1 big endian 512 byte records
+	if be.Uint16(rec[48:]) != 1000 || be.Uint16(rec[50:]) != 0 || rec[52] != encodingSteim1 || rec[53] != 1 || rec[54] != 9 {
+		t.Errorf("v2 blockette % x, want 1000 with Steim1, big endian and 2^9 byte records", rec[48:56])
+	}
+
+	got := steim1Samples(t, rec[v2DataOffset:], len(samples), 0)
+	if !equalInt32s(got, samples) {
+		t.Errorf("v2 data decoded %v, want %v", got, samples)
+	}
+
+	rec = writeRecords(t, Version2, time.Second, samples, nil)
+	if factor := int16(be.Uint16(rec[32:])); factor != 1 {
+		t.Errorf("v2 rate factor %d, want 1 for a 1s period", factor)
+	}
+}
+
+func TestRecordV3Layout(t *testing.T) {
+
+	samples := []int32{125, 126, 124, 2000, -70000}
+	rec := writeRecords(t, Version3, 10*time.Second, samples, nil)
+
+	le := binary.LittleEndian
+	if string(rec[0:2]) != "MS" || rec[2] != 3 || rec[3] != 0 {
+		t.Errorf("v3 indicator %q version %d flags %#x, want MS 3 without flags", rec[0:2], rec[2], rec[3])
+	}
+	start := []int{int(le.Uint32(rec[4:])), int(le.Uint16(rec[8:])), int(le.Uint16(rec[10:])), int(rec[12]), int(rec[13]), int(rec[14])}
+	if want := []int{0, 2020, 306, 12, 0, 0}; !equalInts(start, want) {
+		t.Errorf("v3 start time %v, want %v", start, want)
+	}
+	if rec[15] != encodingSteim1 {
+		t.Errorf("v3 encoding %d, want Steim1", rec[15])
+	}
+	if rate := math.Float64frombits(le.Uint64(rec[16:])); rate != -10 {
+		t.Errorf("v3 sample rate %g, want -10 for a 10s period", rate)
+	}
+	if cnt := le.Uint32(rec[24:]); int(cnt) != len(samples) {
+		t.Errorf("v3 sample count %d, want %d", cnt, len(samples))
+	}
+
+	sidLen := int(rec[33])
+	if sid, want := string(rec[v3HeaderLength:v3HeaderLength+sidLen]), "FDSN:II_VALT_25_M_V_1"; sid != want {
+		t.Errorf("v3 source identifier %q, want %q", sid, want)
+	}
+	dataLen := int(le.Uint32(rec[36:]))
+	if dataLen%steimFrameSize != 0 || len(rec) != v3HeaderLength+sidLen+dataLen {
+		t.Errorf("v3 record of %d bytes with %d bytes of data, want whole frames after the identifier", len(rec), dataLen)
+	}
+
+	crc := le.Uint32(rec[28:])
+	le.PutUint32(rec[28:], 0)
+	if want := crc32.Checksum(rec, crc32.MakeTable(crc32.Castagnoli)); crc != want {
+		t.Errorf("v3 CRC %#08x, want %#08x", crc, want)
+	}
+
+	got := steim1Samples(t, rec[v3HeaderLength+sidLen:], len(samples), 0)
+	if !equalInt32s(got, samples) {
+		t.Errorf("v3 data decoded %v, want %v", got, samples)
+	}
+
+	rec = writeRecords(t, Version3, time.Second, samples, nil)
+	if rate := math.Float64frombits(le.Uint64(rec[16:])); rate != 1 {
+		t.Errorf("v3 sample rate %g, want 1 for a 1s period", rate)
+	}
+}
+
+func TestRecordsContinue(t *testing.T) {
+
+	// differences that each need a word overflow a record
+	samples := make([]int32, 250)
+	for i := range samples {
+		samples[i] = int32(i%3-1) * 1000000
+	}
+
+	out := writeRecords(t, Version2, time.Second, samples, nil)
+	var got []int32
+	var prev int32
+	for seq := 1; len(out) > 0; seq++ {
+		rec := out[:v2RecordLength]
+		out = out[v2RecordLength:]
+
+		if want := fmt.Sprintf("%06d", seq); string(rec[0:6]) != want {
+			t.Errorf("record sequence %q, want %q", rec[0:6], want)
+		}
+		ts := time.Date(int(binary.BigEndian.Uint16(rec[20:])), 1, 1, int(rec[24]), int(rec[25]), int(rec[26]), 0, time.UTC).
+			AddDate(0, 0, int(binary.BigEndian.Uint16(rec[22:]))-1)
+		if want := testStart.Add(time.Duration(len(got)) * time.Second); !ts.Equal(want) {
+			t.Errorf("record %d starts at %s, want %s", seq, ts, want)
+		}
+
+		cnt := int(binary.BigEndian.Uint16(rec[30:]))
+		decoded := steim1Samples(t, rec[v2DataOffset:], cnt, prev)
+		got = append(got, decoded...)
+		prev = decoded[cnt-1]
+	}
+	if len(got) == 0 || !equalInt32s(got, samples) {
+		t.Errorf("records decoded to %d samples, want the %d written", len(got), len(samples))
+	}
+}
+
+func TestRecordGap(t *testing.T) {
+
+	var out bytes.Buffer
+	mw, err := NewWriter(&out, Version2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sec := range []int{0, 1, 2, 10, 11} {
+		if err := mw.Add(testChannel, testStart.Add(time.Duration(sec)*time.Second), int32(sec), Quality{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() != 2*v2RecordLength {
+		t.Fatalf("%d bytes written, want two records either side of the gap", out.Len())
+	}
+	rec := out.Bytes()[v2RecordLength:]
+	if cnt, sec := binary.BigEndian.Uint16(rec[30:]), rec[26]; cnt != 2 || sec != 10 {
+		t.Errorf("record after the gap has %d samples from second %d, want 2 from 10", cnt, sec)
+	}
+}
+
+func equalInts(a, b []int) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalInt32s(a, b []int32) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
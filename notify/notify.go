@@ -0,0 +1,252 @@
+// Package notify sends alarm and relay action events to the [[notify]] sinks of rpm.toml
+package notify
+
+import (
+	"context"
+	"fmt"
+	"rpm/config"
+	rlog "rpm/log"
+	"sync"
+	"time"
+)
+
+// Event kinds
+const (
+	KindAlarm = "alarm"
+	KindRelay = "relay"
+	KindTrap  = "trap"
+)
+
+// queueSize is the number of events a sink can have waiting before new ones are dropped
+const queueSize = 100
+
+// Event describes an alarm transition, a relay action or a trap
+type Event struct {
+	Kind     string    `json:"kind"`
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Host     string    `json:"host"`
+	Net      string    `json:"net"`
+	Sta      string    `json:"sta"`
+	Loc      string    `json:"loc"`
+	Chancode string    `json:"chancode"`
+	Label    string    `json:"label"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	Units    string    `json:"units,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// Sink delivers an event
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, ev Event) error
+}
+
+// worker delivers the events queued for a sink, applying its rate limit and retries
+type worker struct {
+	sink    Sink
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	limit   int
+	period  time.Duration
+
+	queue      chan Event
+	sent       []time.Time
+	suppressed int
+}
+
+// Notifier sends events to all configured sinks in the background
+type Notifier struct {
+	workers []*worker
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	closed  bool
+}
+
+// New returns a Notifier for the sinks in cfgs, with nothing configured
+// events are discarded
+func New(cfgs []config.NotifyConfig) (*Notifier, error) {
+
+	ntf := &Notifier{}
+	ntf.ctx, ntf.cancel = context.WithCancel(context.Background())
+
+	for i, c := range cfgs {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("%s#%d", c.Type, i+1)
+		}
+		var sink Sink
+		switch c.Type {
+		case config.NotifyEmail:
+			sink = &EmailSink{name, c.Smtp, c.From, c.To, c.Username, c.Password, nil}
+		case config.NotifyWebhook:
+			sink = &WebhookSink{name, c.Url}
+		case config.NotifyExec:
+			sink = &ExecSink{name, c.Command, c.Args}
+		default:
+			ntf.cancel()
+			return nil, fmt.Errorf("invalid notifier type: %s", c.Type)
+		}
+
+		ntf.addWorker(sink, c)
+	}
+
+	return ntf, nil
+}
+
+// addWorker starts delivering to sink with the settings of c
+func (ntf *Notifier) addWorker(sink Sink, c config.NotifyConfig) {
+
+	w := &worker{
+		sink:    sink,
+		timeout: c.Timeout,
+		retries: c.Retries,
+		backoff: c.Backoff,
+		limit:   c.Ratelimit,
+		period:  c.Rateperiod,
+		queue:   make(chan Event, queueSize),
+	}
+	if w.timeout == 0 {
+		w.timeout = config.DefaultNotifyTimeout
+	}
+	if w.backoff == 0 {
+		w.backoff = config.DefaultNotifyBackoff
+	}
+	if w.period == 0 {
+		w.period = config.DefaultNotifyPeriod
+	}
+
+	ntf.mutex.Lock()
+	ntf.workers = append(ntf.workers, w)
+	ntf.mutex.Unlock()
+
+	ntf.wg.Add(1)
+	go func() {
+		defer ntf.wg.Done()
+		w.run(ntf.ctx)
+	}()
+}
+
+// Notify queues ev for all sinks
+func (ntf *Notifier) Notify(ev Event) {
+
+	ntf.mutex.Lock()
+	defer ntf.mutex.Unlock()
+
+	if ntf.closed {
+		return
+	}
+	for _, w := range ntf.workers {
+		select {
+		case w.queue <- ev:
+		default:
+			rlog.WarningMsg("notify %s: queue full, dropping %s event for %s", w.sink.Name(), ev.Kind, ev.Chancode)
+		}
+	}
+}
+
+// Close delivers the queued events, waiting at most timeout, and stops the sinks
+func (ntf *Notifier) Close(timeout time.Duration) {
+
+	ntf.mutex.Lock()
+	if ntf.closed {
+		ntf.mutex.Unlock()
+		return
+	}
+	ntf.closed = true
+	for _, w := range ntf.workers {
+		close(w.queue)
+	}
+	ntf.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ntf.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		rlog.WarningMsg("notify: gave up delivering queued notifications after %s", timeout)
+		ntf.cancel()
+		<-done
+	}
+	ntf.cancel()
+}
+
+// run delivers queued events until the queue is closed or ctx is done
+func (w *worker) run(ctx context.Context) {
+
+	for ev := range w.queue {
+		if !w.allow(time.Now()) {
+			w.suppressed++
+			rlog.WarningMsg("notify %s: rate limit of %d per %s reached, suppressing %s event for %s",
+				w.sink.Name(), w.limit, w.period, ev.Kind, ev.Chancode)
+			continue
+		}
+		if w.suppressed > 0 {
+			ev.Message = fmt.Sprintf("%s (%d earlier notification(s) suppressed by rate limit)", ev.Message, w.suppressed)
+			w.suppressed = 0
+		}
+		if err := w.deliver(ctx, ev); err != nil {
+			rlog.ErrMsg("notify %s: giving up on %s event for %s: %s", w.sink.Name(), ev.Kind, ev.Chancode, err.Error())
+		}
+	}
+}
+
+// allow reports whether an event can be sent at now under the rate limit
+func (w *worker) allow(now time.Time) bool {
+
+	if w.limit <= 0 {
+		return true
+	}
+
+	recent := w.sent[:0]
+	for _, ts := range w.sent {
+		if now.Sub(ts) < w.period {
+			recent = append(recent, ts)
+		}
+	}
+	w.sent = recent
+	if len(w.sent) >= w.limit {
+		return false
+	}
+	w.sent = append(w.sent, now)
+
+	return true
+}
+
+// deliver sends ev, retrying with exponential backoff
+func (w *worker) deliver(ctx context.Context, ev Event) error {
+
+	var err error
+	backoff := w.backoff
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			rlog.WarningMsg("notify %s: send failed (%s), retry %d of %d in %s", w.sink.Name(), err.Error(), attempt, w.retries, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+			backoff *= 2
+		}
+
+		sendCtx, cancel := context.WithTimeout(ctx, w.timeout)
+		err = w.sink.Send(sendCtx, ev)
+		cancel()
+		if err == nil {
+			rlog.DebugMsg("notify %s: sent %s event for %s", w.sink.Name(), ev.Kind, ev.Chancode)
+			return nil
+		}
+	}
+
+	return err
+}
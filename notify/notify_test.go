@@ -0,0 +1,356 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rpm/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testEvent() Event {
+	return Event{
+		Kind:     KindAlarm,
+		Time:     time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC),
+		Severity: "crit",
+		Host:     "127.0.0.1",
+		Net:      "II",
+		Sta:      "VALT",
+		Loc:      "25",
+		Chancode: "MV1",
+		Label:    "Battery Output Voltage",
+		From:     "warn",
+		To:       "crit",
+		Value:    "11.2",
+		Units:    "volts",
+		Message:  "alarm MV1 (Battery Output Voltage) warn -> crit: 11.2 volts",
+	}
+}
+
+// smtpServer is a minimal SMTP stand-in that records the messages it
+// receives. With a tlsConfig it offers STARTTLS
+type smtpServer struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+	mutex     sync.Mutex
+	rcpts     []string
+	messages  []string
+	startTLS  bool
+}
+
+func startSMTPServer(t *testing.T, tlsConfig *tls.Config) *smtpServer {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &smtpServer{ln: ln, tlsConfig: tlsConfig}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *smtpServer) serve(conn net.Conn) {
+
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			if srv.tlsConfig != nil {
+				reply("250-localhost")
+				reply("250 STARTTLS")
+				continue
+			}
+			reply("250 localhost")
+		case cmd == "STARTTLS" && srv.tlsConfig != nil:
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, srv.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, rd = tlsConn, bufio.NewReader(tlsConn)
+			srv.mutex.Lock()
+			srv.startTLS = true
+			srv.mutex.Unlock()
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			srv.mutex.Lock()
+			srv.rcpts = append(srv.rcpts, strings.TrimSpace(line[len("RCPT TO:"):]))
+			srv.mutex.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 end with .")
+			var msg strings.Builder
+			for {
+				dataLine, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				msg.WriteString(dataLine)
+			}
+			srv.mutex.Lock()
+			srv.messages = append(srv.messages, msg.String())
+			srv.mutex.Unlock()
+			reply("250 OK queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (srv *smtpServer) received() ([]string, []string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return append([]string(nil), srv.rcpts...), append([]string(nil), srv.messages...)
+}
+
+func TestEmail(t *testing.T) {
+
+	srv := startSMTPServer(t, nil)
+	defer srv.ln.Close()
+
+	ntf, err := New([]config.NotifyConfig{{
+		Type: config.NotifyEmail,
+		Smtp: srv.ln.Addr().String(),
+		From: "rpm@example.org",
+		To:   []string{"ops@example.org", "tech@example.org"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ntf.Notify(testEvent())
+	ntf.Close(5 * time.Second)
+
+	rcpts, messages := srv.received()
+	if len(rcpts) != 2 || rcpts[0] != "<ops@example.org>" {
+		t.Errorf("recipients %v, want ops@ and tech@example.org", rcpts)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("received %d messages, want 1", len(messages))
+	}
+	if !strings.Contains(messages[0], "Subject: [rpm II.VALT.25] CRIT alarm MV1") {
+		t.Errorf("message has no alarm subject:\n%s", messages[0])
+	}
+	if !strings.Contains(messages[0], "chancode:  MV1") {
+		t.Errorf("message has no chancode field:\n%s", messages[0])
+	}
+}
+
+func TestEmailStartTLS(t *testing.T) {
+
+	// borrow the certificate of a TLS test server, it is for 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	srv := startSMTPServer(t, ts.TLS)
+	defer srv.ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	sink := &EmailSink{name: "email", server: srv.ln.Addr().String(), from: "rpm@example.org", to: []string{"ops@example.org"}, rootCAs: roots}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sink.Send(ctx, testEvent()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, messages := srv.received()
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if !srv.startTLS || len(messages) != 1 {
+		t.Errorf("STARTTLS %v and %d messages, want the message sent over TLS", srv.startTLS, len(messages))
+	}
+}
+
+func TestEmailHeaders(t *testing.T) {
+
+	ev := testEvent()
+	ev.Message = "trap 1.3.6.1.4.1.45621.3.0.1 from 10.0.0.9: 1.3.6.1.4.1.9=x\r\nBcc: victim@example.org"
+	msg := string(emailMessage("rpm@example.org\r\nCc: other@example.org", []string{"ops@example.org"}, ev))
+
+	header := msg[:strings.Index(msg, "\r\n\r\n")]
+	for _, line := range strings.Split(header, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") || strings.HasPrefix(line, "Cc:") {
+			t.Errorf("header injected by the event: %q", line)
+		}
+	}
+	if !strings.Contains(header, "Subject: =?utf-8?q?") {
+		t.Errorf("subject with CR LF not Q-encoded:\n%s", header)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+
+	var mutex sync.Mutex
+	attempts := 0
+	var got Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %s, want application/json", ct)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	ntf, err := New([]config.NotifyConfig{{
+		Type:    config.NotifyWebhook,
+		Url:     srv.URL,
+		Retries: 2,
+		Backoff: 10 * time.Millisecond,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ntf.Notify(testEvent())
+	ntf.Close(5 * time.Second)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 2 {
+		t.Errorf("webhook called %d times, want 2", attempts)
+	}
+	if got.Chancode != "MV1" || got.To != "crit" || !got.Time.Equal(testEvent().Time) {
+		t.Errorf("webhook received %+v, want the test event", got)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+
+	var mutex sync.Mutex
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		attempts++
+		mutex.Unlock()
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ntf, err := New([]config.NotifyConfig{{
+		Type:    config.NotifyWebhook,
+		Url:     srv.URL,
+		Retries: 2,
+		Backoff: 10 * time.Millisecond,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ntf.Notify(testEvent())
+	ntf.Close(5 * time.Second)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 3 {
+		t.Errorf("webhook called %d times, want 3 (1 + 2 retries)", attempts)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	var mutex sync.Mutex
+	var messages []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		json.NewDecoder(r.Body).Decode(&ev)
+		mutex.Lock()
+		messages = append(messages, ev.Message)
+		mutex.Unlock()
+	}))
+	defer srv.Close()
+
+	ntf, err := New([]config.NotifyConfig{{
+		Type:       config.NotifyWebhook,
+		Url:        srv.URL,
+		Ratelimit:  2,
+		Rateperiod: 200 * time.Millisecond,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		ntf.Notify(testEvent())
+	}
+	time.Sleep(300 * time.Millisecond)
+	ntf.Notify(testEvent())
+	ntf.Close(5 * time.Second)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(messages) != 3 {
+		t.Fatalf("webhook received %d events, want 3", len(messages))
+	}
+	if !strings.Contains(messages[2], "3 earlier notification(s) suppressed") {
+		t.Errorf("event after the rate limit %q does not report the suppressed events", messages[2])
+	}
+}
+
+func TestExec(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "event.txt")
+
+	ntf, err := New([]config.NotifyConfig{{
+		Type:    config.NotifyExec,
+		Command: "/bin/sh",
+		Args:    []string{"-c", `echo "$RPM_EVENT $RPM_CHANCODE $RPM_FROM $RPM_TO $RPM_VALUE" > ` + out},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ntf.Notify(testEvent())
+	ntf.Close(5 * time.Second)
+
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(content)), "alarm MV1 warn crit 11.2"; got != want {
+		t.Errorf("exec environment gave %q, want %q", got, want)
+	}
+}
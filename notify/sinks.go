@@ -0,0 +1,209 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// EmailSink sends events by SMTP, with PLAIN authentication if Username is
+// set. rootCAs, if set, verify the server certificate instead of the system roots
+type EmailSink struct {
+	name     string
+	server   string
+	from     string
+	to       []string
+	username string
+	password string
+	rootCAs  *x509.CertPool
+}
+
+// Name of the sink
+func (s *EmailSink) Name() string {
+	return s.name
+}
+
+// Send ev as a plain text message
+func (s *EmailSink) Send(ctx context.Context, ev Event) error {
+
+	host, _, err := net.SplitHostPort(s.server)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host, RootCAs: s.rootCAs}); err != nil {
+			return err
+		}
+	}
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	for _, rcpt := range s.to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	wc, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(emailMessage(s.from, s.to, ev)); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// emailMessage formats ev as an RFC 5322 message. The subject is Q-encoded
+// if needed, as the message may have values from traps with CR or LF
+func emailMessage(from string, to []string, ev Event) []byte {
+
+	subject := fmt.Sprintf("[rpm %s.%s.%s] %s %s", ev.Net, ev.Sta, ev.Loc, strings.ToUpper(ev.Severity), ev.Message)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", headerText(from))
+	fmt.Fprintf(&msg, "To: %s\r\n", headerText(strings.Join(to, ", ")))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", ev.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, field := range eventFields(ev) {
+		fmt.Fprintf(&msg, "%-10s %s\r\n", strings.ToLower(field[0])+":", field[1])
+	}
+
+	return msg.Bytes()
+}
+
+// headerText returns s without the CR and LF that would end a header
+func headerText(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// WebhookSink posts events as JSON to a URL
+type WebhookSink struct {
+	name string
+	url  string
+}
+
+// Name of the sink
+func (s *WebhookSink) Name() string {
+	return s.name
+}
+
+// Send ev as a JSON POST, any status other than 2xx is an error
+func (s *WebhookSink) Send(ctx context.Context, ev Event) error {
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", s.url, resp.Status)
+	}
+
+	return nil
+}
+
+// ExecSink runs a command with the event in RPM_* environment variables
+type ExecSink struct {
+	name    string
+	command string
+	args    []string
+}
+
+// Name of the sink
+func (s *ExecSink) Name() string {
+	return s.name
+}
+
+// Send ev by running the command, a non-zero exit status is an error
+func (s *ExecSink) Send(ctx context.Context, ev Event) error {
+
+	cmd := exec.CommandContext(ctx, s.command, s.args...)
+	cmd.Env = os.Environ()
+	for _, field := range eventFields(ev) {
+		cmd.Env = append(cmd.Env, "RPM_"+field[0]+"="+field[1])
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", s.command, err.Error(), strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// eventFields are the names and values of ev for the email body and exec environment
+func eventFields(ev Event) [][2]string {
+	return [][2]string{
+		{"EVENT", ev.Kind},
+		{"TIME", ev.Time.UTC().Format(time.RFC3339)},
+		{"SEVERITY", ev.Severity},
+		{"HOST", ev.Host},
+		{"NET", ev.Net},
+		{"STA", ev.Sta},
+		{"LOC", ev.Loc},
+		{"CHANCODE", ev.Chancode},
+		{"LABEL", ev.Label},
+		{"FROM", ev.From},
+		{"TO", ev.To},
+		{"VALUE", ev.Value},
+		{"UNITS", ev.Units},
+		{"ACTION", ev.Action},
+		{"MESSAGE", ev.Message},
+	}
+}
@@ -0,0 +1,221 @@
+// Package quality checks the values of scans against the [[quality]] rules
+// of rpm.toml, flagging readings that are frozen, implausible or step
+package quality
+
+import (
+	"fmt"
+	"math"
+	"rpm/config"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"sync"
+	"time"
+)
+
+// Flag is the data quality of a value
+type Flag int
+
+// Quality flags, a value gets the first that applies from Missing to Frozen
+const (
+	Good Flag = iota
+	Missing
+	Implausible
+	Step
+	Frozen
+)
+
+var flagLabels = map[Flag]string{
+	Good:        "good",
+	Missing:     "missing",
+	Implausible: "implausible",
+	Step:        "step",
+	Frozen:      "frozen",
+}
+
+func (f Flag) String() string {
+	if label, ok := flagLabels[f]; ok {
+		return label
+	}
+	return fmt.Sprintf("flag(%d)", int(f))
+}
+
+// Change is a change of the quality flag of a channel
+type Change struct {
+	Chancode string
+	Label    string
+	Oid      string
+	Units    string
+	From     Flag
+	To       Flag
+	Value    string
+	Scans    int
+	Time     time.Time
+}
+
+// Message describes the change for logs
+func (c Change) Message() string {
+	switch c.To {
+	case Missing:
+		return fmt.Sprintf("quality %s (%s) %s -> %s: no numeric value", c.Chancode, c.Label, c.From, c.To)
+	case Frozen:
+		return fmt.Sprintf("quality %s (%s) %s -> %s: %s %s for %d scans", c.Chancode, c.Label, c.From, c.To, c.Value, c.Units, c.Scans)
+	}
+	return fmt.Sprintf("quality %s (%s) %s -> %s: %s %s", c.Chancode, c.Label, c.From, c.To, c.Value, c.Units)
+}
+
+// Log the change after prefix, as a warning unless the value is good again
+func (c Change) Log(prefix string) {
+	if c.To == Good {
+		rlog.NoticeMsg("%s%s", prefix, c.Message())
+		return
+	}
+	rlog.WarningMsg("%s%s", prefix, c.Message())
+}
+
+// channel is the rule and state of a checked channel
+type channel struct {
+	rule config.QualityRule
+	info config.OidInfo
+	flag Flag
+	// last is the previous value, ref the first of the values within
+	// epsilon of it, seen for same scans
+	last    float64
+	ref     float64
+	same    int
+	hasLast bool
+}
+
+// Checker keeps the quality flag of each channel with a rule
+type Checker struct {
+	mutex    sync.Mutex
+	channels []*channel
+	lastScan time.Time
+}
+
+// NewChecker returns a Checker for the quality rules of rpmCfg. A chancode
+// rule applies instead of the rule for its category. Rules for chancodes
+// that are not data OIDs are an error
+func NewChecker(rpmCfg *config.RPMConfig) (*Checker, error) {
+
+	chancodes := make(map[string]config.QualityRule)
+	categories := make(map[string]config.QualityRule)
+	for _, rule := range rpmCfg.Quality {
+		if rule.Chancode != "" {
+			chancodes[rule.Chancode] = rule
+		} else {
+			categories[rule.Category] = rule
+		}
+	}
+
+	qc := &Checker{}
+	toids := rpmCfg.Oids
+	for _, category := range []struct {
+		name string
+		oids []config.OidInfo
+	}{
+		{"relays", toids.Relays},
+		{"voltages", toids.Voltages},
+		{"currents", toids.Currents},
+		{"temps", toids.Temps},
+	} {
+		for _, info := range category.oids {
+			rule, ok := chancodes[info.Chancode]
+			if ok {
+				delete(chancodes, info.Chancode)
+			} else if rule, ok = categories[category.name]; !ok {
+				continue
+			}
+			qc.channels = append(qc.channels, &channel{rule: rule, info: info})
+		}
+	}
+	for chancode := range chancodes {
+		return nil, fmt.Errorf("quality rule for unknown chancode: %s", chancode)
+	}
+
+	return qc, nil
+}
+
+// Check the values of scan and return the changes of the quality flags.
+// A scan with the time of the last one checked, e.g. one that is repeated,
+// is not checked again
+func (qc *Checker) Check(scan *tycon.TPDin2Scan) []Change {
+
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	if len(qc.channels) == 0 || scan.TS.Equal(qc.lastScan) {
+		return nil
+	}
+	qc.lastScan = scan.TS
+
+	var changes []Change
+	for _, ch := range qc.channels {
+		raw := scan.Data[ch.info.Oid]
+		flag := ch.check(raw)
+		if flag == ch.flag {
+			continue
+		}
+		changes = append(changes, Change{
+			Chancode: ch.info.Chancode,
+			Label:    ch.info.Label,
+			Oid:      ch.info.Oid,
+			Units:    ch.info.Units,
+			From:     ch.flag,
+			To:       flag,
+			Value:    ch.info.FormatValue(raw),
+			Scans:    ch.same,
+			Time:     scan.TS,
+		})
+		ch.flag = flag
+	}
+
+	return changes
+}
+
+// check returns the flag of the channel's value raw, updating the values
+// it is compared with
+func (ch *channel) check(raw string) Flag {
+
+	val, err := ch.info.Value(raw)
+	if err != nil {
+		// a gap ends any step or frozen run
+		ch.hasLast = false
+		ch.same = 0
+		return Missing
+	}
+
+	step := ch.hasLast && ch.rule.Step > 0 && math.Abs(val-ch.last) > ch.rule.Step
+	if ch.hasLast && math.Abs(val-ch.ref) <= ch.rule.Epsilon {
+		ch.same++
+	} else {
+		ch.ref = val
+		ch.same = 1
+	}
+	ch.last = val
+	ch.hasLast = true
+
+	switch {
+	case ch.rule.Min != nil && val < *ch.rule.Min, ch.rule.Max != nil && val > *ch.rule.Max:
+		return Implausible
+	case step:
+		return Step
+	case ch.rule.Frozen > 0 && ch.same >= ch.rule.Frozen:
+		return Frozen
+	}
+
+	return Good
+}
+
+// Flags returns the quality flags of the checked channels by OID
+func (qc *Checker) Flags() map[string]Flag {
+
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	flags := make(map[string]Flag, len(qc.channels))
+	for _, ch := range qc.channels {
+		flags[ch.info.Oid] = ch.flag
+	}
+
+	return flags
+}
@@ -0,0 +1,135 @@
+package quality
+
+import (
+	"rpm/config"
+	"rpm/tycon"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	batteryOid = "1.3.6.1.4.1.45621.2.2.5.0"
+	tempOid    = "1.3.6.1.4.1.45621.2.2.13.0"
+)
+
+func testConfig(rules ...config.QualityRule) *config.RPMConfig {
+	precision := 1
+	return &config.RPMConfig{
+		Oids: config.TyconOids{
+			Voltages: []config.OidInfo{{Oid: batteryOid, Chancode: "MV1", Label: "Battery Output Voltage", Scale: 0.1, Units: "volts", Precision: &precision}},
+			Temps:    []config.OidInfo{{Oid: tempOid, Chancode: "TPE", Label: "Temp (Ext)", Units: "C"}},
+		},
+		Quality: rules,
+	}
+}
+
+func float(val float64) *float64 {
+	return &val
+}
+
+// checkValues checks a scan a second for each of the raw battery values,
+// returning the flags after each
+func checkValues(t *testing.T, qc *Checker, raws ...string) []Flag {
+
+	var flags []Flag
+	start := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	for i, raw := range raws {
+		data := map[string]string{tempOid: strconv.Itoa(200 + i)}
+		if raw != "" {
+			data[batteryOid] = raw
+		}
+		qc.Check(&tycon.TPDin2Scan{TS: start.Add(time.Duration(i) * time.Second), Data: data})
+		flags = append(flags, qc.Flags()[batteryOid])
+	}
+
+	return flags
+}
+
+func TestCheck(t *testing.T) {
+
+	tests := []struct {
+		name string
+		rule config.QualityRule
+		raws []string
+		want []Flag
+	}{
+		{"frozen", config.QualityRule{Chancode: "MV1", Frozen: 3},
+			[]string{"125", "125", "125", "125", "126"},
+			[]Flag{Good, Good, Frozen, Frozen, Good}},
+		{"frozen epsilon", config.QualityRule{Chancode: "MV1", Frozen: 3, Epsilon: 0.1},
+			[]string{"125", "126", "124", "127", "127"},
+			[]Flag{Good, Good, Frozen, Good, Good}},
+		{"implausible", config.QualityRule{Category: "voltages", Min: float(0), Max: float(60)},
+			[]string{"125", "-5", "125", "700"},
+			[]Flag{Good, Implausible, Good, Implausible}},
+		{"step", config.QualityRule{Chancode: "MV1", Step: 2},
+			[]string{"125", "130", "160", "158"},
+			[]Flag{Good, Good, Step, Good}},
+		{"missing", config.QualityRule{Chancode: "MV1", Step: 2, Frozen: 2},
+			[]string{"125", "", "160", "noSuchObject", "125"},
+			[]Flag{Good, Missing, Good, Missing, Good}},
+	}
+
+	for _, tt := range tests {
+		qc, err := NewChecker(testConfig(tt.rule))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := checkValues(t, qc, tt.raws...)
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: flags %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCheckChanges(t *testing.T) {
+
+	qc, err := NewChecker(testConfig(config.QualityRule{Chancode: "MV1", Frozen: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scan := &tycon.TPDin2Scan{TS: time.Now(), Data: map[string]string{batteryOid: "125"}}
+	if changes := qc.Check(scan); len(changes) != 0 {
+		t.Errorf("first scan changes %v, want none", changes)
+	}
+	// a repeated scan is not another frozen reading
+	if changes := qc.Check(scan); len(changes) != 0 {
+		t.Errorf("repeated scan changes %v, want none", changes)
+	}
+
+	scan = &tycon.TPDin2Scan{TS: scan.TS.Add(time.Second), Data: scan.Data}
+	changes := qc.Check(scan)
+	want := "quality MV1 (Battery Output Voltage) good -> frozen: 12.5 volts for 2 scans"
+	if len(changes) != 1 || changes[0].Message() != want {
+		t.Errorf("changes %v, want one: %s", changes, want)
+	}
+}
+
+func TestRulePrecedence(t *testing.T) {
+
+	qc, err := NewChecker(testConfig(
+		config.QualityRule{Category: "voltages", Frozen: 2},
+		config.QualityRule{Chancode: "MV1", Min: float(0)},
+		config.QualityRule{Category: "temps", Max: float(100)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := checkValues(t, qc, "125", "125", "125")
+	if got[2] != Good {
+		t.Errorf("MV1 flag %s, want the chancode rule instead of the voltages rule", got[2])
+	}
+	if flag := qc.Flags()[tempOid]; flag != Implausible {
+		t.Errorf("TPE flag %s, want %s by the temps rule", flag, Implausible)
+	}
+
+	if _, err := NewChecker(testConfig(config.QualityRule{Chancode: "MV9"})); err == nil {
+		t.Error("NewChecker with a rule for an unknown chancode succeeded")
+	}
+}
@@ -0,0 +1,394 @@
+// Package schedule runs the relay actions of the [[schedules]] of rpm.toml
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"rpm/audit"
+	"rpm/config"
+	"rpm/cron"
+	"rpm/interlock"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"strings"
+	"time"
+)
+
+// auditSource identifies schedule entries in the audit trail
+const auditSource = "schedule"
+
+// Actions of a schedule
+const (
+	ActionSet   = "set"
+	ActionCycle = "cycle"
+)
+
+// maxWait is the longest the scheduler sleeps, so it follows clock changes
+const maxWait = time.Minute
+
+// RunHandler is called after the scheduler runs, or fails, refuses or skips
+// to run, an action of a schedule
+type RunHandler func(sched config.Schedule, relay config.OidInfo, action, state, result, detail string)
+
+// job is the state of a schedule
+type job struct {
+	config.Schedule
+	expr  *cron.Expr
+	relay config.OidInfo
+	next  time.Time
+
+	// end of the window in progress, when the relay is set back to restore
+	end     time.Time
+	restore string
+}
+
+// busyRelay is a relay in a cycle or window of a schedule
+type busyRelay struct {
+	until time.Time
+	by    string
+}
+
+// Scheduler runs the schedules of a config on a device
+type Scheduler struct {
+	dev      tycon.PowerMonitor
+	rpmCfg   *config.RPMConfig
+	host     string
+	auditLog *audit.Log
+	jobs     []*job
+	busy     map[string]busyRelay
+	handlers []RunHandler
+}
+
+// New returns a Scheduler for the [[schedules]] of rpmCfg operating the
+// relays of dev at host. The audit trail tells which runs were missed and
+// which windows are still open
+func New(dev tycon.PowerMonitor, rpmCfg *config.RPMConfig, host string, auditLog *audit.Log) (*Scheduler, error) {
+
+	if len(rpmCfg.Schedules) == 0 {
+		return nil, fmt.Errorf("no [[schedules]] configured")
+	}
+
+	relays := make(map[string]config.OidInfo)
+	for _, info := range rpmCfg.Oids.Relays {
+		relays[info.Chancode] = info
+	}
+
+	s := &Scheduler{
+		dev:      dev,
+		rpmCfg:   rpmCfg,
+		host:     host,
+		auditLog: auditLog,
+		busy:     make(map[string]busyRelay),
+	}
+
+	earlier, err := audit.Read(rpmCfg.Audit.File, func(rec audit.Record) bool {
+		return rec.Source == auditSource && rec.Host == host
+	})
+	if err != nil && !os.IsNotExist(err) {
+		rlog.WarningMsg("schedule: could not read audit trail %s: %s", rpmCfg.Audit.File, err.Error())
+	}
+
+	now := time.Now()
+	for _, sched := range rpmCfg.Schedules {
+		expr, err := cron.Parse(sched.Cron, time.UTC)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %s", sched.Name, err.Error())
+		}
+		info, ok := relays[sched.Relay]
+		if !ok {
+			return nil, fmt.Errorf("schedule %s: unknown relay %s", sched.Name, sched.Relay)
+		}
+		j := &job{Schedule: sched, expr: expr, relay: info, next: expr.Next(now)}
+		s.recover(j, earlier, now)
+		s.jobs = append(s.jobs, j)
+	}
+
+	return s, nil
+}
+
+// recover sets up j from its earlier records: a window still open is
+// closed at its end and a missed run is done if it is less than Catchup late
+func (s *Scheduler) recover(j *job, earlier []audit.Record, now time.Time) {
+
+	var lastRun, lastStart *audit.Record
+	for i := range earlier {
+		rec := &earlier[i]
+		if rec.Schedule != j.Name {
+			continue
+		}
+		if rec.Action == j.Action && rec.Requested == j.State {
+			lastRun = rec
+			if rec.Result == audit.ResultOK && rec.Previous != "" && rec.Previous != j.State {
+				lastStart = rec
+			}
+		} else if lastStart != nil && rec.Result == audit.ResultOK {
+			// the window was closed
+			lastStart = nil
+		}
+	}
+
+	if j.Duration > 0 && lastStart != nil {
+		j.end = lastStart.Time.Add(j.Duration)
+		j.restore = lastStart.Previous
+		s.busy[j.Relay] = busyRelay{j.end, j.Name}
+		rlog.NoticeMsg("schedule %s: window opened %s is still open, relay %s (%s) is set back to %s at %s",
+			j.Name, lastStart.Time.UTC().Format(time.RFC3339), j.relay.Chancode, j.relay.Label, strings.ToUpper(j.restore), j.end.UTC().Format(time.RFC3339))
+	}
+
+	if lastRun == nil {
+		return
+	}
+	missed := j.expr.Next(lastRun.Time)
+	if missed.IsZero() || missed.After(now) {
+		return
+	}
+
+	// the latest run missed that is less than Catchup late
+	from := now.Add(-j.Catchup)
+	if from.Before(lastRun.Time) {
+		from = lastRun.Time
+	}
+	var due time.Time
+	for t := j.expr.Next(from); !t.IsZero() && !t.After(now); t = j.expr.Next(t) {
+		due = t
+	}
+	if j.Catchup > 0 && !due.IsZero() {
+		rlog.NoticeMsg("schedule %s: catching up on the run missed at %s", j.Name, due.UTC().Format(time.RFC3339))
+		j.next = due
+		return
+	}
+	rlog.WarningMsg("schedule %s: run missed at %s is not done, it is more than catchup (%s) late",
+		j.Name, missed.UTC().Format(time.RFC3339), j.Catchup)
+}
+
+// AddRunHandler registers fn to be called after each scheduled action
+func (s *Scheduler) AddRunHandler(fn RunHandler) {
+	s.handlers = append(s.handlers, fn)
+}
+
+// Run does the scheduled actions until ctx is done
+func (s *Scheduler) Run(ctx context.Context) error {
+
+	for _, j := range s.jobs {
+		rlog.NoticeMsg("schedule %s: %s relay %s (%s) at %q UTC, next %s",
+			j.Name, j.describe(), j.relay.Chancode, j.relay.Label, j.Cron, j.next.UTC().Format(time.RFC3339))
+	}
+
+	for {
+		s.runDue(time.Now())
+
+		wait := time.Until(s.nextEvent())
+		if wait > maxWait {
+			wait = maxWait
+		}
+		if wait < 0 {
+			wait = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// nextEvent returns the time of the next run or window end
+func (s *Scheduler) nextEvent() time.Time {
+
+	next := time.Now().Add(maxWait)
+	for _, j := range s.jobs {
+		if !j.next.IsZero() && j.next.Before(next) {
+			next = j.next
+		}
+		if !j.end.IsZero() && j.end.Before(next) {
+			next = j.end
+		}
+	}
+
+	return next
+}
+
+// runDue closes the windows that have ended, then does the runs that are due
+func (s *Scheduler) runDue(now time.Time) {
+
+	for _, j := range s.jobs {
+		if !j.end.IsZero() && !now.Before(j.end) {
+			s.closeWindow(j, now)
+		}
+	}
+	for _, j := range s.jobs {
+		if !j.next.IsZero() && !now.Before(j.next) {
+			due := j.next
+			j.next = j.expr.Next(now)
+			s.run(j, due, now)
+		}
+	}
+}
+
+// run does the action of j due at due
+func (s *Scheduler) run(j *job, due, now time.Time) {
+
+	prefix := fmt.Sprintf("schedule %s: %s relay %s (%s)", j.Name, j.describe(), j.relay.Chancode, j.relay.Label)
+	if now.Sub(due) >= time.Minute {
+		prefix += fmt.Sprintf(" (catch-up of %s)", due.UTC().Format(time.RFC3339))
+	}
+
+	// overlapping schedules and runs during a window are skipped
+	if b, ok := s.busy[j.Relay]; ok && now.Before(b.until) {
+		msg := fmt.Sprintf("%s skipped: relay is busy with schedule %s until %s", prefix, b.by, b.until.UTC().Format(time.RFC3339))
+		rlog.WarningMsg("%s", msg)
+		s.record(j, j.Action, j.State, "", "", audit.ResultSkipped, msg)
+		return
+	}
+
+	previous, err := s.check(j, j.Action, j.State)
+	if err != nil {
+		msg := fmt.Sprintf("%s refused: %s", prefix, err.Error())
+		rlog.ErrMsg("%s", msg)
+		s.record(j, j.Action, j.State, previous, previous, audit.ResultRefused, msg)
+		return
+	}
+
+	switch j.Action {
+	case ActionSet:
+		if previous == j.State {
+			msg := fmt.Sprintf("%s: relay is already %s", prefix, strings.ToUpper(previous))
+			rlog.NoticeMsg("%s", msg)
+			s.record(j, j.Action, j.State, previous, previous, audit.ResultOK, msg)
+			return
+		}
+		err = s.dev.SetRelay(j.relay.Oid, j.State)
+		if err == nil && j.Duration > 0 {
+			j.end = now.Add(j.Duration)
+			j.restore = previous
+			s.busy[j.Relay] = busyRelay{j.end, j.Name}
+			prefix += fmt.Sprintf(" until %s", j.end.UTC().Format(time.RFC3339))
+		}
+	case ActionCycle:
+		err = s.dev.CycleRelay(j.relay.Oid)
+		if err == nil {
+			s.busy[j.Relay] = busyRelay{now.Add(s.rpmCfg.Relay.Cycletime), j.Name}
+		}
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("%s failed: %s", prefix, err.Error())
+		rlog.ErrMsg("%s", msg)
+		s.record(j, j.Action, j.State, previous, s.state(j), audit.ResultFailed, msg)
+		return
+	}
+
+	rlog.NoticeMsg("%s", prefix)
+	s.record(j, j.Action, j.State, previous, s.state(j), audit.ResultOK, prefix)
+}
+
+// closeWindow sets the relay of j back to its state before the window
+func (s *Scheduler) closeWindow(j *job, now time.Time) {
+
+	prefix := fmt.Sprintf("schedule %s: end of window, setting relay %s (%s) back to %s",
+		j.Name, j.relay.Chancode, j.relay.Label, strings.ToUpper(j.restore))
+
+	previous, err := s.check(j, ActionSet, j.restore)
+	if err == nil && previous != j.restore {
+		err = s.dev.SetRelay(j.relay.Oid, j.restore)
+	}
+	if err != nil {
+		// the relay must not be left in the state of the window, retry
+		msg := fmt.Sprintf("%s failed, retrying in %s: %s", prefix, maxWait, err.Error())
+		rlog.ErrMsg("%s", msg)
+		s.record(j, ActionSet, j.restore, previous, previous, audit.ResultFailed, msg)
+		j.end = now.Add(maxWait)
+		s.busy[j.Relay] = busyRelay{j.end, j.Name}
+		return
+	}
+
+	rlog.NoticeMsg("%s", prefix)
+	s.record(j, ActionSet, j.restore, previous, s.state(j), audit.ResultOK, prefix)
+	j.end = time.Time{}
+	delete(s.busy, j.Relay)
+}
+
+// check returns the state of the relay of j and whether the action is
+// allowed by the interlock. Only a schedule with force may operate a
+// protected relay
+func (s *Scheduler) check(j *job, action, state string) (string, error) {
+
+	relayOids, _ := s.rpmCfg.RelayOidsInfo()
+	_, results, err := s.dev.QueryOids(&relayOids)
+	if err != nil {
+		return "", err
+	}
+	previous := tycon.RelayStateLabel(results[j.relay.Oid])
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return previous, err
+	}
+
+	return previous, interlock.New(s.rpmCfg).Check(interlock.Request{
+		Host:   hostname,
+		Relay:  j.relay,
+		Action: action,
+		State:  state,
+		Force:  j.Force,
+	}, results)
+}
+
+// state returns the current state of the relay of j, empty if it cannot be
+// queried or is cycling
+func (s *Scheduler) state(j *job) string {
+
+	if j.Action == ActionCycle {
+		return ""
+	}
+	_, results, err := s.dev.QueryOids(&[]string{j.relay.Oid})
+	if err != nil {
+		return ""
+	}
+
+	return tycon.RelayStateLabel(results[j.relay.Oid])
+}
+
+// record writes an audit trail entry for j and calls the run handlers
+func (s *Scheduler) record(j *job, action, requested, previous, state, result, detail string) {
+
+	if s.auditLog != nil {
+		err := s.auditLog.Write(audit.Record{
+			Operator:  audit.Self(),
+			Source:    auditSource,
+			Schedule:  j.Name,
+			Host:      s.host,
+			Chancode:  j.relay.Chancode,
+			Label:     j.relay.Label,
+			Action:    action,
+			Previous:  previous,
+			Requested: requested,
+			State:     state,
+			Result:    result,
+			Detail:    detail,
+		})
+		if err != nil {
+			rlog.ErrMsg("schedule: could not write audit trail: %s", err.Error())
+		}
+	}
+
+	for _, fn := range s.handlers {
+		fn(j.Schedule, j.relay, action, requested, result, detail)
+	}
+}
+
+// describe returns the action of j for messages
+func (j *job) describe() string {
+
+	switch {
+	case j.Action == ActionCycle:
+		return "cycle"
+	case j.Duration > 0:
+		return fmt.Sprintf("set %s for %s", strings.ToUpper(j.State), j.Duration)
+	}
+
+	return "set " + strings.ToUpper(j.State)
+}
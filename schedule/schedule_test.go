@@ -0,0 +1,146 @@
+package schedule
+
+import (
+	"rpm/audit"
+	"rpm/config"
+	"rpm/tycon"
+	"rpm/tycon/tycontest"
+	"testing"
+	"time"
+)
+
+func testConfig(t *testing.T, schedules ...config.Schedule) *config.RPMConfig {
+
+	rpmCfg := tycontest.Config(t)
+	rpmCfg.Schedules = schedules
+	rpmCfg.ApplyDefaults()
+
+	return rpmCfg
+}
+
+func newScheduler(t *testing.T, dev tycon.PowerMonitor, rpmCfg *config.RPMConfig) *Scheduler {
+
+	auditLog, err := audit.Open(rpmCfg.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+
+	s, err := New(dev, rpmCfg, "127.0.0.1:161", auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestWindow(t *testing.T) {
+
+	dev := tycontest.NewDevice()
+	rpmCfg := testConfig(t, config.Schedule{Name: "aux", Cron: "0 3 * * *", Relay: "RL2", Action: ActionSet, State: "open", Duration: time.Hour})
+	s := newScheduler(t, dev, rpmCfg)
+
+	start := time.Date(2020, 11, 1, 3, 0, 0, 0, time.UTC)
+	s.jobs[0].next = start
+	s.runDue(start)
+	s.runDue(start.Add(30 * time.Minute))
+	s.runDue(start.Add(time.Hour))
+
+	want := []string{"set " + tycontest.RL2Oid + " open", "set " + tycontest.RL2Oid + " closed"}
+	if len(dev.Actions) != len(want) || dev.Actions[0] != want[0] || dev.Actions[1] != want[1] {
+		t.Errorf("actions %v, want %v", dev.Actions, want)
+	}
+}
+
+func TestOverlapSkipped(t *testing.T) {
+
+	dev := tycontest.NewDevice()
+	rpmCfg := testConfig(t,
+		config.Schedule{Name: "window", Cron: "0 3 * * *", Relay: "RL2", Action: ActionSet, State: "open", Duration: 2 * time.Hour},
+		config.Schedule{Name: "reboot", Cron: "0 4 * * *", Relay: "RL2", Action: ActionCycle},
+	)
+	s := newScheduler(t, dev, rpmCfg)
+
+	start := time.Date(2020, 11, 1, 3, 0, 0, 0, time.UTC)
+	s.jobs[0].next = start
+	s.jobs[1].next = start.Add(time.Hour)
+	s.runDue(start)
+	s.runDue(start.Add(time.Hour))
+
+	if len(dev.Actions) != 1 {
+		t.Errorf("actions %v, want only the window opening", dev.Actions)
+	}
+	records, err := audit.Read(rpmCfg.Audit.File, func(rec audit.Record) bool { return rec.Schedule == "reboot" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Result != audit.ResultSkipped {
+		t.Errorf("reboot records %+v, want one skipped", records)
+	}
+}
+
+func TestRecover(t *testing.T) {
+
+	dev := tycontest.NewDevice()
+	dev.States[tycontest.RL2Oid] = "0"
+	rpmCfg := testConfig(t,
+		config.Schedule{Name: "window", Cron: "0 * * * *", Relay: "RL2", Action: ActionSet, State: "open", Duration: 24 * time.Hour},
+		config.Schedule{Name: "reboot", Cron: "* * * * *", Relay: "RL1", Action: ActionCycle, Catchup: time.Hour},
+	)
+
+	// earlier runs: a window that is still open and a cycle before a restart
+	auditLog, err := audit.Open(rpmCfg.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	auditLog.Write(audit.Record{Time: now.Add(-30 * time.Minute), Source: auditSource, Schedule: "window", Host: "127.0.0.1:161",
+		Chancode: "RL2", Action: ActionSet, Previous: "closed", Requested: "open", State: "open", Result: audit.ResultOK})
+	auditLog.Write(audit.Record{Time: now.Add(-10 * time.Minute), Source: auditSource, Schedule: "reboot", Host: "127.0.0.1:161",
+		Chancode: "RL1", Action: ActionCycle, Result: audit.ResultOK})
+	auditLog.Close()
+
+	s := newScheduler(t, dev, rpmCfg)
+	window, reboot := s.jobs[0], s.jobs[1]
+	if want := now.Add(-30 * time.Minute).Add(24 * time.Hour); !window.end.Equal(want) {
+		t.Errorf("window ends %s, want %s", window.end, want)
+	}
+	if window.restore != "closed" {
+		t.Errorf("window restores %q, want closed", window.restore)
+	}
+	if !reboot.next.Before(now) {
+		t.Errorf("reboot next run %s, want the catch-up of a missed run", reboot.next)
+	}
+
+	s.runDue(now)
+	if len(dev.Actions) != 1 || dev.Actions[0] != "cycle "+tycontest.RL1Oid {
+		t.Errorf("actions %v, want the catch-up cycle of RL1", dev.Actions)
+	}
+}
+
+func TestForce(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		force bool
+		want  int
+	}{
+		{"without force", false, 0},
+		{"with force", true, 1},
+	}
+
+	for _, tt := range tests {
+		dev := tycontest.NewDevice()
+		rpmCfg := testConfig(t, config.Schedule{Name: "reboot", Cron: "0 3 * * *", Relay: "RL1", Action: ActionCycle, Force: tt.force})
+		rpmCfg.Interlock.Protected = []string{"RL1"}
+		s := newScheduler(t, dev, rpmCfg)
+
+		// a protected relay is only cycled by a schedule with force
+		start := time.Date(2020, 11, 1, 3, 0, 0, 0, time.UTC)
+		s.jobs[0].next = start
+		s.runDue(start)
+		if len(dev.Actions) != tt.want {
+			t.Errorf("%s: actions %v, want %d", tt.name, dev.Actions, tt.want)
+		}
+	}
+}
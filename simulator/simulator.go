@@ -0,0 +1,492 @@
+// Package simulator provides an in-process SNMP agent that mimics a Tycon TPDin2
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"rpm/config"
+	rlog "rpm/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+const (
+	// DefaultReadCommunity accepted for GET requests
+	DefaultReadCommunity string = config.DefaultReadCommunity
+	// DefaultWriteCommunity accepted for GET and SET requests
+	DefaultWriteCommunity string = config.DefaultWriteCommunity
+	// DefaultCycleTime is how long a relay stays in its opposite state when cycled
+	DefaultCycleTime time.Duration = 5 * time.Second
+
+	relayOpen   int = 0
+	relayClosed int = 1
+	relayCycle  int = 2
+
+	maxPacketSize int = 65535
+)
+
+// Simulator serves the TPDin2 OID tree from an RPMConfig over UDP
+type Simulator struct {
+	ReadCommunity  string
+	WriteCommunity string
+	CycleTime      time.Duration
+
+	conn    net.PacketConn
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	start   time.Time
+	oids    []string
+	static  map[string]string
+	relays  map[string]*simRelay
+	signals map[string]Waveform
+	cycles  map[string]bool
+}
+
+// simRelay holds the state of a simulated relay
+type simRelay struct {
+	state      int
+	cycleUntil time.Time
+}
+
+// current state of the relay at time now, taking any cycle in progress into account
+func (r *simRelay) current(now time.Time) int {
+	if now.Before(r.cycleUntil) {
+		return 1 - r.state
+	}
+	return r.state
+}
+
+// New creates a Simulator for the OIDs and simulator settings in rpmCfg.
+// All relays start closed.
+func New(rpmCfg *config.RPMConfig) *Simulator {
+
+	sim := &Simulator{
+		ReadCommunity:  DefaultReadCommunity,
+		WriteCommunity: DefaultWriteCommunity,
+		CycleTime:      DefaultCycleTime,
+		static:         make(map[string]string),
+		relays:         make(map[string]*simRelay),
+		signals:        make(map[string]Waveform),
+		cycles:         make(map[string]bool),
+	}
+	snmpSettings := rpmCfg.SNMPFor("simulate")
+	sim.ReadCommunity = snmpSettings.Readcommunity
+	sim.WriteCommunity = snmpSettings.Writecommunity
+	if rpmCfg.Simulator.Cycletime > 0 {
+		sim.CycleTime = rpmCfg.Simulator.Cycletime
+	}
+
+	for _, info := range rpmCfg.Oids.Static {
+		sim.static[info.Oid] = info.Label
+	}
+	for _, info := range rpmCfg.Oids.Tests {
+		sim.static[info.Oid] = info.Label
+	}
+	for _, val := range rpmCfg.Simulator.Static {
+		sim.static[val.Oid] = val.Value
+	}
+	for _, info := range rpmCfg.Oids.Relays {
+		sim.relays[info.Oid] = &simRelay{state: relayClosed}
+		if info.Cycletimeoid != "" {
+			sim.cycles[info.Cycletimeoid] = true
+		}
+	}
+
+	defaults := []struct {
+		oids []config.OidInfo
+		wave Waveform
+	}{
+		{rpmCfg.Oids.Voltages, DefaultVoltage},
+		{rpmCfg.Oids.Currents, DefaultCurrent},
+		{rpmCfg.Oids.Temps, DefaultTemp},
+	}
+	chanOids := make(map[string]string)
+	for _, dflt := range defaults {
+		for _, info := range dflt.oids {
+			sim.signals[info.Oid] = dflt.wave
+			chanOids[info.Chancode] = info.Oid
+		}
+	}
+	for _, wf := range rpmCfg.Simulator.Waveforms {
+		if oid, ok := chanOids[wf.Chancode]; ok {
+			sim.signals[oid] = Waveform{
+				Kind:      wf.Kind,
+				Base:      wf.Base,
+				Amplitude: wf.Amplitude,
+				Period:    wf.Period,
+			}
+		} else {
+			rlog.WarningMsg("simulator: no voltage, current or temp OID with chancode %s", wf.Chancode)
+		}
+	}
+
+	for oid := range sim.static {
+		sim.oids = append(sim.oids, oid)
+	}
+	for oid := range sim.relays {
+		sim.oids = append(sim.oids, oid)
+	}
+	for oid := range sim.signals {
+		sim.oids = append(sim.oids, oid)
+	}
+	for oid := range sim.cycles {
+		sim.oids = append(sim.oids, oid)
+	}
+	sort.Slice(sim.oids, func(i, j int) bool {
+		return compareOids(sim.oids[i], sim.oids[j]) < 0
+	})
+
+	return sim
+}
+
+// SetWaveform replaces the simulated signal for oid
+func (sim *Simulator) SetWaveform(oid string, wave Waveform) error {
+
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	if _, ok := sim.signals[oid]; !ok {
+		return fmt.Errorf("simulator: %s is not a voltage, current or temp OID", oid)
+	}
+	sim.signals[oid] = wave
+
+	return nil
+}
+
+// RelayState returns the current state (0=open, 1=closed) of the relay at oid
+func (sim *Simulator) RelayState(oid string) (int, error) {
+
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	relay, ok := sim.relays[oid]
+	if !ok {
+		return 0, fmt.Errorf("simulator: %s is not a relay OID", oid)
+	}
+
+	return relay.current(time.Now()), nil
+}
+
+// Start listening for SNMP requests on the UDP address addr, e.g. "127.0.0.1:0"
+func (sim *Simulator) Start(addr string) error {
+
+	if sim.conn != nil {
+		return errors.New("simulator: already started")
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	sim.conn = conn
+	sim.start = time.Now()
+
+	sim.wg.Add(1)
+	go sim.serve()
+
+	rlog.NoticeMsg("simulator listening on %s", conn.LocalAddr().String())
+
+	return nil
+}
+
+// Addr returns the address the simulator is listening on
+func (sim *Simulator) Addr() net.Addr {
+	if sim.conn == nil {
+		return nil
+	}
+	return sim.conn.LocalAddr()
+}
+
+// HostPort returns the host and port strings the simulator is listening on
+func (sim *Simulator) HostPort() (string, string) {
+	if sim.conn == nil {
+		return "", ""
+	}
+	host, port, _ := net.SplitHostPort(sim.conn.LocalAddr().String())
+	return host, port
+}
+
+// Stop the simulator and wait for the listener to exit
+func (sim *Simulator) Stop() error {
+
+	if sim.conn == nil {
+		return nil
+	}
+
+	err := sim.conn.Close()
+	sim.wg.Wait()
+	sim.conn = nil
+
+	return err
+}
+
+// serve requests until the listener is closed
+func (sim *Simulator) serve() {
+	defer sim.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, raddr, err := sim.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				rlog.ErrMsg("simulator: %s", err.Error())
+			}
+			return
+		}
+
+		resp, err := sim.handle(buf[:n])
+		if err != nil {
+			rlog.WarningMsg("simulator: request from %s: %s", raddr.String(), err.Error())
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+
+		if _, err = sim.conn.WriteTo(resp, raddr); err != nil {
+			rlog.ErrMsg("simulator: %s", err.Error())
+		}
+	}
+}
+
+// handle decodes a request packet and returns the encoded response
+func (sim *Simulator) handle(packet []byte) ([]byte, error) {
+
+	decoder := &g.GoSNMP{Version: g.Version2c}
+	req, err := decoder.SnmpDecodePacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	if req.Version == g.Version3 {
+		return nil, errors.New("SNMPv3 is not supported by the simulator")
+	}
+
+	resp := &g.SnmpPacket{
+		Version:   req.Version,
+		Community: req.Community,
+		PDUType:   g.GetResponse,
+		RequestID: req.RequestID,
+	}
+
+	writeable := req.Community == sim.WriteCommunity
+	if !writeable && req.Community != sim.ReadCommunity {
+		// agents silently drop requests with an unknown community
+		return nil, fmt.Errorf("unknown community: %s", req.Community)
+	}
+
+	sim.mutex.Lock()
+	now := time.Now()
+	switch req.PDUType {
+	case g.GetRequest:
+		sim.get(now, req, resp)
+	case g.GetNextRequest:
+		sim.getNext(now, req, resp)
+	case g.GetBulkRequest:
+		sim.getBulk(now, req, resp)
+	case g.SetRequest:
+		if writeable {
+			sim.set(now, req, resp)
+		} else {
+			resp.Error = g.NoAccess
+			resp.ErrorIndex = 1
+			resp.Variables = req.Variables
+		}
+	default:
+		sim.mutex.Unlock()
+		return nil, fmt.Errorf("unsupported PDU type: %#x", byte(req.PDUType))
+	}
+	sim.mutex.Unlock()
+
+	return resp.MarshalMsg()
+}
+
+// get answers a GetRequest
+func (sim *Simulator) get(now time.Time, req, resp *g.SnmpPacket) {
+
+	for i, vb := range req.Variables {
+		pdu, ok := sim.value(now, trimOid(vb.Name))
+		if !ok {
+			if req.Version == g.Version1 {
+				resp.Error = g.NoSuchName
+				resp.ErrorIndex = uint8(i + 1)
+				resp.Variables = req.Variables
+				return
+			}
+			pdu = g.SnmpPDU{Name: vb.Name, Type: g.NoSuchObject}
+		}
+		resp.Variables = append(resp.Variables, pdu)
+	}
+}
+
+// getNext answers a GetNextRequest
+func (sim *Simulator) getNext(now time.Time, req, resp *g.SnmpPacket) {
+
+	for i, vb := range req.Variables {
+		pdu, ok := sim.next(now, trimOid(vb.Name))
+		if !ok {
+			if req.Version == g.Version1 {
+				resp.Error = g.NoSuchName
+				resp.ErrorIndex = uint8(i + 1)
+				resp.Variables = req.Variables
+				return
+			}
+			pdu = g.SnmpPDU{Name: vb.Name, Type: g.EndOfMibView}
+		}
+		resp.Variables = append(resp.Variables, pdu)
+	}
+}
+
+// getBulk answers a GetBulkRequest
+func (sim *Simulator) getBulk(now time.Time, req, resp *g.SnmpPacket) {
+
+	nonRepeaters := int(req.NonRepeaters)
+	if nonRepeaters > len(req.Variables) {
+		nonRepeaters = len(req.Variables)
+	}
+
+	for _, vb := range req.Variables[:nonRepeaters] {
+		pdu, ok := sim.next(now, trimOid(vb.Name))
+		if !ok {
+			pdu = g.SnmpPDU{Name: vb.Name, Type: g.EndOfMibView}
+		}
+		resp.Variables = append(resp.Variables, pdu)
+	}
+
+	for _, vb := range req.Variables[nonRepeaters:] {
+		oid := trimOid(vb.Name)
+		for r := 0; r < int(req.MaxRepetitions); r++ {
+			pdu, ok := sim.next(now, oid)
+			if !ok {
+				resp.Variables = append(resp.Variables, g.SnmpPDU{Name: "." + oid, Type: g.EndOfMibView})
+				break
+			}
+			resp.Variables = append(resp.Variables, pdu)
+			oid = trimOid(pdu.Name)
+		}
+	}
+}
+
+// set answers a SetRequest. Only relay OIDs are writable
+func (sim *Simulator) set(now time.Time, req, resp *g.SnmpPacket) {
+
+	resp.Variables = req.Variables
+
+	// validate everything before changing anything
+	for i, vb := range req.Variables {
+		oid := trimOid(vb.Name)
+		if _, ok := sim.relays[oid]; !ok {
+			resp.Error = g.NotWritable
+			resp.ErrorIndex = uint8(i + 1)
+			return
+		}
+		val, ok := vb.Value.(int)
+		if vb.Type != g.Integer || !ok {
+			resp.Error = g.WrongType
+			resp.ErrorIndex = uint8(i + 1)
+			return
+		}
+		if val != relayOpen && val != relayClosed && val != relayCycle {
+			resp.Error = g.WrongValue
+			resp.ErrorIndex = uint8(i + 1)
+			return
+		}
+	}
+
+	for _, vb := range req.Variables {
+		oid := trimOid(vb.Name)
+		relay := sim.relays[oid]
+		switch val := vb.Value.(int); val {
+		case relayCycle:
+			relay.state = relay.current(now)
+			relay.cycleUntil = now.Add(sim.CycleTime)
+			rlog.NoticeMsg("simulator: relay %s cycling for %s", oid, sim.CycleTime)
+		default:
+			relay.state = val
+			relay.cycleUntil = time.Time{}
+			rlog.NoticeMsg("simulator: relay %s set to %d", oid, val)
+		}
+	}
+}
+
+// cycleSeconds is the relay cycle time in whole seconds, as the device reports it
+func (sim *Simulator) cycleSeconds() int {
+
+	secs := int(math.Ceil(sim.CycleTime.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+
+	return secs
+}
+
+// value returns the varbind for oid
+func (sim *Simulator) value(now time.Time, oid string) (g.SnmpPDU, bool) {
+
+	name := "." + oid
+
+	if val, ok := sim.static[oid]; ok {
+		return g.SnmpPDU{Name: name, Type: g.OctetString, Value: val}, true
+	}
+	if relay, ok := sim.relays[oid]; ok {
+		return g.SnmpPDU{Name: name, Type: g.Integer, Value: relay.current(now)}, true
+	}
+	if wave, ok := sim.signals[oid]; ok {
+		return g.SnmpPDU{Name: name, Type: g.Integer, Value: wave.Value(now.Sub(sim.start))}, true
+	}
+	if sim.cycles[oid] {
+		return g.SnmpPDU{Name: name, Type: g.Integer, Value: sim.cycleSeconds()}, true
+	}
+
+	return g.SnmpPDU{}, false
+}
+
+// next returns the varbind for the first OID after oid
+func (sim *Simulator) next(now time.Time, oid string) (g.SnmpPDU, bool) {
+
+	ndx := sort.Search(len(sim.oids), func(i int) bool {
+		return compareOids(sim.oids[i], oid) > 0
+	})
+	if ndx >= len(sim.oids) {
+		return g.SnmpPDU{}, false
+	}
+
+	return sim.value(now, sim.oids[ndx])
+}
+
+// trimOid removes the leading dot from an OID
+func trimOid(oid string) string {
+	return strings.TrimPrefix(oid, ".")
+}
+
+// compareOids compares two dotted OIDs numerically, returning -1, 0 or 1
+func compareOids(a, b string) int {
+
+	as := strings.Split(trimOid(a), ".")
+	bs := strings.Split(trimOid(b), ".")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, _ := strconv.ParseUint(as[i], 10, 32)
+		bn, _ := strconv.ParseUint(bs[i], 10, 32)
+		if an < bn {
+			return -1
+		}
+		if an > bn {
+			return 1
+		}
+	}
+
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
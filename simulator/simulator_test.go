@@ -0,0 +1,150 @@
+package simulator
+
+import (
+	"rpm/config"
+	"rpm/tycon"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testConfig() *config.RPMConfig {
+
+	rpmCfg := config.NewConfig()
+	rpmCfg.Oids.Static = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Label: "Product Name"},
+	}
+	rpmCfg.Oids.Relays = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.1.0", Chancode: "RL1", Label: "Relay 1"},
+		{Oid: "1.3.6.1.4.1.45621.2.2.2.0", Chancode: "RL2", Label: "Relay 2"},
+	}
+	rpmCfg.Oids.Voltages = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.5.0", Chancode: "MV1", Label: "Battery"},
+	}
+	rpmCfg.Oids.Temps = []config.OidInfo{
+		{Oid: "1.3.6.1.4.1.45621.2.2.13.0", Chancode: "TPE", Label: "Temp"},
+	}
+	rpmCfg.Simulator.Cycletime = 300 * time.Millisecond
+	rpmCfg.Simulator.Static = []config.StaticValue{
+		{Oid: "1.3.6.1.4.1.45621.2.1.1.0", Value: "TPDIN2-SIM"},
+	}
+	rpmCfg.Simulator.Waveforms = []config.WaveformInfo{
+		{Chancode: "MV1", Kind: WaveConstant, Base: 125},
+	}
+
+	return rpmCfg
+}
+
+func startSimulator(t *testing.T, community string) (*Simulator, tycon.PowerMonitor) {
+
+	sim := New(testConfig())
+	if err := sim.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Stop() })
+
+	host, port := sim.HostPort()
+	dev, err := tycon.NewPowerMonitor(host, port, tycon.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Connect(tycon.Credentials{Community: community}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+
+	return sim, dev
+}
+
+func TestQuery(t *testing.T) {
+
+	_, dev := startSimulator(t, DefaultReadCommunity)
+
+	oids := []string{
+		"1.3.6.1.4.1.45621.2.1.1.0",
+		"1.3.6.1.4.1.45621.2.2.1.0",
+		"1.3.6.1.4.1.45621.2.2.5.0",
+		"1.3.6.1.4.1.45621.2.2.13.0",
+	}
+	_, results, err := dev.QueryOids(&oids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"1.3.6.1.4.1.45621.2.1.1.0": "TPDIN2-SIM",
+		"1.3.6.1.4.1.45621.2.2.1.0": "1",
+		"1.3.6.1.4.1.45621.2.2.5.0": "125",
+	}
+	for oid, val := range want {
+		if results[oid] != val {
+			t.Errorf("%s: got %q, want %q", oid, results[oid], val)
+		}
+	}
+
+	temp, err := strconv.Atoi(results["1.3.6.1.4.1.45621.2.2.13.0"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if temp < 230 || temp > 270 {
+		t.Errorf("default temp waveform out of range: %d", temp)
+	}
+}
+
+func TestSetRelay(t *testing.T) {
+
+	sim, dev := startSimulator(t, DefaultWriteCommunity)
+	oid := "1.3.6.1.4.1.45621.2.2.2.0"
+
+	if err := dev.SetRelay(oid, "open"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := sim.RelayState(oid); state != relayOpen {
+		t.Errorf("relay state after open: got %d, want %d", state, relayOpen)
+	}
+
+	if err := dev.SetRelay(oid, "closed"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := sim.RelayState(oid); state != relayClosed {
+		t.Errorf("relay state after closed: got %d, want %d", state, relayClosed)
+	}
+}
+
+func TestSetRelayReadCommunity(t *testing.T) {
+
+	_, dev := startSimulator(t, DefaultReadCommunity)
+
+	if err := dev.SetRelay("1.3.6.1.4.1.45621.2.2.1.0", "open"); err == nil {
+		t.Error("set with read community succeeded")
+	}
+}
+
+func TestCycleRelay(t *testing.T) {
+
+	sim, dev := startSimulator(t, DefaultWriteCommunity)
+	oid := "1.3.6.1.4.1.45621.2.2.1.0"
+
+	if err := dev.CycleRelay(oid); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := sim.RelayState(oid); state != relayOpen {
+		t.Errorf("relay state during cycle: got %d, want %d", state, relayOpen)
+	}
+
+	time.Sleep(2 * sim.CycleTime)
+	if state, _ := sim.RelayState(oid); state != relayClosed {
+		t.Errorf("relay state after cycle: got %d, want %d", state, relayClosed)
+	}
+}
+
+func TestWaveform(t *testing.T) {
+
+	wave := Waveform{Kind: WaveSquare, Base: 100, Amplitude: 10, Period: time.Minute}
+	if val := wave.Value(10 * time.Second); val != 110 {
+		t.Errorf("square first half: got %d, want 110", val)
+	}
+	if val := wave.Value(40 * time.Second); val != 90 {
+		t.Errorf("square second half: got %d, want 90", val)
+	}
+}
@@ -0,0 +1,58 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Waveform kinds
+const (
+	WaveConstant string = "constant"
+	WaveSine     string = "sine"
+	WaveRamp     string = "ramp"
+	WaveSquare   string = "square"
+	WaveNoise    string = "noise"
+)
+
+// Waveform describes a simulated signal in raw device units (tenths)
+type Waveform struct {
+	Kind      string
+	Base      float64
+	Amplitude float64
+	Period    time.Duration
+}
+
+// Default waveforms by OID category
+var (
+	DefaultVoltage = Waveform{Kind: WaveSine, Base: 132, Amplitude: 3, Period: 10 * time.Minute}
+	DefaultCurrent = Waveform{Kind: WaveSine, Base: 25, Amplitude: 5, Period: 10 * time.Minute}
+	DefaultTemp    = Waveform{Kind: WaveSine, Base: 250, Amplitude: 20, Period: 24 * time.Hour}
+)
+
+// Value of the waveform at elapsed time since the simulator started
+func (w Waveform) Value(elapsed time.Duration) int {
+
+	phase := 0.0
+	if w.Period > 0 {
+		phase = math.Mod(elapsed.Seconds(), w.Period.Seconds()) / w.Period.Seconds()
+	}
+
+	val := w.Base
+	switch w.Kind {
+	case WaveSine:
+		val += w.Amplitude * math.Sin(2*math.Pi*phase)
+	case WaveRamp:
+		val += w.Amplitude * (2*phase - 1)
+	case WaveSquare:
+		if phase < 0.5 {
+			val += w.Amplitude
+		} else {
+			val -= w.Amplitude
+		}
+	case WaveNoise:
+		val += w.Amplitude * (2*rand.Float64() - 1)
+	}
+
+	return int(math.Round(val))
+}
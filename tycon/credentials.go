@@ -0,0 +1,117 @@
+package tycon
+
+import (
+	"fmt"
+	"strings"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// SNMP versions supported by Connect
+const (
+	SNMPVersion2c string = "2c"
+	SNMPVersion3  string = "3"
+)
+
+// SNMPv3 security levels
+const (
+	SecLevelNoAuthNoPriv string = "noAuthNoPriv"
+	SecLevelAuthNoPriv   string = "authNoPriv"
+	SecLevelAuthPriv     string = "authPriv"
+)
+
+// Credentials holds the SNMP version and security settings used by Connect.
+// Community is used for v2c, the remaining fields for v3 (USM).
+type Credentials struct {
+	Version        string
+	Community      string
+	User           string
+	SecurityLevel  string
+	AuthProtocol   string
+	AuthPassphrase string
+	PrivProtocol   string
+	PrivPassphrase string
+}
+
+// authProtocols maps config names to gosnmp auth protocols
+var authProtocols = map[string]g.SnmpV3AuthProtocol{
+	"SHA":     g.SHA,
+	"SHA-224": g.SHA224,
+	"SHA-256": g.SHA256,
+	"SHA-384": g.SHA384,
+	"SHA-512": g.SHA512,
+}
+
+// privProtocols maps config names to gosnmp privacy protocols
+var privProtocols = map[string]g.SnmpV3PrivProtocol{
+	"AES":     g.AES,
+	"AES-192": g.AES192,
+	"AES-256": g.AES256,
+}
+
+// secLevels maps config names to gosnmp message flags
+var secLevels = map[string]g.SnmpV3MsgFlags{
+	strings.ToLower(SecLevelNoAuthNoPriv): g.NoAuthNoPriv,
+	strings.ToLower(SecLevelAuthNoPriv):   g.AuthNoPriv,
+	strings.ToLower(SecLevelAuthPriv):     g.AuthPriv,
+}
+
+// apply the credentials to the gosnmp session parameters
+func (creds *Credentials) apply(snmpParams *g.GoSNMP) error {
+
+	switch creds.Version {
+	case SNMPVersion2c, "":
+		snmpParams.Version = g.Version2c
+		snmpParams.Community = creds.Community
+		return nil
+	case SNMPVersion3:
+	default:
+		return fmt.Errorf("unsupported SNMP version: %s", creds.Version)
+	}
+
+	if creds.User == "" {
+		return fmt.Errorf("SNMPv3 requires a user name")
+	}
+
+	level, ok := secLevels[strings.ToLower(creds.SecurityLevel)]
+	if !ok {
+		return fmt.Errorf("invalid SNMPv3 security level: %s", creds.SecurityLevel)
+	}
+
+	usm := &g.UsmSecurityParameters{
+		UserName:               creds.User,
+		AuthenticationProtocol: g.NoAuth,
+		PrivacyProtocol:        g.NoPriv,
+	}
+
+	if level&g.AuthNoPriv > 0 {
+		proto, ok := authProtocols[strings.ToUpper(creds.AuthProtocol)]
+		if !ok {
+			return fmt.Errorf("invalid SNMPv3 auth protocol: %s", creds.AuthProtocol)
+		}
+		if creds.AuthPassphrase == "" {
+			return fmt.Errorf("SNMPv3 security level %s requires an auth passphrase", creds.SecurityLevel)
+		}
+		usm.AuthenticationProtocol = proto
+		usm.AuthenticationPassphrase = creds.AuthPassphrase
+	}
+
+	if level == g.AuthPriv {
+		proto, ok := privProtocols[strings.ToUpper(creds.PrivProtocol)]
+		if !ok {
+			return fmt.Errorf("invalid SNMPv3 privacy protocol: %s", creds.PrivProtocol)
+		}
+		if creds.PrivPassphrase == "" {
+			return fmt.Errorf("SNMPv3 security level %s requires a privacy passphrase", creds.SecurityLevel)
+		}
+		usm.PrivacyProtocol = proto
+		usm.PrivacyPassphrase = creds.PrivPassphrase
+	}
+
+	snmpParams.Version = g.Version3
+	snmpParams.SecurityModel = g.UserSecurityModel
+	snmpParams.MsgFlags = level
+	snmpParams.SecurityParameters = usm
+
+	return nil
+}
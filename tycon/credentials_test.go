@@ -0,0 +1,97 @@
+package tycon
+
+import (
+	"strings"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// v3Credentials are authPriv credentials, with level
+func v3Credentials(level string) Credentials {
+	return Credentials{
+		Version:        SNMPVersion3,
+		User:           "rpm",
+		SecurityLevel:  level,
+		AuthProtocol:   "sha-256",
+		AuthPassphrase: "authpass",
+		PrivProtocol:   "AES",
+		PrivPassphrase: "privpass",
+	}
+}
+
+func TestCredentialsApply(t *testing.T) {
+
+	noAuthPass := v3Credentials(SecLevelAuthPriv)
+	noAuthPass.AuthPassphrase = ""
+	noPrivPass := v3Credentials(SecLevelAuthPriv)
+	noPrivPass.PrivPassphrase = ""
+	badAuth := v3Credentials(SecLevelAuthNoPriv)
+	badAuth.AuthProtocol = "MD5"
+	badPriv := v3Credentials(SecLevelAuthPriv)
+	badPriv.PrivProtocol = "DES"
+	noUser := v3Credentials(SecLevelAuthPriv)
+	noUser.User = ""
+	// a level without privacy ignores the privacy settings
+	authOnly := v3Credentials(SecLevelAuthNoPriv)
+	authOnly.PrivProtocol, authOnly.PrivPassphrase = "DES", ""
+
+	tests := []struct {
+		name  string
+		creds Credentials
+		flags g.SnmpV3MsgFlags
+		auth  g.SnmpV3AuthProtocol
+		priv  g.SnmpV3PrivProtocol
+		err   string
+	}{
+		{"v3 authPriv", v3Credentials(SecLevelAuthPriv), g.AuthPriv, g.SHA256, g.AES, ""},
+		{"v3 level case", v3Credentials("AUTHPRIV"), g.AuthPriv, g.SHA256, g.AES, ""},
+		{"v3 authNoPriv", v3Credentials(SecLevelAuthNoPriv), g.AuthNoPriv, g.SHA256, g.NoPriv, ""},
+		{"v3 noAuthNoPriv", v3Credentials(SecLevelNoAuthNoPriv), g.NoAuthNoPriv, g.NoAuth, g.NoPriv, ""},
+		{"auth only", authOnly, g.AuthNoPriv, g.SHA256, g.NoPriv, ""},
+		{"version", Credentials{Version: "1"}, 0, 0, 0, "unsupported SNMP version"},
+		{"no user", noUser, 0, 0, 0, "requires a user name"},
+		{"level", v3Credentials("authpriv-typo"), 0, 0, 0, "invalid SNMPv3 security level"},
+		{"auth protocol", badAuth, 0, 0, 0, "invalid SNMPv3 auth protocol"},
+		{"auth passphrase", noAuthPass, 0, 0, 0, "requires an auth passphrase"},
+		{"priv protocol", badPriv, 0, 0, 0, "invalid SNMPv3 privacy protocol"},
+		{"priv passphrase", noPrivPass, 0, 0, 0, "requires a privacy passphrase"},
+	}
+
+	for _, tt := range tests {
+		var params g.GoSNMP
+		err := tt.creds.apply(&params)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		usm, ok := params.SecurityParameters.(*g.UsmSecurityParameters)
+		if params.Version != g.Version3 || params.SecurityModel != g.UserSecurityModel || params.MsgFlags != tt.flags || !ok {
+			t.Errorf("%s: version %s flags %d, want v3 flags %d", tt.name, params.Version, params.MsgFlags, tt.flags)
+			continue
+		}
+		if usm.UserName != "rpm" || usm.AuthenticationProtocol != tt.auth || usm.PrivacyProtocol != tt.priv {
+			t.Errorf("%s: usm %s auth %s priv %s, want auth %s priv %s", tt.name, usm.UserName, usm.AuthenticationProtocol, usm.PrivacyProtocol, tt.auth, tt.priv)
+		}
+	}
+}
+
+func TestCredentialsApplyV2c(t *testing.T) {
+
+	// v2c is the default version
+	for _, version := range []string{"", SNMPVersion2c} {
+		var params g.GoSNMP
+		if err := (&Credentials{Version: version, Community: "write"}).apply(&params); err != nil {
+			t.Fatal(err)
+		}
+		if params.Version != g.Version2c || params.Community != "write" || params.SecurityParameters != nil {
+			t.Errorf("version %q: session version %s community %q, want v2c with community write", version, params.Version, params.Community)
+		}
+	}
+}
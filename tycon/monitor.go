@@ -0,0 +1,62 @@
+package tycon
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PowerMonitor is the interface rpm uses to query and operate a site power
+// controller. TPDin2Device is the first implementation.
+type PowerMonitor interface {
+	// Connect opens the SNMP session to the device
+	Connect(creds Credentials) error
+	// QueryOids gets the current values for the given oids
+	QueryOids(oids *[]string) (time.Time, map[string]string, error)
+	// SetRelay sets the relay at relayOid to targetState (open or closed)
+	SetRelay(relayOid, targetState string) error
+	// CycleRelay starts a cycle of the relay at relayOid
+	CycleRelay(relayOid string) error
+	// PollStart starts an internal loop polling pollOids until ctx is done
+	PollStart(ctx context.Context, wg *sync.WaitGroup, pollOids *[]string, sampleInterval time.Duration) error
+	// GetScan returns the most recent scan from the polling loop
+	GetScan() (*TPDin2Scan, error)
+	// Close the session to the device
+	Close() error
+}
+
+// ErrorCounter is implemented by monitors that count their failed SNMP requests
+type ErrorCounter interface {
+	SNMPErrors() uint64
+}
+
+// Walker is implemented by monitors that can walk an OID subtree
+type Walker interface {
+	Walk(rootOid string) ([]Variable, error)
+}
+
+// Variable is an OID of a walk with its SNMP type and value
+type Variable struct {
+	Oid   string
+	Type  string
+	Value string
+}
+
+// TPDin2Device must satisfy PowerMonitor, ErrorCounter and Walker
+var _ PowerMonitor = (*TPDin2Device)(nil)
+var _ ErrorCounter = (*TPDin2Device)(nil)
+var _ Walker = (*TPDin2Device)(nil)
+
+// NewPowerMonitor returns an initialized, not yet connected, PowerMonitor for host:port
+func NewPowerMonitor(host, port string, opts Options) (PowerMonitor, error) {
+
+	tp2din := NewTPDin2()
+	if err := tp2din.Initialize(host, port); err != nil {
+		return nil, err
+	}
+	if err := tp2din.SetOptions(opts); err != nil {
+		return nil, err
+	}
+
+	return tp2din, nil
+}
@@ -9,7 +9,9 @@ import (
 	"fmt"
 	rlog "rpm/log"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	g "github.com/gosnmp/gosnmp"
@@ -29,7 +31,6 @@ const (
 	relayActionCycleLabel  string = "cycle"
 
 	maxCycleTime int = 99999
-	snmpVersion  int = 2
 )
 
 // // TPDin2Relay is the relay index type
@@ -43,13 +44,16 @@ const (
 
 // TPDin2Device struct object
 type TPDin2Device struct {
+	snmpErrors       uint64 // first for 64-bit alignment of atomic access
 	host             string
 	port             uint64
 	ready            bool
 	internalInterval time.Duration
+	options          Options
 	SNMPParams       *g.GoSNMP
 	ctx              *context.Context
 	mutex            sync.Mutex
+	snmpMutex        sync.Mutex // serializes use of SNMPParams by the polling loop and callers
 	// SampleInterval   time.Duration
 	CurrentScan *TPDin2Scan
 }
@@ -75,11 +79,40 @@ func (scan *TPDin2Scan) copy() *TPDin2Scan {
 	return &newscan
 }
 
+// Options holds the SNMP session settings used by Connect
+type Options struct {
+	Transport string
+	Timeout   time.Duration
+	Retries   int
+	MaxOids   int
+}
+
+// DefaultOptions are the session settings used if none are given
+var DefaultOptions = Options{
+	Transport: "udp4",
+	Timeout:   time.Duration(10) * time.Second,
+	Retries:   0,
+	MaxOids:   g.MaxOids,
+}
+
+// RelayStateLabel returns the state label (open or closed) for a raw relay value
+func RelayStateLabel(val string) string {
+	switch val {
+	case strconv.Itoa(relayActionOpen):
+		return relayActionOpenLabel
+	case strconv.Itoa(relayActionClosed):
+		return relayActionClosedLabel
+	default:
+		return ""
+	}
+}
+
 // NewTPDin2 constructor
 func NewTPDin2() *TPDin2Device {
 
 	tp := TPDin2Device{}
 	tp.ready = false
+	tp.options = DefaultOptions
 	return &tp
 
 }
@@ -108,19 +141,49 @@ func (tp *TPDin2Device) Initialize(host, port string) error {
 	return nil
 }
 
+// SetOptions sets the SNMP session settings used by the next Connect
+func (tp *TPDin2Device) SetOptions(opts Options) error {
+
+	switch opts.Transport {
+	case "":
+		opts.Transport = DefaultOptions.Transport
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid SNMP transport: %s", opts.Transport)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultOptions.Timeout
+	}
+	if opts.Retries < 0 {
+		return fmt.Errorf("invalid SNMP retries: %d", opts.Retries)
+	}
+	if opts.MaxOids <= 0 {
+		opts.MaxOids = DefaultOptions.MaxOids
+	}
+
+	tp.options = opts
+
+	rlog.DebugMsg("debug: tp.options:          %+v", tp.options)
+
+	return nil
+}
+
 // Connect via SNMP to device
-func (tp *TPDin2Device) Connect(community string) error {
+func (tp *TPDin2Device) Connect(creds Credentials) error {
 
 	if !tp.ready {
 
 		snmpParams := &g.GoSNMP{
 			Target:    tp.host,
 			Port:      uint16(tp.port),
-			Transport: "udp4",
-			Community: community,
-			Version:   g.Version2c,
-			Retries:   0,
-			Timeout:   time.Duration(10) * time.Second,
+			Transport: tp.options.Transport,
+			Retries:   tp.options.Retries,
+			Timeout:   tp.options.Timeout,
+			MaxOids:   tp.options.MaxOids,
+		}
+
+		if err := creds.apply(snmpParams); err != nil {
+			return err
 		}
 
 		if err := snmpParams.Connect(); err != nil {
@@ -160,10 +223,16 @@ func (tp *TPDin2Device) SetRelay(relayOid, targetState string) error {
 			Value: snmpVal,
 		},
 	}
-	_, err := tp.SNMPParams.Set(setPDUs)
+	tp.snmpMutex.Lock()
+	result, err := tp.SNMPParams.Set(setPDUs)
+	tp.snmpMutex.Unlock()
 	if err != nil {
+		atomic.AddUint64(&tp.snmpErrors, 1)
 		return err
 	}
+	if result.Error != g.NoError {
+		return fmt.Errorf("set %s refused by device: %s", relayOid, result.Error)
+	}
 
 	return nil
 }
@@ -178,43 +247,113 @@ func (tp *TPDin2Device) CycleRelay(relayOid string) error {
 			Value: relayActionCycle,
 		},
 	}
-	_, err := tp.SNMPParams.Set(setPDUs)
+	tp.snmpMutex.Lock()
+	result, err := tp.SNMPParams.Set(setPDUs)
+	tp.snmpMutex.Unlock()
 	if err != nil {
+		atomic.AddUint64(&tp.snmpErrors, 1)
 		return err
 	}
+	if result.Error != g.NoError {
+		return fmt.Errorf("set %s refused by device: %s", relayOid, result.Error)
+	}
 
 	return nil
 }
 
-// QueryOids to get values for all device oids
+// SNMPErrors returns the number of failed SNMP requests
+func (tp *TPDin2Device) SNMPErrors() uint64 {
+	return atomic.LoadUint64(&tp.snmpErrors)
+}
+
+// QueryOids to get values for all device oids, split into GETs of at most MaxOids
 func (tp *TPDin2Device) QueryOids(oids *[]string) (time.Time, map[string]string, error) {
 
+	results := make(map[string]string)
+	for start := 0; start < len(*oids); start += tp.SNMPParams.MaxOids {
+		end := start + tp.SNMPParams.MaxOids
+		if end > len(*oids) {
+			end = len(*oids)
+		}
+		chunk := (*oids)[start:end]
+		if err := tp.queryChunk(&chunk, results); err != nil {
+			return time.Now(), nil, err
+		}
+	}
+
+	ts := time.Now()
+
+	return ts, results, nil
+}
+
+// queryChunk gets values for oids in a single GET, adding them to results
+func (tp *TPDin2Device) queryChunk(oids *[]string, results map[string]string) error {
+
+	tp.snmpMutex.Lock()
 	snmpVals, err := tp.SNMPParams.Get(*oids)
+	tp.snmpMutex.Unlock()
 	if err != nil {
-		return time.Now(), nil, err
+		atomic.AddUint64(&tp.snmpErrors, 1)
+		return err
 	}
 
-	results := make(map[string]string)
 	for i, variable := range snmpVals.Variables {
+		results[(*oids)[i]] = pduValue(variable)
+	}
 
-		// the Value of each variable returned by Get() implements
-		// interface{}. You could do a type switch...
-		switch variable.Type {
-		case g.OctetString:
-			// fmt.Printf("string: %s\n", string(variable.Value.([]byte)))
-			results[(*oids)[i]] = string(variable.Value.([]byte))
-		default:
-			// ... or often you're just interested in numeric values.
-			// ToBigInt() will return the Value as a BigInt, for plugging
-			// into your calculations.
-			// fmt.Printf("number: %d\n", g.ToBigInt(variable.Value))
-			results[(*oids)[i]] = g.ToBigInt(variable.Value).String()
-		}
+	return nil
+}
+
+// pduValue returns the value of variable as a string
+func pduValue(variable g.SnmpPDU) string {
+
+	// the Value of each variable returned by Get() implements
+	// interface{}. You could do a type switch...
+	switch variable.Type {
+	case g.OctetString:
+		return string(variable.Value.([]byte))
+	case g.ObjectIdentifier, g.IPAddress:
+		return fmt.Sprint(variable.Value)
+	default:
+		// ... or often you're just interested in numeric values.
+		// ToBigInt() will return the Value as a BigInt, for plugging
+		// into your calculations.
+		return g.ToBigInt(variable.Value).String()
 	}
+}
 
-	ts := time.Now()
+// Walk returns the variables of the subtree at rootOid, with GetBulk
+// requests or, for SNMP v1, GetNext requests
+func (tp *TPDin2Device) Walk(rootOid string) ([]Variable, error) {
 
-	return ts, results, nil
+	tp.snmpMutex.Lock()
+	var pdus []g.SnmpPDU
+	var err error
+	if tp.SNMPParams.Version == g.Version1 {
+		pdus, err = tp.SNMPParams.WalkAll(rootOid)
+	} else {
+		pdus, err = tp.SNMPParams.BulkWalkAll(rootOid)
+	}
+	tp.snmpMutex.Unlock()
+	if err != nil {
+		atomic.AddUint64(&tp.snmpErrors, 1)
+		return nil, err
+	}
+
+	variables := make([]Variable, 0, len(pdus))
+	for _, pdu := range pdus {
+		switch pdu.Type {
+		case g.NoSuchObject, g.NoSuchInstance, g.EndOfMibView, g.Null:
+			continue
+		}
+		variables = append(variables, Variable{
+			Oid:   strings.TrimPrefix(pdu.Name, "."),
+			Type:  pdu.Type.String(),
+			Value: pduValue(pdu),
+		})
+	}
+
+	return variables, nil
 }
 
 // queryDeviceVars queries device for TPDin2 OID values
@@ -240,14 +379,15 @@ func (tp *TPDin2Device) saveScan(ts time.Time, results *map[string]string) {
 // GetScan retuns a copy of the most recent TPDin2Scan struct
 func (tp *TPDin2Device) GetScan() (*TPDin2Scan, error) {
 
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
 	if tp.CurrentScan == nil {
 		return nil, errors.New("scan unavailable")
 	}
 
-	tp.mutex.Lock()
 	scan := tp.CurrentScan.copy()
 	tp.CurrentScan = nil
-	tp.mutex.Unlock()
 
 	return scan, nil
 }
@@ -261,17 +401,14 @@ func (tp *TPDin2Device) PollStart(
 
 	tp.internalInterval = sampleInterval / 3.0
 
-	wg.Add(1)
-	defer wg.Done()
-
 	if !tp.ready {
 		rlog.WarningMsg("TP2DinDevice is not connected to host: %s", tp.host)
 		return fmt.Errorf("TP2DinDevice is not connected to host: %s", tp.host)
 	}
 
 	// kick off internval polling loop
+	wg.Add(1)
 	go func(ctx context.Context, wg *sync.WaitGroup) {
-		wg.Add(1)
 		defer wg.Done()
 
 		trigtime := time.Now()
@@ -297,20 +434,18 @@ func (tp *TPDin2Device) PollStart(
 	return nil
 }
 
-//// cycle relay
-// func (tp *TPDin2Device) cycleRelay(relay TPDin2Relay)
+// Close the SNMP session to the device
+func (tp *TPDin2Device) Close() error {
 
-func (tp2din *TPDin2Device) InitAndConnect(host, port, snmpCommunity string) error {
-	err := tp2din.Initialize(host, port)
-	if err != nil {
-		rlog.ErrMsg("unknown error initializing structures for %s:%s, quitting", host, port)
-		// log.Fatalln(err)
-	}
-	err = tp2din.Connect(snmpCommunity)
-	if err != nil {
-		rlog.CritMsg("could not connect to %s:%s, quitting", host, port)
-		// log.Fatalln(fmt.Errorf("could not connect to %s:%s, quitting", host, port))
+	tp.snmpMutex.Lock()
+	defer tp.snmpMutex.Unlock()
+
+	if !tp.ready {
+		return nil
 	}
 
+	err := tp.SNMPParams.Conn.Close()
+	tp.ready = false
+
 	return err
 }
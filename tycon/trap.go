@@ -0,0 +1,414 @@
+package tycon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	rlog "rpm/log"
+	"strings"
+	"sync"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+const (
+	// sysUpTimeOid and snmpTrapOid are the first two varbinds of a v2c or v3 trap
+	sysUpTimeOid = "1.3.6.1.2.1.1.3.0"
+	snmpTrapOid  = "1.3.6.1.6.3.1.1.4.1.0"
+
+	// usmStatsUnknownEngineIDs is the varbind of the Report answering an
+	// SNMPv3 engine ID discovery
+	usmStatsUnknownEngineIDs = "1.3.6.1.6.3.15.1.1.4.0"
+
+	maxTrapSize = 65535
+)
+
+// TrapSender is a device traps and informs are accepted from, with the
+// credentials of its traps. Host, if set, is the IP address they must come
+// from. EngineID is the device's SNMPv3 engine ID in hex, needed for v3
+// traps; v3 informs use the engine ID of the listener
+type TrapSender struct {
+	Name     string
+	Host     string
+	Creds    Credentials
+	EngineID string
+}
+
+// Trap is a trap or inform received from a TrapSender. Uptime is the
+// sysUpTime of the device, TrapOid the OID of the notification
+type Trap struct {
+	Time      time.Time
+	Sender    string
+	Source    string
+	Version   string
+	Inform    bool
+	Uptime    string
+	TrapOid   string
+	Variables []Variable
+}
+
+// trapSender is a TrapSender with the SNMP parameters that decode its traps
+// and, for v3, those that decode its informs
+type trapSender struct {
+	TrapSender
+	params       *g.GoSNMP
+	informParams *g.GoSNMP
+}
+
+// TrapListener receives the traps and informs of its senders, calling
+// handler with each one accepted. Informs are acknowledged once accepted.
+// For v3 informs the listener is the authoritative engine, answering the
+// engine ID discovery of the senders with its own engine ID
+type TrapListener struct {
+	senders   []trapSender
+	handler   func(Trap)
+	engineID  string
+	started   time.Time
+	discovery *g.GoSNMP
+	conn      net.PacketConn
+	wg        sync.WaitGroup
+}
+
+// DefaultTrapEngineID returns the SNMPv3 engine ID of a TrapListener on
+// this host in hex, in the RFC 3411 text format from the hostname
+func DefaultTrapEngineID() string {
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "rpm"
+	}
+	if len(hostname) > 27 {
+		hostname = hostname[:27]
+	}
+
+	return hex.EncodeToString(append([]byte{0x80, 0, 0, 0, 4}, hostname...))
+}
+
+// NewTrapListener returns a TrapListener for senders, with the SNMPv3
+// engine ID engineID in hex for informs, DefaultTrapEngineID if ""
+func NewTrapListener(engineID string, senders []TrapSender, handler func(Trap)) (*TrapListener, error) {
+
+	if engineID == "" {
+		engineID = DefaultTrapEngineID()
+	}
+	localID, err := hex.DecodeString(strings.TrimPrefix(engineID, "0x"))
+	if err != nil || len(localID) == 0 {
+		return nil, fmt.Errorf("invalid trap listener engine ID %q: must be in hex", engineID)
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+	tl := &TrapListener{
+		handler:  handler,
+		engineID: string(localID),
+		// the discovery parameters only read the header of a message, an
+		// encrypted PDU is "decrypted" with a dummy AES key
+		discovery: &g.GoSNMP{
+			Version:       g.Version3,
+			SecurityModel: g.UserSecurityModel,
+			MsgFlags:      g.NoAuthNoPriv,
+			SecurityParameters: &g.UsmSecurityParameters{
+				PrivacyProtocol: g.AES,
+				PrivacyKey:      make([]byte, 16),
+				Logger:          logger,
+			},
+			Logger: logger,
+		},
+	}
+	for _, sender := range senders {
+		params, err := sender.newParams("")
+		if err != nil {
+			return nil, err
+		}
+		ts := trapSender{TrapSender: sender, params: params}
+		if params.Version == g.Version3 {
+			id, err := hex.DecodeString(strings.TrimPrefix(sender.EngineID, "0x"))
+			if err != nil || len(id) == 0 {
+				return nil, fmt.Errorf("traps of %s: SNMPv3 traps require the engine ID of the device in hex", sender.Name)
+			}
+			params.SecurityParameters.(*g.UsmSecurityParameters).AuthoritativeEngineID = string(id)
+			if ts.informParams, err = sender.newParams(tl.engineID); err != nil {
+				return nil, err
+			}
+		}
+		tl.senders = append(tl.senders, ts)
+	}
+
+	return tl, nil
+}
+
+// newParams returns the SNMP parameters of the sender's credentials, with
+// the v3 keys localized to the authoritative engineID
+func (sender TrapSender) newParams(engineID string) (*g.GoSNMP, error) {
+
+	params := &g.GoSNMP{Logger: log.New(ioutil.Discard, "", 0)}
+	if err := sender.Creds.apply(params); err != nil {
+		return nil, fmt.Errorf("traps of %s: %w", sender.Name, err)
+	}
+	if usm, ok := params.SecurityParameters.(*g.UsmSecurityParameters); ok {
+		usm.AuthoritativeEngineID = engineID
+		usm.Logger = params.Logger
+	}
+
+	return params, nil
+}
+
+// EngineID returns the SNMPv3 engine ID of the listener in hex
+func (tl *TrapListener) EngineID() string {
+	return hex.EncodeToString([]byte(tl.engineID))
+}
+
+// Start listening for traps on the UDP address addr, e.g. ":162"
+func (tl *TrapListener) Start(addr string) error {
+
+	if tl.conn != nil {
+		return errors.New("trap listener: already started")
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	tl.conn = conn
+	tl.started = time.Now()
+
+	tl.wg.Add(1)
+	go tl.serve()
+
+	rlog.NoticeMsg("listening for traps on %s", conn.LocalAddr().String())
+
+	return nil
+}
+
+// Addr returns the address the listener is listening on
+func (tl *TrapListener) Addr() net.Addr {
+	if tl.conn == nil {
+		return nil
+	}
+	return tl.conn.LocalAddr()
+}
+
+// Stop the listener and wait for it to exit
+func (tl *TrapListener) Stop() error {
+
+	if tl.conn == nil {
+		return nil
+	}
+
+	err := tl.conn.Close()
+	tl.wg.Wait()
+	tl.conn = nil
+
+	return err
+}
+
+// serve receives traps until the listener is closed
+func (tl *TrapListener) serve() {
+	defer tl.wg.Done()
+
+	buf := make([]byte, maxTrapSize)
+	for {
+		n, raddr, err := tl.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				rlog.ErrMsg("trap listener: %s", err.Error())
+			}
+			return
+		}
+
+		source := raddr.String()
+		if udpAddr, ok := raddr.(*net.UDPAddr); ok {
+			source = udpAddr.IP.String()
+		}
+		if report := tl.report(buf[:n]); report != nil {
+			rlog.DebugMsg("trap listener: engine ID discovery from %s", source)
+			if _, err := tl.conn.WriteTo(report, raddr); err != nil {
+				rlog.ErrMsg("trap listener: report to %s: %s", source, err.Error())
+			}
+			continue
+		}
+		trap, resp, err := tl.decode(buf[:n], source)
+		if err != nil {
+			rlog.WarningMsg("trap from %s ignored: %s", source, err.Error())
+			continue
+		}
+		if resp != nil {
+			if _, err := tl.conn.WriteTo(resp, raddr); err != nil {
+				rlog.ErrMsg("trap listener: inform response to %s: %s", source, err.Error())
+			}
+		}
+		tl.handler(trap)
+	}
+}
+
+// engineTime returns the SNMPv3 engine boots and time of the listener
+func (tl *TrapListener) engineTime() (uint32, uint32) {
+	return 1, uint32(time.Since(tl.started).Seconds())
+}
+
+// report returns the Report with the engine ID of the listener if packet is
+// an SNMPv3 engine ID discovery request, the first message of a v3 inform,
+// else nil
+func (tl *TrapListener) report(packet []byte) []byte {
+
+	// decoding overwrites the packet
+	pkt := tl.discovery.UnmarshalTrap(append([]byte(nil), packet...), false)
+	if pkt == nil || pkt.Version != g.Version3 || pkt.MsgFlags&g.Reportable == 0 {
+		return nil
+	}
+	if usm, ok := pkt.SecurityParameters.(*g.UsmSecurityParameters); !ok || usm.AuthoritativeEngineID != "" {
+		return nil
+	}
+
+	boots, engineTime := tl.engineTime()
+	report := &g.SnmpPacket{
+		Version:       g.Version3,
+		MsgFlags:      g.NoAuthNoPriv,
+		SecurityModel: g.UserSecurityModel,
+		SecurityParameters: &g.UsmSecurityParameters{
+			AuthoritativeEngineID:    tl.engineID,
+			AuthoritativeEngineBoots: boots,
+			AuthoritativeEngineTime:  engineTime,
+			Logger:                   tl.discovery.Logger,
+		},
+		ContextEngineID: tl.engineID,
+		ContextName:     pkt.ContextName,
+		PDUType:         g.Report,
+		MsgID:           pkt.MsgID,
+		RequestID:       pkt.RequestID,
+		MsgMaxSize:      maxTrapSize,
+		Variables:       []g.SnmpPDU{{Name: usmStatsUnknownEngineIDs, Type: g.Counter32, Value: uint32(1)}},
+		Logger:          tl.discovery.Logger,
+	}
+	resp, err := report.MarshalMsg()
+	if err != nil {
+		rlog.ErrMsg("trap listener: report: %s", err.Error())
+		return nil
+	}
+
+	return resp
+}
+
+// decode returns the trap in packet from source, from the first sender
+// whose address and credentials it matches, and for an inform the response
+func (tl *TrapListener) decode(packet []byte, source string) (Trap, []byte, error) {
+
+	err := errors.New("no sender for this address")
+	for _, sender := range tl.senders {
+		if sender.Host != "" && sender.Host != source {
+			continue
+		}
+		var pkt *g.SnmpPacket
+		if pkt, err = sender.accept(packet); err != nil {
+			continue
+		}
+
+		trap := Trap{
+			Time:    time.Now(),
+			Sender:  sender.Name,
+			Source:  source,
+			Version: SNMPVersion2c,
+			Inform:  pkt.PDUType == g.InformRequest,
+		}
+		if pkt.Version == g.Version3 {
+			trap.Version = SNMPVersion3
+		}
+		for _, pdu := range pkt.Variables {
+			oid := strings.TrimPrefix(pdu.Name, ".")
+			switch {
+			case oid == sysUpTimeOid && pdu.Type == g.TimeTicks && trap.Uptime == "":
+				trap.Uptime = pduValue(pdu)
+			case oid == snmpTrapOid:
+				trap.TrapOid = strings.TrimPrefix(pduValue(pdu), ".")
+			default:
+				trap.Variables = append(trap.Variables, Variable{oid, pdu.Type.String(), pduValue(pdu)})
+			}
+		}
+
+		if !trap.Inform {
+			return trap, nil, nil
+		}
+		pkt.PDUType = g.GetResponse
+		pkt.Error = g.NoError
+		pkt.ErrorIndex = 0
+		if pkt.Version == g.Version3 {
+			if err := tl.secureResponse(pkt); err != nil {
+				return trap, nil, fmt.Errorf("inform response: %w", err)
+			}
+		}
+		resp, err := pkt.MarshalMsg()
+		if err != nil {
+			return trap, nil, fmt.Errorf("inform response: %w", err)
+		}
+		return trap, resp, nil
+	}
+
+	return Trap{}, nil, err
+}
+
+// secureResponse sets the engine time and a new privacy salt of the v3
+// response pkt to an inform
+func (tl *TrapListener) secureResponse(pkt *g.SnmpPacket) error {
+
+	usm, ok := pkt.SecurityParameters.(*g.UsmSecurityParameters)
+	if !ok {
+		return errors.New("no USM security parameters")
+	}
+	pkt.MsgFlags &^= g.Reportable
+	usm.AuthoritativeEngineBoots, usm.AuthoritativeEngineTime = tl.engineTime()
+	if pkt.MsgFlags&g.AuthPriv == g.AuthPriv {
+		salt := make([]byte, 8)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		usm.PrivacyParameters = salt
+	}
+
+	return nil
+}
+
+// accept decodes packet if it is a trap or inform with the credentials of
+// the sender. v3 informs are authenticated with the keys of the listener's
+// engine ID, v3 traps with those of the device's
+func (sender *trapSender) accept(packet []byte) (*g.SnmpPacket, error) {
+
+	// decoding a v3 message overwrites its authentication parameters and
+	// encrypted PDU, each attempt decodes a copy
+	pkt := sender.params.UnmarshalTrap(append([]byte(nil), packet...), false)
+	if pkt == nil && sender.informParams != nil {
+		if pkt = sender.informParams.UnmarshalTrap(append([]byte(nil), packet...), false); pkt != nil && pkt.PDUType != g.InformRequest {
+			return nil, fmt.Errorf("unexpected PDU type for the listener's engine ID: %#x", byte(pkt.PDUType))
+		}
+	}
+	if pkt == nil {
+		return nil, errors.New("not a trap with the SNMP version or credentials of the device")
+	}
+	if pkt.PDUType != g.SNMPv2Trap && pkt.PDUType != g.InformRequest {
+		return nil, fmt.Errorf("unexpected PDU type: %#x", byte(pkt.PDUType))
+	}
+	if pkt.Version != sender.params.Version {
+		return nil, fmt.Errorf("SNMP version %s, not %s", pkt.Version, sender.params.Version)
+	}
+
+	if pkt.Version == g.Version2c {
+		if pkt.Community != sender.params.Community {
+			return nil, errors.New("wrong community")
+		}
+		return pkt, nil
+	}
+
+	usm, ok := pkt.SecurityParameters.(*g.UsmSecurityParameters)
+	if !ok || usm.UserName != sender.Creds.User {
+		return nil, errors.New("unknown SNMPv3 user")
+	}
+	if pkt.MsgFlags&g.AuthPriv < sender.params.MsgFlags&g.AuthPriv {
+		return nil, errors.New("SNMPv3 security level below that of the device")
+	}
+
+	return pkt, nil
+}
@@ -0,0 +1,221 @@
+package tycon
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+const (
+	testEngineID = "8000000001020304"
+	testRelayOid = "1.3.6.1.4.1.45621.2.2.1.0"
+	testAlarmOid = "1.3.6.1.4.1.45621.3.0.1"
+)
+
+// startListener starts a TrapListener for senders on a free local port
+func startListener(t *testing.T, senders []TrapSender) (*TrapListener, chan Trap) {
+
+	traps := make(chan Trap, 10)
+	tl, err := NewTrapListener("", senders, func(trap Trap) { traps <- trap })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tl.Stop() })
+
+	return tl, traps
+}
+
+// newSender returns a connected gosnmp session sending to tl with creds
+func newSender(t *testing.T, tl *TrapListener, creds Credentials) *g.GoSNMP {
+
+	addr := tl.Addr().(*net.UDPAddr)
+	sender := &g.GoSNMP{
+		Target:  addr.IP.String(),
+		Port:    uint16(addr.Port),
+		Timeout: time.Second,
+		MaxOids: g.MaxOids,
+	}
+	if err := creds.apply(sender); err != nil {
+		t.Fatal(err)
+	}
+	if usm, ok := sender.SecurityParameters.(*g.UsmSecurityParameters); ok {
+		id, err := hex.DecodeString(testEngineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usm.AuthoritativeEngineID = string(id)
+		usm.AuthoritativeEngineBoots = 1
+		usm.AuthoritativeEngineTime = 1
+	}
+	if err := sender.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sender.Conn.Close() })
+
+	return sender
+}
+
+// testTrap is a relay change notification
+func testTrap(inform bool) g.SnmpTrap {
+	return g.SnmpTrap{
+		IsInform: inform,
+		Variables: []g.SnmpPDU{
+			{Name: "." + sysUpTimeOid, Type: g.TimeTicks, Value: uint32(1234)},
+			{Name: "." + snmpTrapOid, Type: g.ObjectIdentifier, Value: "." + testAlarmOid},
+			{Name: "." + testRelayOid, Type: g.Integer, Value: 0},
+		},
+	}
+}
+
+// receive returns the next trap received, failing after a timeout
+func receive(t *testing.T, traps chan Trap) Trap {
+
+	select {
+	case trap := <-traps:
+		return trap
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the trap")
+	}
+
+	return Trap{}
+}
+
+func checkTrap(t *testing.T, trap Trap, version string, inform bool) {
+
+	if trap.Sender != "vault1" || trap.Source != "127.0.0.1" || trap.Version != version || trap.Inform != inform {
+		t.Errorf("trap %+v, want a version %s trap (inform %v) of vault1 from 127.0.0.1", trap, version, inform)
+	}
+	if trap.TrapOid != testAlarmOid || trap.Uptime != "1234" {
+		t.Errorf("trap oid %s uptime %s, want %s and 1234", trap.TrapOid, trap.Uptime, testAlarmOid)
+	}
+	want := Variable{testRelayOid, "Integer", "0"}
+	if len(trap.Variables) != 1 || trap.Variables[0] != want {
+		t.Errorf("trap variables %+v, want %+v", trap.Variables, want)
+	}
+}
+
+func TestTrapV2c(t *testing.T) {
+
+	creds := Credentials{Version: SNMPVersion2c, Community: "traps"}
+	tl, traps := startListener(t, []TrapSender{{Name: "vault1", Host: "127.0.0.1", Creds: creds}})
+
+	sender := newSender(t, tl, creds)
+	if _, err := sender.SendTrap(testTrap(false)); err != nil {
+		t.Fatal(err)
+	}
+	checkTrap(t, receive(t, traps), SNMPVersion2c, false)
+
+	// an inform is acknowledged
+	if _, err := sender.SendTrap(testTrap(true)); err != nil {
+		t.Fatalf("inform not acknowledged: %v", err)
+	}
+	checkTrap(t, receive(t, traps), SNMPVersion2c, true)
+
+	// traps with another community are ignored
+	other := newSender(t, tl, Credentials{Version: SNMPVersion2c, Community: "public"})
+	if _, err := other.SendTrap(testTrap(false)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case trap := <-traps:
+		t.Errorf("trap %+v with the wrong community accepted", trap)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTrapV3(t *testing.T) {
+
+	creds := Credentials{
+		Version:        SNMPVersion3,
+		User:           "rpm",
+		SecurityLevel:  SecLevelAuthPriv,
+		AuthProtocol:   "SHA",
+		AuthPassphrase: "authpassphrase",
+		PrivProtocol:   "AES",
+		PrivPassphrase: "privpassphrase",
+	}
+	tl, traps := startListener(t, []TrapSender{{Name: "vault1", Creds: creds, EngineID: testEngineID}})
+
+	sender := newSender(t, tl, creds)
+	if _, err := sender.SendTrap(testTrap(false)); err != nil {
+		t.Fatal(err)
+	}
+	checkTrap(t, receive(t, traps), SNMPVersion3, false)
+
+	// traps with another passphrase are ignored
+	wrong := creds
+	wrong.AuthPassphrase = "wrongpassphrase"
+	other := newSender(t, tl, wrong)
+	if _, err := other.SendTrap(testTrap(false)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case trap := <-traps:
+		t.Errorf("trap %+v with the wrong passphrase accepted", trap)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestInformV3(t *testing.T) {
+
+	creds := Credentials{
+		Version:        SNMPVersion3,
+		User:           "rpm",
+		SecurityLevel:  SecLevelAuthPriv,
+		AuthProtocol:   "SHA",
+		AuthPassphrase: "authpassphrase",
+		PrivProtocol:   "AES",
+		PrivPassphrase: "privpassphrase",
+	}
+	tl, traps := startListener(t, []TrapSender{{Name: "vault1", Creds: creds, EngineID: testEngineID}})
+
+	// the sender discovers the engine ID of the listener
+	sender := newSender(t, tl, creds)
+	usm := sender.SecurityParameters.(*g.UsmSecurityParameters)
+	usm.AuthoritativeEngineID = ""
+	if _, err := sender.SendTrap(testTrap(true)); err != nil {
+		t.Fatalf("inform not acknowledged: %v", err)
+	}
+	checkTrap(t, receive(t, traps), SNMPVersion3, true)
+	if id := hex.EncodeToString([]byte(usm.AuthoritativeEngineID)); id != tl.EngineID() {
+		t.Errorf("discovered engine ID %s, want %s", id, tl.EngineID())
+	}
+
+	// and keeps it for the next inform
+	if _, err := sender.SendTrap(testTrap(true)); err != nil {
+		t.Fatalf("second inform not acknowledged: %v", err)
+	}
+	checkTrap(t, receive(t, traps), SNMPVersion3, true)
+
+	// informs with another passphrase are not acknowledged
+	wrong := creds
+	wrong.AuthPassphrase = "wrongpassphrase"
+	other := newSender(t, tl, wrong)
+	other.SecurityParameters.(*g.UsmSecurityParameters).AuthoritativeEngineID = ""
+	other.Timeout = 200 * time.Millisecond
+	if _, err := other.SendTrap(testTrap(true)); err == nil {
+		t.Error("inform with the wrong passphrase acknowledged")
+	}
+	select {
+	case trap := <-traps:
+		t.Errorf("inform %+v with the wrong passphrase accepted", trap)
+	default:
+	}
+}
+
+func TestTrapListenerEngineID(t *testing.T) {
+
+	creds := Credentials{Version: SNMPVersion3, User: "rpm", SecurityLevel: SecLevelNoAuthNoPriv}
+	if _, err := NewTrapListener("", []TrapSender{{Name: "vault1", Creds: creds}}, func(Trap) {}); err == nil {
+		t.Error("NewTrapListener without the engine ID of a v3 sender succeeded")
+	}
+	if _, err := NewTrapListener("0xnothex", nil, func(Trap) {}); err == nil {
+		t.Error("NewTrapListener with an invalid engine ID succeeded")
+	}
+}
@@ -0,0 +1,87 @@
+// Package tycontest provides a fake tycon.PowerMonitor for tests of the
+// packages that operate relays
+package tycontest
+
+import (
+	"context"
+	"path/filepath"
+	"rpm/config"
+	"rpm/tycon"
+	"sync"
+	"testing"
+	"time"
+)
+
+// OIDs of the relays of a Device
+const (
+	RL1Oid = "1.3.6.1.4.1.45621.2.2.1.0"
+	RL2Oid = "1.3.6.1.4.1.45621.2.2.2.0"
+)
+
+// Device is a PowerMonitor with relays that change state when set and
+// records the actions. A cycle leaves the relay in its state, or fails with
+// CycleErr if it is set
+type Device struct {
+	States   map[string]string
+	Actions  []string
+	CycleErr error
+}
+
+// NewDevice returns a Device with RL1 and RL2 closed
+func NewDevice() *Device {
+	return &Device{States: map[string]string{RL1Oid: "1", RL2Oid: "1"}}
+}
+
+// Connect does nothing
+func (d *Device) Connect(creds tycon.Credentials) error { return nil }
+
+// QueryOids returns the states of the relays in oids
+func (d *Device) QueryOids(oids *[]string) (time.Time, map[string]string, error) {
+	results := make(map[string]string)
+	for _, oid := range *oids {
+		results[oid] = d.States[oid]
+	}
+	return time.Now(), results, nil
+}
+
+// SetRelay records the action and sets the state of the relay
+func (d *Device) SetRelay(relayOid, targetState string) error {
+	d.Actions = append(d.Actions, "set "+relayOid+" "+targetState)
+	d.States[relayOid] = map[string]string{"open": "0", "closed": "1"}[targetState]
+	return nil
+}
+
+// CycleRelay records the action, or returns CycleErr
+func (d *Device) CycleRelay(relayOid string) error {
+	if d.CycleErr != nil {
+		return d.CycleErr
+	}
+	d.Actions = append(d.Actions, "cycle "+relayOid)
+	return nil
+}
+
+// PollStart does nothing, a Device has no scans
+func (d *Device) PollStart(ctx context.Context, wg *sync.WaitGroup, pollOids *[]string, sampleInterval time.Duration) error {
+	return nil
+}
+
+// GetScan returns no scan
+func (d *Device) GetScan() (*tycon.TPDin2Scan, error) { return nil, nil }
+
+// Close does nothing
+func (d *Device) Close() error { return nil }
+
+// Config returns a config with the relays of a Device, RL1 (Primary) and
+// RL2 (Secondary), and an audit trail removed when the test ends. The
+// defaults are applied by the caller once it is set up
+func Config(t *testing.T) *config.RPMConfig {
+
+	rpmCfg := config.NewConfig()
+	rpmCfg.Oids.Relays = []config.OidInfo{
+		{Oid: RL1Oid, Chancode: "RL1", Label: "Primary"},
+		{Oid: RL2Oid, Chancode: "RL2", Label: "Secondary"},
+	}
+	rpmCfg.Audit.File = filepath.Join(t.TempDir(), "audit.jsonl")
+
+	return rpmCfg
+}
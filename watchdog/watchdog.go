@@ -0,0 +1,325 @@
+// Package watchdog cycles the relay powering a host that stops answering checks
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"rpm/audit"
+	"rpm/config"
+	"rpm/interlock"
+	rlog "rpm/log"
+	"rpm/tycon"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditSource identifies watchdog entries in the audit trail
+const auditSource = "watchdog"
+
+// Audit trail actions of the watchdog
+const (
+	ActionCheck = "check"
+	ActionCycle = "cycle"
+)
+
+// rebootWindow is the period limited to maxperday relay cycles
+const rebootWindow = 24 * time.Hour
+
+// Checker returns nil if target is up
+type Checker func(ctx context.Context, target config.WatchdogTarget) error
+
+// CycleHandler is called after the watchdog cycles, or fails or refuses to
+// cycle, the relay of a target
+type CycleHandler func(target config.WatchdogTarget, relay config.OidInfo, result, detail string)
+
+// target is the state of a watched host
+type target struct {
+	config.WatchdogTarget
+	relay    config.OidInfo
+	failures int
+	cycles   []time.Time
+	limited  bool
+	refused  bool
+}
+
+// Watchdog checks the targets and cycles their relays
+type Watchdog struct {
+	dev      tycon.PowerMonitor
+	rpmCfg   *config.RPMConfig
+	host     string
+	check    Checker
+	auditLog *audit.Log
+	targets  []*target
+	handlers []CycleHandler
+}
+
+// New returns a Watchdog for the [watchdog] targets of rpmCfg cycling the
+// relays of dev at host. Cycles in the audit trail count toward maxperday
+func New(dev tycon.PowerMonitor, rpmCfg *config.RPMConfig, host string, auditLog *audit.Log) (*Watchdog, error) {
+
+	if len(rpmCfg.Watchdog.Targets) == 0 {
+		return nil, fmt.Errorf("no [[watchdog.targets]] configured")
+	}
+
+	relays := make(map[string]config.OidInfo)
+	for _, info := range rpmCfg.Oids.Relays {
+		relays[info.Chancode] = info
+	}
+
+	wd := &Watchdog{
+		dev:      dev,
+		rpmCfg:   rpmCfg,
+		host:     host,
+		check:    Check,
+		auditLog: auditLog,
+	}
+
+	// earlier cycles from the audit trail, so a restart does not reset the limit
+	since := time.Now().Add(-rebootWindow)
+	earlier, err := audit.Read(rpmCfg.Audit.File, func(rec audit.Record) bool {
+		return rec.Source == auditSource && rec.Action == ActionCycle &&
+			(rec.Result == audit.ResultStarted || rec.Result == audit.ResultOK) &&
+			rec.Host == host && rec.Time.After(since)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		rlog.WarningMsg("watchdog: could not read audit trail %s: %s", rpmCfg.Audit.File, err.Error())
+	}
+
+	for _, t := range rpmCfg.Watchdog.Targets {
+		info, ok := relays[t.Relay]
+		if !ok {
+			return nil, fmt.Errorf("watchdog target %s: unknown relay %s", t.Name, t.Relay)
+		}
+		if t.Name == "" {
+			t.Name = t.Host
+		}
+		tgt := &target{WatchdogTarget: t, relay: info}
+		for _, rec := range earlier {
+			if rec.Chancode == info.Chancode {
+				tgt.cycles = append(tgt.cycles, rec.Time)
+			}
+		}
+		wd.targets = append(wd.targets, tgt)
+	}
+
+	return wd, nil
+}
+
+// AddCycleHandler registers fn to be called after each cycle decision
+func (wd *Watchdog) AddCycleHandler(fn CycleHandler) {
+	wd.handlers = append(wd.handlers, fn)
+}
+
+// Run checks the targets every interval until ctx is done
+func (wd *Watchdog) Run(ctx context.Context) error {
+
+	for _, t := range wd.targets {
+		rlog.NoticeMsg("watchdog: checking %s (%s %s) every %s, cycling relay %s (%s) after %d failures",
+			t.Name, t.Check, t.address(), wd.rpmCfg.Watchdog.Interval, t.relay.Chancode, t.relay.Label, wd.rpmCfg.Watchdog.Failures)
+	}
+
+	ticker := time.NewTicker(wd.rpmCfg.Watchdog.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, t := range wd.targets {
+			wd.checkTarget(ctx, t, time.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkTarget checks t once, cycling its relay if it has failed too often
+func (wd *Watchdog) checkTarget(ctx context.Context, t *target, now time.Time) {
+
+	settings := wd.rpmCfg.Watchdog
+
+	// checks are not counted while the host reboots
+	if n := len(t.cycles); n > 0 && now.Sub(t.cycles[n-1]) < settings.Cooldown {
+		return
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, t.Timeout)
+	err := wd.check(checkCtx, t.WatchdogTarget)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err == nil {
+		if t.failures > 0 {
+			msg := fmt.Sprintf("%s is up again after %d failed check(s)", t.Name, t.failures)
+			rlog.NoticeMsg("watchdog: %s", msg)
+			wd.audit(t, ActionCheck, audit.ResultOK, msg)
+		}
+		t.failures = 0
+		t.limited = false
+		t.refused = false
+		return
+	}
+
+	t.failures++
+	msg := fmt.Sprintf("%s check failed (%d consecutive, cycle after %d): %s", t.Name, t.failures, settings.Failures, err.Error())
+	rlog.WarningMsg("watchdog: %s", msg)
+	wd.audit(t, ActionCheck, audit.ResultFailed, msg)
+	if t.failures < settings.Failures {
+		return
+	}
+
+	// drop cycles that are outside the limit window
+	recent := t.cycles[:0]
+	for _, ts := range t.cycles {
+		if now.Sub(ts) < rebootWindow {
+			recent = append(recent, ts)
+		}
+	}
+	t.cycles = recent
+
+	if len(t.cycles) >= settings.Maxperday {
+		if !t.limited {
+			msg := fmt.Sprintf("not cycling relay %s (%s) for %s: already cycled %d time(s) in 24 hours",
+				t.relay.Chancode, t.relay.Label, t.Name, len(t.cycles))
+			rlog.CritMsg("watchdog: %s", msg)
+			wd.audit(t, ActionCycle, audit.ResultSkipped, msg)
+			wd.handle(t, audit.ResultSkipped, msg)
+			t.limited = true
+		}
+		return
+	}
+
+	if err := wd.interlock(t); err != nil {
+		if !t.refused {
+			msg := fmt.Sprintf("not cycling relay %s (%s) for %s: %s", t.relay.Chancode, t.relay.Label, t.Name, err.Error())
+			rlog.ErrMsg("watchdog: %s", msg)
+			wd.audit(t, ActionCycle, audit.ResultSkipped, msg)
+			wd.handle(t, audit.ResultSkipped, msg)
+			t.refused = true
+		}
+		return
+	}
+	t.refused = false
+
+	msg = fmt.Sprintf("cycling relay %s (%s) for %s after %d failed checks", t.relay.Chancode, t.relay.Label, t.Name, t.failures)
+	rlog.WarningMsg("watchdog: %s", msg)
+	if err := wd.dev.CycleRelay(t.relay.Oid); err != nil {
+		msg = fmt.Sprintf("cycle of relay %s (%s) for %s failed: %s", t.relay.Chancode, t.relay.Label, t.Name, err.Error())
+		rlog.ErrMsg("watchdog: %s", msg)
+		wd.audit(t, ActionCycle, audit.ResultFailed, msg)
+		wd.handle(t, audit.ResultFailed, msg)
+		return
+	}
+
+	// the host coming back up is what counts, the cycle itself is not
+	// waited for
+	t.cycles = append(t.cycles, now)
+	t.failures = 0
+	wd.audit(t, ActionCycle, audit.ResultStarted, msg)
+	wd.handle(t, audit.ResultStarted, msg)
+}
+
+// interlock checks the cycle of the relay of t against the [interlock]
+// policy. Only a target with force may cycle a protected relay
+func (wd *Watchdog) interlock(t *target) error {
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	relayOids, _ := wd.rpmCfg.RelayOidsInfo()
+	_, results, err := wd.dev.QueryOids(&relayOids)
+	if err != nil {
+		return err
+	}
+
+	return interlock.New(wd.rpmCfg).Check(interlock.Request{
+		Host:   hostname,
+		Relay:  t.relay,
+		Action: interlock.ActionCycle,
+		Force:  t.Force,
+	}, results)
+}
+
+func (wd *Watchdog) audit(t *target, action, result, detail string) {
+
+	if wd.auditLog == nil {
+		return
+	}
+	err := wd.auditLog.Write(audit.Record{
+		Operator: audit.Self(),
+		Source:   auditSource,
+		Host:     wd.host,
+		Chancode: t.relay.Chancode,
+		Label:    t.relay.Label,
+		Action:   action,
+		Result:   result,
+		Detail:   detail,
+	})
+	if err != nil {
+		rlog.ErrMsg("watchdog: could not write audit trail: %s", err.Error())
+	}
+}
+
+func (wd *Watchdog) handle(t *target, result, detail string) {
+	for _, fn := range wd.handlers {
+		fn(t.WatchdogTarget, t.relay, result, detail)
+	}
+}
+
+// address of the target as checked
+func (t *target) address() string {
+	if t.Check == config.CheckTCP {
+		return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	}
+	return t.Host
+}
+
+// Check is the Checker doing a ping or TCP connect to the target
+func Check(ctx context.Context, target config.WatchdogTarget) error {
+
+	switch target.Check {
+	case config.CheckTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(target.Host, strconv.Itoa(target.Port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case config.CheckPing:
+		// ICMP sockets need privileges rpm does not have, so use ping(8)
+		wait := int(target.Timeout.Seconds())
+		if wait < 1 {
+			wait = 1
+		}
+		out, err := exec.CommandContext(ctx, "ping", "-n", "-q", "-c", "1", "-W", strconv.Itoa(wait), target.Host).CombinedOutput()
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("ping %s timed out", target.Host)
+			}
+			return fmt.Errorf("ping %s: %s", target.Host, lastLine(string(out), err.Error()))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid check: %s", target.Check)
+}
+
+// lastLine returns the last non-empty line of out, or def
+func lastLine(out, def string) string {
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+
+	return def
+}
@@ -0,0 +1,288 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"rpm/audit"
+	"rpm/config"
+	"rpm/tycon"
+	"rpm/tycon/tycontest"
+	"testing"
+	"time"
+)
+
+// testHost is the device the watchdog cycles the relays of
+const testHost = "127.0.0.1:161"
+
+// fakeChecker is a Checker with a result set by the test that counts checks
+type fakeChecker struct {
+	err    error
+	checks int
+}
+
+func (c *fakeChecker) check(ctx context.Context, target config.WatchdogTarget) error {
+	c.checks++
+	return c.err
+}
+
+// testConfig watches nrts-1 on RL1, cycling after 3 failures at most twice
+// a day, ten minutes apart
+func testConfig(t *testing.T) *config.RPMConfig {
+
+	rpmCfg := tycontest.Config(t)
+	rpmCfg.Watchdog.Targets = []config.WatchdogTarget{{Name: "nrts-1", Host: "10.0.0.1", Check: config.CheckPing, Relay: "RL1"}}
+	rpmCfg.Watchdog.Failures = 3
+	rpmCfg.Watchdog.Cooldown = 10 * time.Minute
+	rpmCfg.Watchdog.Maxperday = 2
+	rpmCfg.ApplyDefaults()
+
+	return rpmCfg
+}
+
+// testWatchdog is a Watchdog with a fake check, and the results of its
+// cycle decisions
+type testWatchdog struct {
+	*Watchdog
+	checker *fakeChecker
+	results []string
+}
+
+func newWatchdog(t *testing.T, dev tycon.PowerMonitor, rpmCfg *config.RPMConfig) *testWatchdog {
+
+	auditLog, err := audit.Open(rpmCfg.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+
+	wd, err := New(dev, rpmCfg, testHost, auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := &testWatchdog{Watchdog: wd, checker: &fakeChecker{}}
+	wd.check = tw.checker.check
+	wd.AddCycleHandler(func(target config.WatchdogTarget, relay config.OidInfo, result, detail string) {
+		tw.results = append(tw.results, result)
+	})
+
+	return tw
+}
+
+// checkAt checks the target at now, up if err is nil
+func (tw *testWatchdog) checkAt(now time.Time, err error) {
+	tw.checker.err = err
+	tw.checkTarget(context.Background(), tw.targets[0], now)
+}
+
+var errDown = errors.New("ping 10.0.0.1: 100% packet loss")
+
+func TestFailures(t *testing.T) {
+
+	dev := tycontest.NewDevice()
+	wd := newWatchdog(t, dev, testConfig(t))
+	now := time.Now()
+
+	// a check that succeeds starts the count again
+	wd.checkAt(now, errDown)
+	wd.checkAt(now.Add(time.Minute), errDown)
+	wd.checkAt(now.Add(2*time.Minute), nil)
+	wd.checkAt(now.Add(3*time.Minute), errDown)
+	wd.checkAt(now.Add(4*time.Minute), errDown)
+	if len(dev.Actions) != 0 || wd.targets[0].failures != 2 {
+		t.Fatalf("actions %v with %d failures, want none before 3 consecutive failures", dev.Actions, wd.targets[0].failures)
+	}
+
+	wd.checkAt(now.Add(5*time.Minute), errDown)
+	if len(dev.Actions) != 1 || dev.Actions[0] != "cycle "+tycontest.RL1Oid {
+		t.Fatalf("actions %v, want a cycle of RL1 after 3 failures", dev.Actions)
+	}
+	if len(wd.results) != 1 || wd.results[0] != audit.ResultStarted || wd.targets[0].failures != 0 {
+		t.Errorf("cycle results %v with %d failures, want started and the count reset", wd.results, wd.targets[0].failures)
+	}
+
+	records, err := audit.Read(wd.rpmCfg.Audit.File, func(rec audit.Record) bool { return rec.Action == ActionCycle })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Result != audit.ResultStarted || records[0].Chancode != "RL1" || records[0].Host != testHost {
+		t.Errorf("audit cycle records %+v, want a started cycle of RL1", records)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+
+	dev := tycontest.NewDevice()
+	wd := newWatchdog(t, dev, testConfig(t))
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		wd.checkAt(now, errDown)
+	}
+	if len(dev.Actions) != 1 {
+		t.Fatalf("actions %v, want a cycle", dev.Actions)
+	}
+
+	// the host is not checked while it reboots
+	checks := wd.checker.checks
+	for i := 1; i < 10; i++ {
+		wd.checkAt(now.Add(time.Duration(i)*time.Minute), errDown)
+	}
+	if wd.checker.checks != checks || wd.targets[0].failures != 0 {
+		t.Errorf("%d checks with %d failures during the cooldown, want none", wd.checker.checks-checks, wd.targets[0].failures)
+	}
+
+	wd.checkAt(now.Add(10*time.Minute), errDown)
+	if wd.checker.checks != checks+1 || wd.targets[0].failures != 1 {
+		t.Errorf("%d checks with %d failures after the cooldown, want 1", wd.checker.checks-checks, wd.targets[0].failures)
+	}
+}
+
+// failCycles fails checks of wd every 10 minutes from start until it has
+// made n cycle decisions, returning the time of the last check
+func failCycles(t *testing.T, wd *testWatchdog, start time.Time, n int) time.Time {
+
+	now := start
+	for want := len(wd.results) + n; len(wd.results) < want; now = now.Add(10 * time.Minute) {
+		if now.Sub(start) > 48*time.Hour {
+			t.Fatalf("cycle results %v, want %d more", wd.results, n)
+		}
+		wd.checkAt(now, errDown)
+	}
+
+	return now.Add(-10 * time.Minute)
+}
+
+func TestMaxperday(t *testing.T) {
+
+	dev := tycontest.NewDevice()
+	wd := newWatchdog(t, dev, testConfig(t))
+	start := time.Now()
+
+	failCycles(t, wd, start, 2)
+	last := failCycles(t, wd, start, 1)
+	if len(dev.Actions) != 2 || wd.results[2] != audit.ResultSkipped {
+		t.Fatalf("actions %v with results %v, want 2 cycles then skipped", dev.Actions, wd.results)
+	}
+
+	// the limit is reported once while the host stays down
+	for i := 1; i <= 6; i++ {
+		wd.checkAt(last.Add(time.Duration(i)*time.Hour), errDown)
+	}
+	if len(dev.Actions) != 2 || len(wd.results) != 3 {
+		t.Errorf("actions %v with results %v, want the limit reported once", dev.Actions, wd.results)
+	}
+
+	// a day after the first cycle there is room for another
+	wd.checkAt(start.Add(25*time.Hour), errDown)
+	if len(dev.Actions) != 3 || wd.results[len(wd.results)-1] != audit.ResultStarted {
+		t.Errorf("actions %v with results %v, want a cycle a day later", dev.Actions, wd.results)
+	}
+}
+
+func TestMaxperdayFromAudit(t *testing.T) {
+
+	rpmCfg := testConfig(t)
+	rpmCfg.Watchdog.Maxperday = 3
+
+	auditLog, err := audit.Open(rpmCfg.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cycle := audit.Record{Source: auditSource, Host: testHost, Chancode: "RL1", Action: ActionCycle, Result: audit.ResultOK}
+	earlier := []audit.Record{cycle, cycle, cycle, cycle, cycle, cycle}
+	earlier[0].Time = now.Add(-time.Hour)
+	earlier[1].Time, earlier[1].Result = now.Add(-2*time.Hour), audit.ResultStarted
+	earlier[2].Time, earlier[2].Host = now.Add(-time.Hour), "127.0.0.2:161"
+	earlier[3].Time, earlier[3].Chancode = now.Add(-time.Hour), "RL2"
+	earlier[4].Time, earlier[4].Result = now.Add(-time.Hour), audit.ResultFailed
+	earlier[5].Time = now.Add(-25 * time.Hour)
+	for _, rec := range earlier {
+		if err := auditLog.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auditLog.Close()
+
+	// only the two ok or started cycles of RL1 on this device in the last day count
+	dev := tycontest.NewDevice()
+	wd := newWatchdog(t, dev, rpmCfg)
+	failCycles(t, wd, now, 2)
+	if len(dev.Actions) != 1 || wd.results[0] != audit.ResultStarted || wd.results[1] != audit.ResultSkipped {
+		t.Errorf("actions %v with results %v, want one cycle then skipped", dev.Actions, wd.results)
+	}
+}
+
+func TestInterlockRefused(t *testing.T) {
+
+	rpmCfg := testConfig(t)
+	rpmCfg.Interlock.Groups = [][]string{{"RL1", "RL2"}}
+	dev := tycontest.NewDevice()
+	dev.States[tycontest.RL2Oid] = "0"
+	wd := newWatchdog(t, dev, rpmCfg)
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		wd.checkAt(now.Add(time.Duration(i)*time.Minute), errDown)
+	}
+	if len(dev.Actions) != 0 || len(wd.results) != 1 || wd.results[0] != audit.ResultSkipped {
+		t.Fatalf("actions %v with results %v, want the cycle refused once", dev.Actions, wd.results)
+	}
+
+	// the next failed check once RL2 is closed again cycles
+	dev.States[tycontest.RL2Oid] = "1"
+	wd.checkAt(now.Add(5*time.Minute), errDown)
+	if len(dev.Actions) != 1 || wd.results[1] != audit.ResultStarted {
+		t.Errorf("actions %v with results %v, want a cycle once RL2 is closed", dev.Actions, wd.results)
+	}
+}
+
+func TestCycleFailed(t *testing.T) {
+
+	dev := tycontest.NewDevice()
+	dev.CycleErr = errors.New("request timeout")
+	wd := newWatchdog(t, dev, testConfig(t))
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		wd.checkAt(now.Add(time.Duration(i)*time.Minute), errDown)
+	}
+	if len(wd.results) != 1 || wd.results[0] != audit.ResultFailed || len(wd.targets[0].cycles) != 0 {
+		t.Fatalf("results %v with %d cycles, want a failed cycle not counted", wd.results, len(wd.targets[0].cycles))
+	}
+
+	// a failed cycle is tried again at the next failed check
+	dev.CycleErr = nil
+	wd.checkAt(now.Add(3*time.Minute), errDown)
+	if len(dev.Actions) != 1 || wd.results[1] != audit.ResultStarted {
+		t.Errorf("actions %v with results %v, want a cycle", dev.Actions, wd.results)
+	}
+}
+
+func TestForce(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		force  bool
+		result string
+	}{
+		{"without force", false, audit.ResultSkipped},
+		{"with force", true, audit.ResultStarted},
+	}
+
+	for _, tt := range tests {
+		rpmCfg := testConfig(t)
+		rpmCfg.Interlock.Protected = []string{"RL1"}
+		rpmCfg.Watchdog.Targets[0].Force = tt.force
+		dev := tycontest.NewDevice()
+		wd := newWatchdog(t, dev, rpmCfg)
+
+		// a protected relay is only cycled for a target with force
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			wd.checkAt(now.Add(time.Duration(i)*time.Minute), errDown)
+		}
+		if len(wd.results) != 1 || wd.results[0] != tt.result {
+			t.Errorf("%s: actions %v with results %v, want %s", tt.name, dev.Actions, wd.results, tt.result)
+		}
+	}
+}